@@ -90,6 +90,13 @@ type Credentials struct {
 	Crt, Key, Override string
 }
 
+// Margin - The Margin struct holds the settings of the cross margin mode: the unit in which the assets and the loans of the cross
+// balance are valued, and the initial, the call and the liquidation margin levels, which are kept as decimal strings so
+// they are compared exactly with the margin level.
+type Margin struct {
+	Valuation, Initial, Call, Liquidation string
+}
+
 type Context struct {
 
 	// Development bool is a boolean value used to check if the current environment is a development environment or not.
@@ -130,6 +137,7 @@ type Context struct {
 	// Redis: Redis is an in-memory data structure store that is used as a database, cache and message broker. It supports data structures such as strings, hashes, lists, sets, sorted sets with range queries and bitmaps.
 	// Rabbitmq: RabbitMQ is an open source message broker software that implements the Advanced Message Queuing Protocol (AMQP). It is used to send, receive and store messages between applications.
 	// Credentials: Credentials are information used to authenticate a user or entity to gain access to a system or service. Examples include usernames, passwords, and security tokens.
+	// Margin: The settings of the cross margin mode, the valuation unit and the margin levels.
 	// RabbitmqClient: MQTT.Client is a client library for the Message Queue Telemetry
 	// RedisClient: This is a Redis client which is used for caching and storing data in a NoSQL key-value store.
 	// GrpcClient: This is a gRPC client which is used for communicating with a remote server using a high-performance RPC protocol.
@@ -142,6 +150,7 @@ type Context struct {
 	Redis          *Redis
 	Rabbitmq       *Rabbitmq
 	Credentials    *Credentials
+	Margin         *Margin
 	RabbitmqClient MQTT.Client
 	RedisClient    *redis.Client
 	GrpcClient     *grpc.ClientConn
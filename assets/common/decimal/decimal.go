@@ -10,7 +10,7 @@ type Float struct {
 	decimal.Decimal
 }
 
-// New - This function creates a new Float object from an interface, which could be a float64, int64, int, or *big.Int. It
+// New - This function creates a new Float object from an interface, which could be a float64, int64, int, *big.Int or Amount. It
 // takes the value from the interface and converts it to a decimal.NewFromFloat, decimal.NewFromInt, or
 // decimal.NewFromString, and then stores it in the Float object.
 func New(value interface{}) *Float {
@@ -31,6 +31,8 @@ func New(value interface{}) *Float {
 		number = decimal.NewFromInt(int64(v))
 	case *big.Int:
 		number, _ = decimal.NewFromString(v.String())
+	case Amount:
+		number = v
 	}
 
 	return &Float{
@@ -131,3 +133,35 @@ func (p *Float) Floating(number int32) float64 {
 
 	return 0
 }
+
+// Amount - The Amount type is an exact fixed-point amount used for money: balances, prices, order values, trade quantities and
+// fees. Unlike Float, it is never converted to float64, so the values scanned from the numeric(32, 18) columns are kept
+// without any rounding drift. It implements sql.Scanner and driver.Valuer, so it can be scanned from and written to the
+// database directly, and it is carried in the protobuf messages as a string.
+type Amount = decimal.Decimal
+
+// Zero - The zero amount.
+var Zero = decimal.Zero
+
+// Parse - This function converts the string representation of an amount, as it is carried in the protobuf messages, into an
+// exact Amount. An empty or invalid string is treated as zero, the same way as a missing double field was before.
+func Parse(value string) Amount {
+
+	// The shopspring decimal parser is exact, the string is converted digit by digit without passing through float64.
+	number, err := decimal.NewFromString(value)
+	if err != nil {
+		return decimal.Zero
+	}
+
+	return number
+}
+
+// Min - This function returns the smaller of the two amounts.
+func Min(first, second Amount) Amount {
+	return decimal.Min(first, second)
+}
+
+// Amount - This method returns the exact Amount of the Float, without converting it to float64.
+func (p *Float) Amount() Amount {
+	return p.Decimal
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -48,19 +49,8 @@ func Price() *Marketplace {
 // exchange. It takes a base and quote currency as parameters and returns the average market price of the currency pair.
 func (p *Marketplace) Unit(base, quote string) float64 {
 
-	// This code is used to initialize four variables in Go. The variables are base, quote, p.count and p.scale. The base
-	// and quote variables are set to the uppercase versions of the strings passed in as arguments, while the p.count
-	// variable is set to 0 and the p.scale variable is set to an empty slice of float64 values.
-	base, quote, p.count, p.scale = strings.ToUpper(base), strings.ToUpper(quote), 0, []float64{}
-
-	// This code is adding data to the "p.scale" array from the various cryptocurrency exchanges. The purpose of this is
-	// likely to collect the data from the different exchanges and store it in the "p.scale" array for further analysis.
-	p.scale = append(p.scale, p.getBinance(base, quote))
-	p.scale = append(p.scale, p.getBitfinex(base, quote))
-	p.scale = append(p.scale, p.getKucoin(base, quote))
-	p.scale = append(p.scale, p.getPoloniex(base, quote))
-	p.scale = append(p.scale, p.getKuna(base, quote))
-	p.scale = append(p.scale, p.getHuobi(base, quote))
+	// The prices of the pair are collected from every exchange into the "p.scale" array for further analysis.
+	p.collect(base, quote)
 
 	var (
 		price float64
@@ -86,6 +76,81 @@ func (p *Marketplace) Unit(base, quote string) float64 {
 	return 0
 }
 
+// Sources - This function returns the last price of the currency pair on every exchange that lists it, the exchanges that
+// do not list the pair or could not be reached are left out. Unlike Unit it does not average the prices, so the caller can
+// combine them in its own way, for example into a weighted median.
+func (p *Marketplace) Sources(base, quote string) []float64 {
+	p.collect(base, quote)
+	return p.filter()
+}
+
+// collect - This function resets the Marketplace structure and fills its scale field with the price of the currency pair
+// on each of the supported exchanges, an exchange that has no price for the pair adds a zero value.
+func (p *Marketplace) collect(base, quote string) {
+
+	// This code is used to initialize four variables in Go. The variables are base, quote, p.count and p.scale. The base
+	// and quote variables are set to the uppercase versions of the strings passed in as arguments, while the p.count
+	// variable is set to 0 and the p.scale variable is set to an empty slice of float64 values.
+	base, quote, p.count, p.scale = strings.ToUpper(base), strings.ToUpper(quote), 0, []float64{}
+
+	// This code is adding data to the "p.scale" array from the various cryptocurrency exchanges. The purpose of this is
+	// likely to collect the data from the different exchanges and store it in the "p.scale" array for further analysis.
+	p.scale = append(p.scale, p.getBinance(base, quote))
+	p.scale = append(p.scale, p.getBitfinex(base, quote))
+	p.scale = append(p.scale, p.getKucoin(base, quote))
+	p.scale = append(p.scale, p.getPoloniex(base, quote))
+	p.scale = append(p.scale, p.getKuna(base, quote))
+	p.scale = append(p.scale, p.getHuobi(base, quote))
+}
+
+// Median - This function returns the weighted median of the values, the value at which half of the total weight lies on
+// each side. When the total weight splits exactly between two values their average is returned. Values without a positive
+// weight are ignored, and zero is returned if nothing is left.
+func Median(values, weights []float64) float64 {
+
+	type sample struct {
+		value, weight float64
+	}
+
+	var (
+		samples []sample
+		total   float64
+	)
+
+	for i := 0; i < len(values) && i < len(weights); i++ {
+		if weights[i] > 0 {
+			samples = append(samples, sample{value: values[i], weight: weights[i]})
+			total += weights[i]
+		}
+	}
+
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].value < samples[j].value
+	})
+
+	var (
+		cumulative float64
+	)
+
+	for i := 0; i < len(samples); i++ {
+		cumulative += samples[i].weight
+
+		if cumulative*2 == total && i+1 < len(samples) {
+			return (samples[i].value + samples[i+1].value) / 2
+		}
+
+		if cumulative*2 >= total {
+			return samples[i].value
+		}
+	}
+
+	return samples[len(samples)-1].value
+}
+
 // filter - This function is used to filter a Marketplace structure by removing all the zero values from the scale field. It
 // takes the Marketplace structure as an input parameter and returns a slice of float64 values that only contains the
 // non-zero elements.
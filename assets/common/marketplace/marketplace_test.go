@@ -53,3 +53,25 @@ func TestMarketplace_Unit(t *testing.T) {
 		})
 	}
 }
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []float64
+		weights []float64
+		want    float64
+	}{
+		{name: "odd", values: []float64{3, 1, 2}, weights: []float64{1, 1, 1}, want: 2},
+		{name: "even", values: []float64{4, 1, 3, 2}, weights: []float64{1, 1, 1, 1}, want: 2.5},
+		{name: "weighted", values: []float64{100, 101, 150}, weights: []float64{1, 1, 3}, want: 150},
+		{name: "outlier", values: []float64{100, 101, 102, 1000}, weights: []float64{1, 1, 2, 1}, want: 102},
+		{name: "empty", values: []float64{5}, weights: []float64{0}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Median(tt.values, tt.weights); got != tt.want {
+				t.Errorf("Median() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -264,7 +264,7 @@ func (m *Migrate) SendMail(userId int64, name string, params ...interface{}) {
 			response.Symbol = strings.ToUpper(params[2].(string))
 		}
 
-		response.Text = fmt.Sprintf("Order ID: %d, Quantit: %v<b>%v</b>, Pair: <b>%v/%s</b>", params[0].(int64), params[1].(float64), response.Symbol, strings.ToUpper(params[2].(string)), strings.ToUpper(params[3].(string)))
+		response.Text = fmt.Sprintf("Order ID: %d, Quantit: %v<b>%v</b>, Pair: <b>%v/%s</b>", params[0].(int64), params[1], response.Symbol, strings.ToUpper(params[2].(string)), strings.ToUpper(params[3].(string)))
 		break
 	case "withdrawal":
 		response.Subject = "Withdrawal Successful"
@@ -15,6 +15,10 @@ create table if not exists public.accounts
     factor_secure boolean                  default false                 not null,
     factor_secret varchar                  default ''::character varying not null,
     status        boolean                  default false                 not null,
+    self_trade    varchar                  default 'cancel_newest'::character varying not null,
+    fees_maker    numeric(8, 4),
+    fees_taker    numeric(8, 4),
+    fees_platform boolean                  default false                 not null,
     create_at     timestamp with time zone default CURRENT_TIMESTAMP
 );
 
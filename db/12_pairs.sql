@@ -10,6 +10,19 @@ create table if not exists public.pairs
     price         numeric(20, 8) default 0.00000000                not null,
     base_decimal  integer        default 2                         not null,
     quote_decimal integer        default 8                         not null,
+    tick_size     numeric(20, 8) default 0.00000000                not null,
+    step_size     numeric(32, 18) default 0.000000000000000000    not null,
+    min_notional  numeric(20, 8) default 0.00000000                not null,
+    max_orders    integer        default 0                         not null,
+    band          numeric(8, 4)  default 0.0000                    not null,
+    band_window   integer        default 0                         not null,
+    halt_duration integer        default 0                         not null,
+    halt          boolean        default false                     not null,
+    halt_until    timestamp with time zone,
+    auction_duration integer     default 0                         not null,
+    auction_until timestamp with time zone,
+    funding_cap   numeric(8, 4)  default 0.7500                    not null,
+    funding_interval integer     default 8                         not null,
     type          varchar        default 'spot'::character varying not null,
     status        boolean        default false                     not null
 );
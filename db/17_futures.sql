@@ -11,17 +11,18 @@ CREATE TABLE public.futures (
 	trading varchar(8) NULL,
 	base_unit varchar(8) NULL,
 	quote_unit varchar(8) NULL,
-	price numeric(16, 8) NULL,
-	quantity numeric(16, 8) NULL,
-	take_profit numeric(16, 8) NULL,
-	stop_loss numeric(4, 4) NULL,
+	price numeric(32, 18) NULL,
+	quantity numeric(32, 18) NULL,
+	take_profit numeric(32, 18) NULL,
+	stop_loss numeric(32, 18) NULL,
 	status varchar(8) NULL,
 	create_at timestamptz NULL DEFAULT CURRENT_TIMESTAMP,
 	leverage numeric(4) NULL DEFAULT 1,
 	user_id numeric(8) NOT NULL,
-	fees numeric(16, 8) NULL,
+	fees numeric(32, 18) NULL,
 	"mode" varchar(8) NULL DEFAULT 'cross'::character varying,
-	value numeric(16, 8) NOT NULL DEFAULT 0,
+	value numeric(32, 18) NOT NULL DEFAULT 0,
+	liquidation bool NOT NULL DEFAULT false,
 	CONSTRAINT futures_pkey PRIMARY KEY (id)
 );
 
@@ -0,0 +1,27 @@
+create table if not exists public.loans
+(
+    id        serial
+        constraint loans_pk
+            primary key
+        constraint loans_id_key
+            unique,
+    user_id   integer,
+    symbol    varchar,
+    value     numeric(32, 18)          default 0.000000000000000000          not null,
+    interest  numeric(32, 18)          default 0.000000000000000000          not null,
+    status    varchar                  default 'pending'::character varying not null,
+    create_at timestamp with time zone default CURRENT_TIMESTAMP
+);
+
+alter table public.loans
+    owner to envoys;
+
+alter table public.loans
+    add unique (id);
+
+create unique index if not exists loans_id_uindex
+    on public.loans (id);
+
+create unique index if not exists loans_user_id_symbol_uindex
+    on public.loans (user_id, symbol)
+    where status = 'pending';
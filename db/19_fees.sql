@@ -0,0 +1,24 @@
+create table if not exists public.fees
+(
+    id        serial
+        constraint fees_pk
+            primary key
+        constraint fees_id_key
+            unique,
+    volume    numeric(32, 18)          default 0.000000000000000000 not null,
+    maker     numeric(8, 4)            default 0.1                  not null,
+    taker     numeric(8, 4)            default 0.1                  not null,
+    create_at timestamp with time zone default CURRENT_TIMESTAMP
+);
+
+alter table public.fees
+    owner to envoys;
+
+alter table public.fees
+    add unique (id);
+
+create unique index if not exists fees_id_uindex
+    on public.fees (id);
+
+create unique index if not exists fees_volume_uindex
+    on public.fees (volume);
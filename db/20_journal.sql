@@ -0,0 +1,41 @@
+create table if not exists public.journal
+(
+    id         bigserial
+        constraint journal_pk
+            primary key,
+    event      varchar                                               not null,
+    order_id   integer                                               not null,
+    counter_id integer                  default 0                    not null,
+    base_unit  varchar,
+    quote_unit varchar,
+    type       varchar,
+    value      numeric(32, 18)          default 0.000000000000000000 not null,
+    price      numeric(20, 8)           default 0.00000000           not null,
+    payload    jsonb                    default '{}'::jsonb          not null,
+    create_at  timestamp with time zone default CURRENT_TIMESTAMP
+);
+
+alter table public.journal
+    owner to envoys;
+
+create index if not exists journal_base_unit_quote_unit_type_id_index
+    on public.journal (base_unit, quote_unit, type, id);
+
+create table if not exists public.checkpoints
+(
+    id         serial
+        constraint checkpoints_pk
+            primary key,
+    base_unit  varchar,
+    quote_unit varchar,
+    type       varchar,
+    sequence   bigint                   default 0           not null,
+    orders     jsonb                    default '[]'::jsonb not null,
+    create_at  timestamp with time zone default CURRENT_TIMESTAMP
+);
+
+alter table public.checkpoints
+    owner to envoys;
+
+create index if not exists checkpoints_base_unit_quote_unit_type_id_index
+    on public.checkpoints (base_unit, quote_unit, type, id);
@@ -0,0 +1,20 @@
+create table if not exists public.marks
+(
+    id          bigserial
+        constraint marks_pk
+            primary key,
+    base_unit   varchar                                               not null,
+    quote_unit  varchar                                               not null,
+    price       numeric(32, 18)          default 0.000000000000000000 not null,
+    index_price numeric(32, 18)          default 0.000000000000000000 not null,
+    basis       numeric(32, 18)          default 0.000000000000000000 not null,
+    premium     numeric(32, 18)          default 0.000000000000000000 not null,
+    sources     integer                  default 0                    not null,
+    create_at   timestamp with time zone default CURRENT_TIMESTAMP    not null
+);
+
+alter table public.marks
+    owner to envoys;
+
+create index if not exists marks_base_unit_quote_unit_id_index
+    on public.marks (base_unit, quote_unit, id);
@@ -0,0 +1,42 @@
+create table if not exists public.maintenance
+(
+    id        serial
+        constraint maintenance_pk
+            primary key,
+    notional  numeric(32, 18)          default 0.000000000000000000 not null,
+    rate      numeric(8, 4)            default 0.5                  not null,
+    leverage  numeric(4)               default 125                  not null,
+    create_at timestamp with time zone default CURRENT_TIMESTAMP
+);
+
+alter table public.maintenance
+    owner to envoys;
+
+create unique index if not exists maintenance_notional_uindex
+    on public.maintenance (notional);
+
+create table if not exists public.liquidations
+(
+    id          serial
+        constraint liquidations_pk
+            primary key,
+    position_id integer                                               not null,
+    order_id    integer                                               not null,
+    user_id     integer                                               not null,
+    base_unit   varchar                                               not null,
+    quote_unit  varchar                                               not null,
+    position    varchar(8)                                            not null,
+    mode        varchar(8)                                            not null,
+    quantity    numeric(32, 18)          default 0.000000000000000000 not null,
+    price       numeric(32, 18)          default 0.000000000000000000 not null,
+    mark        numeric(32, 18)          default 0.000000000000000000 not null,
+    margin      numeric(32, 18)          default 0.000000000000000000 not null,
+    maintenance numeric(32, 18)          default 0.000000000000000000 not null,
+    create_at   timestamp with time zone default CURRENT_TIMESTAMP    not null
+);
+
+alter table public.liquidations
+    owner to envoys;
+
+create index if not exists liquidations_user_id_index
+    on public.liquidations (user_id);
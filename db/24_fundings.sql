@@ -0,0 +1,43 @@
+create table if not exists public.fundings
+(
+    id         serial
+        constraint fundings_pk
+            primary key,
+    base_unit  varchar                                               not null,
+    quote_unit varchar                                               not null,
+    rate       numeric(32, 18)          default 0.000000000000000000 not null,
+    premium    numeric(32, 18)          default 0.000000000000000000 not null,
+    mark       numeric(32, 18)          default 0.000000000000000000 not null,
+    funding_at timestamp with time zone                              not null,
+    create_at  timestamp with time zone default CURRENT_TIMESTAMP    not null
+);
+
+alter table public.fundings
+    owner to envoys;
+
+create unique index if not exists fundings_base_unit_quote_unit_funding_at_uindex
+    on public.fundings (base_unit, quote_unit, funding_at);
+
+create table if not exists public.payments
+(
+    id          serial
+        constraint payments_pk
+            primary key,
+    funding_id  integer                                               not null,
+    position_id integer                                               not null,
+    user_id     integer                                               not null,
+    base_unit   varchar                                               not null,
+    quote_unit  varchar                                               not null,
+    position    varchar(8)                                            not null,
+    quantity    numeric(32, 18)          default 0.000000000000000000 not null,
+    mark        numeric(32, 18)          default 0.000000000000000000 not null,
+    rate        numeric(32, 18)          default 0.000000000000000000 not null,
+    value       numeric(32, 18)          default 0.000000000000000000 not null,
+    create_at   timestamp with time zone default CURRENT_TIMESTAMP    not null
+);
+
+alter table public.payments
+    owner to envoys;
+
+create index if not exists payments_user_id_id_index
+    on public.payments (user_id, id);
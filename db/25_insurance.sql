@@ -0,0 +1,19 @@
+create table if not exists public.insurance
+(
+    id         serial
+        constraint insurance_pk
+            primary key,
+    symbol     varchar                                               not null,
+    value      numeric(32, 18)          default 0.000000000000000000 not null,
+    balance    numeric(32, 18)          default 0.000000000000000000 not null,
+    assigning  varchar                  default 'plus'::character varying not null,
+    order_id   integer                  default 0                    not null,
+    user_id    integer                  default 0                    not null,
+    create_at  timestamp with time zone default CURRENT_TIMESTAMP    not null
+);
+
+alter table public.insurance
+    owner to envoys;
+
+create index if not exists insurance_symbol_id_index
+    on public.insurance (symbol, id);
@@ -15,6 +15,10 @@ create table if not exists public.assets
     fees_discount numeric(4, 4)            default 0                           not null,
     fees_charges  numeric(32, 18)          default 0.000000000000000000        not null,
     fees_costs    numeric(32, 18)          default 0.000000000000000000        not null,
+    fees_borrow   numeric(8, 6)            default 0.000100                    not null,
+    fees_platform numeric(5, 2)            default 0                           not null,
+    insurance     numeric(32, 18)          default 0.000000000000000000        not null,
+    platform      boolean                  default false                       not null,
     marker        boolean                  default false                       not null,
     chains        jsonb                    default '[]'::jsonb                 not null,
     status        boolean                  default false                       not null,
@@ -38,6 +42,10 @@ create unique index if not exists assets_id_uindex
 create unique index if not exists assets_symbol_uindex
     on public.assets (symbol);
 
+create unique index if not exists assets_platform_uindex
+    on public.assets (platform)
+    where platform = true;
+
 insert into public.assets (id, name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, fees_charges, fees_costs, marker, chains, status, "group", type, create_at)
 values  (1, 'Omisego', 'omg', 0.0100, 100.00000000, 0.0100, 1000000.00000000, 0.1500, 0.0500, 0.000000000000000000, 0.000000000000000000, false, '[2]', true, 'crypto', 'spot', '2021-12-26 10:27:02.914683 +00:00'),
         (2, 'Binance', 'bnb', 0.0100, 100.00000000, 0.0010, 1000000.00000000, 0.1500, 0.0500, 0.000000000000000000, 0.000000000000000000, true, '[3, 2]', true, 'crypto', 'spot', '2021-12-26 10:27:02.914683 +00:00'),
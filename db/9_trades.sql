@@ -14,8 +14,10 @@ create table if not exists public.trades
     price      numeric(20, 8),
     quantity   numeric(32, 18),
     assigning  varchar                  default 'buy'::character varying not null,
-    fees       double precision,
+    fees       numeric(32, 18)          default 0.000000000000000000  not null,
+    fees_unit  varchar                  default ''::character varying not null,
     maker      boolean                  default false             not null,
+    sequence   bigint                   default 0                 not null,
     create_at  timestamp with time zone default CURRENT_TIMESTAMP not null
 );
 
@@ -26,4 +28,7 @@ alter table public.trades
     add unique (id);
 
 create unique index if not exists trades_id_uindex
-    on public.trades (id);
\ No newline at end of file
+    on public.trades (id);
+
+create index if not exists trades_user_id_create_at_index
+    on public.trades (user_id, create_at);
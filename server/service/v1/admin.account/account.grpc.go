@@ -174,9 +174,9 @@ func (a *Service) GetAccount(ctx context.Context, req *admin_pbaccount.GetReques
 	}
 
 	// This code is attempting to query a database for a user's account information based on their ID. The query will return
-	// the user's id, name, email, status, and rules and store them in the variables passed to the Scan() function. If the
-	// query fails, an error is returned.
-	if err := a.Context.Db.QueryRow("select id, name, email, status, rules from accounts where id = $1", req.GetId()).Scan(&user.Id, &user.Name, &user.Email, &user.Status, &rules); err != nil {
+	// the user's id, name, email, status, rules and fee overrides and store them in the variables passed to the Scan()
+	// function. An account without an override has an empty fee rate. If the query fails, an error is returned.
+	if err := a.Context.Db.QueryRow("select id, name, email, status, rules, coalesce(fees_maker::text, ''), coalesce(fees_taker::text, '') from accounts where id = $1", req.GetId()).Scan(&user.Id, &user.Name, &user.Email, &user.Status, &rules, &user.FeesMaker, &user.FeesTaker); err != nil {
 		return &response, err
 	}
 
@@ -231,13 +231,16 @@ func (a *Service) SetAccount(ctx context.Context, req *admin_pbaccount.SetReques
 	}
 
 	// This code is executing an update query to the "accounts" table in the database. The purpose of this code is to update
-	// the name, status, and rules of an account in the database by its ID. The parameters of the query are passed in as
-	// variables. If there is an error with executing the query, an error is returned.
-	if _, err := a.Context.Db.Exec("update accounts set name = $1, status = $2, rules = $3 where id = $4;",
+	// the name, status, rules and fee overrides of an account in the database by its ID. An empty fee rate removes the
+	// override, so the account pays the rates of its volume tier again. If there is an error with executing the query,
+	// an error is returned.
+	if _, err := a.Context.Db.Exec("update accounts set name = $1, status = $2, rules = $3, fees_maker = nullif($5, '')::numeric, fees_taker = nullif($6, '')::numeric where id = $4;",
 		req.User.GetName(),
 		req.User.GetStatus(),
 		serialize,
 		req.GetId(),
+		req.User.GetFeesMaker(),
+		req.User.GetFeesTaker(),
 	); err != nil {
 		return &response, err
 	}
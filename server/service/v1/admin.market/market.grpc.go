@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"github.com/cryptogateway/backend-envoys/assets/common/marketplace"
 	"github.com/cryptogateway/backend-envoys/assets/common/query"
 	admin_pbmarket "github.com/cryptogateway/backend-envoys/server/proto/v1/admin.pbmarket"
@@ -47,7 +48,7 @@ func (e *Service) GetPrice(ctx context.Context, req *admin_pbmarket.GetRequestPr
 	// marketplace to get the price, and then it checks if the price is greater than 0. If it is, the code assigns the price
 	// to a response variable.
 	if price := marketplace.Price().Unit(req.GetBaseUnit(), req.GetQuoteUnit()); price > 0 {
-		response.Price = price
+		response.Price = decimal.New(price).Amount().String()
 	}
 
 	return &response, nil
@@ -128,20 +129,22 @@ func (e *Service) SetAsset(ctx context.Context, req *admin_pbmarket.SetRequestAs
 		// database. This statement is written in the Go programming language, and it uses the Exec method to execute a SQL
 		// query that updates the asset's name, symbol, min/max withdraw/deposit/trade, fees, marker, status, type, and
 		// chains based on the parameters passed in through the req object. The last parameter, req.GetSymbol(), is used to identify which record should be updated.
-		if _, err := e.Context.Db.Exec(`update assets set name = $1, symbol = $2, min_withdraw = $3, max_withdraw = $4, min_trade = $5, max_trade = $6, fees_trade = $7, fees_discount = $8, marker = $9, status = $10, "group" = $11, chains = $12 where symbol = $13;`,
+		if _, err := e.Context.Db.Exec(`update assets set name = $1, symbol = $2, min_withdraw = $3, max_withdraw = $4, min_trade = $5, max_trade = $6, fees_trade = $7, fees_discount = $8, marker = $9, status = $10, "group" = $11, chains = $12, platform = $14, fees_platform = $15 where symbol = $13;`,
 			req.Asset.GetName(),
 			req.Asset.GetSymbol(),
-			req.Asset.GetMinWithdraw(),
-			req.Asset.GetMaxWithdraw(),
-			req.Asset.GetMinTrade(),
-			req.Asset.GetMaxTrade(),
-			req.Asset.GetFeesTrade(),
-			req.Asset.GetFeesDiscount(),
+			decimal.Parse(req.Asset.GetMinWithdraw()),
+			decimal.Parse(req.Asset.GetMaxWithdraw()),
+			decimal.Parse(req.Asset.GetMinTrade()),
+			decimal.Parse(req.Asset.GetMaxTrade()),
+			decimal.Parse(req.Asset.GetFeesTrade()),
+			decimal.Parse(req.Asset.GetFeesDiscount()),
 			req.Asset.GetMarker(),
 			req.Asset.GetStatus(),
 			req.Asset.GetGroup(),
 			serialize,
 			req.GetSymbol(),
+			req.Asset.GetPlatform(),
+			decimal.Parse(req.Asset.GetFeesPlatform()),
 		); err != nil {
 			return &response, err
 		}
@@ -163,20 +166,22 @@ func (e *Service) SetAsset(ctx context.Context, req *admin_pbmarket.SetRequestAs
 		// This code is inserting new information into a table called assets. The information being inserted is coming from
 		// the req.Asset object. The information is being inserted into a specific order, corresponding to the columns of
 		// the table. The purpose is to store the information about a currency in the currencies table.
-		if _, err := e.Context.Db.Exec(`insert into assets (name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, marker, "group", status, type, chains) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		if _, err := e.Context.Db.Exec(`insert into assets (name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, marker, "group", status, type, chains, platform, fees_platform) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
 			req.Asset.GetName(),
 			req.Asset.GetSymbol(),
-			req.Asset.GetMinWithdraw(),
-			req.Asset.GetMaxWithdraw(),
-			req.Asset.GetMinTrade(),
-			req.Asset.GetMaxTrade(),
-			req.Asset.GetFeesTrade(),
-			req.Asset.GetFeesDiscount(),
+			decimal.Parse(req.Asset.GetMinWithdraw()),
+			decimal.Parse(req.Asset.GetMaxWithdraw()),
+			decimal.Parse(req.Asset.GetMinTrade()),
+			decimal.Parse(req.Asset.GetMaxTrade()),
+			decimal.Parse(req.Asset.GetFeesTrade()),
+			decimal.Parse(req.Asset.GetFeesDiscount()),
 			req.Asset.GetMarker(),
 			req.Asset.GetGroup(),
 			req.Asset.GetStatus(),
 			req.Asset.GetType(),
 			serialize,
+			req.Asset.GetPlatform(),
+			decimal.Parse(req.Asset.GetFeesPlatform()),
 		); err != nil {
 			return &response, err
 		}
@@ -329,7 +334,7 @@ func (e *Service) GetAssets(ctx context.Context, req *admin_pbmarket.GetRequestA
 
 		// This code is used to query the database. It builds a query with the given parameters (maps, req.GetLimit(), offset).
 		// It then attempts to execute it and, if an error is encountered, the function returns the error. Finally, it closes the rows.
-		rows, err := e.Context.Db.Query(fmt.Sprintf(`select id, name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, fees_charges, fees_costs, marker, status, "group", type, create_at from assets %s order by id desc limit %d offset %d`, strings.Join(maps, " "), req.GetLimit(), offset))
+		rows, err := e.Context.Db.Query(fmt.Sprintf(`select id, name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, fees_charges, fees_costs, fees_platform, platform, marker, status, "group", type, create_at from assets %s order by id desc limit %d offset %d`, strings.Join(maps, " "), req.GetLimit(), offset))
 		if err != nil {
 			return &response, err
 		}
@@ -359,6 +364,8 @@ func (e *Service) GetAssets(ctx context.Context, req *admin_pbmarket.GetRequestA
 				&item.FeesDiscount,
 				&item.FeesCharges,
 				&item.FeesCosts,
+				&item.FeesPlatform,
+				&item.Platform,
 				&item.Marker,
 				&item.Status,
 				&item.Group,
@@ -507,7 +514,7 @@ func (e *Service) GetPairs(ctx context.Context, req *admin_pbmarket.GetRequestPa
 		// ordered by the id column in descending order and limited to the req.GetLimit() number of rows with an offset of
 		// offset. If an error occurs, the code returns the response variable and an error. Finally, the rows.Close() statement
 		// is used to close the connection to the database when the query is complete.
-		rows, err := e.Context.Db.Query(fmt.Sprintf(`select id, base_unit, quote_unit, price, base_decimal, quote_decimal, type, status from pairs %[1]s order by id desc limit %[2]d offset %[3]d`, strings.Join(maps, " "), req.GetLimit(), offset))
+		rows, err := e.Context.Db.Query(fmt.Sprintf(`select id, base_unit, quote_unit, price, base_decimal, quote_decimal, tick_size, step_size, min_notional, max_orders, band, band_window, halt_duration, halt, auction_duration, funding_cap, funding_interval, type, status from pairs %[1]s order by id desc limit %[2]d offset %[3]d`, strings.Join(maps, " "), req.GetLimit(), offset))
 		if err != nil {
 			return &response, err
 		}
@@ -518,7 +525,8 @@ func (e *Service) GetPairs(ctx context.Context, req *admin_pbmarket.GetRequestPa
 		for rows.Next() {
 
 			var (
-				item types.Pair
+				item  types.Pair
+				price decimal.Amount
 			)
 
 			// This code is used to scan a row from a database query and assign the values to variables. The if statement checks
@@ -528,14 +536,26 @@ func (e *Service) GetPairs(ctx context.Context, req *admin_pbmarket.GetRequestPa
 				&item.Id,
 				&item.BaseUnit,
 				&item.QuoteUnit,
-				&item.Price,
+				&price,
 				&item.BaseDecimal,
 				&item.QuoteDecimal,
+				&item.TickSize,
+				&item.StepSize,
+				&item.MinNotional,
+				&item.MaxOrders,
+				&item.Band,
+				&item.BandWindow,
+				&item.HaltDuration,
+				&item.Halt,
+				&item.AuctionDuration,
+				&item.FundingCap,
+				&item.FundingInterval,
 				&item.Type,
 				&item.Status,
 			); err != nil {
 				return &response, err
 			}
+			item.Price = price.String()
 
 			// This appends the item to the end of the response.Fields slice. It adds the item to the existing response.Fields
 			// slice, allowing for the creation of a larger slice with the new item included.
@@ -607,7 +627,8 @@ func (e *Service) SetPair(ctx context.Context, req *admin_pbmarket.SetRequestPai
 		migrate  = query.Migrate{
 			Context: e.Context,
 		}
-		q query.Query
+		q       query.Query
+		enabled bool
 	)
 
 	// This code is part of an authentication process. The purpose of this code is to attempt to authenticate the user and
@@ -632,7 +653,7 @@ func (e *Service) SetPair(ctx context.Context, req *admin_pbmarket.SetRequestPai
 	// This if statement is used to check if the price of a given pair is set to 0. If it is, the statement will return an
 	// error with the status code 46517 and the message "the price must be set". This is likely in place to ensure that the
 	// user is not attempting to purchase a product at an incorrect price.
-	if req.Pair.GetPrice() == 0 {
+	if !decimal.Parse(req.Pair.GetPrice()).IsPositive() {
 		return &response, status.Error(46517, "the price must be set")
 	}
 
@@ -648,19 +669,32 @@ func (e *Service) SetPair(ctx context.Context, req *admin_pbmarket.SetRequestPai
 			_, _ = e.Context.Db.Exec("delete from ohlcv where base_unit = $1 and quote_unit = $2", req.Pair.GetBaseUnit(), req.Pair.GetQuoteUnit())
 		}
 
+		// The previous status of the pair is kept, so a pair that is enabled by this change can be opened with a call auction.
+		_ = e.Context.Db.QueryRow("select status from pairs where id = $1", req.GetId()).Scan(&enabled)
+
 		// This code is used to update an entry in the database table 'pairs', using the values in the 'req' struct. It updates
 		// the 'base_unit', 'quote_unit', 'price', 'base_decimal', 'quote_decimal' and 'status' fields of the database table,
 		// where the value of the 'id' field of the database table is equal to the value of the 'Id' field in the 'req' struct.
 		// The code also includes an if statement to check for any errors in the process.
-		if _, err := e.Context.Db.Exec("update pairs set base_unit = $1, quote_unit = $2, price = $3, base_decimal = $4, quote_decimal = $5, type = $6, status = $7 where id = $8;",
+		if _, err := e.Context.Db.Exec("update pairs set base_unit = $1, quote_unit = $2, price = $3, base_decimal = $4, quote_decimal = $5, type = $6, status = $7, tick_size = $9, step_size = $10, min_notional = $11, max_orders = $12, band = $13, band_window = $14, halt_duration = $15, auction_duration = $16, funding_cap = $17, funding_interval = $18 where id = $8;",
 			req.Pair.GetBaseUnit(),
 			req.Pair.GetQuoteUnit(),
-			req.Pair.GetPrice(),
+			decimal.Parse(req.Pair.GetPrice()),
 			req.Pair.GetBaseDecimal(),
 			req.Pair.GetQuoteDecimal(),
 			req.Pair.GetType(),
 			req.Pair.GetStatus(),
 			req.GetId(),
+			decimal.Parse(req.Pair.GetTickSize()),
+			decimal.Parse(req.Pair.GetStepSize()),
+			decimal.Parse(req.Pair.GetMinNotional()),
+			req.Pair.GetMaxOrders(),
+			decimal.Parse(req.Pair.GetBand()),
+			req.Pair.GetBandWindow(),
+			req.Pair.GetHaltDuration(),
+			req.Pair.GetAuctionDuration(),
+			decimal.Parse(req.Pair.GetFundingCap()),
+			req.Pair.GetFundingInterval(),
 		); err != nil {
 			return &response, err
 		}
@@ -677,19 +711,42 @@ func (e *Service) SetPair(ctx context.Context, req *admin_pbmarket.SetRequestPai
 		// is using the 'Exec' function from the database context to execute an SQL statement for inserting the values into the
 		// table. The 'if _, err' statement is checking for any errors that may have occurred from the execution of the
 		// statement. If an error is detected, the code will return an error response.
-		if _, err := e.Context.Db.Exec("insert into pairs (base_unit, quote_unit, price, base_decimal, quote_decimal, type, status) values ($1, $2, $3, $4, $5, $6, $7)",
+		if _, err := e.Context.Db.Exec("insert into pairs (base_unit, quote_unit, price, base_decimal, quote_decimal, type, status, tick_size, step_size, min_notional, max_orders, band, band_window, halt_duration, auction_duration, funding_cap, funding_interval) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)",
 			req.Pair.GetBaseUnit(),
 			req.Pair.GetQuoteUnit(),
-			req.Pair.GetPrice(),
+			decimal.Parse(req.Pair.GetPrice()),
 			req.Pair.GetBaseDecimal(),
 			req.Pair.GetQuoteDecimal(),
 			req.Pair.GetType(),
 			req.Pair.GetStatus(),
+			decimal.Parse(req.Pair.GetTickSize()),
+			decimal.Parse(req.Pair.GetStepSize()),
+			decimal.Parse(req.Pair.GetMinNotional()),
+			req.Pair.GetMaxOrders(),
+			decimal.Parse(req.Pair.GetBand()),
+			req.Pair.GetBandWindow(),
+			req.Pair.GetHaltDuration(),
+			req.Pair.GetAuctionDuration(),
+			decimal.Parse(req.Pair.GetFundingCap()),
+			req.Pair.GetFundingInterval(),
 		); err != nil {
 			return &response, err
 		}
 
 	}
+
+	// A new listing, or a pair that has just been enabled, is opened with a call auction if the pair has an auction duration.
+	if req.Pair.GetStatus() && !enabled && req.Pair.GetAuctionDuration() > 0 {
+
+		// Provider is used to create a Service instance with the given context.
+		_provider := provider.Service{
+			Context: e.Context,
+		}
+
+		if err := _provider.WriteAuction(req.Pair.GetBaseUnit(), req.Pair.GetQuoteUnit(), req.Pair.GetType(), req.Pair.GetAuctionDuration()); err != nil {
+			return &response, err
+		}
+	}
 	response.Success = true
 
 	return &response, nil
@@ -740,3 +797,195 @@ func (e *Service) DeletePair(ctx context.Context, req *admin_pbmarket.DeleteRequ
 
 	return &response, nil
 }
+
+// SetHalt - The purpose of this code is to halt or resume trading on a pair by an administrator. The user is authenticated and
+// the rules for writing and editing data are checked. A pair halted with a duration is resumed automatically when the
+// duration has passed, a pair halted without a duration stays halted until it is resumed with this request.
+func (e *Service) SetHalt(ctx context.Context, req *admin_pbmarket.SetRequestHalt) (*admin_pbmarket.ResponsePair, error) {
+
+	// The purpose of the above code is to create two variables, response and migrate. response is of type
+	// admin_pbmarket.ResponsePair, while migrate is of type query.Migrate and has a field named Context which is initialized to e.Context.
+	var (
+		response admin_pbmarket.ResponsePair
+		migrate  = query.Migrate{
+			Context: e.Context,
+		}
+	)
+
+	// This code is part of an authentication process. The purpose of this code is to attempt to authenticate the user and
+	// retrieve the authentication data. If there is an error, it is returned to the caller.
+	auth, err := e.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// This code is checking to see if the user has the necessary authorization to perform a write or edit operation on the
+	// data. If the user does not have the correct authorization to do so, an error is returned with a status code of 12011.
+	if !migrate.Rules(auth, "pairs", query.RoleMarket) || migrate.Rules(auth, "deny-record", query.RoleDefault) {
+		return &response, status.Error(12011, "you do not have rules for writing and editing data")
+	}
+
+	// Provider is used to create a Service instance with the given context.
+	_provider := provider.Service{
+		Context: e.Context,
+	}
+
+	// The pair is queried by its id, the halt is kept for its base unit, quote unit and type.
+	row, err := _provider.QueryPair(req.GetId(), types.TypeZero, false)
+	if err != nil {
+		return &response, status.Errorf(11585, "this pair %v does not exist", req.GetId())
+	}
+
+	if req.GetHalt() {
+		if err := _provider.WriteHalt(row.GetBaseUnit(), row.GetQuoteUnit(), row.GetType(), req.GetDuration()); err != nil {
+			return &response, err
+		}
+	} else {
+		if err := _provider.WriteResume(row.GetBaseUnit(), row.GetQuoteUnit(), row.GetType()); err != nil {
+			return &response, err
+		}
+	}
+	response.Success = true
+
+	return &response, nil
+}
+
+// GetReplay - This function rebuilds the order books of a pair and their fills from the matching engine journal and compares them
+// with the orders and the trades tables. The books of the given type are replayed, or all books of the pair if no type is
+// given. Every book is returned with the discrepancies found, an empty list means the journal and the tables agree.
+func (e *Service) GetReplay(ctx context.Context, req *admin_pbmarket.GetRequestReplay) (*admin_pbmarket.ResponseReplay, error) {
+
+	var (
+		response admin_pbmarket.ResponseReplay
+		migrate  = query.Migrate{
+			Context: e.Context,
+		}
+		books []string
+	)
+
+	// This code is part of an authentication process. The purpose of this code is to attempt to authenticate the user and
+	// retrieve the authentication data. If there is an error, it is returned to the caller.
+	auth, err := e.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// This code is checking to see if the user has the necessary authorization to read the data of the pairs.
+	if !migrate.Rules(auth, "pairs", query.RoleMarket) {
+		return &response, status.Error(12011, "you do not have rules for writing and editing data")
+	}
+
+	// Provider is used to create a Service instance with the given context.
+	_provider := provider.Service{
+		Context: e.Context,
+	}
+
+	// The pair is queried by its id, the journal is kept for its base and quote unit.
+	row, err := _provider.QueryPair(req.GetId(), types.TypeZero, false)
+	if err != nil {
+		return &response, status.Errorf(11585, "this pair %v does not exist", req.GetId())
+	}
+
+	// Without a type, every book of the pair that has a checkpoint or an event in the journal is replayed.
+	if len(req.GetType()) > 0 {
+		books = append(books, req.GetType())
+	} else {
+
+		rows, err := e.Context.Db.Query("select type from checkpoints where base_unit = $1 and quote_unit = $2 union select distinct type from journal where base_unit = $1 and quote_unit = $2", row.GetBaseUnit(), row.GetQuoteUnit())
+		if err != nil {
+			return &response, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+
+			var (
+				_type string
+			)
+
+			if err := rows.Scan(&_type); err != nil {
+				return &response, err
+			}
+			books = append(books, _type)
+		}
+	}
+
+	for _, _type := range books {
+
+		replay, err := _provider.QueryReplay(row.GetBaseUnit(), row.GetQuoteUnit(), _type)
+		if err != nil {
+			return &response, err
+		}
+		response.Fields = append(response.Fields, replay)
+	}
+
+	return &response, nil
+}
+
+// GetInsurance - This function returns the balance history of the insurance fund of a quote asset, every surplus credited by
+// a liquidation and every deficit it covered, newest first, together with the current balance of the fund.
+func (e *Service) GetInsurance(ctx context.Context, req *admin_pbmarket.GetRequestInsurance) (*admin_pbmarket.ResponseInsurance, error) {
+
+	var (
+		response admin_pbmarket.ResponseInsurance
+		migrate  = query.Migrate{
+			Context: e.Context,
+		}
+	)
+
+	// This code is part of an authentication process. The purpose of this code is to attempt to authenticate the user and
+	// retrieve the authentication data. If there is an error, it is returned to the caller.
+	auth, err := e.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// This code is checking to see if the user has the necessary authorization to read the data of the pairs.
+	if !migrate.Rules(auth, "pairs", query.RoleMarket) {
+		return &response, status.Error(12011, "you do not have rules for writing and editing data")
+	}
+
+	// The fund is kept on the asset, an asset that does not exist has no fund.
+	if err := e.Context.Db.QueryRow("select insurance from assets where symbol = $1", req.GetSymbol()).Scan(&response.Balance); err != nil {
+		return &response, status.Errorf(11584, "this asset does not exist, %v", req.GetSymbol())
+	}
+
+	if req.GetLimit() == 0 {
+		req.Limit = 30
+	}
+
+	_ = e.Context.Db.QueryRow("select count(*) as count from insurance where symbol = $1", req.GetSymbol()).Scan(&response.Count)
+
+	if response.GetCount() > 0 {
+
+		offset := req.GetLimit() * req.GetPage()
+		if req.GetPage() > 0 {
+			offset = req.GetLimit() * (req.GetPage() - 1)
+		}
+
+		rows, err := e.Context.Db.Query("select id, symbol, value, balance, assigning, order_id, user_id, create_at from insurance where symbol = $1 order by id desc limit $2 offset $3", req.GetSymbol(), req.GetLimit(), offset)
+		if err != nil {
+			return &response, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+
+			var (
+				item types.Insurance
+			)
+
+			if err = rows.Scan(&item.Id, &item.Symbol, &item.Value, &item.Balance, &item.Assigning, &item.OrderId, &item.UserId, &item.CreateAt); err != nil {
+				return &response, err
+			}
+
+			response.Fields = append(response.Fields, &item)
+		}
+
+		if err = rows.Err(); err != nil {
+			return &response, err
+		}
+	}
+
+	return &response, nil
+}
@@ -94,6 +94,37 @@ func (a *Service) writePassword(id int64, oldPassword, newPassword string) error
 	return status.Error(44754, "the old password was entered incorrectly")
 }
 
+// writeSelfTrade - This function sets the self-trade prevention mode of the account. The mode decides what happens when an order
+// of the user would be matched with another order of the same user, unless the order chooses its own mode.
+func (a *Service) writeSelfTrade(id int64, mode string) error {
+
+	if err := types.SelfTrade(mode); err != nil {
+		return status.Error(10505, "incorrect self trade prevention mode")
+	}
+
+	if _, err := a.Context.Db.Exec("update accounts set self_trade = $2 where id = $1", id, mode); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeFeesPlatform - This function turns on ("enable") or off ("disable") the payment of the trading fees of the account in the
+// platform asset. While it is on, the fees are charged from the balance of the platform asset at its discount instead of
+// being deducted from the received asset, as long as that balance is sufficient.
+func (a *Service) writeFeesPlatform(id int64, mode string) error {
+
+	if mode != "enable" && mode != "disable" {
+		return status.Error(10506, "incorrect platform fee payment mode")
+	}
+
+	if _, err := a.Context.Db.Exec("update accounts set fees_platform = $2 where id = $1", id, mode == "enable"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // setSample - This code is part of a Service class in the pbaccount package. The purpose of this function is to set the sample field
 // of a specific account identified by the id int64 parameter. It will check if the index string parameter is in the
 // column array and if it is, it will either remove or add the index to the sample field of the account. It will then
@@ -226,7 +257,7 @@ func (a *Service) QueryUser(id int64) (*types.User, error) {
 	// This code is used to query the database for a specific row using the "id" variable. It then assigns the retrieved row
 	// values to the response struct, which holds the values to be returned to the user. If an error occurs during the
 	// query, it is returned to the user instead.
-	if err := a.Context.Db.QueryRow("select id, name, email, status, sample, rules, factor_secure, factor_secret from accounts where id = $1", id).Scan(&response.Id, &response.Name, &response.Email, &response.Status, &q.Sample, &q.Rules, &response.FactorSecure, &response.FactorSecret); err != nil {
+	if err := a.Context.Db.QueryRow("select id, name, email, status, sample, rules, factor_secure, factor_secret, self_trade, fees_platform from accounts where id = $1", id).Scan(&response.Id, &response.Name, &response.Email, &response.Status, &q.Sample, &q.Rules, &response.FactorSecure, &response.FactorSecret, &response.SelfTrade, &response.FeesPlatform); err != nil {
 		return &response, err
 	}
 
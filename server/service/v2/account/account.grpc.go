@@ -37,6 +37,20 @@ func (a *Service) SetUser(ctx context.Context, req *pbaccount.SetRequestUser) (*
 		}
 	}
 
+	// The self-trade prevention mode of the account is used by the orders that do not choose their own mode.
+	if len(req.GetSelfTrade()) > 0 {
+		if err := a.writeSelfTrade(auth, req.GetSelfTrade()); err != nil {
+			return &response, err
+		}
+	}
+
+	// The payment of the trading fees in the platform asset is turned on or off for the account.
+	if len(req.GetFeesPlatform()) > 0 {
+		if err := a.writeFeesPlatform(auth, req.GetFeesPlatform()); err != nil {
+			return &response, err
+		}
+	}
+
 	// This is an if statement that is checking the length of two variables, req.GetOldPassword() and req.GetNewPassword().
 	// If the length of both of these is greater than 0, then the code in the statement will execute. This if statement is
 	// likely being used to ensure that the user has provided both an old and a new password before some action is taken.
@@ -0,0 +1,219 @@
+package future
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// funding - This function runs every minute and settles the funding of every futures pair whose funding interval has ended.
+func (a *Service) funding() {
+
+	// The code creates a ticker that triggers every minute and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Minute * 1)
+	for range ticker.C {
+		a.writeFundings()
+	}
+}
+
+// writeFundings - This function settles the last ended funding interval of every enabled futures pair. The intervals are
+// aligned to the start of the day in UTC, with an interval of eight hours the funding is settled at 00:00, 08:00 and 16:00.
+// A pair with no funding interval or no funding cap has no funding.
+func (a *Service) writeFundings() {
+
+	var (
+		pairs []*types.Pair
+	)
+
+	rows, err := a.Context.Db.Query(`select base_unit, quote_unit, funding_cap, funding_interval from pairs where type = $1 and status = $2 and funding_interval > 0 and funding_cap > 0 order by id`, types.TypeFuture, true)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	for rows.Next() {
+
+		var (
+			pair types.Pair
+		)
+
+		if err := rows.Scan(&pair.BaseUnit, &pair.QuoteUnit, &pair.FundingCap, &pair.FundingInterval); a.Context.Debug(err) {
+			continue
+		}
+
+		pairs = append(pairs, &pair)
+	}
+	rows.Close()
+
+	for _, pair := range pairs {
+
+		interval := time.Duration(pair.GetFundingInterval()) * time.Hour
+
+		funding, err := a.writeFunding(pair, time.Now().UTC().Truncate(interval), interval)
+		if a.Context.Debug(err) || funding == nil {
+			continue
+		}
+
+		// This code is intended to publish the settled funding to an exchange with the routing key "future/funding".
+		if err := a.Context.Publish(funding, "exchange", "future/funding"); a.Context.Debug(err) {
+			continue
+		}
+	}
+}
+
+// writeFunding - This function settles the funding interval of the pair that ended at the given time. The rate is computed
+// from the premium of the mark price over the index price during the interval, and every open position of the pair pays
+// or receives its notional value at the mark price multiplied by that rate: with a positive rate the longs pay the shorts,
+// with a negative rate the shorts pay the longs. The payments are transferred in the futures balance of the users. The
+// interval is recorded together with the payments, so it is settled only once; nil is returned if it already was.
+func (a *Service) writeFunding(pair *types.Pair, at time.Time, interval time.Duration) (*types.Funding, error) {
+
+	var (
+		funding = types.Funding{
+			BaseUnit:  pair.GetBaseUnit(),
+			QuoteUnit: pair.GetQuoteUnit(),
+			FundingAt: at.Format(time.RFC3339),
+		}
+		positions []*types.Holding
+	)
+
+	// Without a mark price the payments can not be valued, the interval is settled with the next run instead.
+	mark, ok := a.queryMark(pair.GetBaseUnit(), pair.GetQuoteUnit())
+	if !ok {
+		return nil, nil
+	}
+
+	premium, _ := a.queryPremium(pair.GetBaseUnit(), pair.GetQuoteUnit(), at.Add(-interval), at)
+	rate := fundingRate(premium, decimal.Parse(pair.GetFundingCap()))
+
+	funding.Mark, funding.Premium, funding.Rate = mark.String(), premium.String(), rate.String()
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("insert into fundings (base_unit, quote_unit, rate, premium, mark, funding_at) values ($1, $2, $3, $4, $5, $6) on conflict (base_unit, quote_unit, funding_at) do nothing returning id", funding.GetBaseUnit(), funding.GetQuoteUnit(), rate, premium, mark, at).Scan(&funding.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rows, err := tx.Query("select id, user_id, position, quantity from positions where base_unit = $1 and quote_unit = $2 and quantity > 0 for update", pair.GetBaseUnit(), pair.GetQuoteUnit())
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+
+		var (
+			item types.Holding
+		)
+
+		if err := rows.Scan(&item.Id, &item.UserId, &item.Position, &item.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		positions = append(positions, &item)
+	}
+	rows.Close()
+
+	for _, item := range positions {
+
+		value := payment(item, mark, rate)
+
+		if _, err := tx.Exec("update balances set value = value + $2 where symbol = $1 and user_id = $3 and type = $4;", pair.GetQuoteUnit(), value, item.GetUserId(), types.TypeFuture); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("insert into payments (funding_id, position_id, user_id, base_unit, quote_unit, position, quantity, mark, rate, value) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", funding.GetId(), item.GetId(), item.GetUserId(), pair.GetBaseUnit(), pair.GetQuoteUnit(), item.GetPosition(), decimal.Parse(item.GetQuantity()), mark, rate, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &funding, nil
+}
+
+// queryPremium - This function returns the average premium of the mark price over the index price of the pair between the
+// two times, as a fraction of the index price. It reports false when there is no mark price in that period.
+func (a *Service) queryPremium(base, quote string, from, to time.Time) (premium decimal.Amount, ok bool) {
+
+	var (
+		count int
+	)
+
+	if err := a.Context.Db.QueryRow("select count(*), coalesce(avg((price - index_price) / index_price), 0) from marks where base_unit = $1 and quote_unit = $2 and index_price > 0 and price > 0 and create_at >= $3 and create_at < $4", base, quote, from, to).Scan(&count, &premium); err != nil || count == 0 {
+		return decimal.Zero, ok
+	}
+
+	return premium, true
+}
+
+// queryFunding - This function returns the predicted funding of the pair for the running interval, the rate computed from the
+// premium of the interval so far, and the time at which the interval ends and the funding is settled.
+func (a *Service) queryFunding(base, quote string) (*types.Funding, error) {
+
+	var (
+		pair    types.Pair
+		funding = types.Funding{
+			BaseUnit:  base,
+			QuoteUnit: quote,
+		}
+	)
+
+	if err := a.Context.Db.QueryRow("select funding_cap, funding_interval from pairs where base_unit = $1 and quote_unit = $2 and type = $3", base, quote, types.TypeFuture).Scan(&pair.FundingCap, &pair.FundingInterval); err != nil {
+		return nil, err
+	}
+
+	if pair.GetFundingInterval() <= 0 {
+		return &funding, nil
+	}
+
+	interval := time.Duration(pair.GetFundingInterval()) * time.Hour
+	start := time.Now().UTC().Truncate(interval)
+
+	funding.FundingAt = start.Add(interval).Format(time.RFC3339)
+	mark, _ := a.queryMark(base, quote)
+	premium, _ := a.queryPremium(base, quote, start, time.Now().UTC())
+
+	funding.Mark, funding.Premium, funding.Rate = mark.String(), premium.String(), fundingRate(premium, decimal.Parse(pair.GetFundingCap())).String()
+
+	return &funding, nil
+}
+
+// fundingRate - This function returns the funding rate for the premium, clamped between the negative and the positive cap.
+// The cap is given in percent, the premium and the returned rate are fractions.
+func fundingRate(premium, cap decimal.Amount) decimal.Amount {
+
+	limit := cap.Div(decimal.New(100).Amount())
+
+	if premium.GreaterThan(limit) {
+		return limit
+	}
+
+	if premium.LessThan(limit.Neg()) {
+		return limit.Neg()
+	}
+
+	return premium
+}
+
+// payment - This function returns the funding payment of the position, a negative value is paid by the position and a
+// positive value is received by it. The longs pay with a positive rate, the shorts pay with a negative one.
+func payment(holding *types.Holding, mark, rate decimal.Amount) decimal.Amount {
+
+	value := decimal.Parse(holding.GetQuantity()).Mul(mark).Mul(rate)
+	if holding.GetPosition() == types.PositionLong {
+		return value.Neg()
+	}
+
+	return value
+}
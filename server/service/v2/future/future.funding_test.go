@@ -0,0 +1,48 @@
+package future
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestFundingRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		premium string
+		cap     string
+		want    string
+	}{
+		{name: "inside", premium: "0.0001", cap: "0.75", want: "0.0001"},
+		{name: "above", premium: "0.01", cap: "0.75", want: "0.0075"},
+		{name: "below", premium: "-0.01", cap: "0.75", want: "-0.0075"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fundingRate(decimal.Parse(tt.premium), decimal.Parse(tt.cap)); !got.Equal(decimal.Parse(tt.want)) {
+				t.Errorf("fundingRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayment(t *testing.T) {
+	tests := []struct {
+		name    string
+		holding *types.Holding
+		rate    string
+		want    string
+	}{
+		{name: "long pays", holding: &types.Holding{Position: types.PositionLong, Quantity: "2"}, rate: "0.001", want: "-0.2"},
+		{name: "short receives", holding: &types.Holding{Position: types.PositionShort, Quantity: "2"}, rate: "0.001", want: "0.2"},
+		{name: "short pays", holding: &types.Holding{Position: types.PositionShort, Quantity: "2"}, rate: "-0.001", want: "-0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := payment(tt.holding, decimal.New(100).Amount(), decimal.Parse(tt.rate)); !got.Equal(decimal.Parse(tt.want)) {
+				t.Errorf("payment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
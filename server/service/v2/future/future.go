@@ -1,8 +1,7 @@
 package future
 
 import (
-	"fmt"
-	"strconv"
+	"database/sql"
 
 	"github.com/cryptogateway/backend-envoys/assets"
 	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
@@ -14,8 +13,21 @@ type Service struct {
 	Context *assets.Context
 }
 
-func (a *Service) Initialization() {
+// executor - The executor interface is implemented by both *sql.DB and *sql.Tx, so the same code can write directly into the
+// database or into the transaction that places an order or settles a whole fill.
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
 
+// Initialization - The code initializes a Service object and runs three concurrent functions: mark(), which keeps the mark
+// price of every futures pair up to date, liquidation(), which liquidates the positions that fell to their maintenance
+// margin at that mark price, and funding(), which settles the funding between the longs and the shorts.
+func (a *Service) Initialization() {
+	go a.mark()
+	go a.liquidation()
+	go a.funding()
 }
 
 func (a *Service) queryValidatePair(base, quote, _type string) error {
@@ -29,7 +41,7 @@ func (a *Service) queryValidatePair(base, quote, _type string) error {
 	return nil
 }
 
-func (a *Service) queryMarket(base, quote, _type string, assigning string, price float64) float64 {
+func (a *Service) queryMarket(base, quote, _type string, assigning string, price decimal.Amount) decimal.Amount {
 
 	var (
 		ok bool
@@ -52,7 +64,7 @@ func (a *Service) queryMarket(base, quote, _type string, assigning string, price
 	return price
 }
 
-func (a *Service) queryPrice(base, quote string) (price float64, ok bool) {
+func (a *Service) queryPrice(base, quote string) (price decimal.Amount, ok bool) {
 
 	if err := a.Context.Db.QueryRow("select price from pairs where base_unit = $1 and quote_unit = $2", base, quote).Scan(&price); err != nil {
 		return price, ok
@@ -61,55 +73,93 @@ func (a *Service) queryPrice(base, quote string) (price float64, ok bool) {
 	return price, true
 }
 
-func (a *Service) queryValidateOrder(order *types.Future) (summary float64, err error) {
+func (a *Service) queryValidateOrder(order *types.Future) (summary decimal.Amount, err error) {
+
+	var (
+		price    = decimal.Parse(order.GetPrice())
+		quantity = decimal.Parse(order.GetQuantity())
+	)
+
+	if !price.IsPositive() {
+		return summary, status.Errorf(65790, "impossible price %v", order.GetPrice())
+	}
+
+	if order.GetLeverage() < 1 {
+		return summary, status.Errorf(11631, "impossible leverage %v", order.GetLeverage())
+	}
+
+	if err := types.Position(order.GetPosition()); err != nil {
+		return summary, status.Error(11589, "invalid assigning trade position")
+	}
 
-	if order.GetPrice() == 0 {
-		return 0, status.Errorf(65790, "impossible price %v", order.GetPrice())
+	if err := types.Mode(order.GetMode()); err != nil {
+		return summary, status.Error(11632, "invalid margin mode, available modes: cross, isolated")
+	}
+
+	// The position of the user on this pair and side, an empty position is returned if the user has never traded it.
+	position := a.queryPosition(order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPosition())
+
+	// A position that has been taken over by the liquidation engine belongs to it until it is closed.
+	if position.GetStatus() == types.MarginLiquidation {
+		return summary, status.Errorf(11634, "the %v position is being liquidated", position.GetPosition())
 	}
 
 	switch order.GetAssigning() {
 	case types.AssigningOpen:
 
-		quantity := decimal.New(order.GetQuantity()).Mul(order.GetPrice()).Float()
-
-		if min, max, ok := a.queryRange(order.GetQuoteUnit(), quantity); !ok {
-			return 0, status.Errorf(11623, "[quote]: minimum trading amount: %v~%v, maximum trading amount: %v", min, strconv.FormatFloat(decimal.New(min).Mul(2).Float(), 'f', -1, 64), strconv.FormatFloat(max, 'f', -1, 64))
+		// An open position keeps the margin mode and leverage it was opened with, they can only be changed once it is closed.
+		if decimal.Parse(position.GetQuantity()).IsPositive() && (position.GetMode() != order.GetMode() || position.GetLeverage() != order.GetLeverage()) {
+			return summary, status.Errorf(11633, "the %v position is open with %v margin and leverage %v, close it before changing them", position.GetPosition(), position.GetMode(), position.GetLeverage())
 		}
 
-		balance := a.QueryBalance(order.GetQuoteUnit(), "future", order.GetUserId())
+		notional := quantity.Mul(price)
 
-		if decimal.New(quantity).Div(order.GetLeverage()).Float() > balance || order.GetQuantity() == 0 {
-			return 0, status.Error(11586, "[quote]: there is not enough funds on your asset balance to place an order")
+		if min, max, ok := a.queryRange(order.GetQuoteUnit(), notional); !ok {
+			return summary, status.Errorf(11623, "[quote]: minimum trading amount: %v~%v, maximum trading amount: %v", min, min.Mul(decimal.New(2).Amount()), max)
 		}
 
-		return quantity, nil
+		// The larger the position grows, the higher its maintenance tier and the lower the leverage it may use.
+		if tier := queryMaintenance(a.queryTiers(), decimal.Parse(position.GetQuantity()).Add(quantity).Mul(price)); order.GetLeverage() > tier.leverage {
+			return summary, status.Errorf(11635, "the maximum leverage for a position of this size is %v", tier.leverage)
+		}
 
-	case types.AssigningClose:
+		// The initial margin reserved for the order, the notional value of the order divided by its leverage.
+		margin := notional.Div(decimal.New(order.GetLeverage()).Amount())
 
-		quantity := order.GetQuantity()
+		if margin.GreaterThan(a.queryMargin(order.GetUserId(), order.GetQuoteUnit())) || !quantity.IsPositive() {
+			return summary, status.Error(11586, "[quote]: there is not enough funds on your asset balance to place an order")
+		}
 
-		_, openQuantity := a.queryOrders(order.UserId, types.AssigningOpen, order.GetPosition(), order.GetBaseUnit(), order.GetQuoteUnit())
+		return margin, nil
 
-		fmt.Println("TOTAL OPEN QUANTITY IS ", openQuantity)
-		if min, max, ok := a.queryRange(order.GetBaseUnit(), order.GetQuantity()); !ok {
-			return 0, status.Errorf(11587, "[base]: minimum trading amount: %v~%v, maximum trading amount: %v", min, strconv.FormatFloat(decimal.New(min).Mul(2).Float(), 'f', -1, 64), strconv.FormatFloat(max, 'f', -1, 64))
+	case types.AssigningClose:
+
+		if min, max, ok := a.queryRange(order.GetBaseUnit(), quantity); !ok {
+			return summary, status.Errorf(11587, "[base]: minimum trading amount: %v~%v, maximum trading amount: %v", min, min.Mul(decimal.New(2).Amount()), max)
 		}
 
-		// balance := a.QueryBalance(order.GetBaseUnit(), "future", order.GetUserId())
+		// Close orders that are still pending already claim part of the position, so only the rest of it can be closed.
+		if quantity.GreaterThan(decimal.Parse(position.GetQuantity()).Sub(a.queryClosing(order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPosition()))) || !quantity.IsPositive() {
+			return summary, status.Error(11624, "[base]: there is not enough open position to close")
+		}
 
-		if quantity > openQuantity || order.GetQuantity() == 0 {
-			return 0, status.Error(11624, "[base]: there is not enough funds locking in your orders")
+		// An isolated position can not be closed at a loss beyond its margin, a close order priced past the bankruptcy price
+		// would take the loss that the user can not pay from the insurance fund.
+		if position.GetMode() == types.ModeIsolated {
+			if limit := bankruptcy(position); limit.IsPositive() && ((position.GetPosition() == types.PositionLong && price.LessThan(limit)) || (position.GetPosition() == types.PositionShort && price.GreaterThan(limit))) {
+				return summary, status.Errorf(11636, "the close price %v is beyond the bankruptcy price %v of the %v position", price, limit, position.GetPosition())
+			}
 		}
 
 		return quantity, nil
 	}
 
-	return 0, status.Error(11596, "invalid input parameter")
+	return summary, status.Error(11596, "invalid input parameter")
 }
 
-func (a *Service) writeOrder(order *types.Future) (id int64, err error) {
+func (a *Service) writeOrder(tx executor, order *types.Future) (id int64, err error) {
 
-	if err := a.Context.Db.QueryRow("insert into futures (position, trading, base_unit, quote_unit, price, quantity, leverage, take_profit, stop_loss, fees, status, user_id, assigning, value) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning id", order.GetPosition(), order.GetOrderType(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPrice(), order.GetQuantity(), order.GetLeverage(), order.GetTakeProfit(), order.GetStopLoss(), order.GetFees(), types.StatusPending, order.GetUserId(), order.GetAssigning(), order.GetValue()).Scan(&id); err != nil {
+	if err := tx.QueryRow("insert into futures (position, trading, base_unit, quote_unit, price, quantity, leverage, take_profit, stop_loss, fees, status, user_id, assigning, value, mode, liquidation) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) returning id", order.GetPosition(), order.GetOrderType(), order.GetBaseUnit(), order.GetQuoteUnit(), decimal.Parse(order.GetPrice()), decimal.Parse(order.GetQuantity()), order.GetLeverage(), decimal.Parse(order.GetTakeProfit()), decimal.Parse(order.GetStopLoss()), decimal.Parse(order.GetFees()), types.StatusPending, order.GetUserId(), order.GetAssigning(), decimal.Parse(order.GetValue()), order.GetMode(), order.GetLiquidation()).Scan(&id); err != nil {
 		return id, err
 	}
 
@@ -138,18 +188,24 @@ func (a *Service) writeAsset(symbol, _type string, userId int64, error bool) err
 
 	return nil
 }
-func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity float64, cross string) error {
+func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity decimal.Amount, cross string) error {
+	return a.writeBalance(a.Context.Db, symbol, _type, userId, quantity, cross)
+}
+
+// writeBalance - This function does the same as WriteBalance, but executes the update through the given executor, so the balance
+// can be changed inside the transaction that places an order or settles a fill.
+func (a *Service) writeBalance(tx executor, symbol, _type string, userId int64, quantity decimal.Amount, cross string) error {
 
 	switch cross {
 	case types.BalancePlus:
 
-		if _, err := a.Context.Db.Exec("update balances set value = value + $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
+		if _, err := tx.Exec("update balances set value = value + $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
 			return err
 		}
 		break
 	case types.BalanceMinus:
 
-		if _, err := a.Context.Db.Exec("update balances set value = value - $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
+		if _, err := tx.Exec("update balances set value = value - $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
 			return err
 		}
 		break
@@ -158,62 +214,64 @@ func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity floa
 	return nil
 }
 
-func (a *Service) queryRange(symbol string, value float64) (min, max float64, ok bool) {
+func (a *Service) queryRange(symbol string, value decimal.Amount) (min, max decimal.Amount, ok bool) {
 
 	if err := a.Context.Db.QueryRow("select min_trade, max_trade from assets where symbol = $1", symbol).Scan(&min, &max); err != nil {
 		return min, max, ok
 	}
 
-	if value >= min && value <= max {
+	if value.GreaterThanOrEqual(min) && value.LessThanOrEqual(max) {
 		return min, max, true
 	}
 
 	return min, max, ok
 }
-func (a *Service) QueryBalance(symbol, _type string, userId int64) (balance float64) {
+func (a *Service) QueryBalance(symbol, _type string, userId int64) (balance decimal.Amount) {
 
-	// _ = a.Context.Db.QueryRow("select value as balance from balances where symbol = $1 and user_id = $2 and type = $3", symbol, userId, _type).Scan(&balance)
-	_ = a.Context.Db.QueryRow("select value as balance from balances where symbol = $1 and user_id = $2", symbol, userId).Scan(&balance)
+	_ = a.Context.Db.QueryRow("select value as balance from balances where symbol = $1 and user_id = $2 and type = $3", symbol, userId, _type).Scan(&balance)
 
 	return balance
 }
 
-func (a *Service) writeTrade(id int64, symbol string, value, price float64, convert bool) (float64, error) {
-
-	order := a.queryOrder(id)
-	// order.Value = value
+// queryBalance - This function does the same as QueryBalance, but reads the balance through the given executor and locks its row,
+// so inside a transaction the balance can not be changed by anybody else until the transaction ends.
+func (a *Service) queryBalance(tx executor, symbol, _type string, userId int64) (balance decimal.Amount) {
+	_ = tx.QueryRow("select value as balance from balances where symbol = $1 and user_id = $2 and type = $3 for update", symbol, userId, _type).Scan(&balance)
+	return balance
+}
 
-	if convert {
-		value = decimal.New(value).Mul(price).Float()
-	}
+// writeTrade - This function records one side of a fill as a trade and charges its fee, through the given executor, which is the
+// transaction that settles the whole fill.
+func (a *Service) writeTrade(tx executor, order *types.Future, quantity, price decimal.Amount, maker bool) (decimal.Amount, error) {
 
-	s, f, maker, err := a.querySum(id, symbol, value)
+	// The fees of a futures trade are charged in the quote unit on the notional value of the fill.
+	f, err := a.querySum(tx, order.GetQuoteUnit(), quantity.Mul(price), maker)
 	if err != nil {
-		return 0, err
+		return f, err
 	}
 
-	if order.GetPosition() == types.PositionLong {
-		order.Fees = decimal.New(f).Div(price).Float()
-	} else {
-		order.Fees = f
+	// The liquidation and the auto-deleveraging fills are not charged, what is left of a liquidated position goes to the
+	// insurance fund instead.
+	if order.GetLiquidation() {
+		f = decimal.Zero
 	}
 
-	if _, err := a.Context.Db.Exec(`insert into trades (order_id, assigning, user_id, base_unit, quote_unit, quantity, fees, price, maker) values ($1, $2, $3, $4, $5, $6, $7, $8)`, order.GetId(), order.GetAssigning(), order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetQuantity(), order.GetFees(), price, maker); err != nil {
-		return 0, err
+	if _, err := tx.Exec(`insert into trades (order_id, assigning, user_id, base_unit, quote_unit, quantity, fees, fees_unit, price, maker) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, order.GetId(), order.GetAssigning(), order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), quantity, f, order.GetQuoteUnit(), price, maker); err != nil {
+		return f, err
 	}
 
-	if f > 0 {
+	if f.IsPositive() {
 
-		if _, err := a.Context.Db.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", symbol, f); err != nil {
-			return 0, err
+		if err := a.writeBalance(tx, order.GetQuoteUnit(), types.TypeFuture, order.GetUserId(), f, types.BalanceMinus); err != nil {
+			return f, err
 		}
-	}
 
-	if err := a.Context.Publish(a.queryOrder(order.GetId()), "exchange", "future/status"); err != nil {
-		return 0, err
+		if _, err := tx.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", order.GetQuoteUnit(), f); err != nil {
+			return f, err
+		}
 	}
 
-	return s, nil
+	return f, nil
 }
 func (a *Service) queryOrder(id int64) *types.Future {
 
@@ -221,69 +279,34 @@ func (a *Service) queryOrder(id int64) *types.Future {
 		order types.Future
 	)
 
-	_ = a.Context.Db.QueryRow("select id, quantity, price, assigning, user_id, base_unit, quote_unit, status, create_at from futures where id = $1", id).Scan(&order.Id, &order.Quantity, &order.Price, &order.Assigning, &order.UserId, &order.BaseUnit, &order.QuoteUnit, &order.Status, &order.CreateAt)
+	_ = a.Context.Db.QueryRow("select id, quantity, value, price, assigning, position, leverage, mode, user_id, base_unit, quote_unit, status, create_at from futures where id = $1", id).Scan(&order.Id, &order.Quantity, &order.Value, &order.Price, &order.Assigning, &order.Position, &order.Leverage, &order.Mode, &order.UserId, &order.BaseUnit, &order.QuoteUnit, &order.Status, &order.CreateAt)
 	return &order
 }
-func (a *Service) queryOrders(userId int64, assigning string, position string, baseUnit string, quoteUnit string) ([]*types.Future, float64) {
-	var (
-		orders        []*types.Future
-		totalQuantity float64 = 0.0
-	)
-	rows, err := a.Context.Db.Query("select id, quantity, price, assigning, user_id, base_unit, quote_unit, status, position, fees, create_at, leverage from futures where user_id = $1 and assigning = $2 and position = $3 and base_unit = $4 and quote_unit = $5", userId, assigning, position, baseUnit, quoteUnit)
-
-	if err != nil {
-		return nil, 0
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var (
-			order types.Future
-		)
-		if err := rows.Scan(&order.Id, &order.Quantity, &order.Price, &order.Assigning, &order.UserId, &order.BaseUnit, &order.QuoteUnit, &order.Status, &order.Position, &order.Fees, &order.CreateAt, &order.Leverage); err != nil {
-			fmt.Println("Error occured", err)
-			return nil, 0
-		}
-		totalQuantity += decimal.New(totalQuantity).Add(decimal.New(order.Quantity).Mul(order.Price).Div(order.Leverage).Float()).Float()
-		// totalQuantity = totalQuantity + order.Quantity*order.Price/order.Leverage
-		orders = append(orders, &order)
-	}
-
-	return orders, totalQuantity
-}
 
-func (a *Service) querySum(id int64, symbol string, value float64) (b, f float64, m bool, err error) {
+func (a *Service) querySum(tx executor, symbol string, value decimal.Amount, maker bool) (f decimal.Amount, err error) {
 
 	var (
-		d float64
-		s string
+		d decimal.Amount
 	)
 
-	if err := a.Context.Db.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", symbol).Scan(&f, &d); err != nil {
-		return b, f, m, err
-	}
-
-	if err := a.Context.Db.QueryRow("select status from futures where id = $1;", id).Scan(&s); err != nil {
-		return b, f, m, err
-	}
-
-	if s == types.StatusPending {
-		m = true
+	if err := tx.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", symbol).Scan(&f, &d); err != nil {
+		return f, err
 	}
 
-	if m {
-		f = decimal.New(f).Sub(d).Float()
+	if maker {
+		f = f.Sub(d)
 	}
 
-	return decimal.New(value).Sub(decimal.New(decimal.New(value).Mul(f).Float()).Div(100).Float()).Float(), decimal.New(value).Sub(decimal.New(value).Sub(decimal.New(decimal.New(value).Mul(f).Float()).Div(100).Float()).Float()).Float(), m, nil
+	return value.Mul(f).Div(decimal.New(100).Amount()), nil
 }
 
-func (a *Service) queryQuantity(assigning string, position string, quantity, price float64, cross bool) float64 {
+func (a *Service) queryQuantity(assigning string, position string, quantity, price decimal.Amount, cross bool) decimal.Amount {
 
 	if cross {
 
 		switch assigning {
 		case types.AssigningBuy:
-			quantity = decimal.New(quantity).Div(price).Float()
+			quantity = quantity.Div(price)
 		}
 
 		return quantity
@@ -292,7 +315,7 @@ func (a *Service) queryQuantity(assigning string, position string, quantity, pri
 
 		switch assigning {
 		case types.AssigningSell:
-			quantity = decimal.New(quantity).Mul(price).Float()
+			quantity = quantity.Mul(price)
 		}
 
 		return quantity
@@ -14,12 +14,64 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func (a *Service) GetFutures(_ context.Context, req *pbfuture.GetRequestFutures) (*pbfuture.ResponseFutures, error) {
+func (a *Service) GetFutures(ctx context.Context, req *pbfuture.GetRequestFutures) (*pbfuture.ResponseFutures, error) {
+
 	var (
 		response pbfuture.ResponseFutures
-		// exist    bool
-		// success bool
+		maps     []string
+		params   []interface{}
 	)
+
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+	params = append(params, auth)
+
+	// The units of the pair are passed to the query as parameters, they are never written into the query itself.
+	if len(req.GetBaseUnit()) > 0 && len(req.GetQuoteUnit()) > 0 {
+		params = append(params, req.GetBaseUnit(), req.GetQuoteUnit())
+		maps = append(maps, fmt.Sprintf("and base_unit = $%d and quote_unit = $%d", len(params)-1, len(params)))
+	}
+
+	rows, err := a.Context.Db.Query(fmt.Sprintf("select id, user_id, base_unit, quote_unit, position, mode, leverage, quantity, price, margin, realized, status, create_at, update_at from positions where user_id = $1 and quantity > 0 %s order by id", strings.Join(maps, " ")), params...)
+	if err != nil {
+		return &response, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Holding
+		)
+
+		if err = rows.Scan(&item.Id, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Position, &item.Mode, &item.Leverage, &item.Quantity, &item.Price, &item.Margin, &item.Realized, &item.Status, &item.CreateAt, &item.UpdateAt); err != nil {
+			return &response, err
+		}
+
+		// The unrealized profit or loss is what closing the whole position at the mark price of the pair would realize.
+		if price, ok := a.queryMark(item.GetBaseUnit(), item.GetQuoteUnit()); ok {
+			unrealized, _ := settle(&item, decimal.Parse(item.GetQuantity()), price)
+			item.Mark, item.Unrealized = price.String(), unrealized.String()
+		}
+
+		// The indicator shows in which fifth of the auto-deleveraging ranking of its pair and side the position is.
+		ranked := a.queryDeleverage(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetPosition())
+		for i := range ranked {
+			if ranked[i].GetId() == item.GetId() {
+				item.Adl = indicator(i, len(ranked))
+				break
+			}
+		}
+
+		response.Fields = append(response.Fields, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return &response, err
+	}
+
 	return &response, nil
 }
 func (a *Service) GetOrders(ctx context.Context, req *pbfuture.GetRequestOrders) (*pbfuture.ResponseOrder, error) {
@@ -73,7 +125,7 @@ func (a *Service) GetOrders(ctx context.Context, req *pbfuture.GetRequestOrders)
 	if len(req.GetBaseUnit()) > 0 && len(req.GetQuoteUnit()) > 0 {
 		maps = append(maps, fmt.Sprintf("and base_unit = '%v' and quote_unit = '%v'", req.GetBaseUnit(), req.GetQuoteUnit()))
 	}
-	_ = a.Context.Db.QueryRow(fmt.Sprintf("select count(*) as count, sum(value) as volume from futures %s", strings.Join(maps, " "))).Scan(&response.Count, &response.Volume)
+	_ = a.Context.Db.QueryRow(fmt.Sprintf("select count(*) as count, coalesce(sum(value), 0) as volume from futures %s", strings.Join(maps, " "))).Scan(&response.Count, &response.Volume)
 
 	if response.GetCount() > 0 {
 
@@ -116,11 +168,10 @@ func (a *Service) SetOrder(ctx context.Context, req *pbfuture.SetRequestOrder) (
 		order    types.Future
 	)
 
-	// auth, err := a.Context.Auth(ctx)
-	// if err != nil {
-	// 	return &response, err
-	// }
-	var auth int64 = 6
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
 
 	if err := a.queryValidatePair(req.GetBaseUnit(), req.GetQuoteUnit(), "future"); err != nil {
 		return &response, err
@@ -138,7 +189,7 @@ func (a *Service) SetOrder(ctx context.Context, req *pbfuture.SetRequestOrder) (
 		return &response, status.Error(748990, "your account and assets have been blocked, please contact technical support for any questions")
 	}
 
-	order.Quantity = req.GetQuantity()
+	order.Quantity = decimal.Parse(req.GetQuantity()).String()
 	order.Position = req.GetPosition()
 	order.OrderType = req.GetOrderType()
 
@@ -150,11 +201,11 @@ func (a *Service) SetOrder(ctx context.Context, req *pbfuture.SetRequestOrder) (
 		// if req.GetAssigning() == types.AssigningBuy {
 		// 	order.Quantity, order.Value = decimal.New(req.GetQuantity()).Div(order.GetPrice()).Float(), decimal.New(req.GetQuantity()).Div(order.GetPrice()).Float()
 		// }
-		order.Price = req.GetPrice()
+		order.Price = decimal.Parse(req.GetPrice()).String()
 
 	case types.TradingLimit:
 
-		order.Price = req.GetPrice()
+		order.Price = decimal.Parse(req.GetPrice()).String()
 	default:
 		return &response, status.Error(82284, "invalid type trade position")
 	}
@@ -165,41 +216,55 @@ func (a *Service) SetOrder(ctx context.Context, req *pbfuture.SetRequestOrder) (
 	order.Assigning = req.GetAssigning()
 	order.OrderType = req.GetOrderType()
 	order.Leverage = req.GetLeverage()
+	order.Mode = req.GetMode()
 	order.Status = types.StatusPending
 	order.CreateAt = time.Now().UTC().Format(time.RFC3339)
 
-	margin, err := a.queryValidateOrder(&order)
+	// The order is validated, its margin is locked and it is stored in one transaction. The futures balance row of the user is
+	// locked first, so the orders of the same user are validated one after another and can never commit the same margin twice.
+	tx, err := a.Context.Db.Begin()
 	if err != nil {
 		return &response, err
 	}
-	order.Value = decimal.New(req.GetQuantity()).Mul(req.GetPrice()).Float()
+	defer tx.Rollback()
 
-	if order.Id, err = a.writeOrder(&order); err != nil {
+	_ = a.queryBalance(tx, order.GetQuoteUnit(), types.TypeFuture, order.GetUserId())
+
+	margin, err := a.queryValidateOrder(&order)
+	if err != nil {
 		return &response, err
 	}
-	fmt.Println("order saved id ", order.Id)
+
+	// The value of a futures order is the quantity of contracts that is still waiting to be filled.
+	order.Value = order.GetQuantity()
 
 	switch order.GetAssigning() {
 	case types.AssigningOpen:
 
-		if err := a.WriteBalance(order.GetQuoteUnit(), order.GetAssigning(), order.GetUserId(), margin, types.BalanceMinus); err != nil {
+		// The initial margin of the order is locked on placement and moves into the position as the order gets filled.
+		if err := a.writeBalance(tx, order.GetQuoteUnit(), types.TypeFuture, order.GetUserId(), margin, types.BalanceMinus); err != nil {
 			return &response, err
 		}
 
 		break
 	case types.AssigningClose:
 
-		if err := a.WriteBalance(order.GetBaseUnit(), order.GetAssigning(), order.GetUserId(), margin, types.BalancePlus); err != nil {
-			return &response, err
-		}
-
-		a.closePosition(&order)
-
+		// A close order locks nothing, it is backed by the open position it reduces.
 		break
 	default:
 		return &response, status.Error(11588, "invalid assigning trade position")
 	}
 
+	if order.Id, err = a.writeOrder(tx, &order); err != nil {
+		return &response, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &response, err
+	}
+
+	a.match(&order)
+
 	response.Fields = append(response.Fields, &order)
 	return &response, nil
 
@@ -214,7 +279,7 @@ func (a *Service) SetTicker(_ context.Context, req *pbfuture.SetRequestTicker) (
 		return &response, status.Error(654333, "the access key is incorrect")
 	}
 
-	if _, err := a.Context.Db.Exec(`insert into ohlcv (assigning, base_unit, quote_unit, price, quantity) values ($1, $2, $3, $4, $5)`, req.GetAssigning(), req.GetBaseUnit(), req.GetQuoteUnit(), req.GetPrice(), req.GetValue()); a.Context.Debug(err) {
+	if _, err := a.Context.Db.Exec(`insert into ohlcv (assigning, base_unit, quote_unit, price, quantity, type) values ($1, $2, $3, $4, $5, $6)`, req.GetAssigning(), req.GetBaseUnit(), req.GetQuoteUnit(), decimal.Parse(req.GetPrice()), decimal.Parse(req.GetValue()), req.GetType()); a.Context.Debug(err) {
 		return &response, err
 	}
 
@@ -287,3 +352,148 @@ func (a *Service) GetTicker(_ context.Context, req *pbfuture.GetRequestTicker) (
 
 	return &response, nil
 }
+
+func (a *Service) GetMark(_ context.Context, req *pbfuture.GetRequestMark) (*pbfuture.ResponseMark, error) {
+
+	var (
+		response pbfuture.ResponseMark
+	)
+
+	if err := a.queryValidatePair(req.GetBaseUnit(), req.GetQuoteUnit(), types.TypeFuture); err != nil {
+		return &response, err
+	}
+
+	if req.GetLimit() == 0 {
+		req.Limit = 1
+	}
+
+	rows, err := a.Context.Db.Query("select base_unit, quote_unit, price, index_price, basis, premium, sources, create_at from marks where base_unit = $1 and quote_unit = $2 order by id desc limit $3", req.GetBaseUnit(), req.GetQuoteUnit(), req.GetLimit())
+	if err != nil {
+		return &response, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Mark
+		)
+
+		if err = rows.Scan(&item.BaseUnit, &item.QuoteUnit, &item.Price, &item.IndexPrice, &item.Basis, &item.Premium, &item.Sources, &item.CreateAt); err != nil {
+			return &response, err
+		}
+
+		response.Fields = append(response.Fields, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return &response, err
+	}
+
+	return &response, nil
+}
+
+func (a *Service) GetFunding(_ context.Context, req *pbfuture.GetRequestFunding) (*pbfuture.ResponseFunding, error) {
+
+	var (
+		response pbfuture.ResponseFunding
+		err      error
+	)
+
+	if err := a.queryValidatePair(req.GetBaseUnit(), req.GetQuoteUnit(), types.TypeFuture); err != nil {
+		return &response, err
+	}
+
+	if req.GetLimit() == 0 {
+		req.Limit = 30
+	}
+
+	// The predicted rate of the running interval, it is settled at the end of the interval with the premium of the whole interval.
+	if response.Next, err = a.queryFunding(req.GetBaseUnit(), req.GetQuoteUnit()); err != nil {
+		return &response, err
+	}
+
+	rows, err := a.Context.Db.Query("select id, base_unit, quote_unit, rate, premium, mark, funding_at from fundings where base_unit = $1 and quote_unit = $2 order by funding_at desc limit $3", req.GetBaseUnit(), req.GetQuoteUnit(), req.GetLimit())
+	if err != nil {
+		return &response, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Funding
+		)
+
+		if err = rows.Scan(&item.Id, &item.BaseUnit, &item.QuoteUnit, &item.Rate, &item.Premium, &item.Mark, &item.FundingAt); err != nil {
+			return &response, err
+		}
+
+		response.Fields = append(response.Fields, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return &response, err
+	}
+
+	return &response, nil
+}
+
+func (a *Service) GetPayments(ctx context.Context, req *pbfuture.GetRequestPayments) (*pbfuture.ResponsePayments, error) {
+
+	var (
+		response pbfuture.ResponsePayments
+		maps     []string
+	)
+
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	if req.GetLimit() == 0 {
+		req.Limit = 30
+	}
+
+	maps = append(maps, fmt.Sprintf("where p.user_id = '%v'", auth))
+
+	if len(req.GetBaseUnit()) > 0 && len(req.GetQuoteUnit()) > 0 {
+		maps = append(maps, fmt.Sprintf("and p.base_unit = '%v' and p.quote_unit = '%v'", req.GetBaseUnit(), req.GetQuoteUnit()))
+	}
+
+	// The volume is the net result of the funding, what the user received minus what the user paid.
+	_ = a.Context.Db.QueryRow(fmt.Sprintf("select count(*) as count, coalesce(sum(p.value), 0) as volume from payments p %s", strings.Join(maps, " "))).Scan(&response.Count, &response.Volume)
+
+	if response.GetCount() > 0 {
+
+		offset := req.GetLimit() * req.GetPage()
+		if req.GetPage() > 0 {
+			offset = req.GetLimit() * (req.GetPage() - 1)
+		}
+
+		rows, err := a.Context.Db.Query(fmt.Sprintf("select p.id, p.funding_id, p.position_id, p.user_id, p.base_unit, p.quote_unit, p.position, p.quantity, p.mark, p.rate, p.value, f.funding_at from payments p inner join fundings f on f.id = p.funding_id %s order by p.id desc limit %d offset %d", strings.Join(maps, " "), req.GetLimit(), offset))
+		if err != nil {
+			return &response, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+
+			var (
+				item types.Payment
+			)
+
+			if err = rows.Scan(&item.Id, &item.FundingId, &item.PositionId, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Position, &item.Quantity, &item.Mark, &item.Rate, &item.Value, &item.FundingAt); err != nil {
+				return &response, err
+			}
+
+			response.Fields = append(response.Fields, &item)
+		}
+
+		if err = rows.Err(); err != nil {
+			return &response, err
+		}
+	}
+
+	return &response, nil
+}
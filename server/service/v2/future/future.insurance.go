@@ -0,0 +1,327 @@
+package future
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// writeFund - This function credits the value to the insurance fund of the quote unit of the order, a negative value debits
+// it, and records the change together with the new balance of the fund in its history.
+func (a *Service) writeFund(tx *sql.Tx, order *types.Future, value decimal.Amount) error {
+
+	var (
+		balance   decimal.Amount
+		assigning = types.BalancePlus
+	)
+
+	if value.IsZero() {
+		return nil
+	}
+
+	if value.IsNegative() {
+		assigning = types.BalanceMinus
+	}
+
+	if err := tx.QueryRow("update assets set insurance = insurance + $2 where symbol = $1 returning insurance", order.GetQuoteUnit(), value).Scan(&balance); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("insert into insurance (symbol, value, balance, assigning, order_id, user_id) values ($1, $2, $3, $4, $5, $6)", order.GetQuoteUnit(), value, balance, assigning, order.GetId(), order.GetUserId()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// queryFund - This function returns the balance of the insurance fund of the symbol.
+func (a *Service) queryFund(symbol string) (balance decimal.Amount) {
+	_ = a.Context.Db.QueryRow("select insurance from assets where symbol = $1", symbol).Scan(&balance)
+	return balance
+}
+
+// replayInsurance - This function revisits the liquidation orders that still rest in the book. The insurance fund or the
+// book may have changed since the order was placed, so the rest is handed over to the fund and to the deleveraging again
+// at the bankruptcy price that was recorded with the liquidation, until the position is closed.
+func (a *Service) replayInsurance() {
+
+	var (
+		orders []*types.Future
+		prices []decimal.Amount
+	)
+
+	rows, err := a.Context.Db.Query("select f.id, f.quantity, f.value, f.assigning, f.position, f.trading, f.leverage, f.mode, f.user_id, f.base_unit, f.quote_unit, f.status, f.liquidation, f.create_at, l.price from futures f inner join liquidations l on l.order_id = f.id where f.liquidation = true and f.status = $1 order by f.id", types.StatusPending)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	for rows.Next() {
+
+		var (
+			item  types.Future
+			price decimal.Amount
+		)
+
+		if err := rows.Scan(&item.Id, &item.Quantity, &item.Value, &item.Assigning, &item.Position, &item.OrderType, &item.Leverage, &item.Mode, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Status, &item.Liquidation, &item.CreateAt, &price); a.Context.Debug(err) {
+			continue
+		}
+		item.Price = price.String()
+
+		orders, prices = append(orders, &item), append(prices, price)
+	}
+	rows.Close()
+
+	for i, order := range orders {
+
+		// The order is matched at the bankruptcy price first, the book may have gained the depth it lacked before.
+		if _, err := a.Context.Db.Exec("update futures set price = $2 where id = $1 and status = $3", order.GetId(), prices[i], types.StatusPending); a.Context.Debug(err) {
+			continue
+		}
+		a.match(order)
+
+		a.writeInsurance(order, prices[i])
+		a.writeDeleverage(order, prices[i])
+	}
+}
+
+// writeInsurance - This function hands the rest of a liquidation order that could not be filled at the bankruptcy price over
+// to the insurance fund. The order is repriced to the worst price whose deficit the fund can still cover, and it is
+// matched again, so the book can take the position at a loss that is paid by the fund.
+func (a *Service) writeInsurance(order *types.Future, price decimal.Amount) {
+
+	fund, value := a.queryFund(order.GetQuoteUnit()), decimal.Parse(order.GetValue())
+	if !fund.IsPositive() || !value.IsPositive() {
+		return
+	}
+
+	// The fund covers the difference to the bankruptcy price for every contract that is left.
+	limit := fund.Div(value)
+
+	next := price.Sub(limit)
+	if direction(order) {
+		next = price.Add(limit)
+	}
+
+	if next.IsNegative() {
+		next = decimal.Zero
+	}
+	order.Price = next.String()
+
+	if _, err := a.Context.Db.Exec("update futures set price = $2 where id = $1 and status = $3", order.GetId(), next, types.StatusPending); a.Context.Debug(err) {
+		return
+	}
+
+	a.match(order)
+}
+
+// writeDeleverage - This function closes the rest of a liquidation order that neither the book nor the insurance fund could
+// take against the opposing positions of other users, the most profitable and highest leveraged first. The positions are
+// deleveraged only once the insurance fund of the quote unit is depleted, while the fund still has a balance the order
+// stays in the book at the price the fund can cover. Every deleveraged position is closed at the bankruptcy price of the
+// liquidated position, so no deficit is left. What can not be deleveraged stays in the book at the bankruptcy price.
+func (a *Service) writeDeleverage(order *types.Future, price decimal.Amount) {
+
+	if !decimal.Parse(order.GetValue()).IsPositive() {
+		return
+	}
+
+	if a.queryFund(order.GetQuoteUnit()).IsPositive() {
+		return
+	}
+
+	order.Price = price.String()
+	if _, err := a.Context.Db.Exec("update futures set price = $2 where id = $1 and status = $3", order.GetId(), price, types.StatusPending); a.Context.Debug(err) {
+		return
+	}
+
+	position := types.PositionLong
+	if order.GetPosition() == types.PositionLong {
+		position = types.PositionShort
+	}
+
+	lock := queryLock(order.GetBaseUnit(), order.GetQuoteUnit())
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, holding := range a.queryDeleverage(order.GetBaseUnit(), order.GetQuoteUnit(), position) {
+
+		if !decimal.Parse(order.GetValue()).IsPositive() {
+			break
+		}
+
+		if holding.GetUserId() == order.GetUserId() {
+			continue
+		}
+
+		var (
+			deleverage = types.Future{
+				Assigning:   types.AssigningClose,
+				Position:    holding.GetPosition(),
+				OrderType:   types.TradingLimit,
+				BaseUnit:    holding.GetBaseUnit(),
+				QuoteUnit:   holding.GetQuoteUnit(),
+				Price:       price.String(),
+				Quantity:    holding.GetQuantity(),
+				Value:       holding.GetQuantity(),
+				Leverage:    holding.GetLeverage(),
+				Mode:        holding.GetMode(),
+				UserId:      holding.GetUserId(),
+				Status:      types.StatusPending,
+				Liquidation: true,
+				CreateAt:    time.Now().UTC().Format(time.RFC3339),
+			}
+			err error
+		)
+
+		if decimal.Parse(order.GetValue()).LessThan(decimal.Parse(deleverage.GetQuantity())) {
+			deleverage.Quantity, deleverage.Value = order.GetValue(), order.GetValue()
+		}
+
+		// The pending close orders of the holder already claim part of the position, what the deleveraging takes beyond the
+		// unclaimed rest is released from them first, so the fill never closes more than the position still holds.
+		if excess := decimal.Parse(deleverage.GetQuantity()).Sub(decimal.Parse(holding.GetQuantity()).Sub(a.queryClosing(holding.GetUserId(), holding.GetBaseUnit(), holding.GetQuoteUnit(), holding.GetPosition()))); excess.IsPositive() {
+			if err := a.writeReduce(holding, excess); a.Context.Debug(err) {
+				continue
+			}
+		}
+
+		if deleverage.Id, err = a.writeOrder(a.Context.Db, &deleverage); a.Context.Debug(err) {
+			continue
+		}
+
+		// The liquidation order rests in the book, so the deleveraged position is filled at its bankruptcy price.
+		a.handleFutureTrade(&deleverage, order)
+
+		// This code is intended to publish the deleveraged order to an exchange with the routing key "future/deleverage".
+		if err := a.Context.Publish(a.queryOrder(deleverage.GetId()), "exchange", "future/deleverage"); a.Context.Debug(err) {
+			continue
+		}
+	}
+}
+
+// writeReduce - This function releases the quantity of the position from the pending close orders of its owner, the newest
+// first. A close order that has nothing left is canceled; close orders lock no margin, so nothing is returned to the balance.
+func (a *Service) writeReduce(holding *types.Holding, quantity decimal.Amount) error {
+
+	var (
+		orders []*types.Future
+	)
+
+	rows, err := a.Context.Db.Query("select id, value from futures where user_id = $1 and base_unit = $2 and quote_unit = $3 and position = $4 and assigning = $5 and status = $6 order by id desc", holding.GetUserId(), holding.GetBaseUnit(), holding.GetQuoteUnit(), holding.GetPosition(), types.AssigningClose, types.StatusPending)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+
+		var (
+			item types.Future
+		)
+
+		if err := rows.Scan(&item.Id, &item.Value); err != nil {
+			rows.Close()
+			return err
+		}
+
+		orders = append(orders, &item)
+	}
+	rows.Close()
+
+	for _, item := range orders {
+
+		if !quantity.IsPositive() {
+			break
+		}
+
+		reduce := decimal.Min(quantity, decimal.Parse(item.GetValue()))
+
+		if _, err := a.Context.Db.Exec("update futures set value = value - $2, status = case when value - $2 = 0 then $3 else status end where id = $1 and status = $4", item.GetId(), reduce, types.StatusCancel, types.StatusPending); err != nil {
+			return err
+		}
+		quantity = quantity.Sub(reduce)
+
+		if err := a.Context.Publish(a.queryOrder(item.GetId()), "exchange", "future/status"); a.Context.Debug(err) {
+			continue
+		}
+	}
+
+	return nil
+}
+
+// queryDeleverage - This function returns the profitable positions of the pair and side at the mark price, ordered by their
+// auto-deleveraging ranking from the first to be deleveraged. The positions being liquidated are left out.
+func (a *Service) queryDeleverage(base, quote, position string) []*types.Holding {
+
+	var (
+		positions []*types.Holding
+		scores    = make(map[int64]decimal.Amount)
+	)
+
+	price, ok := a.queryMark(base, quote)
+	if !ok {
+		return positions
+	}
+
+	rows, err := a.Context.Db.Query("select id, user_id, base_unit, quote_unit, position, mode, leverage, quantity, price, margin from positions where base_unit = $1 and quote_unit = $2 and position = $3 and quantity > 0 and status = $4", base, quote, position, types.MarginNormal)
+	if a.Context.Debug(err) {
+		return positions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Holding
+		)
+
+		if err := rows.Scan(&item.Id, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Position, &item.Mode, &item.Leverage, &item.Quantity, &item.Price, &item.Margin); a.Context.Debug(err) {
+			continue
+		}
+
+		if score := ranking(&item, price); score.IsPositive() {
+			item.Mark, scores[item.GetId()] = price.String(), score
+			positions = append(positions, &item)
+		}
+	}
+
+	sort.SliceStable(positions, func(i, j int) bool {
+		return scores[positions[i].GetId()].GreaterThan(scores[positions[j].GetId()])
+	})
+
+	return positions
+}
+
+// ranking - This function returns the auto-deleveraging score of the position at the mark price, its profit in relation
+// to its margin multiplied by its effective leverage, the notional value in relation to the margin with the profit. A
+// position without profit has no score and is never deleveraged.
+func ranking(holding *types.Holding, mark decimal.Amount) decimal.Amount {
+
+	var (
+		quantity = decimal.Parse(holding.GetQuantity())
+		margin   = decimal.Parse(holding.GetMargin())
+	)
+
+	pnl, _ := settle(holding, quantity, mark)
+	if !pnl.IsPositive() || !margin.IsPositive() {
+		return decimal.Zero
+	}
+
+	equity := margin.Add(pnl)
+	notional := quantity.Mul(mark)
+
+	return pnl.Div(margin).Mul(notional.Div(equity))
+}
+
+// indicator - This function returns the auto-deleveraging indicator of the position at the index of the ranking, from five
+// for the first fifth of the ranked positions, which are deleveraged first, down to one for the last fifth.
+func indicator(index, total int) int32 {
+
+	if index < 0 || index >= total {
+		return 0
+	}
+
+	return int32(5 - index*5/total)
+}
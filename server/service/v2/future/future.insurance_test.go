@@ -0,0 +1,46 @@
+package future
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestRanking(t *testing.T) {
+	tests := []struct {
+		name    string
+		holding *types.Holding
+		mark    string
+		want    string
+	}{
+		{name: "profitable long", holding: &types.Holding{Position: types.PositionLong, Quantity: "1", Price: "100", Margin: "10"}, mark: "110", want: "5.5"},
+		{name: "losing long", holding: &types.Holding{Position: types.PositionLong, Quantity: "1", Price: "100", Margin: "10"}, mark: "90", want: "0"},
+		{name: "profitable short", holding: &types.Holding{Position: types.PositionShort, Quantity: "1", Price: "100", Margin: "10"}, mark: "90", want: "4.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ranking(tt.holding, decimal.Parse(tt.mark)); !got.Equal(decimal.Parse(tt.want)) {
+				t.Errorf("ranking() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndicator(t *testing.T) {
+	tests := []struct {
+		index, total int
+		want         int32
+	}{
+		{index: 0, total: 10, want: 5},
+		{index: 2, total: 10, want: 4},
+		{index: 9, total: 10, want: 1},
+		{index: 0, total: 1, want: 5},
+		{index: -1, total: 10, want: 0},
+	}
+	for _, tt := range tests {
+		if got := indicator(tt.index, tt.total); got != tt.want {
+			t.Errorf("indicator(%v, %v) = %v, want %v", tt.index, tt.total, got, tt.want)
+		}
+	}
+}
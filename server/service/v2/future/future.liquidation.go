@@ -0,0 +1,351 @@
+package future
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+const (
+	// maintenanceRate - the maintenance margin rate in percent of a position that no tier of the maintenance schedule applies to.
+	maintenanceRate = 0.5
+
+	// maintenanceLeverage - the maximum leverage of a position that no tier of the maintenance schedule applies to.
+	maintenanceLeverage = 125
+)
+
+// maintenances - The maintenances variable keeps the maintenance schedule (maintenance) together with the time it was read. The
+// schedule is needed for every position on every check, and it rarely changes, so it is read again only once it is older
+// than a minute.
+var maintenances = struct {
+	sync.Mutex
+	tiers []tier
+	at    time.Time
+}{}
+
+// tier - The tier type is a tier of the maintenance schedule, it applies to the positions whose notional value at the mark
+// price has reached the notional of the tier.
+type tier struct {
+	notional, rate decimal.Amount
+	leverage       float64
+}
+
+// queryTiers - This function returns the maintenance schedule ordered by the notional of the tiers.
+func (a *Service) queryTiers() []tier {
+
+	maintenances.Lock()
+	defer maintenances.Unlock()
+
+	if maintenances.tiers != nil && time.Since(maintenances.at) < time.Minute {
+		return maintenances.tiers
+	}
+
+	rows, err := a.Context.Db.Query("select notional, rate, leverage from maintenance order by notional")
+	if a.Context.Debug(err) {
+		return maintenances.tiers
+	}
+	defer rows.Close()
+
+	var (
+		tiers = make([]tier, 0)
+	)
+
+	for rows.Next() {
+
+		var (
+			item tier
+		)
+
+		if err := rows.Scan(&item.notional, &item.rate, &item.leverage); a.Context.Debug(err) {
+			continue
+		}
+
+		tiers = append(tiers, item)
+	}
+
+	maintenances.tiers, maintenances.at = tiers, time.Now()
+
+	return tiers
+}
+
+// queryMaintenance - This function returns the tier of the schedule that applies to a position of the notional value, the
+// highest tier whose notional has been reached. Below the first tier the default rate and leverage apply.
+func queryMaintenance(tiers []tier, notional decimal.Amount) tier {
+
+	var (
+		result = tier{rate: decimal.New(maintenanceRate).Amount(), leverage: maintenanceLeverage}
+	)
+
+	for _, item := range tiers {
+		if item.notional.GreaterThan(notional) {
+			break
+		}
+		result = item
+	}
+
+	return result
+}
+
+// requirement - This function returns the maintenance margin of the position, its notional value at the mark price multiplied
+// by the maintenance rate of its tier.
+func requirement(tiers []tier, holding *types.Holding) decimal.Amount {
+	notional := decimal.Parse(holding.GetQuantity()).Mul(decimal.Parse(holding.GetMark()))
+	return notional.Mul(queryMaintenance(tiers, notional).rate).Div(decimal.New(100).Amount())
+}
+
+// bankruptcy - This function returns the bankruptcy price of the position, the price at which its loss equals its margin.
+// Zero is returned when that price is not positive, a long position with leverage one can never go bankrupt.
+func bankruptcy(holding *types.Holding) decimal.Amount {
+
+	quantity := decimal.Parse(holding.GetQuantity())
+	if !quantity.IsPositive() {
+		return decimal.Zero
+	}
+
+	// The margin spread over every contract of the position is how far the price can move against it.
+	move := decimal.Parse(holding.GetMargin()).Div(quantity)
+
+	price := decimal.Parse(holding.GetPrice()).Sub(move)
+	if holding.GetPosition() == types.PositionShort {
+		price = decimal.Parse(holding.GetPrice()).Add(move)
+	}
+
+	if !price.IsPositive() {
+		return decimal.Zero
+	}
+
+	return price
+}
+
+// liquidation - This function runs every five seconds and checks every open position against the mark price of its pair.
+func (a *Service) liquidation() {
+
+	// The code creates a ticker that triggers every five seconds and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Second * 5)
+	for range ticker.C {
+		a.replayLiquidation()
+		a.replayInsurance()
+	}
+}
+
+// replayLiquidation - This function checks the margin of every open position. An isolated position is liquidated when its
+// own margin together with its unrealized profit or loss at the mark price falls to its maintenance margin. The cross
+// positions of a user in the same quote unit share the futures balance, so they are checked together: when the balance
+// and the margins and the unrealized results of all of them fall to the sum of their maintenance margins, all of them
+// are liquidated.
+func (a *Service) replayLiquidation() {
+
+	var (
+		positions []*types.Holding
+		accounts  = make(map[string][]*types.Holding)
+	)
+
+	rows, err := a.Context.Db.Query("select id, user_id, base_unit, quote_unit, position, mode, leverage, quantity, price, margin from positions where quantity > 0 and status = $1 order by id", types.MarginNormal)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	for rows.Next() {
+
+		var (
+			item types.Holding
+		)
+
+		if err := rows.Scan(&item.Id, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Position, &item.Mode, &item.Leverage, &item.Quantity, &item.Price, &item.Margin); a.Context.Debug(err) {
+			continue
+		}
+
+		positions = append(positions, &item)
+	}
+	rows.Close()
+
+	tiers := a.queryTiers()
+
+	for _, item := range positions {
+
+		// A position is only checked against a recent mark price, the last trade price is never used for liquidation.
+		price, ok := a.queryMark(item.GetBaseUnit(), item.GetQuoteUnit())
+		if !ok {
+			continue
+		}
+		unrealized, _ := settle(item, decimal.Parse(item.GetQuantity()), price)
+		item.Mark, item.Unrealized = price.String(), unrealized.String()
+
+		switch item.GetMode() {
+		case types.ModeIsolated:
+
+			if maintenance := requirement(tiers, item); decimal.Parse(item.GetMargin()).Add(unrealized).LessThanOrEqual(maintenance) {
+				a.writeLiquidation(item, maintenance)
+			}
+
+		case types.ModeCross:
+
+			key := fmt.Sprintf("%v:%v", item.GetUserId(), item.GetQuoteUnit())
+			accounts[key] = append(accounts[key], item)
+		}
+	}
+
+	for _, items := range accounts {
+
+		var (
+			equity      = a.QueryBalance(items[0].GetQuoteUnit(), types.TypeFuture, items[0].GetUserId())
+			maintenance = decimal.Zero
+		)
+
+		for _, item := range items {
+			equity = equity.Add(decimal.Parse(item.GetMargin()).Add(decimal.Parse(item.GetUnrealized())))
+			maintenance = maintenance.Add(requirement(tiers, item))
+		}
+
+		if equity.GreaterThan(maintenance) {
+			continue
+		}
+
+		for _, item := range items {
+			a.writeLiquidation(item, requirement(tiers, item))
+		}
+	}
+}
+
+// writeLiquidation - This function takes over the position and closes it through the order book. The position is marked as
+// being liquidated, which can only succeed once, so a position is never taken over twice. The pending orders of the user
+// on the pair and side are canceled, and a close order for the whole position is placed at its bankruptcy price and
+// matched, then handed over to the insurance fund and finally to the auto-deleveraging. The liquidation is published to
+// the owner.
+func (a *Service) writeLiquidation(holding *types.Holding, maintenance decimal.Amount) {
+
+	result, err := a.Context.Db.Exec("update positions set status = $2 where id = $1 and status = $3", holding.GetId(), types.MarginLiquidation, types.MarginNormal)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	if affected, err := result.RowsAffected(); a.Context.Debug(err) || affected == 0 {
+		return
+	}
+
+	// The pending orders are canceled under the lock of the pair, so none of them is matched while it is being canceled.
+	lock := queryLock(holding.GetBaseUnit(), holding.GetQuoteUnit())
+	lock.Lock()
+	a.writeCancels(holding)
+	lock.Unlock()
+
+	var (
+		order = types.Future{
+			Assigning:   types.AssigningClose,
+			Position:    holding.GetPosition(),
+			OrderType:   types.TradingLimit,
+			BaseUnit:    holding.GetBaseUnit(),
+			QuoteUnit:   holding.GetQuoteUnit(),
+			Price:       bankruptcy(holding).String(),
+			Quantity:    holding.GetQuantity(),
+			Value:       holding.GetQuantity(),
+			Leverage:    holding.GetLeverage(),
+			Mode:        holding.GetMode(),
+			UserId:      holding.GetUserId(),
+			Status:      types.StatusPending,
+			Liquidation: true,
+			CreateAt:    time.Now().UTC().Format(time.RFC3339),
+		}
+	)
+
+	// A position that can not go bankrupt is closed at the mark price.
+	if !decimal.Parse(order.GetPrice()).IsPositive() {
+		order.Price = holding.GetMark()
+	}
+
+	if order.Id, err = a.writeOrder(a.Context.Db, &order); a.Context.Debug(err) {
+
+		// Without the close order nobody would close the position, so it is given back to be checked again.
+		if _, err := a.Context.Db.Exec("update positions set status = $2 where id = $1", holding.GetId(), types.MarginNormal); a.Context.Debug(err) {
+			return
+		}
+
+		return
+	}
+
+	var (
+		liquidation = types.Liquidation{
+			PositionId:  holding.GetId(),
+			OrderId:     order.GetId(),
+			UserId:      holding.GetUserId(),
+			BaseUnit:    holding.GetBaseUnit(),
+			QuoteUnit:   holding.GetQuoteUnit(),
+			Position:    holding.GetPosition(),
+			Mode:        holding.GetMode(),
+			Quantity:    holding.GetQuantity(),
+			Price:       order.GetPrice(),
+			Mark:        holding.GetMark(),
+			Margin:      holding.GetMargin(),
+			Maintenance: maintenance.String(),
+		}
+	)
+
+	if err := a.Context.Db.QueryRow("insert into liquidations (position_id, order_id, user_id, base_unit, quote_unit, position, mode, quantity, price, mark, margin, maintenance) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id, create_at", liquidation.GetPositionId(), liquidation.GetOrderId(), liquidation.GetUserId(), liquidation.GetBaseUnit(), liquidation.GetQuoteUnit(), liquidation.GetPosition(), liquidation.GetMode(), decimal.Parse(liquidation.GetQuantity()), decimal.Parse(liquidation.GetPrice()), decimal.Parse(liquidation.GetMark()), decimal.Parse(liquidation.GetMargin()), decimal.Parse(liquidation.GetMaintenance())).Scan(&liquidation.Id, &liquidation.CreateAt); a.Context.Debug(err) {
+		return
+	}
+
+	// This code is intended to publish the liquidation to an exchange with the routing key "future/liquidation".
+	if err := a.Context.Publish(&liquidation, "exchange", "future/liquidation"); a.Context.Debug(err) {
+		return
+	}
+
+	a.match(&order)
+
+	// What the book could not take at the bankruptcy price is handed over to the insurance fund, and once the fund is
+	// depleted the rest is deleveraged against the most profitable opposing positions.
+	a.writeInsurance(&order, decimal.Parse(liquidation.GetPrice()))
+	a.writeDeleverage(&order, decimal.Parse(liquidation.GetPrice()))
+}
+
+// writeCancels - This function cancels the pending orders of the user on the pair and side of the position. The margin that
+// was reserved by an open order is returned to the futures balance.
+func (a *Service) writeCancels(holding *types.Holding) {
+
+	var (
+		orders []*types.Future
+	)
+
+	rows, err := a.Context.Db.Query("select id, assigning, value, price, leverage, quote_unit, user_id from futures where user_id = $1 and base_unit = $2 and quote_unit = $3 and position = $4 and status = $5", holding.GetUserId(), holding.GetBaseUnit(), holding.GetQuoteUnit(), holding.GetPosition(), types.StatusPending)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	for rows.Next() {
+
+		var (
+			item types.Future
+		)
+
+		if err := rows.Scan(&item.Id, &item.Assigning, &item.Value, &item.Price, &item.Leverage, &item.QuoteUnit, &item.UserId); a.Context.Debug(err) {
+			continue
+		}
+
+		orders = append(orders, &item)
+	}
+	rows.Close()
+
+	for _, item := range orders {
+
+		result, err := a.Context.Db.Exec("update futures set status = $2 where id = $1 and status = $3", item.GetId(), types.StatusCancel, types.StatusPending)
+		if a.Context.Debug(err) {
+			continue
+		}
+
+		if affected, err := result.RowsAffected(); a.Context.Debug(err) || affected == 0 {
+			continue
+		}
+
+		if item.GetAssigning() == types.AssigningOpen {
+			if err := a.WriteBalance(item.GetQuoteUnit(), types.TypeFuture, item.GetUserId(), decimal.Parse(item.GetValue()).Mul(decimal.Parse(item.GetPrice())).Div(decimal.New(item.GetLeverage()).Amount()), types.BalancePlus); a.Context.Debug(err) {
+				continue
+			}
+		}
+
+		if err := a.Context.Publish(a.queryOrder(item.GetId()), "exchange", "future/status"); a.Context.Debug(err) {
+			continue
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package future
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestQueryMaintenance(t *testing.T) {
+	tiers := []tier{
+		{notional: decimal.Parse("0"), rate: decimal.Parse("0.4"), leverage: 125},
+		{notional: decimal.Parse("50000"), rate: decimal.Parse("0.5"), leverage: 100},
+		{notional: decimal.Parse("250000"), rate: decimal.Parse("1"), leverage: 50},
+	}
+	tests := []struct {
+		name     string
+		tiers    []tier
+		notional string
+		want     tier
+	}{
+		{name: "first", tiers: tiers, notional: "1000", want: tiers[0]},
+		{name: "boundary", tiers: tiers, notional: "50000", want: tiers[1]},
+		{name: "last", tiers: tiers, notional: "1000000", want: tiers[2]},
+		{name: "default", tiers: nil, notional: "1000", want: tier{notional: decimal.Zero, rate: decimal.New(maintenanceRate).Amount(), leverage: maintenanceLeverage}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryMaintenance(tt.tiers, decimal.Parse(tt.notional)); !got.notional.Equal(tt.want.notional) || !got.rate.Equal(tt.want.rate) || got.leverage != tt.want.leverage {
+				t.Errorf("queryMaintenance() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBankruptcy(t *testing.T) {
+	tests := []struct {
+		name    string
+		holding *types.Holding
+		want    string
+	}{
+		{name: "long", holding: &types.Holding{Position: types.PositionLong, Quantity: "2", Price: "100", Margin: "20"}, want: "90"},
+		{name: "short", holding: &types.Holding{Position: types.PositionShort, Quantity: "2", Price: "100", Margin: "20"}, want: "110"},
+		{name: "unleveraged long", holding: &types.Holding{Position: types.PositionLong, Quantity: "1", Price: "100", Margin: "100"}, want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bankruptcy(tt.holding); !got.Equal(decimal.Parse(tt.want)) {
+				t.Errorf("bankruptcy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package future
+
+import (
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/assets/common/marketplace"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+const (
+	// markWeight - the weight of our own spot last price in the index, every external exchange weighs one.
+	markWeight = 2
+
+	// markWindow - the period over which the premium of the futures last price over the index is averaged into the basis.
+	markWindow = "30 minutes"
+
+	// markStale - a mark price older than this is no longer used, the pair then has no mark until the next one is written.
+	markStale = "5 minutes"
+
+	// markHistory - the period for which the mark prices are kept.
+	markHistory = "24 hours"
+)
+
+// mark - This function runs every ten seconds and writes a new mark price for every enabled futures pair.
+func (a *Service) mark() {
+
+	// The code creates a ticker that triggers every ten seconds and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Second * 10)
+	for range ticker.C {
+		a.writeMarks()
+	}
+}
+
+// writeMarks - This function writes the mark price of every enabled futures pair and removes the mark prices that are older
+// than the kept history.
+func (a *Service) writeMarks() {
+
+	var (
+		pairs []*types.Pair
+	)
+
+	rows, err := a.Context.Db.Query(`select base_unit, quote_unit from pairs where type = $1 and status = $2 order by id`, types.TypeFuture, true)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	// The pairs are read before the marks are written, the marketplace requests are slow and should not hold the rows open.
+	for rows.Next() {
+
+		var (
+			pair types.Pair
+		)
+
+		if err := rows.Scan(&pair.BaseUnit, &pair.QuoteUnit); a.Context.Debug(err) {
+			continue
+		}
+
+		pairs = append(pairs, &pair)
+	}
+	rows.Close()
+
+	for _, pair := range pairs {
+
+		mark, err := a.writeMark(pair.GetBaseUnit(), pair.GetQuoteUnit())
+		if a.Context.Debug(err) || mark == nil {
+			continue
+		}
+
+		if err := a.Context.Publish(mark, "exchange", "future/mark"); a.Context.Debug(err) {
+			continue
+		}
+	}
+
+	if _, err := a.Context.Db.Exec("delete from marks where create_at < now() - $1::interval", markHistory); a.Context.Debug(err) {
+		return
+	}
+}
+
+// writeMark - This function computes and stores the mark price of the pair. The index price is the weighted median of the
+// last prices on the external exchanges and of our own spot last price, so no single venue can move it on its own. The
+// premium of our futures last price over the index is stored with every mark, and its average over the mark window is the
+// funding basis added to the index to get the mark price. If no index can be computed nil is returned.
+func (a *Service) writeMark(base, quote string) (*types.Mark, error) {
+
+	var (
+		mark = types.Mark{
+			BaseUnit:  base,
+			QuoteUnit: quote,
+		}
+		values  = marketplace.Price().Sources(base, quote)
+		weights []float64
+	)
+
+	for range values {
+		weights = append(weights, 1)
+	}
+	mark.Sources = int32(len(values))
+
+	if price, ok := a.querySpot(base, quote); ok {
+		values, weights = append(values, price.InexactFloat64()), append(weights, markWeight)
+		mark.Sources += 1
+	}
+
+	// The last prices of the external exchanges are only known as floating point numbers, the index is exact from here on.
+	index := decimal.New(marketplace.Median(values, weights)).Amount()
+	if !index.IsPositive() {
+		return nil, nil
+	}
+
+	// Without any futures trade there is no premium, the mark then follows the index.
+	premium := decimal.Zero
+	if price, ok := a.queryLast(base, quote); ok {
+		premium = price.Sub(index)
+	}
+
+	var (
+		id    int64
+		basis decimal.Amount
+	)
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("insert into marks (base_unit, quote_unit, index_price, premium, sources) values ($1, $2, $3, $4, $5) returning id, create_at", base, quote, index, premium, mark.GetSources()).Scan(&id, &mark.CreateAt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.QueryRow("select avg(premium) from marks where base_unit = $1 and quote_unit = $2 and create_at > now() - $3::interval", base, quote, markWindow).Scan(&basis); err != nil {
+		return nil, err
+	}
+
+	price := index.Add(basis)
+
+	if _, err := tx.Exec("update marks set price = $2, basis = $3 where id = $1", id, price, basis); err != nil {
+		return nil, err
+	}
+
+	mark.Price, mark.IndexPrice, mark.Basis, mark.Premium = price.String(), index.String(), basis.String(), premium.String()
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &mark, nil
+}
+
+// queryMark - This function returns the current mark price of the futures pair, the price used for the profit and loss,
+// the margin and the liquidation of positions. It reports false when the pair has no recent mark price.
+func (a *Service) queryMark(base, quote string) (price decimal.Amount, ok bool) {
+
+	if err := a.Context.Db.QueryRow("select price from marks where base_unit = $1 and quote_unit = $2 and create_at > now() - $3::interval order by id desc limit 1", base, quote, markStale).Scan(&price); err != nil || !price.IsPositive() {
+		return price, ok
+	}
+
+	return price, true
+}
+
+// querySpot - This function returns the last price of our own spot pair with the same units as the futures pair.
+func (a *Service) querySpot(base, quote string) (price decimal.Amount, ok bool) {
+
+	if err := a.Context.Db.QueryRow("select price from pairs where base_unit = $1 and quote_unit = $2 and type = $3 and status = $4", base, quote, types.TypeSpot, true).Scan(&price); err != nil || !price.IsPositive() {
+		return price, ok
+	}
+
+	return price, true
+}
+
+// queryLast - This function returns the price of the last futures trade of the pair, a trade older than the mark window is
+// not taken into account.
+func (a *Service) queryLast(base, quote string) (price decimal.Amount, ok bool) {
+
+	if err := a.Context.Db.QueryRow("select price from trades where base_unit = $1 and quote_unit = $2 and assigning in ($3, $4) and create_at > now() - $5::interval order by id desc limit 1", base, quote, types.AssigningOpen, types.AssigningClose, markWindow).Scan(&price); err != nil {
+		return price, ok
+	}
+
+	return price, true
+}
+
+// queryMargin - This function returns the balance the user can still commit as margin in the quote unit. The unrealized
+// losses of the cross positions of the user, valued at the mark price, are taken out of the futures balance because the
+// cross positions are backed by it; their unrealized profits are not counted until they are realized.
+func (a *Service) queryMargin(userId int64, quote string) decimal.Amount {
+
+	var (
+		balance = a.QueryBalance(quote, types.TypeFuture, userId)
+	)
+
+	rows, err := a.Context.Db.Query("select base_unit, quote_unit, position, quantity, price, margin from positions where user_id = $1 and quote_unit = $2 and mode = $3 and quantity > 0", userId, quote, types.ModeCross)
+	if a.Context.Debug(err) {
+		return balance
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Holding
+		)
+
+		if err := rows.Scan(&item.BaseUnit, &item.QuoteUnit, &item.Position, &item.Quantity, &item.Price, &item.Margin); a.Context.Debug(err) {
+			continue
+		}
+
+		price, ok := a.queryMark(item.GetBaseUnit(), item.GetQuoteUnit())
+		if !ok {
+			continue
+		}
+
+		// The margin of the position itself absorbs its loss first, only the rest of it is taken from the balance.
+		if pnl, _ := settle(&item, decimal.Parse(item.GetQuantity()), price); decimal.Parse(item.GetMargin()).Add(pnl).IsNegative() {
+			balance = balance.Add(decimal.Parse(item.GetMargin()).Add(pnl))
+		}
+	}
+
+	return balance
+}
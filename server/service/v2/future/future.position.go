@@ -0,0 +1,142 @@
+package future
+
+import (
+	"database/sql"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// queryPosition - returns the aggregated position of the user on the pair and side, every user holds at most one long and
+// one short position per pair. If the user has never traded that side an empty position is returned.
+func (a *Service) queryPosition(userId int64, base, quote, position string) *types.Holding {
+
+	var (
+		holding = types.Holding{
+			UserId:    userId,
+			BaseUnit:  base,
+			QuoteUnit: quote,
+			Position:  position,
+		}
+	)
+
+	_ = a.Context.Db.QueryRow("select id, mode, leverage, quantity, price, margin, realized, status, create_at, update_at from positions where user_id = $1 and base_unit = $2 and quote_unit = $3 and position = $4", userId, base, quote, position).Scan(&holding.Id, &holding.Mode, &holding.Leverage, &holding.Quantity, &holding.Price, &holding.Margin, &holding.Realized, &holding.Status, &holding.CreateAt, &holding.UpdateAt)
+
+	return &holding
+}
+
+// queryClosing - returns the quantity of the position that is still claimed by pending close orders of the user.
+func (a *Service) queryClosing(userId int64, base, quote, position string) (value decimal.Amount) {
+	_ = a.Context.Db.QueryRow("select coalesce(sum(value), 0) from futures where user_id = $1 and base_unit = $2 and quote_unit = $3 and position = $4 and assigning = $5 and status = $6", userId, base, quote, position, types.AssigningClose, types.StatusPending).Scan(&value)
+	return value
+}
+
+// writePosition - applies a fill of the order to the position of its owner. An open fill grows the position, moving the
+// entry price to the weighted average and adding the margin that was reserved for that quantity when the order was placed.
+// A close fill shrinks the position, realizes the profit or loss against the entry price and returns the released margin
+// together with that result to the futures balance of the user. Everything is written in the given transaction, which
+// settles the whole fill.
+func (a *Service) writePosition(tx *sql.Tx, order *types.Future, quantity, price decimal.Amount) error {
+
+	switch order.GetAssigning() {
+	case types.AssigningOpen:
+
+		margin := quantity.Mul(decimal.Parse(order.GetPrice())).Div(decimal.New(order.GetLeverage()).Amount())
+
+		if _, err := tx.Exec(`insert into positions (user_id, base_unit, quote_unit, position, mode, leverage, quantity, price, margin) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			on conflict (user_id, base_unit, quote_unit, position) do update set
+				price = (positions.price * positions.quantity + excluded.price * excluded.quantity) / (positions.quantity + excluded.quantity),
+				quantity = positions.quantity + excluded.quantity,
+				margin = positions.margin + excluded.margin,
+				mode = excluded.mode,
+				leverage = excluded.leverage,
+				update_at = now()`, order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPosition(), order.GetMode(), order.GetLeverage(), quantity, price, margin); err != nil {
+			return err
+		}
+
+	case types.AssigningClose:
+
+		var (
+			holding = types.Holding{
+				Position: order.GetPosition(),
+			}
+		)
+
+		if err := tx.QueryRow("select id, mode, quantity, price, margin, status from positions where user_id = $1 and base_unit = $2 and quote_unit = $3 and position = $4 for update", order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPosition()).Scan(&holding.Id, &holding.Mode, &holding.Quantity, &holding.Price, &holding.Margin, &holding.Status); err != nil {
+			return err
+		}
+
+		// The close orders are validated against the position when they are placed, so the fill can only exceed it after
+		// the position has been reduced elsewhere, in which case only what is left of it is closed.
+		quantity = decimal.Min(quantity, decimal.Parse(holding.GetQuantity()))
+
+		pnl, margin := settle(&holding, quantity, price)
+
+		// A position taken over by the liquidation engine is given back to the user once it is fully closed.
+		if _, err := tx.Exec("update positions set quantity = quantity - $2, margin = margin - $3, realized = realized + $4, status = case when quantity - $2 = 0 then $5 else status end, update_at = now() where id = $1", holding.GetId(), quantity, margin, pnl, types.MarginNormal); err != nil {
+			return err
+		}
+
+		credit := margin.Add(pnl)
+
+		// The margin of a liquidated position is lost to the user. What is left of it after the fill is a surplus that is
+		// credited to the insurance fund of the quote unit, and a loss beyond it is a deficit that is covered by the fund.
+		if holding.GetStatus() == types.MarginLiquidation {
+
+			return a.writeFund(tx, order, credit)
+		}
+
+		if !credit.IsNegative() {
+			return a.writeBalance(tx, order.GetQuoteUnit(), types.TypeFuture, order.GetUserId(), credit, types.BalancePlus)
+		}
+
+		// An isolated position can never lose more than its own margin, and a cross position settles the rest of the loss
+		// against the whole futures balance of the user, which can never go below zero. The counterparty has been credited
+		// the whole profit, so the loss that the user can not pay is a deficit that is covered by the insurance fund.
+		if holding.GetMode() == types.ModeIsolated {
+			return a.writeFund(tx, order, credit)
+		}
+
+		var (
+			balance decimal.Amount
+		)
+
+		if err := tx.QueryRow("select value from balances where symbol = $1 and user_id = $2 and type = $3 for update", order.GetQuoteUnit(), order.GetUserId(), types.TypeFuture).Scan(&balance); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if deficit := credit.Add(balance); deficit.IsNegative() {
+			if err := a.writeFund(tx, order, deficit); err != nil {
+				return err
+			}
+			credit = balance.Neg()
+		}
+
+		return a.writeBalance(tx, order.GetQuoteUnit(), types.TypeFuture, order.GetUserId(), credit.Neg(), types.BalanceMinus)
+	}
+
+	return nil
+}
+
+// settle - returns the profit or loss of closing the quantity of the position at the price, and the share of the position
+// margin that is released by it. A long position earns when the price rises above the entry, a short one when it falls.
+func settle(holding *types.Holding, quantity, price decimal.Amount) (pnl, margin decimal.Amount) {
+
+	pnl = price.Sub(decimal.Parse(holding.GetPrice())).Mul(quantity)
+	if holding.GetPosition() == types.PositionShort {
+		pnl = decimal.Parse(holding.GetPrice()).Sub(price).Mul(quantity)
+	}
+
+	margin = decimal.Parse(holding.GetMargin())
+	if quantity.LessThan(decimal.Parse(holding.GetQuantity())) {
+		margin = margin.Mul(quantity).Div(decimal.Parse(holding.GetQuantity()))
+	}
+
+	return pnl, margin
+}
+
+// direction - reports whether the order buys the contract: opening a long and closing a short both buy it, while opening
+// a short and closing a long both sell it.
+func direction(order *types.Future) bool {
+	return (order.GetAssigning() == types.AssigningOpen) == (order.GetPosition() == types.PositionLong)
+}
@@ -0,0 +1,70 @@
+package future
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name     string
+		holding  *types.Holding
+		quantity string
+		price    string
+		pnl      string
+		margin   string
+	}{
+		{
+			name:     "long profit partial",
+			holding:  &types.Holding{Position: types.PositionLong, Quantity: "2", Price: "100", Margin: "20"},
+			quantity: "1",
+			price:    "110",
+			pnl:      "10",
+			margin:   "10",
+		},
+		{
+			name:     "long loss full",
+			holding:  &types.Holding{Position: types.PositionLong, Quantity: "2", Price: "100", Margin: "20"},
+			quantity: "2",
+			price:    "95",
+			pnl:      "-10",
+			margin:   "20",
+		},
+		{
+			name:     "short profit",
+			holding:  &types.Holding{Position: types.PositionShort, Quantity: "4", Price: "100", Margin: "40"},
+			quantity: "1",
+			price:    "90",
+			pnl:      "10",
+			margin:   "10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pnl, margin := settle(tt.holding, decimal.Parse(tt.quantity), decimal.Parse(tt.price))
+			if !pnl.Equal(decimal.Parse(tt.pnl)) || !margin.Equal(decimal.Parse(tt.margin)) {
+				t.Errorf("settle() = %v, %v, want %v, %v", pnl, margin, tt.pnl, tt.margin)
+			}
+		})
+	}
+}
+
+func TestDirection(t *testing.T) {
+	tests := []struct {
+		assigning string
+		position  string
+		buy       bool
+	}{
+		{types.AssigningOpen, types.PositionLong, true},
+		{types.AssigningClose, types.PositionShort, true},
+		{types.AssigningOpen, types.PositionShort, false},
+		{types.AssigningClose, types.PositionLong, false},
+	}
+	for _, tt := range tests {
+		if got := direction(&types.Future{Assigning: tt.assigning, Position: tt.position}); got != tt.buy {
+			t.Errorf("direction(%v %v) = %v, want %v", tt.assigning, tt.position, got, tt.buy)
+		}
+	}
+}
@@ -3,170 +3,152 @@ package future
 import (
 	"context"
 	"fmt"
+	"sync"
 
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"github.com/cryptogateway/backend-envoys/assets/common/query"
 	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbfuture"
 	"github.com/cryptogateway/backend-envoys/server/types"
-	"google.golang.org/grpc/status"
 )
 
-func (a *Service) closePosition(order *types.Future) {
-	// publish exchange
-	fmt.Println("PUBLISH EXCHANGE")
+// markets - The markets variable holds a lock for every futures pair. The orders of a pair are matched by the requests of the
+// users and by the liquidation engine at the same time, so the matching of a pair is serialized with its lock.
+var markets = struct {
+	sync.Mutex
+	pairs map[string]*sync.Mutex
+}{
+	pairs: make(map[string]*sync.Mutex),
+}
+
+// queryLock - This function returns the lock of the futures pair, the lock is created the first time the pair is matched.
+func queryLock(base, quote string) *sync.Mutex {
+
+	markets.Lock()
+	defer markets.Unlock()
+
+	key := fmt.Sprintf("%v:%v", base, quote)
+	if _, ok := markets.pairs[key]; !ok {
+		markets.pairs[key] = new(sync.Mutex)
+	}
+
+	return markets.pairs[key]
+}
+
+// match - publishes the new order and matches it against the pending orders of other users that trade the contract in the
+// opposite direction, best price first and then by time. Open and close orders of both sides share the same book, so an
+// opening long can be filled by another user closing their long as well as by another user opening a short.
+func (a *Service) match(order *types.Future) {
+
 	if err := a.Context.Publish(order, "exchange", "future/create"); a.Context.Debug(err) {
 		return
 	}
 
-	var position string
+	lock := queryLock(order.GetBaseUnit(), order.GetQuoteUnit())
+	lock.Lock()
+	defer lock.Unlock()
 
-	if order.Position == types.PositionLong {
-		position = types.PositionShort
-	} else {
-		position = types.PositionLong
-	}
+	var (
+		compare, sort = "<=", "price asc, id"
+		opening       = types.PositionShort
+		closing       = types.PositionLong
+	)
 
-	// get future orders by position
-	rows, err := a.Context.Db.Query(`select id, assigning, position, base_unit, quote_unit, quantity, price, user_id, status from futures where assigning = $1 and base_unit = $2 and quote_unit = $3 and user_id != $4 and status = $5 and position = $6 order by id`, "close", order.GetBaseUnit(), order.GetQuoteUnit(), order.GetUserId(), types.StatusPending, position)
+	if !direction(order) {
+		compare, sort = ">=", "price desc, id"
+		opening, closing = types.PositionLong, types.PositionShort
+	}
 
+	rows, err := a.Context.Db.Query(fmt.Sprintf(`select id, assigning, position, base_unit, quote_unit, quantity, value, price, leverage, mode, user_id, status, liquidation from futures where ((assigning = $1 and position = $2) or (assigning = $3 and position = $4)) and base_unit = $5 and quote_unit = $6 and user_id != $7 and status = $8 and price %s $9 order by %s`, compare, sort), types.AssigningOpen, opening, types.AssigningClose, closing, order.GetBaseUnit(), order.GetQuoteUnit(), order.GetUserId(), types.StatusPending, decimal.Parse(order.GetPrice()))
 	if a.Context.Debug(err) {
 		return
 	}
-
 	defer rows.Close()
 
 	for rows.Next() {
+
 		var (
 			item types.Future
 		)
 
-		if err = rows.Scan(&item.Id, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.Quantity, &item.Price, &item.UserId, &item.Status); a.Context.Debug(err) {
-			return
+		if !decimal.Parse(order.GetValue()).IsPositive() {
+			break
 		}
 
-		// check order status and update value
+		if err = rows.Scan(&item.Id, &item.Assigning, &item.Position, &item.BaseUnit, &item.QuoteUnit, &item.Quantity, &item.Value, &item.Price, &item.Leverage, &item.Mode, &item.UserId, &item.Status, &item.Liquidation); a.Context.Debug(err) {
+			return
+		}
 
-		// swtich position
-		switch position {
-		//case long
-		case types.PositionLong:
-			if order.GetPrice() <= item.GetPrice() {
-				a.Context.Logger.Infof("[BID]: (item [%v]) >= (order [%v]), order ID: %v", order.GetPrice(), item.GetPrice(), item.GetId())
+		a.Context.Logger.Infof("[%v/%v]: (item [%v]) %s (order [%v]), order ID: %v", order.GetAssigning(), order.GetPosition(), item.GetPrice(), compare, order.GetPrice(), item.GetId())
 
-				//process trade
-				a.handleFutureTrade(position, order, &item)
-			} else {
-				a.Context.Logger.Infof("[BID]: no matches found: (item [%v]) >= (order [%v])", order.GetPrice(), item.GetPrice())
-			}
-			break
-			//case short
-		case types.PositionShort:
-			if order.GetPrice() >= item.GetPrice() {
-				a.Context.Logger.Infof("[ASK]: (order [%v]) <= (item [%v]), order ID: %v", order.GetPrice(), item.GetPrice(), item.GetId())
-				//process trade
-
-				a.handleFutureTrade(position, order, &item)
-			} else {
-				a.Context.Logger.Infof("[ASK]: no matches found: (order [%v]) <= (item [%v])", order.GetPrice(), item.GetPrice())
-			}
-			break
-		default:
-			if err := a.Context.Debug(status.Error(11589, "invalid assigning trade position")); err {
-				return
-			}
-		}
+		a.handleFutureTrade(order, &item)
 	}
 }
 
-func (a *Service) handleFutureTrade(position string, params ...*types.Future) {
+// handleFutureTrade - fills the incoming order params[0] against the resting order params[1] at the price of the resting
+// order, for the quantity both of them still have open. Each side of the fill updates the position of its owner and is
+// recorded as a trade, the resting order being the maker. Both sides are settled in one transaction, so a fill is either
+// applied to both orders and both positions or not at all, and only after the commit the in-memory values of the orders
+// are updated, the mails are sent and the new statuses are published.
+func (a *Service) handleFutureTrade(params ...*types.Future) {
 
 	var (
-		price    float64
-		instance int
+		price    = decimal.Parse(params[1].GetPrice())
+		quantity = decimal.Min(decimal.Parse(params[0].GetValue()), decimal.Parse(params[1].GetValue()))
+		values   [2]decimal.Amount
 		migrate  = query.Migrate{
 			Context: a.Context,
 		}
 	)
 
-	if params[0].GetValue() >= params[1].GetValue() {
-		instance = 1
+	if !quantity.IsPositive() {
+		return
 	}
 
-	switch position {
-	case types.PositionLong:
-		price = params[1].GetPrice()
-	case types.PositionShort:
-		price = params[0].GetPrice()
+	tx, err := a.Context.Db.Begin()
+	if a.Context.Debug(err) {
+		return
 	}
+	defer tx.Rollback()
 
-	if params[instance].GetValue() > 0 {
-
-		for i := 0; i < 2; i++ {
-
-			var (
-				value float64
-			)
-
-			if err := a.Context.Db.QueryRow("update futures set value = value - $2 where id = $1 and status = $3 returning value;", params[i].GetId(), params[instance].GetValue(), types.StatusPending).Scan(&value); a.Context.Debug(err) {
-				return
-			}
-
-			if value == 0 {
-
-				if _, err := a.Context.Db.Exec("update futures set status = $2 where id = $1", params[i].GetId(), types.StatusFilled); a.Context.Debug(err) {
-					return
-				}
+	for i := 0; i < 2; i++ {
 
-				go migrate.SendMail(params[i].GetUserId(), "order_filled", params[i].GetId(), a.queryQuantity(params[i].GetAssigning(), params[i].GetPosition(), params[i].GetQuantity(), price, false), params[i].GetBaseUnit(), params[i].GetQuoteUnit(), params[i].GetAssigning())
-			}
+		if err := tx.QueryRow("update futures set value = value - $2 where id = $1 and status = $3 returning value;", params[i].GetId(), quantity, types.StatusPending).Scan(&values[i]); a.Context.Debug(err) {
+			return
 		}
 
-		switch params[1].GetPosition() {
-		case types.PositionLong:
-
-			quantity, err := a.writeTrade(params[0].GetId(), params[0].GetQuoteUnit(), params[instance].GetValue(), price, true)
-			if a.Context.Debug(err) {
-				return
-			}
-
-			if err := a.WriteBalance(params[0].GetQuoteUnit(), "future", params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
-				return
-			}
-
-			quantity, err = a.writeTrade(params[1].GetId(), params[0].GetBaseUnit(), params[instance].GetValue(), price, false)
-			if a.Context.Debug(err) {
-				return
-			}
-
-			if err := a.WriteBalance(params[0].GetBaseUnit(), "future", params[1].GetUserId(), quantity, types.BalancePlus); err != nil {
+		if values[i].IsZero() {
+			if _, err := tx.Exec("update futures set status = $2 where id = $1", params[i].GetId(), types.StatusFilled); a.Context.Debug(err) {
 				return
 			}
+		}
 
-			break
-		case types.PositionShort:
+		if err := a.writePosition(tx, params[i], quantity, price); a.Context.Debug(err) {
+			return
+		}
 
-			quantity, err := a.writeTrade(params[0].GetId(), params[0].GetBaseUnit(), params[instance].GetValue(), price, false)
-			if a.Context.Debug(err) {
-				return
-			}
+		if _, err := a.writeTrade(tx, params[i], quantity, price, i == 1); a.Context.Debug(err) {
+			return
+		}
+	}
 
-			if err := a.WriteBalance(params[0].GetBaseUnit(), "future", params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
-				return
-			}
+	if err := tx.Commit(); a.Context.Debug(err) {
+		return
+	}
 
-			quantity, err = a.writeTrade(params[1].GetId(), params[0].GetQuoteUnit(), params[instance].GetValue(), price, true)
-			if a.Context.Debug(err) {
-				return
-			}
+	for i := 0; i < 2; i++ {
 
-			if err := a.WriteBalance(params[0].GetQuoteUnit(), "future", params[1].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
-				return
-			}
+		params[i].Value = values[i].String()
+		if values[i].IsZero() {
+			params[i].Status = types.StatusFilled
+			go migrate.SendMail(params[i].GetUserId(), "order_filled", params[i].GetId(), a.queryQuantity(params[i].GetAssigning(), params[i].GetPosition(), decimal.Parse(params[i].GetQuantity()), price, false), params[i].GetBaseUnit(), params[i].GetQuoteUnit(), params[i].GetAssigning())
+		}
 
-			break
+		if err := a.Context.Publish(a.queryOrder(params[i].GetId()), "exchange", "future/status"); a.Context.Debug(err) {
+			return
 		}
 	}
 
-	if _, err := a.SetTicker(context.Background(), &pbfuture.SetRequestTicker{Key: a.Context.Secrets[2], Price: params[0].GetPrice(), Value: params[0].GetValue(), BaseUnit: params[0].GetBaseUnit(), QuoteUnit: params[0].GetQuoteUnit(), Assigning: params[0].GetAssigning()}); a.Context.Debug(err) {
+	if _, err := a.SetTicker(context.Background(), &pbfuture.SetRequestTicker{Key: a.Context.Secrets[2], Price: price.String(), Value: quantity.String(), BaseUnit: params[0].GetBaseUnit(), QuoteUnit: params[0].GetQuoteUnit(), Assigning: params[0].GetAssigning(), Type: types.TypeFuture}); a.Context.Debug(err) {
 		return
 	}
 }
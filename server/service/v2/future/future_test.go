@@ -32,11 +32,11 @@ func TestApi_FutureSetOrder(t *testing.T) {
 				OrderType:  "limit",
 				BaseUnit:   "eth",
 				QuoteUnit:  "usd",
-				Price:      28000.0,
-				Quantity:   0.1,
+				Price:      "28000.0",
+				Quantity:   "0.1",
 				Leverage:   10,
-				TakeProfit: 0.0,
-				StopLoss:   0.0,
+				TakeProfit: "0.0",
+				StopLoss:   "0.0",
 				Mode:       "cross",
 			},
 			want: 0,
@@ -2,6 +2,7 @@ package index
 
 import (
 	"github.com/cryptogateway/backend-envoys/assets"
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 )
 
 // Service - The Service struct is used to create a structure that holds a pointer to an assets.Context. This allows the Service
@@ -11,14 +12,14 @@ type Service struct {
 }
 
 // queryPrice - This function is used to calculate the price ratio between two different units of a currency. It takes the base and
-// quote units as arguments and returns the ratio as a float64 and an error (if any). It uses the database to query the
+// quote units as arguments and returns the ratio as an exact amount and an error (if any). It uses the database to query the
 // price of the two units, then calculates the ratio based on the prices.
-func (i *Service) queryPrice(base, quote string) (ratio float64, err error) {
+func (i *Service) queryPrice(base, quote string) (ratio decimal.Amount, err error) {
 
-	// The purpose of this code is to create a variable called "scales" that is an empty slice of type float64. This
-	// variable can then be used to store floats in a list.
+	// The purpose of this code is to create a variable called "scales" that is an empty slice of amounts. This
+	// variable can then be used to store the prices in a list.
 	var (
-		scales []float64
+		scales []decimal.Amount
 	)
 
 	// This code is querying a database for two values: the price from trades for two provided units, and ordering the
@@ -34,10 +35,10 @@ func (i *Service) queryPrice(base, quote string) (ratio float64, err error) {
 	// the next row from the result set. This allows the program to loop through all the returned rows in order to process them.
 	for rows.Next() {
 
-		// The purpose of the following is to declare a variable named current of type float64. This variable will be used to
-		// store a number with decimal places.
+		// The purpose of the following is to declare a variable named current of type decimal.Amount. This variable will be used to
+		// store the exact price.
 		var (
-			current float64
+			current decimal.Amount
 		)
 
 		// This statement is used to check for errors while scanning the rows of data. If an error is found, it will return the
@@ -53,8 +54,8 @@ func (i *Service) queryPrice(base, quote string) (ratio float64, err error) {
 
 	// This code is used to calculate the ratio between two scales. The ratio is calculated by subtracting the two scales
 	// and then dividing by the second scale, and then multiplying by 100.
-	if len(scales) == 2 {
-		ratio = ((scales[0] - scales[1]) / scales[1]) * 100
+	if len(scales) == 2 && !scales[1].IsZero() {
+		ratio = scales[0].Sub(scales[1]).DivRound(scales[1], 18).Mul(decimal.New(100).Amount())
 	}
 
 	return ratio, nil
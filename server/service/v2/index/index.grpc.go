@@ -190,22 +190,25 @@ func (i *Service) GetMarkets(ctx context.Context, req *pbindex.GetRequestMarkets
 			// The above code declares a variable 'pair' of type pbindex.Market. This variable is used to store a pair of values
 			// which is commonly used in programming. It can be used to store two related values such as a key-value pair.
 			var (
-				item pbindex.Market
+				item  pbindex.Market
+				price decimal.Amount
 			)
 
 			// This code is used to scan the rows of a database query result and assigns the values to the variables in the order
 			// they are specified. If any errors occur during the scanning, it returns an error.
-			if err := rows.Scan(&item.Id, &item.BaseUnit, &item.QuoteUnit, &item.Price, &item.Status); err != nil {
+			if err := rows.Scan(&item.Id, &item.BaseUnit, &item.QuoteUnit, &price, &item.Status); err != nil {
 				return &response, err
 			}
+			item.Price = price.String()
 
 			// This code is attempting to get the current price of a currency pair (pair) and set the pair.Ratio value to that
 			// price. If there is an error encountered while getting the price (i.queryPrice(pair.GetBaseUnit(),
 			// pair.GetQuoteUnit())), the function will return an error.
-			item.Ratio, err = i.queryPrice(item.GetBaseUnit(), item.GetQuoteUnit())
+			ratio, err := i.queryPrice(item.GetBaseUnit(), item.GetQuoteUnit())
 			if err != nil {
 				return &response, err
 			}
+			item.Ratio = ratio.String()
 
 			// This code is retrieving the latest 50 candles for a specific trading pair. The request is sent to the spot exchange
 			// and if the request is successful, the candles are returned. If there is an error, it is returned with the err variable.
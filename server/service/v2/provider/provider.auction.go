@@ -0,0 +1,341 @@
+package provider
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
+	"github.com/cryptogateway/backend-envoys/server/types"
+	"google.golang.org/grpc/status"
+)
+
+// auctions - The auctions variable is the registry of the pairs in the opening call auction, the key is the base unit, the quote
+// unit and the type of the pair and the value is the uncross time of the auction. While a pair is in the auction, its orders
+// are collected in the book without being matched. The auctions are kept in the pairs table as well, the registry is
+// the copy the matching engine reads, so it is a package level registry shared by all services, the same as the books.
+var auctions = struct {
+	sync.Mutex
+	pairs map[string]time.Time
+}{
+	pairs: make(map[string]time.Time),
+}
+
+// queryClearing - This function returns the clearing price of the call auction and the volume executed at it. The clearing price
+// is the price of the resting orders that maximizes the executed volume, which is the smaller of the demand (the bids at
+// or above the price) and the supply (the asks at or below the price). If several prices execute the same volume, the
+// one with the smallest imbalance between the demand and the supply is taken, and then the one closest to the reference
+// price. If no orders cross, the volume is zero.
+func queryClearing(bids, asks []*types.Order, reference decimal.Amount) (price, volume decimal.Amount) {
+
+	var (
+		prices    []decimal.Amount
+		imbalance decimal.Amount
+	)
+
+	for _, item := range append(append([]*types.Order{}, bids...), asks...) {
+		prices = append(prices, decimal.Parse(item.GetPrice()))
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].LessThan(prices[j]) })
+
+	for _, level := range prices {
+
+		var (
+			demand, supply decimal.Amount
+		)
+
+		for _, item := range bids {
+			if decimal.Parse(item.GetPrice()).GreaterThanOrEqual(level) {
+				demand = demand.Add(decimal.Parse(item.GetValue()))
+			}
+		}
+
+		for _, item := range asks {
+			if decimal.Parse(item.GetPrice()).LessThanOrEqual(level) {
+				supply = supply.Add(decimal.Parse(item.GetValue()))
+			}
+		}
+
+		executed, rest := decimal.Min(demand, supply), demand.Sub(supply).Abs()
+		if !executed.IsPositive() {
+			continue
+		}
+
+		switch {
+		case executed.GreaterThan(volume):
+		case executed.Equal(volume) && rest.LessThan(imbalance):
+		case executed.Equal(volume) && rest.Equal(imbalance) && level.Sub(reference).Abs().LessThan(price.Sub(reference).Abs()):
+		default:
+			continue
+		}
+
+		price, volume, imbalance = level, executed, rest
+	}
+
+	return price, volume
+}
+
+// queryAuction - This function returns the uncross time of the call auction of the pair of the type, and false if the pair is not
+// in the auction.
+func (a *Service) queryAuction(base, quote, _type string) (time.Time, bool) {
+
+	auctions.Lock()
+	defer auctions.Unlock()
+
+	until, ok := auctions.pairs[base+"/"+quote+"/"+_type]
+	return until, ok
+}
+
+// queryValidateAuction - This function returns an error if the order can not be collected in the call auction of its pair. The
+// orders of the auction rest in the book until the uncross, so only the orders that can rest there are accepted.
+func (a *Service) queryValidateAuction(order *types.Order) error {
+
+	if _, ok := a.queryAuction(order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType()); !ok {
+		return nil
+	}
+
+	switch order.GetTimeInForce() {
+	case types.TimeInForceIOC, types.TimeInForceFOK, types.TimeInForcePostOnly:
+		return status.Errorf(11630, "the pair %v-%v is in the call auction, only the orders that rest in the book are accepted", order.GetBaseUnit(), order.GetQuoteUnit())
+	}
+
+	return nil
+}
+
+// queryIndicative - This function returns the indicative clearing price and volume of the book, the price and the volume the
+// auction would uncross at now. The book must be locked by the caller.
+func (a *Service) queryIndicative(book *book, until time.Time) *pbprovider.ResponseAuction {
+
+	price, volume := queryClearing(book.side(types.AssigningBuy), book.side(types.AssigningSell), a.queryLast(book.base, book.quote))
+
+	return &pbprovider.ResponseAuction{
+		BaseUnit:     book.base,
+		QuoteUnit:    book.quote,
+		Type:         book._type,
+		Price:        price.String(),
+		Volume:       volume.String(),
+		AuctionUntil: until.Format(time.RFC3339),
+		Auction:      true,
+	}
+}
+
+// WriteAuction - This function starts the opening call auction of the pair, which lasts for the given duration in seconds. The
+// orders placed during the auction are collected in the book without being matched, and at the uncross time they are
+// all crossed at a single clearing price. The pair is published to the "pair/auction" channel.
+func (a *Service) WriteAuction(base, quote, _type string, duration int32) error {
+
+	var (
+		pair types.Pair
+	)
+
+	until := time.Now().UTC().Add(time.Duration(duration) * time.Second)
+
+	if err := a.Context.Db.QueryRow("update pairs set auction_until = $4 where base_unit = $1 and quote_unit = $2 and type = $3 returning id", base, quote, _type, until).Scan(&pair.Id); err != nil {
+		return err
+	}
+
+	auctions.Lock()
+	auctions.pairs[base+"/"+quote+"/"+_type] = until
+	auctions.Unlock()
+
+	pair.BaseUnit, pair.QuoteUnit, pair.Type, pair.AuctionDuration, pair.AuctionUntil = base, quote, _type, duration, until.Format(time.RFC3339)
+
+	if err := a.Context.Publish(&pair, "exchange", "pair/auction"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeUncross - This function ends the call auction of the pair. The book of the pair is locked, crossed at its clearing price
+// and the result is published to the "auction/uncross" channel. The auction is removed before the book is released, so
+// the next order of the pair is already matched continuously against the uncrossed book. It is also used to uncross
+// the book of a pair resumed after a halt without an auction.
+func (a *Service) writeUncross(base, quote, _type string) {
+
+	book := a.queryBook(base, quote, _type)
+	book.Lock()
+	defer a.release(book)
+
+	// The clearing prices with the same volume are decided by the last price of the pair, or by its price before the first trade.
+	reference := a.queryLast(base, quote)
+	if !reference.IsPositive() {
+		reference, _ = a.queryPrice(base, quote)
+	}
+
+	price, volume := a.uncross(book, reference)
+
+	if err := a.Context.Publish(&pbprovider.ResponseAuction{BaseUnit: base, QuoteUnit: quote, Type: _type, Price: price.String(), Volume: volume.String()}, "exchange", "auction/uncross"); a.Context.Debug(err) {
+		return
+	}
+
+	if _, err := a.Context.Db.Exec("update pairs set auction_until = null where base_unit = $1 and quote_unit = $2 and type = $3", base, quote, _type); a.Context.Debug(err) {
+		return
+	}
+
+	auctions.Lock()
+	delete(auctions.pairs, base+"/"+quote+"/"+_type)
+	auctions.Unlock()
+}
+
+// uncross - This function crosses the book at the clearing price. The bids at or above the clearing price are matched, from the
+// best one, with the asks at or below it, and every trade is executed at the clearing price, so the buyers get the
+// difference to their prices back. Both orders rest in the book, the newer one takes the place of the incoming order of
+// the continuous matching: it pays the taker fee and the older one the maker fee. The orders of the same user are not
+// matched with each other, the self-trade prevention mode of the newer of the two orders decides which of them is
+// canceled, so the book opens uncrossed. The book must be locked by the caller.
+func (a *Service) uncross(book *book, reference decimal.Amount) (price, volume decimal.Amount) {
+
+	price, volume = queryClearing(book.side(types.AssigningBuy), book.side(types.AssigningSell), reference)
+	if !volume.IsPositive() {
+		return price, volume
+	}
+
+	for _, bid := range book.side(types.AssigningBuy) {
+
+		if decimal.Parse(bid.GetPrice()).LessThan(price) {
+			break
+		}
+
+		// The asks are walked again while an iceberg ask has been filled up to its slice, because its next slice can be
+		// matched as well.
+		for again := true; again; {
+			again = false
+
+			for _, ask := range book.side(types.AssigningSell) {
+
+				if bid.GetStatus() != types.StatusPending || !decimal.Parse(bid.GetValue()).IsPositive() || decimal.Parse(ask.GetPrice()).GreaterThan(price) {
+					break
+				}
+
+				// The ask has been canceled by the self-trade prevention of an earlier bid.
+				if ask.GetStatus() != types.StatusPending {
+					continue
+				}
+
+				// Both orders rest in the book, the newer one takes the place of the incoming order of the continuous matching.
+				taker, maker := queryTaker(bid, ask)
+
+				// The orders that are canceled by the self-trade prevention are removed from the book.
+				if ask.GetUserId() == bid.GetUserId() {
+
+					a.selfTrade(book, taker, maker)
+
+					if taker.GetStatus() != types.StatusPending {
+						book.remove(taker.GetId())
+					} else {
+						book.touch(taker)
+					}
+					continue
+				}
+
+				value := decimal.Parse(ask.GetValue())
+
+				switch bid.GetType() {
+				case types.TypeSpot, types.TypeStock:
+					a.defaultProcess(maker.GetAssigning(), price, taker, maker)
+				case types.TypeCross:
+					a.marginProcess(maker.GetAssigning(), price, taker, maker)
+				}
+
+				if rest := decimal.Parse(ask.GetValue()); !rest.IsPositive() {
+					book.remove(ask.GetId())
+				} else if rest.LessThan(value) {
+					book.touch(ask)
+					again = true
+				}
+			}
+		}
+
+		if bid.GetStatus() != types.StatusPending || !decimal.Parse(bid.GetValue()).IsPositive() {
+			book.remove(bid.GetId())
+		} else {
+			book.touch(bid)
+		}
+	}
+
+	return price, volume
+}
+
+// queryTaker - This function decides the sides of a fill between two orders that both rest in the book at the uncross. The
+// newer order is the taker, as if it had been placed after the older one in the continuous matching, and the older
+// order is the maker.
+func queryTaker(bid, ask *types.Order) (taker, maker *types.Order) {
+
+	if ask.GetId() > bid.GetId() {
+		return ask, bid
+	}
+
+	return bid, ask
+}
+
+// restoreAuction - This function loads the pairs in the call auction from the pairs table into the registry at startup.
+func (a *Service) restoreAuction() {
+
+	rows, err := a.Context.Db.Query("select base_unit, quote_unit, type, auction_until from pairs where auction_until is not null")
+	if a.Context.Debug(err) {
+		return
+	}
+	defer rows.Close()
+
+	auctions.Lock()
+	defer auctions.Unlock()
+
+	for rows.Next() {
+
+		var (
+			base, quote, _type string
+			until              time.Time
+		)
+
+		if err := rows.Scan(&base, &quote, &_type, &until); a.Context.Debug(err) {
+			continue
+		}
+
+		auctions.pairs[base+"/"+quote+"/"+_type] = until
+	}
+}
+
+// auction - The purpose of this code is to run the call auctions. Every second the indicative clearing price and volume of the
+// book of every pair in the auction are published to the "auction/indicative" channel, and the auctions whose uncross time has passed
+// are uncrossed with writeUncross.
+func (a *Service) auction() {
+
+	// The code creates a ticker that triggers every second and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Second * 1)
+	for range ticker.C {
+
+		var (
+			pairs = make(map[[3]string]time.Time)
+		)
+
+		// The auctions are copied from the registry first, so the registry is not locked while the books are crossed.
+		auctions.Lock()
+		for key, until := range auctions.pairs {
+			if units := strings.Split(key, "/"); len(units) == 3 {
+				pairs[[3]string{units[0], units[1], units[2]}] = until
+			}
+		}
+		auctions.Unlock()
+
+		for pair, until := range pairs {
+
+			if time.Now().After(until) {
+				a.writeUncross(pair[0], pair[1], pair[2])
+				continue
+			}
+
+			row := a.queryBook(pair[0], pair[1], pair[2])
+
+			row.Lock()
+			response := a.queryIndicative(row, until)
+			row.Unlock()
+
+			if err := a.Context.Publish(response, "exchange", "auction/indicative"); a.Context.Debug(err) {
+				continue
+			}
+		}
+	}
+}
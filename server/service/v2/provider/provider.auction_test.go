@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestQueryClearing(t *testing.T) {
+	tests := []struct {
+		name      string
+		bids      []*types.Order
+		asks      []*types.Order
+		reference string
+		price     string
+		volume    string
+	}{
+		{
+			name:   "maximum volume",
+			bids:   []*types.Order{{Price: "102", Value: "3"}, {Price: "100", Value: "2"}},
+			asks:   []*types.Order{{Price: "99", Value: "2"}, {Price: "101", Value: "4"}},
+			price:  "101",
+			volume: "3",
+		},
+		{
+			name:      "reference price",
+			bids:      []*types.Order{{Price: "101", Value: "2"}},
+			asks:      []*types.Order{{Price: "99", Value: "2"}},
+			reference: "100.5",
+			price:     "101",
+			volume:    "2",
+		},
+		{
+			name:   "no cross",
+			bids:   []*types.Order{{Price: "99", Value: "2"}},
+			asks:   []*types.Order{{Price: "100", Value: "2"}},
+			price:  "0",
+			volume: "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, volume := queryClearing(tt.bids, tt.asks, decimal.Parse(tt.reference))
+			if price.String() != tt.price || volume.String() != tt.volume {
+				t.Errorf("queryClearing() = %v, %v, want %v, %v", price, volume, tt.price, tt.volume)
+			}
+		})
+	}
+}
+
+func TestQueryTaker(t *testing.T) {
+	tests := []struct {
+		name  string
+		bid   *types.Order
+		ask   *types.Order
+		taker int64
+		maker int64
+	}{
+		{name: "newer ask", bid: &types.Order{Id: 1, Assigning: types.AssigningBuy}, ask: &types.Order{Id: 2, Assigning: types.AssigningSell}, taker: 2, maker: 1},
+		{name: "newer bid", bid: &types.Order{Id: 3, Assigning: types.AssigningBuy}, ask: &types.Order{Id: 2, Assigning: types.AssigningSell}, taker: 3, maker: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taker, maker := queryTaker(tt.bid, tt.ask)
+			if taker.GetId() != tt.taker || maker.GetId() != tt.maker {
+				t.Errorf("queryTaker() = %v, %v, want %v, %v", taker.GetId(), maker.GetId(), tt.taker, tt.maker)
+			}
+		})
+	}
+}
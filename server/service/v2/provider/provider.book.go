@@ -0,0 +1,498 @@
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// book - The book struct is an in-memory order book for a single trading pair. It keeps the resting buy orders (bids) sorted
+// by price from the highest to the lowest and the resting sell orders (asks) sorted by price from the lowest to the
+// highest. Orders with the same price are kept in the order of their arrival in the book, which gives the price-time
+// priority used by the matching engine. The embedded mutex serializes the matching of all orders placed on the same pair.
+// Every change of a price level is collected in changes and published as a depth diff with the next sequence number
+// when the book is released, so clients can keep a local copy of the book and detect the diffs they have missed.
+type book struct {
+	sync.Mutex
+	bids     []*types.Order
+	asks     []*types.Order
+	base     string
+	quote    string
+	_type    string
+	sequence int64
+	changes  map[string]map[string]bool
+}
+
+// books - The books variable is the registry of all in-memory order books, one per (base unit, quote unit, type). It is a
+// package level registry because the provider service is created in many places (gRPC server, admin and spot services),
+// while the order book must be the same for all of them.
+var books = struct {
+	sync.Mutex
+	pairs map[string]*book
+}{
+	pairs: make(map[string]*book),
+}
+
+// queryBook - This function returns the in-memory order book for the given base unit, quote unit and order type. If the book
+// does not exist yet, an empty book is created and registered, so the function never returns nil.
+func (a *Service) queryBook(base, quote, _type string) *book {
+
+	// The registry is locked while the book is looked up or created, so two concurrent callers always get the same book.
+	books.Lock()
+	defer books.Unlock()
+
+	// The key of the book consists of the base unit, the quote unit and the type of the order, because spot, stock and
+	// cross orders of the same pair are matched independently of each other.
+	key := base + "/" + quote + "/" + _type
+
+	if row, ok := books.pairs[key]; ok {
+		return row
+	}
+
+	row := &book{base: base, quote: quote, _type: _type}
+	books.pairs[key] = row
+
+	return row
+}
+
+// lookupBook - This function returns the in-memory order book for the given base unit, quote unit and order type, or nil if
+// the book does not exist. Unlike queryBook it never creates a book, so it is used by the read-only requests, which
+// may be called with any pair.
+func (a *Service) lookupBook(base, quote, _type string) *book {
+
+	books.Lock()
+	defer books.Unlock()
+
+	return books.pairs[base+"/"+quote+"/"+_type]
+}
+
+// restore - This function is used to rebuild the in-memory order books at startup. The books are rebuilt from their latest
+// checkpoints and the tail of the journal (restoreCheckpoint). If there is no checkpoint yet, all pending orders are
+// loaded from the orders table ordered by id, so that orders with the same price keep their time priority, and pushed
+// into their books. Either way a new checkpoint of every book is written, which is the starting point of the next
+// restore and of the replay.
+func (a *Service) restore() {
+
+	if !a.restoreCheckpoint() {
+		a.restoreOrders()
+	}
+
+	// The restored orders are part of the first snapshot of every book, they are not published as a diff.
+	books.Lock()
+	for _, row := range books.pairs {
+		row.changes = nil
+	}
+	books.Unlock()
+
+	a.writeCheckpoints()
+}
+
+// restoreOrders - This function pushes all pending orders of the orders table into their books.
+func (a *Service) restoreOrders() {
+
+	// This code queries all pending orders from the database. The orders table is the persistent storage of the order books,
+	// so every order that was resting in a book before the restart is still pending there.
+	rows, err := a.Context.Db.Query(`select id, assigning, base_unit, quote_unit, value, quantity, price, user_id, type, trading, status, self_trade, display, hidden, create_at from orders where status = $1 order by id`, types.StatusPending)
+	if a.Context.Debug(err) {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Order
+		)
+
+		if err := rows.Scan(&item.Id, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.Value, &item.Quantity, &item.Price, &item.UserId, &item.Type, &item.Trading, &item.Status, &item.SelfTrade, &item.Display, &item.Hidden, &item.CreateAt); a.Context.Debug(err) {
+			continue
+		}
+
+		// The order is pushed into the book of its pair, the book is created on the first order of the pair.
+		a.queryBook(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType()).push(&item)
+	}
+
+	if err = rows.Err(); a.Context.Debug(err) {
+		return
+	}
+}
+
+// push - This function inserts an order into the book on the side defined by its assigning. The position of the order is found
+// with a binary search, so the side stays sorted by price and, for the same price, by the time of arrival: the order is
+// always placed behind the orders with the same price, so an order that is pushed again loses its place in the queue.
+func (b *book) push(order *types.Order) {
+
+	// The price of the order is parsed once, the prices are compared as exact amounts and never as strings.
+	price := decimal.Parse(order.GetPrice())
+
+	switch order.GetAssigning() {
+	case types.AssigningBuy:
+
+		// Bids are sorted by price descending, an order is placed after all bids with a higher or the same price.
+		i := sort.Search(len(b.bids), func(i int) bool {
+			c := decimal.Parse(b.bids[i].GetPrice()).Cmp(price)
+			return c < 0
+		})
+		b.bids = append(b.bids, nil)
+		copy(b.bids[i+1:], b.bids[i:])
+		b.bids[i] = order
+		b.touch(order)
+
+	case types.AssigningSell:
+
+		// Asks are sorted by price ascending, an order is placed after all asks with a lower or the same price.
+		i := sort.Search(len(b.asks), func(i int) bool {
+			c := decimal.Parse(b.asks[i].GetPrice()).Cmp(price)
+			return c > 0
+		})
+		b.asks = append(b.asks, nil)
+		copy(b.asks[i+1:], b.asks[i:])
+		b.asks[i] = order
+		b.touch(order)
+	}
+}
+
+// remove - This function removes the order with the given id from the book and returns it. If the order is not in the book,
+// for example because it has already been filled, the function returns nil.
+func (b *book) remove(id int64) *types.Order {
+
+	for _, side := range []*[]*types.Order{&b.bids, &b.asks} {
+		for i, item := range *side {
+			if item.GetId() == id {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+				b.touch(item)
+				return item
+			}
+		}
+	}
+
+	return nil
+}
+
+// find - This function returns the order with the given id that rests in the book, or nil if the order is not in the book. The
+// order is returned by pointer, so it can be changed in place without losing its place in the queue.
+func (b *book) find(id int64) *types.Order {
+
+	for _, side := range [][]*types.Order{b.bids, b.asks} {
+		for _, item := range side {
+			if item.GetId() == id {
+				return item
+			}
+		}
+	}
+
+	return nil
+}
+
+// side - This function returns a copy of the resting orders of the given side, sorted from the best price to the worst. A copy
+// is returned so that the caller can iterate over it while filled orders are removed from the book.
+func (b *book) side(assigning string) []*types.Order {
+
+	var (
+		orders []*types.Order
+	)
+
+	switch assigning {
+	case types.AssigningBuy:
+		orders = append(orders, b.bids...)
+	case types.AssigningSell:
+		orders = append(orders, b.asks...)
+	}
+
+	return orders
+}
+
+// best - This function returns the best resting order of the given side: the highest bid or the lowest ask. If the side is
+// empty, the function returns nil.
+func (b *book) best(assigning string) *types.Order {
+
+	switch assigning {
+	case types.AssigningBuy:
+		if len(b.bids) > 0 {
+			return b.bids[0]
+		}
+	case types.AssigningSell:
+		if len(b.asks) > 0 {
+			return b.asks[0]
+		}
+	}
+
+	return nil
+}
+
+// cross - This function checks whether the taker order can be matched with the resting order. A buy order crosses an ask with
+// the same or a lower price, a sell order crosses a bid with the same or a higher price.
+func (b *book) cross(order, item *types.Order) bool {
+
+	switch order.GetAssigning() {
+	case types.AssigningBuy:
+		return decimal.Parse(order.GetPrice()).GreaterThanOrEqual(decimal.Parse(item.GetPrice()))
+	case types.AssigningSell:
+		return decimal.Parse(order.GetPrice()).LessThanOrEqual(decimal.Parse(item.GetPrice()))
+	}
+
+	return false
+}
+
+// peak - This function returns the part of the remaining value of the order that can be matched at its place in the queue.
+// An iceberg order shows only its display quantity: the remaining value is worked in slices of the display quantity,
+// and when the current slice is filled, the next one is placed at the back of the queue. The last slice of the value
+// may be smaller than the display quantity, it is worked first. The whole remaining value of any other order can be matched.
+func peak(order *types.Order) decimal.Amount {
+
+	value, display := decimal.Parse(order.GetValue()), decimal.Parse(order.GetDisplay())
+	if !display.IsPositive() || value.LessThanOrEqual(display) {
+		return value
+	}
+
+	if rest := value.Mod(display); rest.IsPositive() {
+		return rest
+	}
+
+	return display
+}
+
+// shown - This function returns the part of the remaining value of the order that is shown in the depth of the book: nothing
+// for a hidden order, the current slice for an iceberg order and the whole remaining value for any other order.
+func shown(order *types.Order) decimal.Amount {
+
+	if order.GetHidden() {
+		return decimal.Zero
+	}
+
+	return peak(order)
+}
+
+// masked - This function returns the order the way other users may see it on the public channels of the exchange, the same way
+// as GetOrders shows it to them: a hidden order is not shown at all (nil), an iceberg order is shown with its current
+// slice only, and any other order is returned as it is.
+func masked(order *types.Order) *types.Order {
+
+	if order.GetHidden() {
+		return nil
+	}
+
+	if !decimal.Parse(order.GetDisplay()).IsPositive() {
+		return order
+	}
+
+	return &types.Order{
+		Id:              order.GetId(),
+		Assigning:       order.GetAssigning(),
+		Price:           order.GetPrice(),
+		Trigger:         order.GetTrigger(),
+		Value:           shown(order).String(),
+		Quantity:        order.GetDisplay(),
+		BaseUnit:        order.GetBaseUnit(),
+		QuoteUnit:       order.GetQuoteUnit(),
+		UserId:          order.GetUserId(),
+		CreateAt:        order.GetCreateAt(),
+		Type:            order.GetType(),
+		Trading:         order.GetTrading(),
+		Status:          order.GetStatus(),
+		TimeInForce:     order.GetTimeInForce(),
+		ExpireAt:        order.GetExpireAt(),
+		TrailingOffset:  order.GetTrailingOffset(),
+		TrailingPercent: order.GetTrailingPercent(),
+		Watermark:       order.GetWatermark(),
+	}
+}
+
+// liquidity - This function returns the value of the resting orders of the given side that the taker order could be matched
+// with: the orders that cross the price of the taker order and do not belong to the same user. It is used to check a
+// fill-or-kill order, which must be filled entirely, and a post-only order, which must not be matched at all.
+func (b *book) liquidity(order *types.Order, assigning string) (value decimal.Amount) {
+
+	for _, item := range b.side(assigning) {
+
+		if !b.cross(order, item) {
+			break
+		}
+
+		if item.GetUserId() == order.GetUserId() {
+			continue
+		}
+
+		value = value.Add(decimal.Parse(item.GetValue()))
+	}
+
+	return value
+}
+
+// sweep - This function walks the resting orders of the given side level by level, the same way a market order is matched, and
+// returns the quantity the market order can take and the price of the worst order it reaches. The amount of a buy order
+// is an amount of the quote unit, which is consumed at the price of every resting order, the amount of a sell order is
+// a quantity of the base unit. The price of the order is the slippage limit, the walk stops at the first resting order
+// beyond it, a price equal to zero means no limit. The orders of the same user are skipped, they would not be matched.
+// The rest is the part of the amount that the book can not take.
+func (b *book) sweep(order *types.Order, assigning string, amount decimal.Amount) (quantity, price, rest decimal.Amount) {
+
+	for _, item := range b.side(assigning) {
+
+		if !amount.IsPositive() {
+			break
+		}
+
+		if decimal.Parse(order.GetPrice()).IsPositive() && !b.cross(order, item) {
+			break
+		}
+
+		if item.GetUserId() == order.GetUserId() {
+			continue
+		}
+
+		value, level := decimal.Parse(item.GetValue()), decimal.Parse(item.GetPrice())
+
+		// The buy order takes as much of the resting order as the rest of its quote amount can pay at the price of it.
+		if order.GetAssigning() == types.AssigningBuy {
+
+			if take := amount.Div(level); take.LessThan(value) {
+				value = take
+			}
+			amount = amount.Sub(value.Mul(level))
+		} else {
+
+			if amount.LessThan(value) {
+				value = amount
+			}
+			amount = amount.Sub(value)
+		}
+
+		quantity, price = quantity.Add(value), level
+	}
+
+	return quantity, price, amount
+}
+
+// depth - This function aggregates the resting orders of the given side into price levels, from the best price to the worst. The
+// prices are grouped by the given precision: bids are rounded down and asks are rounded up to a multiple of it, so a
+// level never shows a better price than the orders in it. A precision equal to zero keeps the exact prices. The number
+// of levels is limited by the given limit.
+func (b *book) depth(assigning string, precision decimal.Amount, limit int) []*pbprovider.Level {
+
+	var (
+		levels []*pbprovider.Level
+		price  decimal.Amount
+	)
+
+	for _, item := range b.side(assigning) {
+
+		value := decimal.Parse(item.GetPrice())
+		if precision.IsPositive() {
+			switch assigning {
+			case types.AssigningBuy:
+				value = value.Div(precision).Floor().Mul(precision)
+			case types.AssigningSell:
+				value = value.Div(precision).Ceil().Mul(precision)
+			}
+		}
+
+		// A hidden order is never shown in the depth, an iceberg order is shown with its current slice only.
+		quantity := shown(item)
+		if !quantity.IsPositive() {
+			continue
+		}
+
+		// The order belongs to the last level if it has the same grouped price, otherwise a new level is started.
+		if len(levels) > 0 && value.Equal(price) {
+			level := levels[len(levels)-1]
+			level.Quantity = decimal.Parse(level.GetQuantity()).Add(quantity).String()
+			level.Count++
+			continue
+		}
+
+		if len(levels) == limit {
+			break
+		}
+
+		price = value
+		levels = append(levels, &pbprovider.Level{Price: value.String(), Quantity: quantity.String(), Count: 1})
+	}
+
+	return levels
+}
+
+// touch - This function marks the price level of the order as changed, because the order has been pushed, removed or its
+// remaining value has changed. The level is published with the next depth diff.
+func (b *book) touch(order *types.Order) {
+
+	if b.changes == nil {
+		b.changes = make(map[string]map[string]bool)
+	}
+
+	if b.changes[order.GetAssigning()] == nil {
+		b.changes[order.GetAssigning()] = make(map[string]bool)
+	}
+
+	// The price is normalized, so the same price read from the database and from a request is the same level.
+	b.changes[order.GetAssigning()][decimal.Parse(order.GetPrice()).String()] = true
+}
+
+// diff - This function returns the changed price levels of the book with their current quantities and the next sequence
+// number, and clears the changes. A level without orders is returned with a zero quantity, which tells the client to
+// delete it. If nothing has changed, nil is returned and the sequence number stays the same.
+func (b *book) diff() *pbprovider.ResponseDepth {
+
+	if len(b.changes) == 0 {
+		return nil
+	}
+
+	b.sequence++
+
+	response := &pbprovider.ResponseDepth{
+		BaseUnit:  b.base,
+		QuoteUnit: b.quote,
+		Type:      b._type,
+		Sequence:  b.sequence,
+	}
+
+	for assigning, prices := range b.changes {
+
+		var (
+			levels []*pbprovider.Level
+			keys   []string
+		)
+
+		for price := range prices {
+			keys = append(keys, price)
+		}
+		sort.Strings(keys)
+
+		for _, price := range keys {
+
+			level := &pbprovider.Level{Price: price, Quantity: decimal.Zero.String()}
+			for _, item := range b.side(assigning) {
+				if quantity := shown(item); quantity.IsPositive() && decimal.Parse(item.GetPrice()).String() == price {
+					level.Quantity = decimal.Parse(level.GetQuantity()).Add(quantity).String()
+					level.Count++
+				}
+			}
+
+			levels = append(levels, level)
+		}
+
+		switch assigning {
+		case types.AssigningBuy:
+			response.Bids = levels
+		case types.AssigningSell:
+			response.Asks = levels
+		}
+	}
+	b.changes = nil
+
+	return response
+}
+
+// release - This function publishes the changes of the book as a depth diff to the "depth/diff" channel and unlocks the book.
+// It is deferred instead of Unlock by every function that changes the book, so the diffs are published in the order
+// of their sequence numbers.
+func (a *Service) release(b *book) {
+	defer b.Unlock()
+
+	if diff := b.diff(); diff != nil {
+		a.Context.Debug(a.Context.Publish(diff, "exchange", "depth/diff"))
+	}
+}
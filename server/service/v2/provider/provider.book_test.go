@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestBook_Push(t *testing.T) {
+	type args struct {
+		orders []*types.Order
+	}
+	tests := []struct {
+		name      string
+		args      args
+		assigning string
+		want      []int64
+	}{
+		{
+			name: t.Name(),
+			args: args{
+				orders: []*types.Order{
+					{Id: 1, Assigning: types.AssigningBuy, Price: "100"},
+					{Id: 2, Assigning: types.AssigningBuy, Price: "101"},
+					{Id: 3, Assigning: types.AssigningBuy, Price: "100"},
+					{Id: 4, Assigning: types.AssigningBuy, Price: "99"},
+				},
+			},
+			assigning: types.AssigningBuy,
+			want:      []int64{2, 1, 3, 4},
+		},
+		{
+			name: t.Name(),
+			args: args{
+				orders: []*types.Order{
+					{Id: 1, Assigning: types.AssigningSell, Price: "100"},
+					{Id: 2, Assigning: types.AssigningSell, Price: "99"},
+					{Id: 3, Assigning: types.AssigningSell, Price: "100"},
+					{Id: 4, Assigning: types.AssigningSell, Price: "101"},
+				},
+			},
+			assigning: types.AssigningSell,
+			want:      []int64{2, 1, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := new(book)
+			for _, order := range tt.args.orders {
+				b.push(order)
+			}
+			side := b.side(tt.assigning)
+			if len(side) != len(tt.want) {
+				t.Fatalf("side() = %v orders, want %v", len(side), len(tt.want))
+			}
+			for i, item := range side {
+				if item.GetId() != tt.want[i] {
+					t.Errorf("side()[%v] = %v, want %v", i, item.GetId(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBook_Remove(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningSell, Price: "100"})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningSell, Price: "99"})
+
+	if order := b.remove(2); order == nil || order.GetId() != 2 {
+		t.Fatalf("remove() = %v, want order 2", order)
+	}
+	if order := b.remove(2); order != nil {
+		t.Errorf("remove() = %v, want nil", order)
+	}
+	if order := b.best(types.AssigningSell); order == nil || order.GetId() != 1 {
+		t.Errorf("best() = %v, want order 1", order)
+	}
+}
+
+func TestBook_Liquidity(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, UserId: 1, Assigning: types.AssigningSell, Price: "100", Value: "2"})
+	b.push(&types.Order{Id: 2, UserId: 2, Assigning: types.AssigningSell, Price: "101", Value: "3"})
+	b.push(&types.Order{Id: 3, UserId: 1, Assigning: types.AssigningSell, Price: "99", Value: "5"})
+	b.push(&types.Order{Id: 4, UserId: 1, Assigning: types.AssigningSell, Price: "102", Value: "7"})
+
+	order := &types.Order{UserId: 2, Assigning: types.AssigningBuy, Price: "101"}
+	if value := b.liquidity(order, types.AssigningSell); value.String() != "7" {
+		t.Errorf("liquidity() = %v, want 7", value)
+	}
+
+	order = &types.Order{UserId: 3, Assigning: types.AssigningBuy, Price: "98"}
+	if value := b.liquidity(order, types.AssigningSell); value.IsPositive() {
+		t.Errorf("liquidity() = %v, want 0", value)
+	}
+}
+
+func TestBook_Requeue(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningBuy, Price: "100"})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningBuy, Price: "100"})
+
+	// An order that is pushed again is placed behind the orders with the same price.
+	if order := b.find(1); order == nil {
+		t.Fatalf("find() = nil, want order 1")
+	}
+	b.push(b.remove(1))
+
+	if order := b.best(types.AssigningBuy); order == nil || order.GetId() != 2 {
+		t.Errorf("best() = %v, want order 2", order)
+	}
+	if order := b.find(3); order != nil {
+		t.Errorf("find() = %v, want nil", order)
+	}
+}
+
+func TestBook_Sweep(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningSell, Price: "100", Value: "1", UserId: 2})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningSell, Price: "101", Value: "1", UserId: 1})
+	b.push(&types.Order{Id: 3, Assigning: types.AssigningSell, Price: "102", Value: "2", UserId: 2})
+	b.push(&types.Order{Id: 4, Assigning: types.AssigningSell, Price: "110", Value: "5", UserId: 2})
+
+	// The buy order spends 304 of the quote unit: 100 for the first order and 204 for the whole third one, its own order is skipped.
+	quantity, price, rest := b.sweep(&types.Order{Assigning: types.AssigningBuy, UserId: 1}, types.AssigningSell, decimal.Parse("304"))
+	if quantity.String() != "3" || price.String() != "102" || !rest.IsZero() {
+		t.Errorf("sweep() = %v, %v, %v, want 3, 102, 0", quantity, price, rest)
+	}
+
+	// The slippage limit stops the walk before the order at 110, the rest of the quote amount can not be spent.
+	quantity, price, rest = b.sweep(&types.Order{Assigning: types.AssigningBuy, UserId: 1, Price: "105"}, types.AssigningSell, decimal.Parse("10000"))
+	if quantity.String() != "3" || price.String() != "102" || rest.String() != "9696" {
+		t.Errorf("sweep() = %v, %v, %v, want 3, 102, 9696", quantity, price, rest)
+	}
+
+	b.push(&types.Order{Id: 5, Assigning: types.AssigningBuy, Price: "99", Value: "2", UserId: 2})
+	b.push(&types.Order{Id: 6, Assigning: types.AssigningBuy, Price: "98", Value: "2", UserId: 2})
+
+	quantity, price, _ = b.sweep(&types.Order{Assigning: types.AssigningSell, UserId: 1}, types.AssigningBuy, decimal.Parse("3"))
+	if quantity.String() != "3" || price.String() != "98" {
+		t.Errorf("sweep() = %v, %v, want 3, 98", quantity, price)
+	}
+
+	if quantity, _, rest = b.sweep(&types.Order{Assigning: types.AssigningSell, UserId: 1, Price: "99"}, types.AssigningBuy, decimal.Parse("3")); quantity.String() != "2" || rest.String() != "1" {
+		t.Errorf("sweep() = %v, %v, want 2, 1", quantity, rest)
+	}
+}
+
+func TestBook_Depth(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningBuy, Price: "100.4", Value: "1"})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningBuy, Price: "100.1", Value: "2"})
+	b.push(&types.Order{Id: 3, Assigning: types.AssigningBuy, Price: "99.9", Value: "3"})
+	b.push(&types.Order{Id: 4, Assigning: types.AssigningSell, Price: "101.1", Value: "4"})
+	b.push(&types.Order{Id: 5, Assigning: types.AssigningSell, Price: "101.6", Value: "5"})
+
+	bids := b.depth(types.AssigningBuy, decimal.Parse("1"), 10)
+	if len(bids) != 2 || bids[0].GetPrice() != "100" || bids[0].GetQuantity() != "3" || bids[0].GetCount() != 2 || bids[1].GetPrice() != "99" {
+		t.Errorf("depth() = %v, want levels 100 (3) and 99 (3)", bids)
+	}
+
+	asks := b.depth(types.AssigningSell, decimal.Parse("1"), 1)
+	if len(asks) != 1 || asks[0].GetPrice() != "102" || asks[0].GetQuantity() != "9" {
+		t.Errorf("depth() = %v, want level 102 (9)", asks)
+	}
+
+	if levels := b.depth(types.AssigningSell, decimal.Zero, 10); len(levels) != 2 || levels[0].GetPrice() != "101.1" {
+		t.Errorf("depth() = %v, want exact levels", levels)
+	}
+}
+
+func TestBook_Diff(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningBuy, Price: "100", Value: "1"})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningBuy, Price: "100", Value: "2"})
+	b.push(&types.Order{Id: 3, Assigning: types.AssigningSell, Price: "101", Value: "3"})
+
+	response := b.diff()
+	if response == nil || response.GetSequence() != 1 || len(response.GetBids()) != 1 || response.GetBids()[0].GetQuantity() != "3" || len(response.GetAsks()) != 1 {
+		t.Fatalf("diff() = %v, want sequence 1 with levels 100 (3) and 101 (3)", response)
+	}
+
+	// Nothing has changed since the last diff, the sequence number stays the same.
+	if response := b.diff(); response != nil {
+		t.Errorf("diff() = %v, want nil", response)
+	}
+
+	b.remove(3)
+
+	response = b.diff()
+	if response == nil || response.GetSequence() != 2 || len(response.GetBids()) != 0 || len(response.GetAsks()) != 1 || response.GetAsks()[0].GetQuantity() != "0" {
+		t.Errorf("diff() = %v, want sequence 2 with level 101 (0)", response)
+	}
+}
+
+func TestPeak(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *types.Order
+		want  string
+	}{
+		{name: "plain", order: &types.Order{Value: "10"}, want: "10"},
+		{name: "iceberg", order: &types.Order{Value: "9", Display: "3"}, want: "3"},
+		{name: "iceberg with a smaller slice", order: &types.Order{Value: "10", Display: "3"}, want: "1"},
+		{name: "iceberg below the display", order: &types.Order{Value: "2", Display: "3"}, want: "2"},
+		{name: "hidden", order: &types.Order{Value: "10", Hidden: true}, want: "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := peak(tt.order); got.String() != tt.want {
+				t.Errorf("peak() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMasked(t *testing.T) {
+	plain := &types.Order{Id: 1, Value: "10", Quantity: "10"}
+	if got := masked(plain); got != plain {
+		t.Errorf("masked() = %v, want the order itself", got)
+	}
+
+	if got := masked(&types.Order{Id: 2, Value: "10", Quantity: "10", Hidden: true}); got != nil {
+		t.Errorf("masked() = %v, want nil", got)
+	}
+
+	// The iceberg order is shown with its current slice, the order itself keeps its remaining value.
+	iceberg := &types.Order{Id: 3, Value: "10", Quantity: "12", Display: "3", UserId: 7}
+	if got := masked(iceberg); got == nil || got.GetValue() != "1" || got.GetQuantity() != "3" || got.GetDisplay() != "" || got.GetUserId() != 7 || iceberg.GetValue() != "10" {
+		t.Errorf("masked() = %v, want value 1 of quantity 3", got)
+	}
+}
+
+func TestBook_DepthHidden(t *testing.T) {
+	b := new(book)
+	b.push(&types.Order{Id: 1, Assigning: types.AssigningBuy, Price: "100", Value: "9", Display: "3"})
+	b.push(&types.Order{Id: 2, Assigning: types.AssigningBuy, Price: "100", Value: "5", Hidden: true})
+	b.push(&types.Order{Id: 3, Assigning: types.AssigningBuy, Price: "99", Value: "5", Hidden: true})
+
+	// Only the slice of the iceberg order is shown, the hidden orders are not shown at all.
+	bids := b.depth(types.AssigningBuy, decimal.Zero, 10)
+	if len(bids) != 1 || bids[0].GetQuantity() != "3" || bids[0].GetCount() != 1 {
+		t.Errorf("depth() = %v, want level 100 (3)", bids)
+	}
+
+	response := b.diff()
+	if response == nil || len(response.GetBids()) != 2 || response.GetBids()[0].GetQuantity() != "3" || response.GetBids()[1].GetQuantity() != "0" {
+		t.Errorf("diff() = %v, want levels 100 (3) and 99 (0)", response)
+	}
+
+	// The liquidity of the hidden orders can still be matched.
+	if value := b.liquidity(&types.Order{Assigning: types.AssigningSell, Price: "99", UserId: 1}, types.AssigningBuy); value.String() != "19" {
+		t.Errorf("liquidity() = %v, want 19", value)
+	}
+}
@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// volumes - The volumes variable keeps the rolling 30-day traded volume of the users, valued in the valuation unit, together with
+// the time it was calculated. The volume decides the fee tier of every fill, and a tier does not need to follow every
+// single trade, so the volume is calculated again only once it is older than a minute.
+var volumes = struct {
+	sync.Mutex
+	users map[int64]volume
+}{
+	users: make(map[int64]volume),
+}
+
+// volume - The volume type is a cached 30-day traded volume of a user.
+type volume struct {
+	value decimal.Amount
+	at    time.Time
+}
+
+// queryVolume - This function returns the traded volume of the user over the last 30 days, valued in the valuation unit (usd).
+// The volume of every pair is the sum of the quantities of the trades multiplied by their prices, which is an amount of
+// the quote unit, and it is valued with the price of the quote unit. The quote units without a price are skipped.
+func (a *Service) queryVolume(tx executor, userId int64) decimal.Amount {
+
+	volumes.Lock()
+	cache, ok := volumes.users[userId]
+	volumes.Unlock()
+
+	if ok && time.Since(cache.at) < time.Minute {
+		return cache.value
+	}
+
+	var (
+		value decimal.Amount
+	)
+
+	rows, err := tx.Query("select quote_unit, sum(quantity * price) from trades where user_id = $1 and create_at >= now() - interval '30 days' group by quote_unit", userId)
+	if a.Context.Debug(err) {
+		return value
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			quote string
+			total decimal.Amount
+		)
+
+		if err := rows.Scan(&quote, &total); a.Context.Debug(err) {
+			continue
+		}
+
+		if price, ok := a.queryValuation(quote); ok {
+			value = value.Add(total.Mul(price))
+		}
+	}
+
+	volumes.Lock()
+	volumes.users[userId] = volume{value: value, at: time.Now()}
+	volumes.Unlock()
+
+	return value
+}
+
+// fee - The fee type is a tier of the fee schedule: the 30-day traded volume that reaches the tier and its maker and taker rates.
+type fee struct {
+	volume, maker, taker decimal.Amount
+}
+
+// queryTier - This function returns the maker and the taker fee rates of the user in percent. The rates start from the given
+// rates of the asset, they are replaced by the rates of the highest tier of the fee schedule (fees) whose volume the
+// 30-day traded volume of the user has reached, and finally by the overrides of the account (accounts.fees_maker,
+// accounts.fees_taker). A negative maker rate is a rebate paid to the maker. The function runs on the transaction of
+// the fill, so the schedule is read completely and its rows are closed before the account is queried.
+func (a *Service) queryTier(tx executor, userId int64, maker, taker decimal.Amount) *pbprovider.ResponseFeeTier {
+
+	var (
+		response = pbprovider.ResponseFeeTier{
+			Maker: maker.String(),
+			Taker: taker.String(),
+		}
+		schedule []fee
+		override [2]string
+	)
+
+	value := a.queryVolume(tx, userId)
+	response.Volume = value.String()
+
+	rows, err := tx.Query("select volume, maker, taker from fees order by volume")
+	if a.Context.Debug(err) {
+		return &response
+	}
+
+	for rows.Next() {
+
+		var (
+			item fee
+		)
+
+		if err := rows.Scan(&item.volume, &item.maker, &item.taker); a.Context.Debug(err) {
+			continue
+		}
+		schedule = append(schedule, item)
+	}
+
+	if err := rows.Close(); a.Context.Debug(err) {
+		return &response
+	}
+
+	tiers(&response, schedule, value)
+
+	if err := tx.QueryRow("select coalesce(fees_maker::text, ''), coalesce(fees_taker::text, '') from accounts where id = $1", userId).Scan(&override[0], &override[1]); a.Context.Debug(err) {
+		return &response
+	}
+
+	overrides(&response, override[0], override[1])
+
+	return &response
+}
+
+// tiers - This function walks the fee schedule from the lowest volume, every tier reached by the volume replaces the rates of the
+// previous one, and the first tier that is not reached yet is the volume the user needs for the next tier.
+func tiers(response *pbprovider.ResponseFeeTier, schedule []fee, value decimal.Amount) {
+
+	for _, item := range schedule {
+
+		if item.volume.GreaterThan(value) {
+			response.NextVolume = item.volume.String()
+			return
+		}
+
+		response.Tier++
+		response.Maker, response.Taker = item.maker.String(), item.taker.String()
+	}
+}
+
+// overrides - This function replaces the rates of the schedule by the overrides of the account, every rate on its own. An empty
+// override leaves the rate of the schedule.
+func overrides(response *pbprovider.ResponseFeeTier, maker, taker string) {
+
+	if len(maker) > 0 {
+		response.Maker, response.Override = decimal.Parse(maker).String(), true
+	}
+
+	if len(taker) > 0 {
+		response.Taker, response.Override = decimal.Parse(taker).String(), true
+	}
+}
+
+// writePlatform - This function charges the fee of a trade from the balance of the platform asset, if the owner of the order pays
+// the trading fees in the platform asset (accounts.fees_platform). The fee is converted from the received asset into
+// the platform asset at the current price of their pair, the discount of the platform asset (assets.fees_platform) is
+// taken off, and the result is subtracted from the balance of the same type as the order. If the fee can not be paid
+// this way, because there is no platform asset, no pair to convert the fee with, or the balance is insufficient, the
+// function returns false and the fee is deducted from the received asset as usual.
+func (a *Service) writePlatform(tx executor, order *types.Order, symbol string, fee decimal.Amount) (charged decimal.Amount, platform string, ok bool, err error) {
+
+	var (
+		enabled  bool
+		discount decimal.Amount
+	)
+
+	if err := tx.QueryRow("select fees_platform from accounts where id = $1", order.GetUserId()).Scan(&enabled); err != nil || !enabled {
+		return charged, platform, false, nil
+	}
+
+	if err := tx.QueryRow("select symbol, fees_platform from assets where platform = true").Scan(&platform, &discount); err != nil || platform == symbol {
+		return charged, platform, false, nil
+	}
+
+	// The fee is converted with the price of the direct pair (asset/platform), or with the inverse price of the inverse pair.
+	if price, ok := a.queryPrice(symbol, platform); ok && price.IsPositive() {
+		charged = fee.Mul(price)
+	} else if price, ok := a.queryPrice(platform, symbol); ok && price.IsPositive() {
+		charged = fee.DivRound(price, 18)
+	} else {
+		return charged, platform, false, nil
+	}
+
+	charged = charged.Sub(charged.Mul(discount).Div(decimal.New(100).Amount())).Truncate(a.queryPrecision(platform))
+	if !charged.IsPositive() {
+		return charged, platform, false, nil
+	}
+
+	// The balance is only charged if it covers the whole fee, otherwise no row is updated.
+	result, err := tx.Exec("update balances set value = value - $2 where symbol = $1 and user_id = $3 and type = $4 and value >= $2;", platform, charged, order.GetUserId(), order.GetType())
+	if err != nil {
+		return charged, platform, false, err
+	}
+
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return charged, platform, false, err
+	}
+
+	if _, err := tx.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", platform, charged); err != nil {
+		return charged, platform, false, err
+	}
+
+	return charged, platform, true, nil
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
+)
+
+func TestTiers(t *testing.T) {
+	schedule := []fee{
+		{volume: decimal.Parse("0"), maker: decimal.Parse("0.1"), taker: decimal.Parse("0.2")},
+		{volume: decimal.Parse("10000"), maker: decimal.Parse("0.08"), taker: decimal.Parse("0.15")},
+		{volume: decimal.Parse("100000"), maker: decimal.Parse("-0.01"), taker: decimal.Parse("0.1")},
+	}
+
+	tests := []struct {
+		name     string
+		schedule []fee
+		volume   string
+		tier     int32
+		maker    string
+		taker    string
+		next     string
+	}{
+		{name: "empty", schedule: nil, volume: "500", tier: 0, maker: "0.25", taker: "0.25", next: ""},
+		{name: "first", schedule: schedule, volume: "500", tier: 1, maker: "0.1", taker: "0.2", next: "10000"},
+		{name: "reached", schedule: schedule, volume: "10000", tier: 2, maker: "0.08", taker: "0.15", next: "100000"},
+		{name: "top", schedule: schedule, volume: "250000", tier: 3, maker: "-0.01", taker: "0.1", next: ""},
+		{name: "below", schedule: schedule[1:], volume: "500", tier: 0, maker: "0.25", taker: "0.25", next: "10000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := pbprovider.ResponseFeeTier{Maker: "0.25", Taker: "0.25"}
+			tiers(&response, tt.schedule, decimal.Parse(tt.volume))
+
+			if response.GetTier() != tt.tier || response.GetMaker() != tt.maker || response.GetTaker() != tt.taker || response.GetNextVolume() != tt.next {
+				t.Errorf("tiers() = %v %v/%v next %v, want %v %v/%v next %v", response.GetTier(), response.GetMaker(), response.GetTaker(), response.GetNextVolume(), tt.tier, tt.maker, tt.taker, tt.next)
+			}
+		})
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		maker    string
+		taker    string
+		want     [2]string
+		override bool
+	}{
+		{name: "none", want: [2]string{"0.1", "0.2"}, override: false},
+		{name: "maker", maker: "0.000", want: [2]string{"0", "0.2"}, override: true},
+		{name: "taker", taker: "0.05", want: [2]string{"0.1", "0.05"}, override: true},
+		{name: "both", maker: "-0.02", taker: "0.05", want: [2]string{"-0.02", "0.05"}, override: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := pbprovider.ResponseFeeTier{Maker: "0.1", Taker: "0.2"}
+			overrides(&response, tt.maker, tt.taker)
+
+			if response.GetMaker() != tt.want[0] || response.GetTaker() != tt.want[1] || response.GetOverride() != tt.override {
+				t.Errorf("overrides() = %v/%v %v, want %v/%v %v", response.GetMaker(), response.GetTaker(), response.GetOverride(), tt.want[0], tt.want[1], tt.override)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/cryptogateway/backend-envoys/assets"
@@ -13,7 +14,7 @@ import (
 	"google.golang.org/grpc/status"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 )
 
@@ -21,18 +22,40 @@ type Service struct {
 	Context *assets.Context
 }
 
-// Initialization - The code initializes a Service object and runs six concurrent functions: chain(), price(), market().
+// executor - The executor interface is implemented by both *sql.DB and *sql.Tx. The settlement helpers accept it, so the same
+// code can write directly into the database or into a transaction that settles a whole fill atomically.
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Initialization - The code initializes a Service object, rebuilds the in-memory order books with restore(), the halted pairs
+// with restoreHalt() and the call auctions with restoreAuction(), and runs eleven concurrent functions: chain(), price(),
+// market(), margin(), valuation(), interest(), expire(), snapshot(), resume(), auction() and checkpoint().
 func (a *Service) Initialization() {
+	a.restore()
+	a.restoreHalt()
+	a.restoreAuction()
+
 	go a.chain()
 	go a.price()
 	go a.market()
+	go a.margin()
+	go a.valuation()
+	go a.interest()
+	go a.expire()
+	go a.snapshot()
+	go a.resume()
+	go a.auction()
+	go a.checkpoint()
 }
 
 // queryRatio - This function is used to calculate the ratio of a given base and quote. It takes in two strings, base and quote, as
 // parameters and returns a float64 representing the ratio and a boolean to indicate whether the ratio was successfully
 // calculated. It uses the GetCandles function to retrieve the last 2 candles and then calculates the ratio by taking the
 // difference between the first and second close prices and dividing it by the second close price.
-func (a *Service) queryRatio(base, quote string) (ratio float64, ok bool) {
+func (a *Service) queryRatio(base, quote string) (ratio decimal.Amount, ok bool) {
 
 	// This code is part of a function that is attempting to get the ratio of two different currencies. The code is
 	// attempting to get two candles from the e (which is an exchange) with the given base and quote units. If an error is
@@ -46,17 +69,19 @@ func (a *Service) queryRatio(base, quote string) (ratio float64, ok bool) {
 	// prices between the two Fields. The ratio is calculated by subtracting the closing price of the first Field from the
 	// closing price of the second Field, then dividing by the closing price of the second Field and multiplying by 100.
 	if len(migrate.Fields) == 2 {
-		ratio = ((migrate.Fields[0].Close - migrate.Fields[1].Close) / migrate.Fields[1].Close) * 100
+		if previous := decimal.Parse(migrate.Fields[1].GetClose()); !previous.IsZero() {
+			ratio = decimal.Parse(migrate.Fields[0].GetClose()).Sub(previous).DivRound(previous, 18).Mul(decimal.New(100).Amount())
+		}
 	}
 
 	return ratio, true
 }
 
 // queryPrice - This function is used to query a database for the price of a currency pair given the base and quote units. It takes
-// two parameters, base and quote, which are strings and returns a float value and a boolean. The function uses the
+// two parameters, base and quote, which are strings and returns the exact price and a boolean. The function uses the
 // QueryRow() method to execute the query, and the Scan() method to store the returned value in the price variable. If an
 // error occurs, the ok boolean is returned as false, otherwise it is returned as true.
-func (a *Service) queryPrice(base, quote string) (price float64, ok bool) {
+func (a *Service) queryPrice(base, quote string) (price decimal.Amount, ok bool) {
 
 	// This code is used to query and retrieve a price from a database. The "if err" statement is used to check for any
 	// errors that may occur during the query and retrieve process. If an error is encountered, the code will return the price and ok.
@@ -68,89 +93,178 @@ func (a *Service) queryPrice(base, quote string) (price float64, ok bool) {
 }
 
 // querySum - The purpose of this code is to calculate the final value of a given value after subtracting fees. It queries the
-// database for the corresponding currency's fees_trade and fees_discount columns, and checks the status of an order
-// based on an id. If the order is a maker order, the discount is subtracted from the fees. Finally, the actual value
-// after subtracting fees and the rounded value after subtracting fees are returned.
-func (a *Service) querySum(id int64, symbol string, value float64) (b, f float64, m bool, err error) {
-
-	// The purpose of this code is to declare three variables of different types: d is a float64, m is a boolean, and s is a
-	// types.Status. This can be used to assign values to these variables and use them in your program.
+// database for the corresponding currency's fees_trade and fees_discount columns, and the owner of an order based on an
+// id. The fee rate is the maker or the taker rate of the fee tier of the owner (queryTier), the asset rates are used
+// when the fee schedule is empty, in which case the discount is the maker rate. Whether the order is the maker of the
+// fill is decided by the matching engine, the resting order of the book is the maker and the incoming order the taker.
+// A negative maker rate is a rebate, so the value after the fees is larger than the given value. The value that remains
+// after the fees is truncated to the precision of the asset, and everything cut off is added to the fees, so the value
+// and the fees always add up exactly to the given value.
+func (a *Service) querySum(tx executor, id int64, symbol string, value decimal.Amount, maker bool) (b, f decimal.Amount, err error) {
+
+	// The purpose of this code is to declare the variables used by the calculation: d is the maker discount, r is the fee
+	// rate in percent and u is the owner of the order.
 	var (
-		d float64
-		s string
+		d, r decimal.Amount
+		u    int64
 	)
 
 	// This code is used to query a database for a particular record associated with the given symbol. It then scans the
-	// result and stores the values of the fees_trade and fees_discount columns in the variables fees and discount
-	// respectively. If an error occurs during the query, it returns the balance and fees variables.
-	if err := a.Context.Db.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", symbol).Scan(&f, &d); err != nil {
-		return b, f, m, err
+	// result and stores the values of the fees_trade and fees_discount columns in the variables r and d respectively. If an
+	// error occurs during the query, it returns the balance and fees variables.
+	if err := tx.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", symbol).Scan(&r, &d); err != nil {
+		return b, f, err
 	}
 
-	// The purpose of this code is to query a database for the status of an order based on the id and store the result in a
+	// The purpose of this code is to query a database for the owner of an order based on the id and store the result in a
 	// variable. If there is an error with the query, an error is returned.
-	if err := a.Context.Db.QueryRow("select status from orders where id = $1;", id).Scan(&s); err != nil {
-		return b, f, m, err
+	if err := tx.QueryRow("select user_id from orders where id = $1;", id).Scan(&u); err != nil {
+		return b, f, err
 	}
 
-	// This if statement assigns the boolean value true to the variable m if the variable s is equal to the constant
-	// types.Status_PENDING. This can be used to evaluate a condition or determine if a specific value is present in a given set.
-	if s == types.StatusPending {
-		m = true
+	// This code takes the fee tier of the owner of the order, and uses its maker rate for a maker order and its taker rate
+	// otherwise.
+	tier := a.queryTier(tx, u, r.Sub(d), r)
+	if maker {
+		r = decimal.Parse(tier.GetMaker())
+	} else {
+		r = decimal.Parse(tier.GetTaker())
 	}
 
-	// This code is checking if the variable "maker" is true, and if it is, it is subtracting the value of "discount" from
-	// "fees" and storing the result in "fees" as a float. This is likely being done to calculate a discounted fee for a maker order.
-	if m {
-		f = decimal.New(f).Sub(d).Float()
-	}
+	// The value after the fees is truncated to the precision of the asset, so it can be credited to the balance exactly, and
+	// the fees are the exact difference between the given value and the credited value.
+	b = value.Sub(value.Mul(r).Div(decimal.New(100).Amount())).Truncate(a.queryPrecision(symbol))
+	f = value.Sub(b)
 
-	// This code is used to calculate the final value of a given value after subtracting fees. The two return values
-	// represent the actual value after subtracting fees and the rounded value after subtracting fees.
-	return decimal.New(value).Sub(decimal.New(decimal.New(value).Mul(f).Float()).Div(100).Float()).Float(), decimal.New(value).Sub(decimal.New(value).Sub(decimal.New(decimal.New(value).Mul(f).Float()).Div(100).Float()).Float()).Float(), m, nil
+	return b, f, nil
 }
 
-// queryMarket - This function is used to get the market price for a given base and quote currency. It takes in the base, quote,
-// assigning (buy/sell), and current price as parameters. It then gets the current price from the getPrice() function
-// and, depending on the assigning, queries the database for either the minimum or maximum price that is greater than or
-// less than the current price and is in the pending status. Finally, it returns the market price.
-func (a *Service) queryMarket(base, quote, _type string, assigning string, price float64) float64 {
+// queryPrecision - This function returns the number of decimal places in which the balances of the given asset are kept. The
+// precision is the smallest number of decimals of the chains the asset is issued on (chains.decimals), limited by the
+// scale of the balances column. Assets without chains, for example stocks, use the scale of the balances column.
+func (a *Service) queryPrecision(symbol string) int32 {
 
+	// The scale of the numeric(32, 18) balances column is the highest precision a balance can be stored with.
 	var (
-		ok bool
+		precision int32 = 18
 	)
 
+	// This code takes the smallest decimals of all chains listed in the chains column of the asset. If the asset has no
+	// chains, the coalesce keeps the scale of the balances column.
+	_ = a.Context.Db.QueryRow("select coalesce(min(c.decimals), $2) from assets a inner join chains c on a.chains @> to_jsonb(c.id) where a.symbol = $1", symbol, precision).Scan(&precision)
+
+	if precision > 18 {
+		precision = 18
+	}
+
+	return precision
+}
+
+// queryDecimal - This function returns the number of decimal places of the base and the quote unit of the pair
+// (pairs.base_decimal, pairs.quote_decimal). The quantity of an order is kept in the precision of the base unit and the
+// price of an order in the precision of the quote unit. Cross orders use the precision of the spot pair.
+func (a *Service) queryDecimal(base, quote, _type string) (b, q int32, err error) {
+
+	// Convert TypeCross to TypeSpot, cross orders are placed on the spot pairs.
+	if _type == types.TypeCross {
+		_type = types.TypeSpot
+	}
+
+	// This code queries the precision of the pair, if the pair does not exist an error is returned.
+	if err := a.Context.Db.QueryRow("select base_decimal, quote_decimal from pairs where base_unit = $1 and quote_unit = $2 and type = $3", base, quote, _type).Scan(&b, &q); err != nil {
+		return b, q, status.Errorf(11585, "this pair %v-%v does not exist", base, quote)
+	}
+
+	return b, q, nil
+}
+
+// queryMarket - This function is used to get the market price for a given base and quote currency. It takes in the base, quote,
+// assigning (buy/sell), and current price as parameters. It then gets the current price from the getPrice() function
+// and, depending on the assigning, takes the best price of the opposite side of the in-memory order book: the lowest ask
+// for a buy order and the highest bid for a sell order. If the opposite side is empty, the price of the pair is returned.
+func (a *Service) queryMarket(base, quote, _type string, assigning string) (price decimal.Amount) {
+
 	// This code is checking for the existence of a price by attempting to get it from e.queryPrice(), which takes in two
-	// parameters, base and quote. If the price exists (indicated by the ok return value), then it will be returned. If the
-	// price does not exist (indicated by the !ok return value), then it will not be returned.
-	if price, ok = a.queryPrice(base, quote); !ok {
+	// parameters, base and quote. If the price does not exist (indicated by the !ok return value), then zero is returned.
+	price, ok := a.queryPrice(base, quote)
+	if !ok {
 		return price
 	}
 
+	// The book of the pair is locked while the best price is read, so the price is taken from a consistent state of the book.
+	book := a.queryBook(base, quote, _type)
+	book.Lock()
+	defer book.Unlock()
+
 	// The switch statement is used to evaluate an expression and determine which statement should be executed based on the
 	// value of the expression. The switch statement assigns the expression to a variable called assigning, which is then
 	// used to make the determination of which statement to execute.
 	switch assigning {
 	case types.AssigningBuy:
 
-		// The purpose of this code is to query the database for the minimum price of a particular order that has a specific
-		// assigning, base unit, quote unit, price, and status. The result is then stored in the variable 'price'.
-		_ = a.Context.Db.QueryRow("select min(price) as price from orders where assigning = $1 and base_unit = $2 and quote_unit = $3 and price >= $4 and status = $5 and type = $6", types.AssigningSell, base, quote, price, types.StatusPending, _type).Scan(&price)
+		// The purpose of this code is to take the lowest price of the resting sell orders, which is the best price a buy order can get.
+		if item := book.best(types.AssigningSell); item != nil {
+			price = decimal.Parse(item.GetPrice())
+		}
 
 	case types.AssigningSell:
 
-		// The purpose of this code is to query a database for the maximum price from orders that meet certain criteria
-		// (assigning, base unit, quote unit, price and status) and scan the result into the variable "price".
-		_ = a.Context.Db.QueryRow("select max(price) as price from orders where assigning = $1 and base_unit = $2 and quote_unit = $3 and price <= $4 and status = $5 and type = $6", types.AssigningBuy, base, quote, price, types.StatusPending, _type).Scan(&price)
+		// The purpose of this code is to take the highest price of the resting buy orders, which is the best price a sell order can get.
+		if item := book.best(types.AssigningBuy); item != nil {
+			price = decimal.Parse(item.GetPrice())
+		}
 	}
 
 	return price
 }
 
+// querySweep - This function prices a market order by walking the opposite side of the book of the pair. The slippage is a
+// percentage of the best opposite price, it defines the worst price the order can be filled at, zero means no limit.
+// It returns the quantity the order can take within the limit, which for a buy order is the quantity its quote amount
+// pays for, the price of the worst order reached, which is used as the price of the order, and the rest of the amount
+// that the book can not take within the limit.
+func (a *Service) querySweep(base, quote, _type, assigning string, userId int64, amount, slippage decimal.Amount) (quantity, price, rest decimal.Amount) {
+
+	var (
+		opposite string
+		limit    = types.Order{Assigning: assigning, UserId: userId}
+	)
+
+	switch assigning {
+	case types.AssigningBuy:
+		opposite = types.AssigningSell
+	case types.AssigningSell:
+		opposite = types.AssigningBuy
+	}
+
+	// The book of the pair is locked while it is walked, so the quantity and the price are taken from a consistent state of the book.
+	book := a.queryBook(base, quote, _type)
+	book.Lock()
+	defer book.Unlock()
+
+	best := book.best(opposite)
+	if best == nil {
+		return quantity, price, amount
+	}
+
+	// The limit price is the best price moved by the slippage against the user: up for a buy order, down for a sell order.
+	if slippage.IsPositive() {
+
+		move := decimal.Parse(best.GetPrice()).Mul(slippage).Div(decimal.New(100).Amount())
+		if assigning == types.AssigningBuy {
+			limit.Price = decimal.Parse(best.GetPrice()).Add(move).String()
+		} else {
+			limit.Price = decimal.Parse(best.GetPrice()).Sub(move).String()
+		}
+	}
+
+	return book.sweep(&limit, opposite, amount)
+}
+
 // queryRange - This function is used to retrieve the minimum and maximum trade value of a given currency symbol from a database and
 // to check if a given value is within the range. If the given value is within the range, it will return the min and max
 // trade values, as well as a boolean value indicating whether the given value is within the range.
-func (a *Service) queryRange(symbol string, value float64) (min, max float64, ok bool) {
+func (a *Service) queryRange(symbol string, value decimal.Amount) (min, max decimal.Amount, ok bool) {
 
 	// This if statement is used to query a database for a row containing the min_trade and max_trade columns for the
 	// currency with the symbol given as an argument. If the query is successful, the values for min_trade and max_trade are
@@ -161,7 +275,7 @@ func (a *Service) queryRange(symbol string, value float64) (min, max float64, ok
 
 	// This statement is checking to see if a given value is within a minimum and maximum range. If the value is between the
 	// min and max values, then the function returns the min and max values, along with a boolean value of true.
-	if value >= min && value <= max {
+	if value.GreaterThanOrEqual(min) && value.LessThanOrEqual(max) {
 		return min, max, true
 	}
 
@@ -172,16 +286,15 @@ func (a *Service) queryRange(symbol string, value float64) (min, max float64, ok
 // cross-trade or not. The function takes in the assigning (buy or sell), the quantity, the price, and a boolean value to
 // check if it is a cross-trade. If it is a cross-trade, the function will divide the quantity by the price. Otherwise,
 // it will multiply the quantity by the price. The function then returns the calculated quantity.
-func (a *Service) queryQuantity(assigning string, quantity, price float64, cross bool) float64 {
+func (a *Service) queryQuantity(assigning string, quantity, price decimal.Amount, cross bool) decimal.Amount {
 
 	if cross {
 
 		// The purpose of this code is to calculate the quantity of an item by dividing it by its price. This switch statement
-		// checks the assigning value to make sure it is set to "BUY", and then uses the decimal.New() method to divide the
-		// quantity by the price and convert it to a float.
+		// checks the assigning value to make sure it is set to "BUY", and then divides the quantity by the price.
 		switch assigning {
 		case types.AssigningBuy:
-			quantity = decimal.New(quantity).Div(price).Float()
+			quantity = quantity.Div(price)
 		}
 
 		return quantity
@@ -193,7 +306,7 @@ func (a *Service) queryQuantity(assigning string, quantity, price float64, cross
 		// purchase.
 		switch assigning {
 		case types.AssigningSell:
-			quantity = decimal.New(quantity).Mul(price).Float()
+			quantity = quantity.Mul(price)
 		}
 
 		return quantity
@@ -203,14 +316,15 @@ func (a *Service) queryQuantity(assigning string, quantity, price float64, cross
 // queryValidateOrder - This function is a helper function for placing orders in a Spot trading service. It performs checks on the order
 // before it is submitted, such as checking the price is not 0, checking the user has enough funds to cover the order,
 // and ensuring the quantity of the order is within the predetermined range. If any of these checks fail, an error is
-// returned. Otherwise, the order is accepted and the quantity is returned.
-func (a *Service) queryValidateOrder(order *types.Order) (summary float64, err error) {
-
-	// This code checks if the order's price is 0, and if it is, it returns an error message (65790) with the impossible
-	// price that is being requested. This helps to identify errors in the order's price and allows for more accurate
-	// debugging of the program.
-	if order.GetPrice() == 0 {
-		return 0, status.Errorf(65790, "impossible price %v", order.GetPrice())
+// returned. Otherwise, the order is accepted and the quantity is returned. The balance is read through the given
+// executor and its row stays locked until the transaction that reserves the quantity ends.
+func (a *Service) queryValidateOrder(tx executor, order *types.Order) (summary decimal.Amount, err error) {
+
+	// This code checks if the order's price is 0 or negative, and if it is, it returns an error message (65790) with the
+	// impossible price that is being requested. This helps to identify errors in the order's price and allows for more
+	// accurate debugging of the program.
+	if !decimal.Parse(order.GetPrice()).IsPositive() {
+		return summary, status.Errorf(65790, "impossible price %v", order.GetPrice())
 	}
 
 	// This switch statement is used to check the value of the GetAssigning() method on the order object. Depending on the
@@ -221,27 +335,32 @@ func (a *Service) queryValidateOrder(order *types.Order) (summary float64, err e
 		// The purpose of this code is to calculate the total cost of an order, given the quantity and price of a product. The
 		// code uses the decimal library to get the quantity and price of the order, and then multiplies them together to
 		// calculate the total cost.
-		quantity := decimal.New(order.GetQuantity()).Mul(order.GetPrice()).Float()
+		quantity := decimal.Parse(order.GetQuantity()).Mul(decimal.Parse(order.GetPrice()))
+
+		// A market buy order reserves its budget, the quote amount the user has asked to spend.
+		if budget := order.GetBudget(); len(budget) > 0 {
+			quantity = decimal.Parse(budget)
+		}
 
 		// This code is checking the range of a given quantity, and returning an error if the quantity is not within the
 		// specified range. The min and max variables represent the minimum and maximum values of the quantity, while the ok
 		// variable indicates whether the range is valid. If the range is invalid, the code will return an error with a message
 		// containing the minimum and maximum values.
 		if min, max, ok := a.queryRange(order.GetQuoteUnit(), quantity); !ok {
-			return 0, status.Errorf(11623, "[quote]: minimum trading amount: %v~%v, maximum trading amount: %v", min, strconv.FormatFloat(decimal.New(min).Mul(2).Float(), 'f', -1, 64), strconv.FormatFloat(max, 'f', -1, 64))
+			return summary, status.Errorf(11623, "[quote]: minimum trading amount: %v~%v, maximum trading amount: %v", min, min.Mul(decimal.New(2).Amount()), max)
 		}
 
 		// This line of code is used to get the balance of the user in a given quote unit. It is used to determine the amount
 		// of funds available to the user for a particular order. The getBalance() method takes in two parameters, the quote
 		// unit and the user id, and returns the balance for the user in the specified quote unit.
-		balance := a.QueryBalance(order.GetQuoteUnit(), order.GetType(), order.GetUserId())
+		balance := a.queryBalance(tx, order.GetQuoteUnit(), order.GetType(), order.GetUserId())
 
 		// This statement is an if-statement that is used to check if the quantity is greater than the balance or if the
 		// order's quantity is equal to 0. If either of these conditions are true, then the statement will return a value of 0,
 		// along with an error message. The purpose of this statement is to ensure that a user does not place an order with
 		// insufficient funds and to inform them if they have attempted to do so.
-		if quantity > balance || order.GetQuantity() == 0 {
-			return 0, status.Error(11586, "[quote]: there is not enough funds on your asset balance to place an order")
+		if quantity.GreaterThan(balance) || !decimal.Parse(order.GetQuantity()).IsPositive() {
+			return summary, status.Error(11586, "[quote]: there is not enough funds on your asset balance to place an order")
 		}
 
 		return quantity, nil
@@ -249,30 +368,30 @@ func (a *Service) queryValidateOrder(order *types.Order) (summary float64, err e
 	case types.AssigningSell:
 
 		// This statement retrieves the quantity of an order from the order object and assigns it to the variable "quantity".
-		quantity := order.GetQuantity()
+		quantity := decimal.Parse(order.GetQuantity())
 
 		// This code is checking to see if the order's base unit and quantity meet a certain minimum and maximum trading
 		// amount. If the order does not meet the requirements, an error is returned with a message that states the minimum and
 		// maximum trading amounts.
-		if min, max, ok := a.queryRange(order.GetBaseUnit(), order.GetQuantity()); !ok {
-			return 0, status.Errorf(11587, "[base]: minimum trading amount: %v~%v, maximum trading amount: %v", min, strconv.FormatFloat(decimal.New(min).Mul(2).Float(), 'f', -1, 64), strconv.FormatFloat(max, 'f', -1, 64))
+		if min, max, ok := a.queryRange(order.GetBaseUnit(), quantity); !ok {
+			return summary, status.Errorf(11587, "[base]: minimum trading amount: %v~%v, maximum trading amount: %v", min, min.Mul(decimal.New(2).Amount()), max)
 		}
 
 		// The purpose of this code is to get the balance of the user from the order object. The order object contains the base
 		// unit and the userId of the user, which are used to call the getBalance() method of the e object to get the balance.
-		balance := a.QueryBalance(order.GetBaseUnit(), order.GetType(), order.GetUserId())
+		balance := a.queryBalance(tx, order.GetBaseUnit(), order.GetType(), order.GetUserId())
 
 		// This code is testing whether the quantity of an order is greater than the balance of the asset used to place the
 		// order. If the quantity is greater than the balance or the order quantity is 0, it will return an error message
 		// indicating that there is not enough funds on the asset balance to place the order.
-		if quantity > balance || order.GetQuantity() == 0 {
-			return 0, status.Error(11624, "[base]: there is not enough funds on your asset balance to place an order")
+		if quantity.GreaterThan(balance) || !quantity.IsPositive() {
+			return summary, status.Error(11624, "[base]: there is not enough funds on your asset balance to place an order")
 		}
 
 		return quantity, nil
 	}
 
-	return 0, status.Error(11596, "invalid input parameter")
+	return summary, status.Error(11596, "invalid input parameter")
 }
 
 // queryValidatePair - checks if a pair with given base and quote unit, and type exists in the DB. If not, an error is returned.
@@ -308,10 +427,21 @@ func (a *Service) queryOrder(id int64) *types.Order {
 	// This code is used to query a database for a single row of data matching the specified criteria (in this case, the "id
 	// = $1" condition) and then assign the returned values to the specified variables (in this case, the fields of the
 	// "order" struct). This allows the program to retrieve data from the database and store it in a convenient and organized format.
-	_ = a.Context.Db.QueryRow("select id, value, quantity, price, assigning, user_id, base_unit, quote_unit, status, create_at from orders where id = $1", id).Scan(&order.Id, &order.Value, &order.Quantity, &order.Price, &order.Assigning, &order.UserId, &order.BaseUnit, &order.QuoteUnit, &order.Status, &order.CreateAt)
+	_ = a.Context.Db.QueryRow("select id, value, quantity, price, assigning, user_id, base_unit, quote_unit, status, display, hidden, create_at from orders where id = $1", id).Scan(&order.Id, &order.Value, &order.Quantity, &order.Price, &order.Assigning, &order.UserId, &order.BaseUnit, &order.QuoteUnit, &order.Status, &order.Display, &order.Hidden, &order.CreateAt)
 	return &order
 }
 
+// writePublish - This function publishes the order to the given topic of the exchange. The channels are public, so the order is
+// masked first: a hidden order is not published at all and an iceberg order is published with its current slice only.
+func (a *Service) writePublish(order *types.Order, topic string) error {
+
+	if order = masked(order); order == nil {
+		return nil
+	}
+
+	return a.Context.Publish(order, "exchange", topic)
+}
+
 // writeAsset - This function is used to set a new asset for a given user. It takes in three parameters - a string symbol to identify
 // the asset, an int64 userId to identify the user, and a boolean error indicating whether an error should be returned if
 // the asset already exists. The function checks if the asset already exists in the database, and if it does not exist,
@@ -352,75 +482,395 @@ func (a *Service) writeAsset(symbol, _type string, userId int64, error bool) err
 }
 
 // writeOrder - This function is used to set an order in the database. It takes in a pointer to a types.Order which contains the
-// order's details, and inserts the data into the 'orders' table. It then returns the id of the newly created order and any potential errors.
-func (a *Service) writeOrder(order *types.Order) (id int64, err error) {
+// order's details, and inserts the data into the 'orders' table through the given executor. It then returns the id of the newly created order and any potential errors.
+func (a *Service) writeOrder(tx executor, order *types.Order) (id int64, err error) {
+
+	var (
+		expire interface{}
+	)
+
+	// Only a good-till-date order has an expiration time, the other orders are stored without it.
+	if len(order.GetExpireAt()) > 0 {
+		expire = order.GetExpireAt()
+	}
 
-	if err := a.Context.Db.QueryRow("insert into orders (assigning, base_unit, quote_unit, price, value, quantity, user_id, type, trading) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id", order.GetAssigning(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPrice(), order.GetQuantity(), order.GetValue(), order.GetUserId(), order.GetType(), order.GetTrading()).Scan(&id); err != nil {
+	// An order placed without a time in force rests in the book until it is filled or canceled.
+	if len(order.GetTimeInForce()) == 0 {
+		order.TimeInForce = types.TimeInForceGTC
+	}
+
+	// An order placed without a self-trade prevention mode is canceled when it would be matched with an order of the same user.
+	if len(order.GetSelfTrade()) == 0 {
+		order.SelfTrade = types.SelfTradeCancelNewest
+	}
+
+	if err := tx.QueryRow("insert into orders (assigning, base_unit, quote_unit, price, value, quantity, user_id, type, trading, trigger, status, time_in_force, expire_at, self_trade, display, hidden, trailing_offset, trailing_percent, watermark) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19) returning id", order.GetAssigning(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetPrice(), order.GetQuantity(), order.GetValue(), order.GetUserId(), order.GetType(), order.GetTrading(), decimal.Parse(order.GetTrigger()), order.GetStatus(), order.GetTimeInForce(), expire, order.GetSelfTrade(), decimal.Parse(order.GetDisplay()), order.GetHidden(), decimal.Parse(order.GetTrailingOffset()), order.GetTrailingPercent(), decimal.Parse(order.GetWatermark())).Scan(&id); err != nil {
 		return id, err
 	}
 
 	return id, nil
 }
 
+// writeOpen - This function places the order into the database and reserves its amount: the quote amount of a buy order and the
+// base quantity of a sell order. The balance is checked, the order is inserted and the amount is taken from the balance
+// in one transaction, which locks the balance row first, so two orders placed at the same time can never both spend the
+// same balance, and an order is never stored without its amount being reserved.
+func (a *Service) writeOpen(order *types.Order) error {
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	quantity, err := a.queryValidateOrder(tx, order)
+	if err != nil {
+		return err
+	}
+
+	if order.Id, err = a.writeOrder(tx, order); err != nil {
+		return err
+	}
+
+	symbol := order.GetQuoteUnit()
+	if order.GetAssigning() == types.AssigningSell {
+		symbol = order.GetBaseUnit()
+	}
+
+	if err := a.writeBalance(tx, symbol, order.GetType(), order.GetUserId(), quantity, types.BalanceMinus); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// writeCancel - This function is used to cancel a pending order. The book of the pair is locked, so the order cannot be matched
+// while it is being cancelled. The order is removed from the book, and the remaining value is taken from the book,
+// because the order might have been partially filled after it was read from the database. The status of the order and
+// the refund of the remaining value are written in one transaction, and the canceled order is published. A waiting
+// conditional order is not in the book, its whole value is refunded, unless it has been activated in the meantime.
+func (a *Service) writeCancel(item *types.Order) error {
+
+	book := a.queryBook(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+	book.Lock()
+	defer a.release(book)
+
+	// The status the order is expected to have in the database, a waiting conditional order is not in the book.
+	state := types.StatusPending
+
+	// If the order is no longer in the book, it has already been filled or canceled.
+	if item.GetStatus() == types.StatusWaiting {
+		state = types.StatusWaiting
+	} else if order := book.remove(item.GetId()); order != nil {
+		item.Value = order.GetValue()
+	} else {
+		return status.Error(11538, "the requested order does not exist")
+	}
+
+	return a.writeRefund(item, state, types.StatusCancel)
+}
+
+// writeRefund - This function closes an order that is not in the book with the given status and returns its remaining value to the
+// balance of the user. The status of the order is only changed from the expected state, so an order that has been
+// filled, canceled or activated in the meantime is not refunded twice. The status and the refund are written in one
+// transaction, and the closed order is published to the "order/cancel" channel. The book is not locked here, the
+// caller either holds the lock of the book or the order has never been in it.
+func (a *Service) writeRefund(item *types.Order, state, _status string) error {
+
+	// The transaction is started before anything is written, so the order is never canceled without being refunded.
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The purpose of the code is to update the status of an order for a particular user in the database. It takes three
+	// parameters: the ID of the order, the user ID, and the new status for the order. If the execution of the SQL query
+	// fails, an error is returned.
+	result, err := tx.Exec("update orders set status = $3 where id = $1 and user_id = $2 and status = $4;", item.GetId(), item.GetUserId(), _status, state)
+	if err != nil {
+		return err
+	}
+
+	// The status of the order is checked by the update itself, a waiting order that has just been activated is not
+	// canceled here, it is already in the book.
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return status.Error(11538, "the requested order does not exist")
+	}
+
+	// Only a pending order has been accepted by the engine, its cancel is written to the journal.
+	if state == types.StatusPending {
+		if _, err := a.writeJournal(tx, journalCancel, item, 0, decimal.Zero, decimal.Zero); err != nil {
+			return err
+		}
+	}
+
+	// The switch statement is used to compare the value of a variable (in this case, item.Assigning) to a list of possible
+	// values. If the value matches one of the values in the list, a specific action will be executed.
+	switch item.GetAssigning() {
+	case types.AssigningBuy:
+
+		// This code is setting the balance of a user for a given item. It is using the item's quote unit, user id, value and
+		// price to calculate the new balance and then updating the balance using the types.Balance_PLUS parameter. If there
+		// is an error setting the balance, an error is returned. A market buy order returns what is left of its budget.
+		refund := decimal.Parse(item.GetValue()).Mul(decimal.Parse(item.GetPrice()))
+		if budget := item.GetBudget(); len(budget) > 0 {
+			refund = decimal.Parse(budget)
+		}
+
+		if err := a.writeBalance(tx, item.GetQuoteUnit(), item.GetType(), item.GetUserId(), refund, types.BalancePlus); err != nil {
+			return err
+		}
+
+	case types.AssigningSell:
+
+		// This code is used to set a balance for a user in a particular base unit. The "if err" statement is used to check if
+		// there is an error when setting the balance. If there is an error, the code will return an error message.
+		if err := a.writeBalance(tx, item.GetBaseUnit(), item.GetType(), item.GetUserId(), decimal.Parse(item.GetValue()), types.BalancePlus); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	item.Status = _status
+
+	// This code is intended to publish an item to an exchange with the routing key "order/cancel". If any errors occur
+	// while attempting to publish the item, the error is returned.
+	if err := a.writePublish(item, "order/cancel"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeCancelAll - This function cancels the given orders of a user at once. The books of all pairs of the orders are locked in
+// the order of their keys, so no order can be matched while the orders are being canceled and two callers can never
+// wait for each other. The statuses of all orders and the refunds are written in one transaction, the refunds are
+// summed up per asset, so every balance is changed only once. The orders that have been filled, canceled or activated
+// in the meantime are skipped. The function returns the canceled orders.
+func (a *Service) writeCancelAll(userId int64, orders []*types.Order) ([]*types.Order, error) {
+
+	var (
+		canceled []*types.Order
+		keys     []string
+		symbols  []string
+		pairs    = make(map[string]*book)
+		refunds  = make(map[string]decimal.Amount)
+	)
+
+	for _, item := range orders {
+		key := item.GetBaseUnit() + "/" + item.GetQuoteUnit() + "/" + item.GetType()
+		if _, ok := pairs[key]; !ok {
+			pairs[key] = a.queryBook(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		pairs[key].Lock()
+		defer a.release(pairs[key])
+	}
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, item := range orders {
+
+		// The remaining value of a pending order is taken from the book, a waiting conditional order is not in the book.
+		state := types.StatusPending
+		if item.GetStatus() == types.StatusWaiting {
+			state = types.StatusWaiting
+		} else if order := pairs[item.GetBaseUnit()+"/"+item.GetQuoteUnit()+"/"+item.GetType()].find(item.GetId()); order != nil {
+			item.Value = order.GetValue()
+		} else {
+			continue
+		}
+
+		result, err := tx.Exec("update orders set status = $3 where id = $1 and user_id = $2 and status = $4;", item.GetId(), userId, types.StatusCancel, state)
+		if err != nil {
+			return nil, err
+		}
+
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			continue
+		}
+
+		if state == types.StatusPending {
+			if _, err := a.writeJournal(tx, journalCancel, item, 0, decimal.Zero, decimal.Zero); err != nil {
+				return nil, err
+			}
+		}
+
+		// The refund is the quote amount of a buy order and the base amount of a sell order, summed up per asset and type.
+		switch item.GetAssigning() {
+		case types.AssigningBuy:
+			refunds[item.GetQuoteUnit()+"/"+item.GetType()] = refunds[item.GetQuoteUnit()+"/"+item.GetType()].Add(decimal.Parse(item.GetValue()).Mul(decimal.Parse(item.GetPrice())))
+		case types.AssigningSell:
+			refunds[item.GetBaseUnit()+"/"+item.GetType()] = refunds[item.GetBaseUnit()+"/"+item.GetType()].Add(decimal.Parse(item.GetValue()))
+		}
+
+		canceled = append(canceled, item)
+	}
+
+	// The balances are written in the order of their keys, so two transactions always lock the balances in the same order.
+	for symbol := range refunds {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		part := strings.SplitN(symbol, "/", 2)
+		if err := a.writeBalance(tx, part[0], part[1], userId, refunds[symbol], types.BalancePlus); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The canceled orders are removed from the books only after the commit, the books are still locked.
+	for _, item := range canceled {
+		if item.GetStatus() != types.StatusWaiting {
+			pairs[item.GetBaseUnit()+"/"+item.GetQuoteUnit()+"/"+item.GetType()].remove(item.GetId())
+		}
+		item.Status = types.StatusCancel
+	}
+
+	return canceled, nil
+}
+
+// writeDecrement - This function decreases the remaining value of a pending order by the given value and returns the decreased
+// part to the balance of the user, the same way as a cancellation returns the whole remaining value. It is used by the
+// decrement-and-cancel self-trade prevention mode, the order stays in the book with the smaller value and the new
+// value is published to the "order/status" channel.
+func (a *Service) writeDecrement(item *types.Order, value decimal.Amount) error {
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("update orders set value = value - $2 where id = $1 and status = $3;", item.GetId(), value, types.StatusPending); err != nil {
+		return err
+	}
+
+	if _, err := a.writeJournal(tx, journalDecrement, item, 0, value, decimal.Zero); err != nil {
+		return err
+	}
+
+	switch item.GetAssigning() {
+	case types.AssigningBuy:
+
+		// The budget of a market buy order is not tied to its quantity, it stays reserved and is returned at the end.
+		if len(item.GetBudget()) > 0 {
+			break
+		}
+
+		if err := a.writeBalance(tx, item.GetQuoteUnit(), item.GetType(), item.GetUserId(), value.Mul(decimal.Parse(item.GetPrice())), types.BalancePlus); err != nil {
+			return err
+		}
+	case types.AssigningSell:
+		if err := a.writeBalance(tx, item.GetBaseUnit(), item.GetType(), item.GetUserId(), value, types.BalancePlus); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	item.Value = decimal.Parse(item.GetValue()).Sub(value).String()
+
+	if err := a.writePublish(item, "order/status"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // writeTrade - The purpose of this code is to set a trade by converting a given value to a decimal number multiplied by a given
-// price, get the sum of a given order, symbol, and value, insert the data into a database, update the "fees_charges"
-// column in the "currencies" table in a database, and publish a particular order to an exchange.
-func (a *Service) writeTrade(id int64, symbol string, value, price float64, convert bool) (float64, error) {
+// price, get the sum of a given order, symbol, and value, insert the data into a database and update the "fees_charges"
+// column in the "assets" table. If the owner of the order pays the fees in the platform asset, the fee is charged from
+// that balance instead (writePlatform) and the whole value is credited, the asset of the fee is kept in the trade
+// (trades.fees_unit). All statements are executed through the given executor, which is the transaction of the
+// fill, so the trade and the fee accrual are committed or rolled back together with the orders and the balances. The
+// maker flag tells whether the order is the resting order of the fill.
+func (a *Service) writeTrade(tx executor, id int64, symbol string, value, price decimal.Amount, sequence int64, convert, maker bool) (decimal.Amount, error) {
 
 	// The purpose of this code is to retrieve an order from a database, given its ID. The variable 'order' will store the
 	// order object that is returned from the queryOrder() method.
 	order := a.queryOrder(id)
-	order.Value = value
+	order.Value = value.String()
 
-	// This code is used to convert a given value to a decimal number multiplied by a given price. The result is then stored
-	// as a floating point number. This is likely used for some kind of financial calculation or to convert a given value to
-	// a currency amount.
+	// This code is used to convert a given value to the quote amount by multiplying it by the given price. The product of two
+	// exact amounts is exact, so no rounding happens here.
 	if convert {
-		value = decimal.New(value).Mul(price).Float()
+		value = value.Mul(price)
 	}
 
 	// This code is attempting to get the sum of a given order, symbol and value. The variables s and f are used to store
 	// the sum and any error encountered, respectively. The if statement checks for any errors that may have occurred and
 	// returns 0 and the error if one is encountered.
-	s, f, maker, err := a.querySum(id, symbol, value)
+	s, f, err := a.querySum(tx, id, symbol, value, maker)
 	if err != nil {
-		return 0, err
+		return s, err
+	}
+
+	// The fee is paid in the platform asset if the owner of the order has chosen so and the balance covers it, the value
+	// is then credited without any deduction.
+	if f.IsPositive() {
+
+		charged, platform, ok, err := a.writePlatform(tx, order, symbol, f)
+		if err != nil {
+			return s, err
+		}
+
+		if ok {
+
+			order.Fees = charged.String()
+
+			if _, err := tx.Exec(`insert into trades (order_id, assigning, user_id, base_unit, quote_unit, quantity, fees, fees_unit, price, maker, sequence) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`, order.GetId(), order.GetAssigning(), order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetValue(), order.GetFees(), platform, price, maker, sequence); err != nil {
+				return s, err
+			}
+
+			return value, nil
+		}
 	}
 
 	// This code is used to calculate the fee for an order based on the assigned type. If the order is assigned to be a
 	// SELL, the fee is calculated by dividing the fee (f) by the price. If the order is assigned to be something else, the
-	// fee is simply set to be f.
+	// fee is simply set to be f. Either way the fee is kept in the base unit.
 	if order.GetAssigning() == types.AssigningSell {
-		order.Fees = decimal.New(f).Div(price).Float()
+		order.Fees = f.DivRound(price, 18).String()
 	} else {
-		order.Fees = f
+		order.Fees = f.String()
 	}
 
 	// This code is used to insert data into the "transfers" table in a database using the parameters provided in the array
 	// "param". The code first checks for any errors in the insertion process, and if there are any, it will return an error.
-	if _, err := a.Context.Db.Exec(`insert into trades (order_id, assigning, user_id, base_unit, quote_unit, quantity, fees, price, maker) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, order.GetId(), order.GetAssigning(), order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetValue(), order.GetFees(), price, maker); err != nil {
-		return 0, err
+	if _, err := tx.Exec(`insert into trades (order_id, assigning, user_id, base_unit, quote_unit, quantity, fees, fees_unit, price, maker, sequence) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`, order.GetId(), order.GetAssigning(), order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetValue(), order.GetFees(), order.GetBaseUnit(), price, maker, sequence); err != nil {
+		return s, err
 	}
 
-	// This statement is checking to see if the value of the parameter at index i in the param array is greater than 0. If
-	// it is, then the code within the if statement will be executed. This is likely being used to check if a fee is
-	// associated with the parameter at index i.
-	if f > 0 {
+	// This statement is checking to see if a fee is associated with the trade. A negative fee is a maker rebate, which is
+	// paid out of the charged fees of the asset.
+	if !f.IsZero() {
 
 		// This code is updating the "fees_charges" column in the "currencies" table in a database. The "symbol" and
 		// "fee" are parameters that are passed into the statement. If an error occurs during the
 		// execution of the statement, the function will return the error.
-		if _, err := a.Context.Db.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", symbol, f); err != nil {
-			return 0, err
+		if _, err := tx.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", symbol, f); err != nil {
+			return s, err
 		}
 	}
 
-	// The purpose of the code snippet is to publish a particular order to an exchange with the routing key "order/status".
-	// The if statement checks for any errors encountered while publishing the order, and returns an error if one occurs.
-	if err := a.Context.Publish(a.queryOrder(order.GetId()), "exchange", "order/status"); err != nil {
-		return 0, err
-	}
-
 	return s, nil
 }
 
@@ -432,6 +882,7 @@ func (a *Service) QueryPair(id int64, _type string, status bool) (*types.Pair, e
 
 	var (
 		chain types.Pair
+		price decimal.Amount
 		maps  []string
 	)
 
@@ -449,17 +900,27 @@ func (a *Service) QueryPair(id int64, _type string, status bool) (*types.Pair, e
 	// This code is used to query a database and retrieve information about a pair with a specified id. The query is formed
 	// using the fmt.Sprintf() function, and it is a combination of a string and the id parameter. The retrieved information
 	// is then assigned to the chain struct. Finally, the code returns the chain struct and an error if it fails.
-	if err := a.Context.Db.QueryRow(fmt.Sprintf("select id, base_unit, quote_unit, price, base_decimal, quote_decimal, status from pairs where id = %[1]d %[2]s", id, strings.Join(maps, " "))).Scan(
+	if err := a.Context.Db.QueryRow(fmt.Sprintf("select id, base_unit, quote_unit, price, base_decimal, quote_decimal, tick_size, step_size, min_notional, max_orders, band, band_window, halt_duration, halt, auction_duration, status from pairs where id = %[1]d %[2]s", id, strings.Join(maps, " "))).Scan(
 		&chain.Id,
 		&chain.BaseUnit,
 		&chain.QuoteUnit,
-		&chain.Price,
+		&price,
 		&chain.BaseDecimal,
 		&chain.QuoteDecimal,
+		&chain.TickSize,
+		&chain.StepSize,
+		&chain.MinNotional,
+		&chain.MaxOrders,
+		&chain.Band,
+		&chain.BandWindow,
+		&chain.HaltDuration,
+		&chain.Halt,
+		&chain.AuctionDuration,
 		&chain.Status,
 	); err != nil {
 		return &chain, err
 	}
+	chain.Price = price.String()
 
 	return &chain, nil
 }
@@ -478,7 +939,7 @@ func (a *Service) QueryAddress(userId int64, platform string) (address string) {
 
 // QueryBalance - This function is used to query the balance of a user's assets by symbol. It takes a symbol and userID as parameters
 // and queries the assets table in the database for the balance associated with that symbol and userID, then returns the balance.
-func (a *Service) QueryBalance(symbol, _type string, userId int64) (balance float64) {
+func (a *Service) QueryBalance(symbol, _type string, userId int64) (balance decimal.Amount) {
 
 	// This line of code is used to retrieve the balance from the assets table in a database. It takes in two parameters
 	// (symbol and userId) and uses them to query the database. The result is then stored in the variable balance.
@@ -486,6 +947,13 @@ func (a *Service) QueryBalance(symbol, _type string, userId int64) (balance floa
 	return balance
 }
 
+// queryBalance - This function does the same as QueryBalance, but reads the balance through the given executor and locks its row,
+// so inside a transaction the balance can not be changed by anybody else until the transaction ends.
+func (a *Service) queryBalance(tx executor, symbol, _type string, userId int64) (balance decimal.Amount) {
+	_ = tx.QueryRow("select value as balance from balances where symbol = $1 and user_id = $2 and type = $3 for update", symbol, userId, _type).Scan(&balance)
+	return balance
+}
+
 // QueryAsset - This function is used to retrieve asset information from a database. It takes a currency symbol and a status
 // boolean as arguments. It then queries the database to retrieve information about the currency and stores it in the
 // 'response' variable. It then checks for the existence of the asset icon and stores the result in the 'icon' field
@@ -508,7 +976,7 @@ func (a *Service) QueryAsset(symbol string, status bool) (*types.Asset, error) {
 	// This code is performing a query of a database table called "currencies" and scanning the results into a response
 	// object. The query is using the symbol parameter to filter the results and strings.Join(maps, " ") to join any
 	// additional parameters. If the query fails, an error is returned.
-	if err := a.Context.Db.QueryRow(fmt.Sprintf(`select id, name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, fees_charges, fees_costs, marker, status, "group", type, create_at, chains from assets where symbol = '%v' %s`, symbol, strings.Join(maps, " "))).Scan(
+	if err := a.Context.Db.QueryRow(fmt.Sprintf(`select id, name, symbol, min_withdraw, max_withdraw, min_trade, max_trade, fees_trade, fees_discount, fees_charges, fees_costs, fees_platform, platform, marker, status, "group", type, create_at, chains from assets where symbol = '%v' %s`, symbol, strings.Join(maps, " "))).Scan(
 		&response.Id,
 		&response.Name,
 		&response.Symbol,
@@ -520,6 +988,8 @@ func (a *Service) QueryAsset(symbol string, status bool) (*types.Asset, error) {
 		&response.FeesDiscount,
 		&response.FeesCharges,
 		&response.FeesCosts,
+		&response.FeesPlatform,
+		&response.Platform,
 		&response.Marker,
 		&response.Status,
 		&response.Group,
@@ -632,8 +1102,8 @@ func (a *Service) QueryContract(symbol string, cid int64) (*types.Contract, erro
 
 // QueryReserve - This function is used to get the total reserve for a given symbol, platform, and protocol from a database. It takes
 // three parameters (symbol, platform, and protocol) and uses a SQL query to get the sum of the values from the reserves
-// table where the symbol, platform, and protocol match the provided parameters. Finally, it returns the total reserve as a float64.
-func (a *Service) QueryReserve(symbol, platform, protocol string) (reserve float64) {
+// table where the symbol, platform, and protocol match the provided parameters. Finally, it returns the exact total reserve.
+func (a *Service) QueryReserve(symbol, platform, protocol string) (reserve decimal.Amount) {
 
 	if len(protocol) == 0 {
 		protocol = types.ProtocolMainnet
@@ -641,13 +1111,13 @@ func (a *Service) QueryReserve(symbol, platform, protocol string) (reserve float
 
 	// The purpose of this code is to query a database for the sum of values from a specific set of reserves (symbol,
 	// platform, and protocol) and store the result in the reserve variable.
-	_ = a.Context.Db.QueryRow(`select sum(value) from reserves where symbol = $1 and platform = $2 and protocol = $3`, symbol, platform, protocol).Scan(&reserve)
+	_ = a.Context.Db.QueryRow(`select coalesce(sum(value), 0) from reserves where symbol = $1 and platform = $2 and protocol = $3`, symbol, platform, protocol).Scan(&reserve)
 	return reserve
 }
 
 // QueryReverse - This code is used to get the reverse of a certain user's address for a certain platform and symbol from a database. It
-// takes in the userId, address, symbol, and platform as parameters, and returns the reverse value stored in the database.
-func (a *Service) QueryReverse(userId int64, address, symbol, platform string) (reverse float64) {
+// takes in the userId, address, symbol, and platform as parameters, and returns the exact reverse value stored in the database.
+func (a *Service) QueryReverse(userId int64, address, symbol, platform string) (reverse decimal.Amount) {
 
 	// The purpose of this code is to query a database for the sum of values from a specific set of reserves (symbol,
 	// platform, and protocol) and store the result in the reserve variable.
@@ -658,7 +1128,13 @@ func (a *Service) QueryReverse(userId int64, address, symbol, platform string) (
 // WriteBalance - This function is used to update the balance of a user in a database. Depending on the cross parameter, either the
 // balance is increased (types.Balance_PLUS) or decreased (types.Balance_MINUS) by a given quantity. The balance is
 // updated in the assets table of the database, using a query. Finally, an error is returned if an error occurred during the update.
-func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity float64, cross string) error {
+func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity decimal.Amount, cross string) error {
+	return a.writeBalance(a.Context.Db, symbol, _type, userId, quantity, cross)
+}
+
+// writeBalance - This function does the same as WriteBalance, but executes the update through the given executor, so the balance
+// can be changed inside the transaction that settles a fill.
+func (a *Service) writeBalance(tx executor, symbol, _type string, userId int64, quantity decimal.Amount, cross string) error {
 
 	switch cross {
 	case types.BalancePlus:
@@ -666,7 +1142,7 @@ func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity floa
 		// The code above is an if statement that is used to update the balance of an asset with a given symbol and user_id in
 		// a database. The statement executes an update query, passing in the values of symbol, quantity, and userId as
 		// parameters to the query. If the query fails to execute, the if statement will return an error.
-		if _, err := a.Context.Db.Exec("update balances set value = value + $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
+		if _, err := tx.Exec("update balances set value = value + $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
 			return err
 		}
 		break
@@ -675,7 +1151,7 @@ func (a *Service) WriteBalance(symbol, _type string, userId int64, quantity floa
 		// This code is used to update the balance of a user's assets in a database. The code updates the user's balance by
 		// subtracting the quantity given. The values being used to update the balance are stored in variables, and are passed
 		// into the code as parameters ($1, $2, and $3). The code also checks for errors and returns an error if one is found.
-		if _, err := a.Context.Db.Exec("update balances set value = value - $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
+		if _, err := tx.Exec("update balances set value = value - $2 where symbol = $1 and user_id = $3 and type = $4;", symbol, quantity, userId, _type); err != nil {
 			return err
 		}
 		break
@@ -766,7 +1242,7 @@ func (a *Service) WriteTransaction(transaction *types.Transaction) (*types.Trans
 // WriteReserve - This function is used to set a reserve for a user in a database. It takes the userId, address, symbol, value,
 // platform, protocol, and cross as parameters. It first checks if the reserve already exists in the database. If it
 // does, it updates it depending on the value of "cross." If the reserve does not exist, it inserts a new row into the database.
-func (a *Service) WriteReserve(userId int64, address, symbol string, value float64, platform, protocol, cross string) error {
+func (a *Service) WriteReserve(userId int64, address, symbol string, value decimal.Amount, platform, protocol, cross string) error {
 
 	if len(protocol) == 0 {
 		protocol = types.ProtocolMainnet
@@ -857,7 +1333,7 @@ func (a *Service) WriteReserveUnlock(userId int64, symbol, platform, protocol st
 // WriteReverse - The purpose of this code is to query a database for a specific set of information, insert data into a database table,
 // and update the value of an existing record in the database. The code uses SQL queries to perform these operations and
 // also checks for errors that may occur in the process.
-func (a *Service) WriteReverse(userId int64, address, symbol string, value float64, platform, cross string) error {
+func (a *Service) WriteReverse(userId int64, address, symbol string, value decimal.Amount, platform, cross string) error {
 
 	// This code is querying a database for a specific set of information. The code is using placeholders ($1, $2, etc.) to
 	// make the query more secure by preventing SQL injection. The row variable is the result of the query, and the defer
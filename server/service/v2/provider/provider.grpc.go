@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
@@ -62,18 +63,11 @@ func (a *Service) GetSymbol(_ context.Context, req *pbprovider.GetRequestSymbol)
 // errors encountered during the process.
 func (a *Service) SetOrder(ctx context.Context, req *pbprovider.SetRequestOrder) (*pbprovider.ResponseOrder, error) {
 
-	// The purpose of this code is to declare two variables of type pbprovider.ResponseOrder and types.Order respectively.
-	// Declaring the variables allows them to be used in the code.
+	// The purpose of this code is to declare a variable of type pbprovider.ResponseOrder, which is returned to the client.
 	var (
 		response pbprovider.ResponseOrder
-		order    types.Order
 	)
 
-	// Validates the type of the request and returns an error if it is invalid.
-	if err := types.Type(req.GetType()); err != nil {
-		return &response, err
-	}
-
 	// This code snippet checks if the request is authenticated by calling the Auth() method on the Context object. If the
 	// authentication fails, the code returns an error.
 	auth, err := a.Context.Auth(ctx)
@@ -81,11 +75,28 @@ func (a *Service) SetOrder(ctx context.Context, req *pbprovider.SetRequestOrder)
 		return &response, err
 	}
 
-	// Validate that the requested base and quote units and type are valid for the given configuration before proceeding with the request.
-	if err := a.queryValidatePair(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType()); err != nil {
+	// The user is queried and checked once, before the order is placed.
+	user, err := a.queryTrader(auth)
+	if err != nil {
+		return &response, err
+	}
+
+	// The order is validated, the balance is reserved and the order is matched against the book.
+	order, err := a.writePlace(user, req, make(map[string]*rules))
+	if err != nil {
 		return &response, err
 	}
 
+	// This statement is used to append an element to the "Fields" slice of the "response" struct. The element being
+	// appended is the "order" struct.
+	response.Fields = append(response.Fields, order)
+
+	return &response, nil
+}
+
+// queryTrader - This function queries the user who places orders and checks that the account of the user is not blocked.
+func (a *Service) queryTrader(auth int64) (*types.User, error) {
+
 	// The purpose of this code is to create a Service object that uses the context stored in the variable e. The Service
 	// object is then assigned to the variable migrate.
 	_account := account.Service{
@@ -103,13 +114,62 @@ func (a *Service) SetOrder(ctx context.Context, req *pbprovider.SetRequestOrder)
 	// error message informing the user that their account and assets have been blocked and instructing them to contact
 	// technical support for any questions.
 	if !user.GetStatus() {
-		return &response, status.Error(748990, "your account and assets have been blocked, please contact technical support for any questions")
+		return nil, status.Error(748990, "your account and assets have been blocked, please contact technical support for any questions")
+	}
+
+	return user, nil
+}
+
+// writePlace - This function places a new order of the user: it validates the pair and the request, reserves the balance and
+// matches the order against the book, or keeps a conditional order waiting for its trigger price. The pairs map caches
+// the trading rules of the pairs that have already been validated, so a batch of orders on the same pair validates the
+// pair only once.
+func (a *Service) writePlace(user *types.User, req *pbprovider.SetRequestOrder, pairs map[string]*rules) (*types.Order, error) {
+
+	var (
+		order types.Order
+	)
+
+	// Validates the type of the request and returns an error if it is invalid.
+	if err := types.Type(req.GetType()); err != nil {
+		return nil, err
+	}
+
+	// The pair is validated and its trading rules are queried only once for the same base unit, quote unit and type.
+	key := req.GetBaseUnit() + "/" + req.GetQuoteUnit() + "/" + req.GetType()
+	if _, ok := pairs[key]; !ok {
+
+		// Validate that the requested base and quote units and type are valid for the given configuration before proceeding with the request.
+		if err := a.queryValidatePair(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType()); err != nil {
+			return nil, err
+		}
+
+		// The precision of the pair defines how many decimal places the quantity (base unit) and the price (quote unit) of an
+		// order can have. Everything beyond the precision is truncated, so the amounts stored in the order book are exact.
+		// The other rules of the pair are checked when the order is complete.
+		pair, err := a.queryRules(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType())
+		if err != nil {
+			return nil, err
+		}
+		pairs[key] = pair
+	}
+	pair := pairs[key]
+
+	// No orders are accepted while trading on the pair is halted.
+	if err := a.queryValidateHalt(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType()); err != nil {
+		return nil, err
+	}
+
+	// A market order has no price to rest in the book at, so it can not be placed during the call auction of the pair.
+	if _, ok := a.queryAuction(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType()); ok && req.GetTrading() == types.TradingMarket {
+		return nil, status.Errorf(11630, "the pair %v-%v is in the call auction, only the orders that rest in the book are accepted", req.GetBaseUnit(), req.GetQuoteUnit())
 	}
+	base, quote := pair.base, pair.quote
 
 	// This is setting the order quantity and value based on the request quantity and price.
 	// The request quantity is used to set the order quantity, order type, and the order value is calculated by multiplying the request quantity by the request price.
-	order.Quantity = req.GetQuantity()
-	order.Value = req.GetQuantity()
+	order.Quantity = decimal.Parse(req.GetQuantity()).Truncate(base).String()
+	order.Value = order.GetQuantity()
 	order.Type = req.GetType()
 
 	// This is a switch statement that is used to evaluate the trade type of the request object. Depending on the trade
@@ -118,23 +178,116 @@ func (a *Service) SetOrder(ctx context.Context, req *pbprovider.SetRequestOrder)
 	switch req.GetTrading() {
 	case types.TradingMarket:
 
-		// The purpose of this code is to set the price of the order (order.Price) to the market price of the requested base
-		// and quote units, assigning, and price, which is retrieved from the "e.getMarket" function.
-		order.Price = a.queryMarket(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType(), req.GetAssigning(), req.GetPrice())
+		// The optional max slippage is a percentage of the best opposite price, the market order is never filled at a price
+		// worse than the best price moved by it.
+		slippage := decimal.Parse(req.GetMaxSlippage())
+		if slippage.IsNegative() || slippage.GreaterThanOrEqual(decimal.New(100).Amount()) {
+			return nil, status.Errorf(11596, "invalid max slippage %v", req.GetMaxSlippage())
+		}
+
+		// The quantity of a buy order is an amount of the quote unit, so it has the precision of the quote unit.
+		amount := decimal.Parse(req.GetQuantity()).Truncate(base)
+		if req.GetAssigning() == types.AssigningBuy {
+			amount = decimal.Parse(req.GetQuantity()).Truncate(quote)
+		}
 
-		// This if statement is checking to see if the request is to buy something. If it is, it is calculating the quantity
-		// and value of the order by dividing the quantity by the price.
+		// The market order walks the book level by level: the quantity of a sell order and the quote amount of a buy order
+		// are consumed at the prices of the resting orders within the slippage. The price of the order is the price of the
+		// worst order reached, so the order crosses every level of the walk.
+		quantity, price, rest := a.querySweep(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType(), req.GetAssigning(), user.GetId(), amount, slippage)
 		if req.GetAssigning() == types.AssigningBuy {
-			order.Quantity, order.Value = decimal.New(req.GetQuantity()).Div(order.GetPrice()).Float(), decimal.New(req.GetQuantity()).Div(order.GetPrice()).Float()
+			quantity = pair.floor(quantity.Truncate(base))
+		}
+
+		if !quantity.IsPositive() {
+			return nil, status.Error(11597, "there is no liquidity in the book to fill the market order within the slippage")
+		}
+
+		// A fill-or-kill order keeps the whole requested amount, it is rejected if the book can not take all of it.
+		if req.GetTimeInForce() == types.TimeInForceFOK && rest.IsPositive() {
+			return nil, status.Error(11591, "the fill-or-kill order can not be filled entirely and has been rejected")
+		}
+
+		order.Quantity = quantity.String()
+		order.Value = order.GetQuantity()
+		order.Price = price.Truncate(quote).String()
+
+		// The buy order reserves the quote amount it was asked to spend, not its quantity at the worst price. The fills are
+		// paid from this budget at their own prices, and what is left of it is returned to the balance at the end.
+		if req.GetAssigning() == types.AssigningBuy {
+			order.Budget = amount.String()
 		}
 
 	case types.TradingLimit:
 
 		// The purpose of this code is to set the value of the order.Price variable to the value returned by the GetPrice()
-		// method of the req object.
-		order.Price = req.GetPrice()
+		// method of the req object, truncated to the precision of the quote unit.
+		order.Price = decimal.Parse(req.GetPrice()).Truncate(quote).String()
+	case types.TradingStopLimit, types.TradingStopMarket, types.TradingTakeProfit:
+
+		// A conditional order carries a trigger price, it waits without entering the book until the last price of the pair
+		// reaches the trigger price, and only then it is activated into a limit or a market order.
+		trigger := decimal.Parse(req.GetTrigger()).Truncate(quote)
+		if !trigger.IsPositive() {
+			return nil, status.Errorf(65791, "impossible trigger price %v", req.GetTrigger())
+		}
+		order.Trigger = trigger.String()
+
+		// An order whose trigger price has already been reached by the last price would be activated at once, so it is
+		// rejected, the user should place a limit or a market order instead.
+		if last := a.queryLast(req.GetBaseUnit(), req.GetQuoteUnit()); last.IsPositive() && queryTriggered(req.GetTrading(), req.GetAssigning(), trigger, last) {
+			return nil, status.Errorf(65792, "the trigger price %v has already been reached by the last price %v", trigger, last)
+		}
+
+		// The stop market order does not know its price until it is activated, so the trigger price is used to reserve the
+		// balance. The reserved amount is corrected by the market price at the activation. The quantity of the buy order is
+		// an amount of the quote unit, the same as for the market order.
+		if req.GetTrading() == types.TradingStopMarket {
+			order.Price = trigger.String()
+			if req.GetAssigning() == types.AssigningBuy {
+				order.Quantity = pair.floor(decimal.Parse(req.GetQuantity()).Div(trigger).Truncate(base)).String()
+				order.Value = order.GetQuantity()
+			}
+		} else {
+			order.Price = decimal.Parse(req.GetPrice()).Truncate(quote).String()
+		}
+
+	case types.TradingTrailingStop, types.TradingTrailingStopLimit:
+
+		// A trailing stop order is a stop order whose trigger price follows the price at the given offset, which is an amount
+		// of the quote unit or a percentage. The watermark starts at the last price of the pair and moves with every better
+		// price, the trigger price moves with it, and the order is activated when the price retraces by the offset.
+		offset := decimal.Parse(req.GetTrailingOffset())
+		if !offset.IsPositive() || (req.GetTrailingPercent() && offset.GreaterThanOrEqual(decimal.New(100).Amount())) {
+			return nil, status.Errorf(65793, "impossible trailing offset %v", req.GetTrailingOffset())
+		}
+
+		last := a.queryLast(req.GetBaseUnit(), req.GetQuoteUnit())
+		if !last.IsPositive() {
+			return nil, status.Errorf(65794, "the pair %v-%v has no last price to trail", req.GetBaseUnit(), req.GetQuoteUnit())
+		}
+
+		trigger := queryTrailing(req.GetAssigning(), offset, req.GetTrailingPercent(), last).Truncate(quote)
+		if !trigger.IsPositive() {
+			return nil, status.Errorf(65791, "impossible trigger price %v", trigger)
+		}
+
+		order.Trigger = trigger.String()
+		order.Watermark = last.String()
+		order.TrailingOffset = offset.String()
+		order.TrailingPercent = req.GetTrailingPercent()
+
+		// The balance is reserved at the trigger price, the reserved amount is corrected by the price of the activation: the
+		// market price of a trailing stop order or the last trigger price of a trailing stop limit order. The quantity of the
+		// trailing stop buy order is an amount of the quote unit, the same as for the market order.
+		order.Price = trigger.String()
+		if req.GetTrading() == types.TradingTrailingStop && req.GetAssigning() == types.AssigningBuy {
+			order.Quantity = pair.floor(decimal.Parse(req.GetQuantity()).Div(trigger).Truncate(base)).String()
+			order.Value = order.GetQuantity()
+		}
+
 	default:
-		return &response, status.Error(82284, "invalid type trade position")
+		return nil, status.Error(82284, "invalid type trade position")
 	}
 
 	// The purpose of these lines of code is to assign the values of certain variables to the corresponding values from a
@@ -149,67 +302,128 @@ func (a *Service) SetOrder(ctx context.Context, req *pbprovider.SetRequestOrder)
 	order.Status = types.StatusPending
 	order.CreateAt = time.Now().UTC().Format(time.RFC3339)
 
-	// This code is checking for an error in the queryValidateOrder() function and if one is found, it returns an error response
-	// and calls the Context.Error() method with the error. The quantity variable is used to store the result of queryValidateOrder(), which is used to complete the order.
-	quantity, err := a.queryValidateOrder(&order)
-	if err != nil {
-		return &response, err
+	// The conditional order has its own status while it waits for the trigger price.
+	if len(order.GetTrigger()) > 0 {
+		order.Status = types.StatusWaiting
 	}
 
-	// This is a conditional statement used to set a new order and check for any errors that might occur. If an error is
-	// encountered, the statement will return a response and an Error context to indicate that an error has occurred.
-	if order.Id, err = a.writeOrder(&order); err != nil {
-		return &response, err
+	// The time in force defines how long the order stays in the book, an order without it is good till canceled.
+	order.TimeInForce = types.TimeInForceGTC
+	if len(req.GetTimeInForce()) > 0 {
+
+		if err := types.TimeInForce(req.GetTimeInForce()); err != nil {
+			return nil, err
+		}
+		order.TimeInForce = req.GetTimeInForce()
 	}
 
-	// The switch statement is used to evaluate the value of the expression "order.GetAssigning()" and execute the
-	// corresponding case statement. It is a type of conditional statement that allows a program to make decisions based on different conditions.
-	switch order.GetAssigning() {
-	case types.AssigningBuy:
+	// The market order never rests in the book, whatever it can not fill is canceled and refunded. It can only be a
+	// fill-or-kill order, which is not filled at all unless the book fills it entirely.
+	if order.GetTrading() == types.TradingMarket && order.GetTimeInForce() != types.TimeInForceFOK {
+		order.TimeInForce = types.TimeInForceIOC
+	}
 
-		// This code snippet is likely a part of a function that processes an order. The purpose of the code is to use the
-		// function "writeAsset()" to set the base unit and user ID of the order to false. If an error occurs during the process,
-		// the code will return the response and an error message.
-		if err := a.writeAsset(order.GetBaseUnit(), order.GetType(), order.GetUserId(), false); err != nil {
-			return &response, err
+	// The orders placed during the call auction of the pair wait in the book for the uncross.
+	if err := a.queryValidateAuction(&order); err != nil {
+		return nil, err
+	}
+
+	// The self-trade prevention mode of the order, if it is not chosen by the order, the mode of the account is used.
+	order.SelfTrade = user.GetSelfTrade()
+	if len(req.GetSelfTrade()) > 0 {
+
+		if err := types.SelfTrade(req.GetSelfTrade()); err != nil {
+			return nil, err
 		}
+		order.SelfTrade = req.GetSelfTrade()
+	}
 
-		// This code is checking the balance of a user and attempting to subtract the specified quantity from it. If the
-		// operation is successful, it will continue with the program. If an error occurs, it will return an error response.
-		if err := a.WriteBalance(order.GetQuoteUnit(), order.GetType(), order.GetUserId(), quantity, types.BalanceMinus); err != nil {
-			return &response, err
+	// An iceberg order shows only the display quantity of its value in the depth of the book, a hidden order shows nothing.
+	// The display quantity must be less than the quantity of the order, otherwise the whole order would be shown anyway.
+	if len(req.GetDisplay()) > 0 {
+
+		display := decimal.Parse(req.GetDisplay()).Truncate(base)
+		if !display.IsPositive() || display.GreaterThanOrEqual(decimal.Parse(order.GetQuantity())) {
+			return nil, status.Errorf(11598, "the display quantity %v must be positive and less than the quantity of the order", req.GetDisplay())
 		}
+		order.Display = display.String()
+	}
+	order.Hidden = req.GetHidden()
 
-		a.trade(&order, types.AssigningSell)
+	// Both orders are worked in the book, a market order never rests there, and an order is either iceberg or hidden.
+	if order.GetHidden() || len(order.GetDisplay()) > 0 {
 
-		break
-	case types.AssigningSell:
+		if order.GetTrading() == types.TradingMarket {
+			return nil, status.Error(11599, "a market order can not be an iceberg or a hidden order")
+		}
 
-		// This code snippet is likely a part of a function that processes an order. The purpose of the code is to use the
-		// function "writeAsset()" to set the base unit and user ID of the order to false. If an error occurs during the process,
-		// the code will return the response and an error message.
-		if err := a.writeAsset(order.GetQuoteUnit(), order.GetType(), order.GetUserId(), false); err != nil {
-			return &response, err
+		if order.GetHidden() && len(order.GetDisplay()) > 0 {
+			return nil, status.Error(11599, "an order can not be an iceberg and a hidden order at the same time")
 		}
+	}
 
-		// This code is checking the balance of a user and attempting to subtract the specified quantity from it. If the
-		// operation is successful, it will continue with the program. If an error occurs, it will return an error response.
-		if err := a.WriteBalance(order.GetBaseUnit(), order.GetType(), order.GetUserId(), quantity, types.BalanceMinus); err != nil {
-			return &response, err
+	// A good-till-date order expires at the requested time, which must be in the future.
+	if order.GetTimeInForce() == types.TimeInForceGTD {
+
+		expire, err := time.Parse(time.RFC3339, req.GetExpireAt())
+		if err != nil || !expire.After(time.Now()) {
+			return nil, status.Errorf(11593, "invalid expiration time %v", req.GetExpireAt())
 		}
+		order.ExpireAt = expire.UTC().Format(time.RFC3339)
+	}
 
-		a.trade(&order, types.AssigningBuy)
+	// The price, the quantity and the value of the order must follow the trading rules of the pair, and the user must not
+	// exceed the maximum number of open orders on the pair.
+	if err := pair.validate(&order); err != nil {
+		return nil, err
+	}
 
-		break
-	default:
-		return &response, status.Error(11588, "invalid assigning trade position")
+	if err := a.queryValidateCount(pair, &order); err != nil {
+		return nil, err
 	}
 
-	// This statement is used to append an element to the "Fields" slice of the "response" struct. The element being
-	// appended is the "order" struct.
-	response.Fields = append(response.Fields, &order)
+	// The balance that receives the fills of the order is created if the user does not have it yet.
+	symbol := order.GetBaseUnit()
+	if order.GetAssigning() == types.AssigningSell {
+		symbol = order.GetQuoteUnit()
+	}
 
-	return &response, nil
+	if err := a.writeAsset(symbol, order.GetType(), order.GetUserId(), false); err != nil {
+		return nil, err
+	}
+
+	// The balance is checked, the order is stored and its amount is reserved in one transaction.
+	if err := a.writeOpen(&order); err != nil {
+		return nil, err
+	}
+
+	// The waiting conditional order does not enter the book, it is only announced, and it is matched when it is activated.
+	if order.GetStatus() == types.StatusWaiting {
+		if err := a.writePublish(&order, "order/create"); err != nil {
+			return nil, err
+		}
+		return &order, nil
+	}
+
+	// The buy order is matched against the sell side of the book, and the sell order against the buy side.
+	switch order.GetAssigning() {
+	case types.AssigningBuy:
+		a.trade(&order, types.AssigningSell)
+	case types.AssigningSell:
+		a.trade(&order, types.AssigningBuy)
+	}
+
+	// The order has been rejected by its time in force, its reserved balance has already been returned.
+	if order.GetStatus() == types.StatsRejected {
+		switch order.GetTimeInForce() {
+		case types.TimeInForceFOK:
+			return nil, status.Error(11591, "the fill-or-kill order can not be filled entirely and has been rejected")
+		case types.TimeInForcePostOnly:
+			return nil, status.Error(11592, "the post-only order would take liquidity and has been rejected")
+		}
+	}
+
+	return &order, nil
 }
 
 // GetMarkers - This function is part of a service that is used to retrieve marker symbols from a database. It takes in a context and
@@ -382,7 +596,7 @@ func (a *Service) GetAsset(ctx context.Context, req *pbprovider.GetRequestAsset)
 
 	// This line of code sets the value of the Balance attribute of the row object to the balance of the account associated
 	// with the symbol in the request object, which is authenticated using the auth parameter.
-	row.Balance = a.QueryBalance(req.GetSymbol(), req.GetType(), auth)
+	row.Balance = a.QueryBalance(req.GetSymbol(), req.GetType(), auth).String()
 
 	// This query is used to calculate the volume of orders for a particular symbol, with the given assigning and status,
 	// for the given user. It is checking the base unit and quote unit against the given symbol and using the price to
@@ -423,7 +637,7 @@ func (a *Service) GetAsset(ctx context.Context, req *pbprovider.GetRequestAsset)
 					// The purpose of this code is to calculate the fees for withdrawing from a particular chain. The chain.FeesWithdraw
 					// variable is assigned to a decimal value which is calculated by multiplying the chain.GetFeesWithdraw() value with
 					// the price.GetPrice() value. The result is then converted to a floating point number.
-					chain.Fees = decimal.New(chain.GetFees()).Mul(price.GetPrice()).Float()
+					chain.Fees = decimal.New(decimal.New(chain.GetFees()).Amount().Mul(decimal.Parse(price.GetPrice()))).Float()
 
 					// The purpose of this statement is to set the contract for the chain. This statement is typically used in a
 					// blockchain context and assigns the contract object to the chain object. This allows the chain to access the
@@ -433,7 +647,7 @@ func (a *Service) GetAsset(ctx context.Context, req *pbprovider.GetRequestAsset)
 
 				// The purpose of this code is to set the reserve of the chain to the reserve of the asset that is requested from the
 				// symbol, platform, and protocol. The code is retrieving the reserve of the asset in order to set the reserve of the chain.
-				chain.Reserve = a.QueryReserve(req.GetSymbol(), chain.GetPlatform(), chain.Contract.GetProtocol())
+				chain.Reserve = a.QueryReserve(req.GetSymbol(), chain.GetPlatform(), chain.Contract.GetProtocol()).String()
 
 				// Switch statement to set chain address and balance based on the group.
 				switch row.GetGroup() {
@@ -534,8 +748,8 @@ func (a *Service) GetAssets(ctx context.Context, req *pbprovider.GetRequestAsset
 
 			// This code is checking the balance of a certain asset (identified by the symbol) from the account of the user
 			// (identified by the auth variable) and assigning the balance to the asset.Balance variable if the balance is greater than 0.
-			if balance := a.QueryBalance(asset.GetSymbol(), req.GetType(), auth); balance > 0 {
-				asset.Balance = balance
+			if balance := a.QueryBalance(asset.GetSymbol(), req.GetType(), auth); balance.IsPositive() {
+				asset.Balance = balance.String()
 			}
 		}
 
@@ -603,14 +817,14 @@ func (a *Service) GetPairs(_ context.Context, req *pbprovider.GetRequestPairs) (
 		// ratio is assigned to the pair. The if statement checks is the ratio is returned by the queryRatio() function, and if
 		// it is, the ok variable will be true, and the ratio will be assigned to the pair.
 		if ratio, ok := a.queryRatio(pair.GetBaseUnit(), pair.GetQuoteUnit()); ok {
-			pair.Ratio = ratio
+			pair.Ratio = ratio.String()
 		}
 
 		// This if statement is used to check if the getPrice function returns a value. If it does, it assigns that value to
 		// the Price field of the pair variable. The ok variable is a boolean which is used to determine if the getPrice
 		// function returns a value or not. The ok variable will be true if the getPrice function returns a value, and false otherwise.
 		if price, ok := a.queryPrice(pair.GetBaseUnit(), pair.GetQuoteUnit()); ok {
-			pair.Price = price
+			pair.Price = price.String()
 		}
 
 		// _status is used to indicate the current status of a process.
@@ -653,7 +867,7 @@ func (a *Service) GetPair(_ context.Context, req *pbprovider.GetRequestPair) (*p
 	// This code is querying a database for a specific row in the table. The query is looking for a row with the specified
 	// base_unit and quote_unit from the 'parameters' req.GetBaseUnit() and req.GetQuoteUnit(). If an error occurs, the error.
 	// Finally, the row is closed with the defer keyword so that it is properly released back to the server.
-	row, err := a.Context.Db.Query(`select id, base_unit, quote_unit, price, base_decimal, quote_decimal, status from pairs where base_unit = $1 and quote_unit = $2`, req.GetBaseUnit(), req.GetQuoteUnit())
+	row, err := a.Context.Db.Query(`select id, base_unit, quote_unit, price, base_decimal, quote_decimal, tick_size, step_size, min_notional, max_orders, band, band_window, halt_duration, halt, halt_until, auction_duration, auction_until, status from pairs where base_unit = $1 and quote_unit = $2`, req.GetBaseUnit(), req.GetQuoteUnit())
 	if err != nil {
 		return &response, err
 	}
@@ -666,16 +880,29 @@ func (a *Service) GetPair(_ context.Context, req *pbprovider.GetRequestPair) (*p
 		// The purpose of this code is to declare a variable called 'pair' of type 'types.Pair'. This variable can then be
 		// used to store values of type 'types.Pair'.
 		var (
-			pair types.Pair
+			pair    types.Pair
+			price   decimal.Amount
+			until   sql.NullTime
+			auction sql.NullTime
 		)
 
 		// This code is part of a larger program which likely retrieves data from a database. The purpose of this code is to
 		// scan each row of the retrieved data and store the relevant information into a structure called "pair", which likely
 		// holds data regarding currency pairs. The "if" statement is a check to make sure that the data was successfully read
 		// and stored into the structure, and if not, it will return an error.
-		if err := row.Scan(&pair.Id, &pair.BaseUnit, &pair.QuoteUnit, &pair.Price, &pair.BaseDecimal, &pair.QuoteDecimal, &pair.Status); err != nil {
+		if err := row.Scan(&pair.Id, &pair.BaseUnit, &pair.QuoteUnit, &price, &pair.BaseDecimal, &pair.QuoteDecimal, &pair.TickSize, &pair.StepSize, &pair.MinNotional, &pair.MaxOrders, &pair.Band, &pair.BandWindow, &pair.HaltDuration, &pair.Halt, &until, &pair.AuctionDuration, &auction, &pair.Status); err != nil {
 			return &response, err
 		}
+		pair.Price = price.String()
+
+		// Only a halt that ends automatically has an end time, and only a pair in the call auction has an uncross time.
+		if until.Valid {
+			pair.HaltUntil = until.Time.UTC().Format(time.RFC3339)
+		}
+
+		if auction.Valid {
+			pair.AuctionUntil = auction.Time.UTC().Format(time.RFC3339)
+		}
 
 		// _status is used to indicate the current status of a process.
 		var (
@@ -794,6 +1021,119 @@ func (a *Service) GetTicker(_ context.Context, req *pbprovider.GetRequestTicker)
 	return &response, nil
 }
 
+// GetDepth - This function returns the aggregated price levels of the order book of a pair: the bids from the highest price and
+// the asks from the lowest price. The levels can be grouped by a precision, for example 0.1 or 10, and their number is
+// limited by the limit of the request. The depth is read from the in-memory book, the database is not queried.
+func (a *Service) GetDepth(_ context.Context, req *pbprovider.GetRequestDepth) (*pbprovider.ResponseDepth, error) {
+
+	var (
+		response pbprovider.ResponseDepth
+	)
+
+	if len(req.GetType()) == 0 {
+		req.Type = types.TypeSpot
+	}
+
+	if err := types.Type(req.GetType()); err != nil {
+		return &response, err
+	}
+
+	// The number of levels is limited, 20 levels are returned by default.
+	if req.GetLimit() <= 0 {
+		req.Limit = 20
+	}
+	if req.GetLimit() > 500 {
+		req.Limit = 500
+	}
+
+	// The precision must be positive, no precision keeps the exact prices of the orders.
+	precision := decimal.Parse(req.GetPrecision())
+	if len(req.GetPrecision()) > 0 && !precision.IsPositive() {
+		return &response, status.Errorf(11628, "invalid depth precision %v", req.GetPrecision())
+	}
+
+	// A pair without a book has no resting orders, the depth is empty.
+	book := a.lookupBook(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType())
+	if book == nil {
+		return &response, nil
+	}
+
+	book.Lock()
+	defer book.Unlock()
+
+	// The snapshot carries the sequence number of the last published diff, so a client applies only the later diffs.
+	response.Bids = book.depth(types.AssigningBuy, precision, int(req.GetLimit()))
+	response.Asks = book.depth(types.AssigningSell, precision, int(req.GetLimit()))
+	response.Sequence = book.sequence
+	response.BaseUnit = req.GetBaseUnit()
+	response.QuoteUnit = req.GetQuoteUnit()
+	response.Type = req.GetType()
+
+	return &response, nil
+}
+
+// GetBookTicker - This function returns the best bid and the best ask of a pair with the quantities resting at these prices. It
+// is read from the in-memory book, the same as GetDepth, and is meant for frequent polling.
+func (a *Service) GetBookTicker(_ context.Context, req *pbprovider.GetRequestBookTicker) (*pbprovider.ResponseBookTicker, error) {
+
+	var (
+		response pbprovider.ResponseBookTicker
+	)
+
+	if len(req.GetType()) == 0 {
+		req.Type = types.TypeSpot
+	}
+
+	book := a.lookupBook(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType())
+	if book == nil {
+		return &response, nil
+	}
+
+	book.Lock()
+	defer book.Unlock()
+
+	if levels := book.depth(types.AssigningBuy, decimal.Zero, 1); len(levels) > 0 {
+		response.BidPrice, response.BidQuantity = levels[0].GetPrice(), levels[0].GetQuantity()
+	}
+
+	if levels := book.depth(types.AssigningSell, decimal.Zero, 1); len(levels) > 0 {
+		response.AskPrice, response.AskQuantity = levels[0].GetPrice(), levels[0].GetQuantity()
+	}
+
+	return &response, nil
+}
+
+// GetAuction - This function returns the call auction state of the pair: whether the pair is in the auction, the uncross time,
+// and the indicative clearing price and volume the auction would uncross at now.
+func (a *Service) GetAuction(_ context.Context, req *pbprovider.GetRequestAuction) (*pbprovider.ResponseAuction, error) {
+
+	if len(req.GetType()) == 0 {
+		req.Type = types.TypeSpot
+	}
+
+	response := &pbprovider.ResponseAuction{
+		BaseUnit:  req.GetBaseUnit(),
+		QuoteUnit: req.GetQuoteUnit(),
+		Type:      req.GetType(),
+	}
+
+	until, ok := a.queryAuction(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType())
+	if !ok {
+		return response, nil
+	}
+	response.Auction, response.AuctionUntil = true, until.Format(time.RFC3339)
+
+	book := a.lookupBook(req.GetBaseUnit(), req.GetQuoteUnit(), req.GetType())
+	if book == nil {
+		return response, nil
+	}
+
+	book.Lock()
+	defer book.Unlock()
+
+	return a.queryIndicative(book, until), nil
+}
+
 // SetTicker - The purpose of this code is to retrieve two candles with a given resolution from a spot exchange, add a new row to a
 // database table, publish a message to an exchange on a specific topic, and append the returned values to a response array.
 func (a *Service) SetTicker(_ context.Context, req *pbprovider.SetRequestTicker) (*pbprovider.ResponseTicker, error) {
@@ -816,10 +1156,15 @@ func (a *Service) SetTicker(_ context.Context, req *pbprovider.SetRequestTicker)
 	// "ohlcv" table, based on the values stored in the params array. The five columns in the table are assigning,
 	// base_unit, quote_unit, price, and quantity, and each of these is being populated with the corresponding value from
 	// the params array. The code then checks for any errors that may have occurred while executing the query and returns if any are found.
-	if _, err := a.Context.Db.Exec(`insert into ohlcv (assigning, base_unit, quote_unit, price, quantity) values ($1, $2, $3, $4, $5)`, req.GetAssigning(), req.GetBaseUnit(), req.GetQuoteUnit(), req.GetPrice(), req.GetValue()); a.Context.Debug(err) {
+	// The type of the book is kept with the price, so the trades of the spot, the cross and the stock books do not mix.
+	if _, err := a.Context.Db.Exec(`insert into ohlcv (assigning, base_unit, quote_unit, price, quantity, type) values ($1, $2, $3, $4, $5, $6)`, req.GetAssigning(), req.GetBaseUnit(), req.GetQuoteUnit(), decimal.Parse(req.GetPrice()), decimal.Parse(req.GetValue()), req.GetType()); a.Context.Debug(err) {
 		return &response, err
 	}
 
+	// The new last price may reach the trigger prices of the waiting conditional orders of the pair. They are activated in
+	// the background, because the ticker is also set from the fill process while the book of the pair is locked.
+	go a.replayTrigger(req.GetBaseUnit(), req.GetQuoteUnit(), decimal.Parse(req.GetPrice()))
+
 	// The for loop is used to iterate through each element in the Depth() array. The underscore is used to assign the index
 	// number to a variable that is not used in the loop. The interval variable is used to access the contents of each
 	// element in the Depth() array.
@@ -861,21 +1206,21 @@ func (a *Service) GetPrice(_ context.Context, req *pbprovider.GetRequestPrice) (
 	// code is to create two variables that can be used in the code that follows.
 	var (
 		response pbprovider.ResponsePrice
-		ok       bool
 	)
 
 	// The purpose of this code is to check whether the price of a certain item has been successfully retrieved, and if so,
 	// return the response and a nil (no error) value. The line starts by attempting to get the price of the item based on
 	// the given base and quote units, and then assigns the response and the boolean value of ok to the variables'
 	// response.Price and ok, respectively. Finally, the code returns the response and a nil value if ok is true.
-	if response.Price, ok = a.queryPrice(req.GetBaseUnit(), req.GetQuoteUnit()); ok {
+	if price, ok := a.queryPrice(req.GetBaseUnit(), req.GetQuoteUnit()); ok {
+		response.Price = price.String()
 		return &response, nil
 	}
 
 	// This code is checking if the price of a product or service can be obtained given the quote and base units. If the
 	// price can be obtained, the response will be rounded to 8 decimal places and stored in the response.Price variable.
-	if response.Price, ok = a.queryPrice(req.GetQuoteUnit(), req.GetBaseUnit()); ok {
-		response.Price = decimal.New(decimal.New(1).Div(response.Price).Float()).Round(8).Float()
+	if price, ok := a.queryPrice(req.GetQuoteUnit(), req.GetBaseUnit()); ok && price.IsPositive() {
+		response.Price = decimal.New(1).Amount().DivRound(price, 8).String()
 	}
 
 	return &response, nil
@@ -957,6 +1302,8 @@ func (a *Service) GetOrders(ctx context.Context, req *pbprovider.GetRequestOrder
 		maps = append(maps, fmt.Sprintf("and status = '%v'", types.StatusPending))
 	case types.StatusCancel:
 		maps = append(maps, fmt.Sprintf("and status = '%v'", types.StatusCancel))
+	case types.StatusWaiting:
+		maps = append(maps, fmt.Sprintf("and status = '%v'", types.StatusWaiting))
 	}
 
 	// This code checks if the length of the base unit and the quote unit in the request are greater than 0. If they are, it
@@ -966,9 +1313,17 @@ func (a *Service) GetOrders(ctx context.Context, req *pbprovider.GetRequestOrder
 		maps = append(maps, fmt.Sprintf("and base_unit = '%v' and quote_unit = '%v'", req.GetBaseUnit(), req.GetQuoteUnit()))
 	}
 
+	// The hidden orders and the hidden part of the iceberg orders are shown only to their owner. Everybody else does not see
+	// the hidden orders at all, and sees an iceberg order with the size of its current slice.
+	volume := "value"
+	if !req.GetOwner() {
+		maps = append(maps, "and hidden = false")
+		volume = "case when display > 0 and value > display then coalesce(nullif(mod(value, display), 0), display) else value end"
+	}
+
 	// The purpose of this code is to query the database to count the number of orders and total value of the orders in the
 	// database. It then stores the count and volume in the response variable.
-	_ = a.Context.Db.QueryRow(fmt.Sprintf("select count(*) as count, sum(value) as volume from orders %s", strings.Join(maps, " "))).Scan(&response.Count, &response.Volume)
+	_ = a.Context.Db.QueryRow(fmt.Sprintf("select count(*) as count, sum(%s) as volume from orders %s", volume, strings.Join(maps, " "))).Scan(&response.Count, &response.Volume)
 
 	// This statement is testing if the response from a user has a count that is greater than 0. If the response has a count
 	// greater than 0, then something else will occur.
@@ -985,7 +1340,7 @@ func (a *Service) GetOrders(ctx context.Context, req *pbprovider.GetRequestOrder
 		// This code is used to perform a SQL query on a database. It is used to select certain columns from the orders table
 		// and to order them by the id in descending order. The limit and offset parameters are used to limit the number of
 		// rows returned and to specify where in the result set to start returning rows from. The strings.Join function is used to join the "maps" parameter which is an array of strings.
-		rows, err := a.Context.Db.Query(fmt.Sprintf("select id, assigning, price, value, quantity, base_unit, quote_unit, user_id, create_at, type, status from orders %s order by id desc limit %d offset %d", strings.Join(maps, " "), req.GetLimit(), offset))
+		rows, err := a.Context.Db.Query(fmt.Sprintf("select id, assigning, price, trigger, value, quantity, base_unit, quote_unit, user_id, create_at, type, trading, status, time_in_force, expire_at, display, hidden, trailing_offset, trailing_percent, watermark from orders %s order by id desc limit %d offset %d", strings.Join(maps, " "), req.GetLimit(), offset))
 		if err != nil {
 			return &response, err
 		}
@@ -999,15 +1354,26 @@ func (a *Service) GetOrders(ctx context.Context, req *pbprovider.GetRequestOrder
 			// The purpose of the above code is to declare a variable called item with the type types.Order. This allows the
 			// program to create an object of type types.Order and assign it to the item variable.
 			var (
-				item types.Order
+				item   types.Order
+				expire sql.NullTime
 			)
 
 			// This code is scanning the rows returned from a database query and assigning the values to the variables in the item
 			// struct. If an error is encountered during the scanning process, an error is returned.
-			if err = rows.Scan(&item.Id, &item.Assigning, &item.Price, &item.Value, &item.Quantity, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.CreateAt, &item.Type, &item.Status); err != nil {
+			if err = rows.Scan(&item.Id, &item.Assigning, &item.Price, &item.Trigger, &item.Value, &item.Quantity, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.CreateAt, &item.Type, &item.Trading, &item.Status, &item.TimeInForce, &expire, &item.Display, &item.Hidden, &item.TrailingOffset, &item.TrailingPercent, &item.Watermark); err != nil {
 				return &response, err
 			}
 
+			// The iceberg order of another user is shown with the size of its current slice only.
+			if !req.GetOwner() && decimal.Parse(item.GetDisplay()).IsPositive() {
+				item.Value, item.Quantity, item.Display = shown(&item).String(), item.GetDisplay(), ""
+			}
+
+			// Only a good-till-date order has an expiration time.
+			if expire.Valid {
+				item.ExpireAt = expire.Time.UTC().Format(time.RFC3339)
+			}
+
 			// The purpose of this statement is to add an item to the existing list of fields in a response object. The
 			// response.Fields list is appended with the item, which is passed as an argument to the append function.
 			response.Fields = append(response.Fields, &item)
@@ -1080,7 +1446,7 @@ func (a *Service) GetTrades(ctx context.Context, req *pbprovider.GetRequestTrade
 	// This code is used to query the table 'transfers' with the given parameters. It uses a fmt.Sprintf statement to format the
 	// query string with the given parameters, then it uses the a.Context.Db.Query() to execute the query and store the
 	// results into the rows variable. If an error occurs, it returns an error response. Finally, it closes the rows variable.
-	rows, err := a.Context.Db.Query(fmt.Sprintf("select id, user_id, base_unit, quote_unit, price, quantity, assigning, fees, maker, create_at from trades %s order by id desc limit %d", strings.Join(maps, " "), req.GetLimit()))
+	rows, err := a.Context.Db.Query(fmt.Sprintf("select id, user_id, base_unit, quote_unit, price, quantity, assigning, fees, fees_unit, maker, create_at from trades %s order by id desc limit %d", strings.Join(maps, " "), req.GetLimit()))
 	if err != nil {
 		return &response, err
 	}
@@ -1099,7 +1465,7 @@ func (a *Service) GetTrades(ctx context.Context, req *pbprovider.GetRequestTrade
 		// This code is part of a function that retrieves data from a database. The purpose of the if statement is to scan the
 		// rows of the database and assign each row's values to the corresponding variables. If an error occurs while scanning
 		// the rows, the function will return an error.
-		if err = rows.Scan(&item.Id, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Price, &item.Quantity, &item.Assigning, &item.Fees, &item.Maker, &item.CreateAt); err != nil {
+		if err = rows.Scan(&item.Id, &item.UserId, &item.BaseUnit, &item.QuoteUnit, &item.Price, &item.Quantity, &item.Assigning, &item.Fees, &item.FeesUnit, &item.Maker, &item.CreateAt); err != nil {
 			return &response, err
 		}
 
@@ -1286,7 +1652,7 @@ func (a *Service) CancelOrder(ctx context.Context, req *pbprovider.CancelRequest
 	// only the desired records are returned. The parameters are the status, id, and user_id. The query also includes an
 	// order by clause to ensure that the data is returned in a specific order. The data is then stored in the row variable
 	// and the defer statement is used to close the row when the query is finished.
-	row, err := a.Context.Db.Query(`select id, value, quantity, price, assigning, base_unit, quote_unit, user_id, type, create_at from orders where id = $1 and status = $2 and user_id = $3 order by id`, req.GetId(), types.StatusPending, auth)
+	row, err := a.Context.Db.Query(`select id, value, quantity, price, trigger, assigning, base_unit, quote_unit, user_id, type, trading, status, display, hidden, create_at from orders where id = $1 and (status = $2 or status = $3) and user_id = $4 order by id`, req.GetId(), types.StatusPending, types.StatusWaiting, auth)
 	if err != nil {
 		return &response, err
 	}
@@ -1306,51 +1672,552 @@ func (a *Service) CancelOrder(ctx context.Context, req *pbprovider.CancelRequest
 
 		// This code is used to scan the row of a database table and assign the values to the relevant variables. The if
 		// statement checks for any errors that may occur during the scanning process, and if an error is found, it will return an error response.
-		if err = row.Scan(&item.Id, &item.Value, &item.Quantity, &item.Price, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.Type, &item.CreateAt); err != nil {
+		if err = row.Scan(&item.Id, &item.Value, &item.Quantity, &item.Price, &item.Trigger, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.Type, &item.Trading, &item.Status, &item.Display, &item.Hidden, &item.CreateAt); err != nil {
 			return &response, err
 		}
 
-		// The purpose of the code is to update the status of an order for a particular user in the database. It takes three
-		// parameters: the ID of the order, the user ID, and the new status for the order. If the execution of the SQL query
-		// fails, an error is returned.
-		if _, err := a.Context.Db.Exec("update orders set status = $3 where id = $1 and user_id = $2;", item.GetId(), item.GetUserId(), types.StatusCancel); err != nil {
+		// The order is removed from the book, its status is set to canceled and the remaining value is returned to the
+		// balance of the user. If the order is no longer in the book, it has already been filled and an error is returned.
+		// A waiting conditional order is not in the book, it is canceled unless it has been activated in the meantime.
+		if err := a.writeCancel(&item); err != nil {
 			return &response, err
 		}
 
-		// The switch statement is used to compare the value of a variable (in this case, item.Assigning) to a list of possible
-		// values. If the value matches one of the values in the list, a specific action will be executed.
-		switch item.Assigning {
-		case types.AssigningBuy:
+	} else {
+		return &response, status.Error(11538, "the requested order does not exist")
+	}
+	response.Success = true
+
+	return &response, nil
+}
 
-			// This code is setting the balance of a user for a given item. It is using the item's quote unit, user id, value and
-			// price to calculate the new balance and then updating the balance using the types.Balance_PLUS parameter. If there
-			// is an error setting the balance, an error is returned.
-			if err := a.WriteBalance(item.GetQuoteUnit(), item.GetType(), item.GetUserId(), decimal.New(item.GetValue()).Mul(item.GetPrice()).Float(), types.BalancePlus); err != nil {
-				return &response, err
-			}
+// SetOrders - This function places a batch of orders of the user at once. The user is queried and checked only once, and every
+// pair is validated only once for the whole batch. The orders are placed one after another in the order of the request,
+// an order that fails does not stop the batch, and the result of every order is returned with its index in the request.
+func (a *Service) SetOrders(ctx context.Context, req *pbprovider.SetRequestOrders) (*pbprovider.ResponseOrders, error) {
+
+	var (
+		response pbprovider.ResponseOrders
+		pairs    = make(map[string]*rules)
+	)
+
+	// The size of the batch is limited, so a single request can not hold the books of the pairs for too long.
+	if len(req.GetFields()) == 0 || len(req.GetFields()) > 50 {
+		return &response, status.Error(11595, "the batch must contain from 1 to 50 orders")
+	}
+
+	// This code is checking to make sure a valid authentication token is present in the context.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// The user is queried and checked once for the whole batch.
+	user, err := a.queryTrader(auth)
+	if err != nil {
+		return &response, err
+	}
+
+	for index, item := range req.GetFields() {
+
+		order, err := a.writePlace(user, item, pairs)
+		if err != nil {
+			response.Fields = append(response.Fields, &pbprovider.ResultOrder{Index: int32(index), Error: status.Convert(err).Message()})
+			continue
+		}
+
+		response.Fields = append(response.Fields, &pbprovider.ResultOrder{Index: int32(index), Order: order, Success: true})
+	}
+
+	return &response, nil
+}
+
+// CancelAllOrders - This function cancels all pending and waiting orders of the user that match the filter: the pair, the side and
+// the type of the orders, every part of the filter is optional. All reserved balances are refunded in one transaction,
+// and the canceled orders are published together as one event to the "order/cancel-all" channel.
+func (a *Service) CancelAllOrders(ctx context.Context, req *pbprovider.CancelRequestAllOrders) (*pbprovider.ResponseOrder, error) {
+
+	var (
+		response pbprovider.ResponseOrder
+		orders   []*types.Order
+		maps     []string
+	)
+
+	// This code is checking to make sure a valid authentication token is present in the context.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	params := []interface{}{auth, types.StatusPending, types.StatusWaiting}
+
+	if len(req.GetBaseUnit()) > 0 && len(req.GetQuoteUnit()) > 0 {
+		params = append(params, req.GetBaseUnit(), req.GetQuoteUnit())
+		maps = append(maps, fmt.Sprintf("and base_unit = $%d and quote_unit = $%d", len(params)-1, len(params)))
+	}
+
+	if len(req.GetAssigning()) > 0 {
+
+		if req.GetAssigning() != types.AssigningBuy && req.GetAssigning() != types.AssigningSell {
+			return &response, status.Error(11588, "invalid assigning trade position")
+		}
+
+		params = append(params, req.GetAssigning())
+		maps = append(maps, fmt.Sprintf("and assigning = $%d", len(params)))
+	}
+
+	if len(req.GetType()) > 0 {
+
+		if err := types.Type(req.GetType()); err != nil {
+			return &response, err
+		}
 
-			break
-		case types.AssigningSell:
+		params = append(params, req.GetType())
+		maps = append(maps, fmt.Sprintf("and type = $%d", len(params)))
+	}
+
+	rows, err := a.Context.Db.Query(fmt.Sprintf("select id, value, quantity, price, assigning, base_unit, quote_unit, user_id, type, trading, status, display, hidden, create_at from orders where user_id = $1 and (status = $2 or status = $3) %s order by id", strings.Join(maps, " ")), params...)
+	if err != nil {
+		return &response, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item types.Order
+		)
+
+		if err := rows.Scan(&item.Id, &item.Value, &item.Quantity, &item.Price, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.Type, &item.Trading, &item.Status, &item.Display, &item.Hidden, &item.CreateAt); err != nil {
+			return &response, err
+		}
+		orders = append(orders, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return &response, err
+	}
+
+	if len(orders) == 0 {
+		return &response, nil
+	}
+
+	// All orders are canceled and refunded at once.
+	if response.Fields, err = a.writeCancelAll(auth, orders); err != nil {
+		return &response, err
+	}
+	response.Count = int32(len(response.Fields))
+	response.Success = true
+
+	// The canceled orders are published as one consolidated event, masked the same way as every single order.
+	if response.GetCount() > 0 {
+
+		var (
+			event = pbprovider.ResponseOrder{Success: true}
+		)
+
+		for _, item := range response.GetFields() {
+			if item = masked(item); item != nil {
+				event.Fields = append(event.Fields, item)
+			}
+		}
+		event.Count = int32(len(event.GetFields()))
 
-			// This code is used to set a balance for a user in a particular base unit. The "if err" statement is used to check if
-			// there is an error when setting the balance. If there is an error, the code will return an error message.
-			if err := a.WriteBalance(item.GetBaseUnit(), item.GetType(), item.GetUserId(), item.GetValue(), types.BalancePlus); err != nil {
+		if event.GetCount() > 0 {
+			if err := a.Context.Publish(&event, "exchange", "order/cancel-all"); err != nil {
 				return &response, err
 			}
+		}
+	}
+
+	return &response, nil
+}
+
+// AmendOrder - This function changes the price and/or the quantity of a pending order of the user in place, without canceling it.
+// The new quantity applies to the whole order, so the remaining value changes by the same amount as the quantity, and
+// the filled part of the order stays as it is. The reserved balance is adjusted by the difference between the new and
+// the old reserved amount in one transaction with the order. The order keeps its place in the queue when only its
+// quantity is reduced, otherwise it is requeued behind the orders with the same price and matched again.
+func (a *Service) AmendOrder(ctx context.Context, req *pbprovider.AmendRequestOrder) (*pbprovider.ResponseOrder, error) {
+
+	var (
+		response  pbprovider.ResponseOrder
+		item      types.Order
+		before    decimal.Amount
+		after     decimal.Amount
+		symbol    string
+		assigning string
+	)
+
+	// This code is checking to make sure a valid authentication token is present in the context.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// The pair of the order is needed to find its book, only a pending order of the user can be amended.
+	if err := a.Context.Db.QueryRow(`select id, assigning, base_unit, quote_unit, type from orders where id = $1 and status = $2 and user_id = $3`, req.GetId(), types.StatusPending, auth).Scan(&item.Id, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.Type); err != nil {
+		return &response, status.Error(11538, "the requested order does not exist")
+	}
+
+	// The precision of the pair defines how many decimal places the new quantity and the new price can have, the other
+	// trading rules of the pair apply to the amended order the same as to a new order.
+	pair, err := a.queryRules(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+	if err != nil {
+		return &response, err
+	}
+	base, quote := pair.base, pair.quote
+
+	// The orders of a halted pair can not be changed until trading on the pair is resumed.
+	if err := a.queryValidateHalt(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType()); err != nil {
+		return &response, err
+	}
+
+	// The book of the pair is locked for the whole change, so the order can not be matched while it is being amended.
+	book := a.queryBook(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+	book.Lock()
+	defer a.release(book)
+
+	// The order is taken from the book, because it might have been partially filled after it was read from the database.
+	order := book.find(item.GetId())
+	if order == nil {
+		return &response, status.Error(11538, "the requested order does not exist")
+	}
+
+	// The price and the quantity that are not given in the request stay the same.
+	price, quantity, value := decimal.Parse(order.GetPrice()), decimal.Parse(order.GetQuantity()), decimal.Parse(order.GetValue())
+	if len(req.GetPrice()) > 0 {
+		price = decimal.Parse(req.GetPrice()).Truncate(quote)
+	}
+	if len(req.GetQuantity()) > 0 {
+		quantity = decimal.Parse(req.GetQuantity()).Truncate(base)
+	}
+
+	if !price.IsPositive() {
+		return &response, status.Errorf(65790, "impossible price %v", req.GetPrice())
+	}
+
+	// The remaining value changes by the same amount as the quantity, the filled part of the order can not be taken back.
+	remainder := value.Add(quantity.Sub(decimal.Parse(order.GetQuantity())))
+	if !remainder.IsPositive() {
+		return &response, status.Error(11594, "the quantity can not be reduced below the filled part of the order")
+	}
+
+	if err := pair.validate(&types.Order{Trading: order.GetTrading(), Price: price.String(), Quantity: quantity.String()}); err != nil {
+		return &response, err
+	}
+
+	// The amount reserved by the order before and after the change: the quote amount of a buy order and the base amount of
+	// a sell order.
+	switch order.GetAssigning() {
+	case types.AssigningBuy:
+		before, after, symbol, assigning = value.Mul(decimal.Parse(order.GetPrice())), remainder.Mul(price), order.GetQuoteUnit(), types.AssigningSell
+	case types.AssigningSell:
+		before, after, symbol, assigning = value, remainder, order.GetBaseUnit(), types.AssigningBuy
+	}
+
+	// The new amount must stay within the trading range of the asset, the same as for a new order.
+	if min, max, ok := a.queryRange(symbol, after); !ok {
+		return &response, status.Errorf(11623, "minimum trading amount: %v~%v, maximum trading amount: %v", min, min.Mul(decimal.New(2).Amount()), max)
+	}
+
+	// The order and the balance are changed in one transaction, so the reservation always matches the order.
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return &response, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("update orders set price = $2, quantity = $3, value = $4 where id = $1 and status = $5", order.GetId(), price, quantity, remainder, types.StatusPending); err != nil {
+		return &response, err
+	}
+
+	// The new state of the order is written to the journal, the replay decides from it whether the order is requeued.
+	if _, err := a.writeJournal(tx, journalAmend, &types.Order{Id: order.GetId(), BaseUnit: order.GetBaseUnit(), QuoteUnit: order.GetQuoteUnit(), Type: order.GetType(), Price: price.String(), Quantity: quantity.String(), Value: remainder.String()}, 0, decimal.Zero, decimal.Zero); err != nil {
+		return &response, err
+	}
+
+	// The difference is taken from the balance when the order reserves more, and returned to it when it reserves less.
+	if delta := after.Sub(before); delta.IsPositive() {
+
+		var (
+			balance decimal.Amount
+		)
 
-			break
+		if err := tx.QueryRow("select value from balances where symbol = $1 and user_id = $2 and type = $3 for update", symbol, order.GetUserId(), order.GetType()).Scan(&balance); err != nil || delta.GreaterThan(balance) {
+			return &response, status.Error(11586, "there is not enough funds on your asset balance to amend the order")
 		}
 
-		// This code is intended to publish an item to an exchange with the routing key "order/cancel". If any errors occur
-		// while attempting to publish the item, the error is returned and the response is returned.
-		if err := a.Context.Publish(&item, "exchange", "order/cancel"); err != nil {
+		if err := a.writeBalance(tx, symbol, order.GetType(), order.GetUserId(), delta, types.BalanceMinus); err != nil {
 			return &response, err
 		}
 
-	} else {
-		return &response, status.Error(11538, "the requested order does not exist")
+	} else if delta.IsNegative() {
+
+		if err := a.writeBalance(tx, symbol, order.GetType(), order.GetUserId(), delta.Neg(), types.BalancePlus); err != nil {
+			return &response, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &response, err
+	}
+
+	// The order keeps its place in the queue only when the price stays the same and the quantity is not increased.
+	requeue := !price.Equal(decimal.Parse(order.GetPrice())) || remainder.GreaterThan(value)
+	if requeue {
+		book.remove(order.GetId())
+	}
+
+	order.Price = price.String()
+	order.Quantity = quantity.String()
+	order.Value = remainder.String()
+
+	// The order that keeps its place changes the quantity of its level, the requeued order is pushed again.
+	if !requeue {
+		book.touch(order)
+	}
+
+	if err := a.writePublish(order, "order/status"); err != nil {
+		return &response, err
+	}
+
+	// The requeued order is matched again, a new price may cross the opposite side of the book.
+	if requeue {
+		a.match(book, order, assigning)
+	}
+
+	response.Fields = append(response.Fields, order)
+
+	return &response, nil
+}
+
+// SetTransfer - This function is used to move an asset between the spot balance and the cross balance of a user. A deposit moves
+// the asset from the spot balance to the cross balance, where it serves as the collateral of the loans, a withdrawal
+// moves it back. A withdrawal is only allowed while the margin level stays at or above the initial level.
+func (a *Service) SetTransfer(ctx context.Context, req *pbprovider.SetRequestTransfer) (*pbprovider.ResponseTransfer, error) {
+
+	// The purpose of this code is to declare the variables used by the transfer: the response, the source and the
+	// destination balance types, and the balance of the source.
+	var (
+		response pbprovider.ResponseTransfer
+		from, to string
+		balance  decimal.Amount
+	)
+
+	// This code snippet checks if the request is authenticated by calling the Auth() method on the Context object. If the
+	// authentication fails, the code returns an error.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// The asset must exist and be active, otherwise it can not be transferred.
+	if _, err := a.QueryAsset(req.GetSymbol(), true); err != nil {
+		return &response, err
+	}
+
+	// The quantity is truncated to the precision of the asset, a zero or negative quantity is rejected.
+	quantity := decimal.Parse(req.GetQuantity()).Truncate(a.queryPrecision(req.GetSymbol()))
+	if !quantity.IsPositive() {
+		return &response, status.Error(11699, "the quantity must be greater than zero")
+	}
+
+	// This switch statement defines the direction of the transfer.
+	switch req.GetAssignment() {
+	case types.AssignmentDeposit:
+		from, to = types.TypeSpot, types.TypeCross
+	case types.AssignmentWithdrawal:
+		from, to = types.TypeCross, types.TypeSpot
+	default:
+		return &response, status.Error(11700, "invalid transfer assignment")
+	}
+
+	// The balance of the destination is created if the user does not have it yet.
+	if err := a.writeAsset(req.GetSymbol(), to, auth, false); err != nil {
+		return &response, err
+	}
+
+	// The balance of the source is locked, checked and moved to the destination in one transaction.
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return &response, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("select value from balances where symbol = $1 and user_id = $2 and type = $3 for update", req.GetSymbol(), auth, from).Scan(&balance); err != nil || quantity.GreaterThan(balance) {
+		return &response, status.Error(11701, "there is not enough funds on your asset balance to make a transfer")
+	}
+
+	// The withdrawn collateral reduces the assets of the cross balance, so the margin level after the withdrawal is checked.
+	// The check is made in the transaction of the transfer, which keeps the cross balances and the loans of the user locked,
+	// so a concurrent transfer or loan can not bring the level below the initial level in the meantime.
+	if req.GetAssignment() == types.AssignmentWithdrawal {
+
+		price, ok := a.queryValuation(req.GetSymbol())
+		if !ok {
+			price = decimal.Zero
+		}
+
+		if err := a.queryLevel(tx, auth, quantity.Mul(price).Neg(), decimal.Zero); err != nil {
+			return &response, err
+		}
+	}
+
+	if err := a.writeBalance(tx, req.GetSymbol(), from, auth, quantity, types.BalanceMinus); err != nil {
+		return &response, err
+	}
+
+	if err := a.writeBalance(tx, req.GetSymbol(), to, auth, quantity, types.BalancePlus); err != nil {
+		return &response, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &response, err
+	}
+	response.Success = true
+
+	return &response, nil
+}
+
+// SetLoan - This function is used to borrow an asset against the collateral of the cross balance or to repay a loan. The borrowed
+// asset is credited to the cross balance of the user and can be traded with the cross orders. A new loan is only
+// allowed while the margin level stays at or above the initial level. A repayment pays the accrued interest first and
+// then the borrowed value, and is taken from the cross balance of the borrowed asset.
+func (a *Service) SetLoan(ctx context.Context, req *pbprovider.SetRequestLoan) (*pbprovider.ResponseLoan, error) {
+
+	// The purpose of this code is to declare a variable of type pbprovider.ResponseLoan.
+	var (
+		response pbprovider.ResponseLoan
+	)
+
+	// This code snippet checks if the request is authenticated by calling the Auth() method on the Context object. If the
+	// authentication fails, the code returns an error.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &response, err
+	}
+
+	// The asset must exist and be active, otherwise it can not be borrowed or repaid.
+	if _, err := a.QueryAsset(req.GetSymbol(), true); err != nil {
+		return &response, err
+	}
+
+	// The quantity is truncated to the precision of the asset, a zero or negative quantity is rejected.
+	quantity := decimal.Parse(req.GetQuantity()).Truncate(a.queryPrecision(req.GetSymbol()))
+	if !quantity.IsPositive() {
+		return &response, status.Error(11699, "the quantity must be greater than zero")
+	}
+
+	switch req.GetAssigning() {
+	case types.AssigningBorrow:
+
+		// The purpose of this code is to create a Service object that uses the context stored in the variable e. The Service
+		// object is then assigned to the variable migrate.
+		_account := account.Service{
+			Context: a.Context,
+		}
+
+		// This code is checking the user's status. A blocked user can not take a new loan.
+		if user, err := _account.QueryUser(auth); err != nil || !user.GetStatus() {
+			return &response, status.Error(748990, "your account and assets have been blocked, please contact technical support for any questions")
+		}
+
+		price, ok := a.queryValuation(req.GetSymbol())
+		if !ok {
+			return &response, status.Errorf(11695, "the price of the asset %v is not available", req.GetSymbol())
+		}
+
+		// The cross balance of the borrowed asset is created if the user does not have it yet.
+		if err := a.writeAsset(req.GetSymbol(), types.TypeCross, auth, false); err != nil {
+			return &response, err
+		}
+
+		// The loan and the credit of the cross balance are written in one transaction. A user has one open loan per asset, a
+		// new loan of the same asset increases the borrowed value of the open one.
+		tx, err := a.Context.Db.Begin()
+		if err != nil {
+			return &response, err
+		}
+		defer tx.Rollback()
+
+		// The borrowed asset increases both the assets and the liabilities of the cross balance by the same value, so the
+		// margin level after the loan is checked against the initial level, in the transaction that writes the loan.
+		if err := a.queryLevel(tx, auth, quantity.Mul(price), quantity.Mul(price)); err != nil {
+			return &response, err
+		}
+
+		if _, err := tx.Exec("insert into loans (user_id, symbol, value) values ($1, $2, $3) on conflict (user_id, symbol) where status = 'pending' do update set value = loans.value + excluded.value", auth, req.GetSymbol(), quantity); err != nil {
+			return &response, err
+		}
+
+		if err := a.writeBalance(tx, req.GetSymbol(), types.TypeCross, auth, quantity, types.BalancePlus); err != nil {
+			return &response, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return &response, err
+		}
+
+	case types.AssigningRepay:
+
+		// The loan is repaid from the cross balance of the borrowed asset.
+		if _, err := a.writeRepay(auth, req.GetSymbol(), quantity); err != nil {
+			return &response, err
+		}
+
+	default:
+		return &response, status.Error(11588, "invalid assigning loan position")
+	}
+
+	// The open loans of the user after the change are returned.
+	margin, err := a.queryMargin(a.Context.Db, auth)
+	if err != nil {
+		return &response, err
 	}
+	response.Fields = margin.GetFields()
 	response.Success = true
 
 	return &response, nil
 }
+
+// GetMargin - This function returns the state of the cross margin of a user: the open loans with their accrued interest, the value
+// of the assets and the liabilities of the cross balance in the valuation unit, the margin level and the margin status.
+func (a *Service) GetMargin(ctx context.Context, _ *pbprovider.GetRequestMargin) (*pbprovider.ResponseMargin, error) {
+
+	// This code snippet checks if the request is authenticated by calling the Auth() method on the Context object. If the
+	// authentication fails, the code returns an error.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &pbprovider.ResponseMargin{}, err
+	}
+
+	return a.queryMargin(a.Context.Db, auth)
+}
+
+// GetFeeTier - This function returns the fee tier of a user: the traded volume of the last 30 days in the valuation unit, the
+// reached tier of the fee schedule with its maker and taker rates in percent, the volume of the next tier and whether
+// the rates are overridden for the account. If a symbol is given, the rates of the asset are shown while the fee
+// schedule is empty.
+func (a *Service) GetFeeTier(ctx context.Context, req *pbprovider.GetRequestFeeTier) (*pbprovider.ResponseFeeTier, error) {
+
+	var (
+		discount, rate decimal.Amount
+	)
+
+	// This code snippet checks if the request is authenticated by calling the Auth() method on the Context object. If the
+	// authentication fails, the code returns an error.
+	auth, err := a.Context.Auth(ctx)
+	if err != nil {
+		return &pbprovider.ResponseFeeTier{}, err
+	}
+
+	// This code takes the fee rate and the maker discount of the asset, which are the rates while the fee schedule is empty.
+	if len(req.GetSymbol()) > 0 {
+		if err := a.Context.Db.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", req.GetSymbol()).Scan(&rate, &discount); err != nil {
+			return &pbprovider.ResponseFeeTier{}, err
+		}
+	}
+
+	return a.queryTier(a.Context.Db, auth, rate.Sub(discount), rate), nil
+}
@@ -0,0 +1,235 @@
+package provider
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+	"google.golang.org/grpc/status"
+)
+
+// halts - The halts variable is the registry of the halted pairs, the key is the base unit, the quote unit and the type of the
+// pair, and the value is the time the halt ends at automatically, a zero time means the pair is halted until it is
+// resumed by an administrator. The cross books are traded on the spot pairs, so they share the halt of the spot pair.
+// The halts are kept in the pairs table as well, the registry is the copy the matching engine reads on
+// every fill, so it is a package level registry shared by all services, the same as the order books.
+var halts = struct {
+	sync.Mutex
+	pairs map[string]time.Time
+}{
+	pairs: make(map[string]time.Time),
+}
+
+// queryBreached - This function checks whether the price has moved away from the reference price by more than the band, which is
+// the maximum deviation in percent. A band equal to zero, or a reference price that is not known, means no limit.
+func queryBreached(reference, price, band decimal.Amount) bool {
+
+	if !band.IsPositive() || !reference.IsPositive() {
+		return false
+	}
+
+	return price.Sub(reference).Abs().Div(reference).Mul(decimal.New(100).Amount()).GreaterThan(band)
+}
+
+// queryPairType - This function returns the type of the row of the pairs table that holds the trading rules, the band and the
+// halt of a book. The cross books are traded on the spot pairs, so they use the row of the spot pair.
+func queryPairType(_type string) string {
+
+	if _type == types.TypeCross {
+		return types.TypeSpot
+	}
+
+	return _type
+}
+
+// queryHalted - This function returns true if trading on the pair of the type is halted.
+func (a *Service) queryHalted(base, quote, _type string) bool {
+
+	halts.Lock()
+	defer halts.Unlock()
+
+	_, ok := halts.pairs[base+"/"+quote+"/"+queryPairType(_type)]
+	return ok
+}
+
+// queryValidateHalt - This function returns an error if trading on the pair is halted, it is used to reject the new orders and the
+// changes of the orders while the pair is halted.
+func (a *Service) queryValidateHalt(base, quote, _type string) error {
+
+	if a.queryHalted(base, quote, _type) {
+		return status.Errorf(11629, "trading on the pair %v-%v is halted", base, quote)
+	}
+
+	return nil
+}
+
+// replayBand - This function is called with the price of every trade of a pair. It compares the price with the reference price of
+// the band window of the pair, which is the first price recorded within the window for the same type of book, and halts the
+// pair if the price has moved away from it by more than the band of the pair. A cross book uses the band of the spot
+// pair, but its reference is taken from its own trades. The prices of the external markets never halt a pair.
+func (a *Service) replayBand(base, quote, _type string, price decimal.Amount) {
+
+	var (
+		band      decimal.Amount
+		reference decimal.Amount
+		window    int32
+		duration  int32
+	)
+
+	if err := a.Context.Db.QueryRow("select band, band_window, halt_duration from pairs where base_unit = $1 and quote_unit = $2 and type = $3", base, quote, queryPairType(_type)).Scan(&band, &window, &duration); err != nil {
+		return
+	}
+
+	if !band.IsPositive() || window <= 0 || a.queryHalted(base, quote, _type) {
+		return
+	}
+
+	if err := a.Context.Db.QueryRow("select price from ohlcv where base_unit = $1 and quote_unit = $2 and type = $3 and create_at >= now() - make_interval(secs => $4) order by create_at limit 1", base, quote, _type, window).Scan(&reference); err != nil {
+		return
+	}
+
+	if queryBreached(reference, price, band) {
+		a.Context.Debug(a.WriteHalt(base, quote, _type, duration))
+	}
+}
+
+// WriteHalt - This function halts trading on the pair: the matching of the pair is paused, the new orders are rejected and the
+// waiting conditional orders are not activated. The halt ends automatically after the given duration in seconds, a
+// duration equal to zero halts the pair until it is resumed by an administrator. The halted pair is published to the
+// "pair/halt" channel. A halt of a cross book halts its spot pair, and with it both books.
+func (a *Service) WriteHalt(base, quote, _type string, duration int32) error {
+
+	var (
+		until sql.NullTime
+		pair  types.Pair
+	)
+
+	_type = queryPairType(_type)
+
+	if duration > 0 {
+		until = sql.NullTime{Time: time.Now().UTC().Add(time.Duration(duration) * time.Second), Valid: true}
+	}
+
+	if err := a.Context.Db.QueryRow("update pairs set halt = true, halt_until = $4 where base_unit = $1 and quote_unit = $2 and type = $3 returning id", base, quote, _type, until).Scan(&pair.Id); err != nil {
+		return err
+	}
+
+	halts.Lock()
+	halts.pairs[base+"/"+quote+"/"+_type] = until.Time
+	halts.Unlock()
+
+	pair.BaseUnit, pair.QuoteUnit, pair.Type, pair.Halt = base, quote, _type, true
+	if until.Valid {
+		pair.HaltUntil = until.Time.Format(time.RFC3339)
+	}
+
+	if err := a.Context.Publish(&pair, "exchange", "pair/halt"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteResume - This function resumes trading on a halted pair and publishes the pair to the "pair/resume" channel. If the pair
+// has an auction duration, trading is reopened with a call auction, which is started before the halt is lifted, so no
+// order is matched continuously against the thin book. Otherwise the book is uncrossed right away, because the orders
+// placed into the book while the pair was halted may cross each other. The waiting conditional orders of the pair are
+// activated with the next last price. The cross book of a spot pair is resumed together with it, it has no call auction
+// of its own, so it is uncrossed right away.
+func (a *Service) WriteResume(base, quote, _type string) error {
+
+	var (
+		pair types.Pair
+	)
+
+	_type = queryPairType(_type)
+
+	if err := a.Context.Db.QueryRow("update pairs set halt = false, halt_until = null where base_unit = $1 and quote_unit = $2 and type = $3 returning id, auction_duration", base, quote, _type).Scan(&pair.Id, &pair.AuctionDuration); err != nil {
+		return err
+	}
+
+	if pair.GetAuctionDuration() > 0 {
+		if err := a.WriteAuction(base, quote, _type, pair.GetAuctionDuration()); err != nil {
+			return err
+		}
+	}
+
+	halts.Lock()
+	delete(halts.pairs, base+"/"+quote+"/"+_type)
+	halts.Unlock()
+
+	if pair.GetAuctionDuration() <= 0 {
+		a.writeUncross(base, quote, _type)
+	}
+
+	if _type == types.TypeSpot {
+		a.writeUncross(base, quote, types.TypeCross)
+	}
+
+	pair.BaseUnit, pair.QuoteUnit, pair.Type = base, quote, _type
+
+	if err := a.Context.Publish(&pair, "exchange", "pair/resume"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// restoreHalt - This function loads the halted pairs from the pairs table into the registry at startup.
+func (a *Service) restoreHalt() {
+
+	rows, err := a.Context.Db.Query("select base_unit, quote_unit, type, halt_until from pairs where halt = true")
+	if a.Context.Debug(err) {
+		return
+	}
+	defer rows.Close()
+
+	halts.Lock()
+	defer halts.Unlock()
+
+	for rows.Next() {
+
+		var (
+			base, quote, _type string
+			until              sql.NullTime
+		)
+
+		if err := rows.Scan(&base, &quote, &_type, &until); a.Context.Debug(err) {
+			continue
+		}
+
+		halts.pairs[base+"/"+quote+"/"+_type] = until.Time
+	}
+}
+
+// resume - The purpose of this code is to resume the halted pairs whose halt duration has passed. Every second the registry is
+// checked and the pairs with an expired halt are resumed with WriteResume.
+func (a *Service) resume() {
+
+	// The code creates a ticker that triggers every second and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Second * 1)
+	for range ticker.C {
+
+		var (
+			pairs [][3]string
+		)
+
+		// The expired halts are collected first, so the registry is not locked while the pairs are resumed.
+		halts.Lock()
+		for key, until := range halts.pairs {
+			if units := strings.Split(key, "/"); len(units) == 3 && !until.IsZero() && time.Now().After(until) {
+				pairs = append(pairs, [3]string{units[0], units[1], units[2]})
+			}
+		}
+		halts.Unlock()
+
+		for _, pair := range pairs {
+			if err := a.WriteResume(pair[0], pair[1], pair[2]); a.Context.Debug(err) {
+				continue
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestQueryBreached(t *testing.T) {
+	type args struct {
+		reference string
+		price     string
+		band      string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{name: "inside", args: args{reference: "100", price: "104", band: "5"}, want: false},
+		{name: "edge", args: args{reference: "100", price: "95", band: "5"}, want: false},
+		{name: "above", args: args{reference: "100", price: "105.5", band: "5"}, want: true},
+		{name: "below", args: args{reference: "100", price: "90", band: "5"}, want: true},
+		{name: "no band", args: args{reference: "100", price: "200", band: "0"}, want: false},
+		{name: "no reference", args: args{reference: "0", price: "200", band: "5"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryBreached(decimal.Parse(tt.args.reference), decimal.Parse(tt.args.price), decimal.Parse(tt.args.band)); got != tt.want {
+				t.Errorf("queryBreached() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryPairType(t *testing.T) {
+	tests := []struct {
+		_type string
+		want  string
+	}{
+		{_type: types.TypeSpot, want: types.TypeSpot},
+		{_type: types.TypeCross, want: types.TypeSpot},
+		{_type: types.TypeStock, want: types.TypeStock},
+	}
+	for _, tt := range tests {
+		t.Run(tt._type, func(t *testing.T) {
+			if got := queryPairType(tt._type); got != tt.want {
+				t.Errorf("queryPairType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
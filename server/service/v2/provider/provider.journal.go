@@ -0,0 +1,472 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// The events of the matching engine journal. Every change of a book is one event: an order is accepted by the engine, an order
+// leaves the book without being filled (cancel), an order is changed (amend) or decreased by the self-trade prevention
+// (decrement), two orders are filled with each other (fill), and an iceberg order is placed at the back of its queue
+// with its next slice (requeue).
+const (
+	journalAccept    = "accept"
+	journalCancel    = "cancel"
+	journalAmend     = "amend"
+	journalDecrement = "decrement"
+	journalFill      = "fill"
+	journalRequeue   = "requeue"
+)
+
+// entry - The entry struct is one event of the journal as it is replayed on a book. The order is the state of the order carried
+// by the accept and the amend events, the counter is the resting order of a fill, and the value and the price are the
+// filled value and the price of a fill, or the decreased value of a decrement.
+type entry struct {
+	id      int64
+	event   string
+	orderId int64
+	counter int64
+	value   decimal.Amount
+	price   decimal.Amount
+	order   *types.Order
+}
+
+// writeJournal - This function appends an event of the order to the journal and returns its sequence number. The events of a book
+// are always written while the book is locked, and the events that change the database are written through the same
+// executor, so the journal is committed or rolled back together with the change itself and the sequence numbers of the
+// events of a book follow the order in which the engine has processed them. The accept and the amend events carry the
+// state of the order, which is needed to place it into the book again.
+func (a *Service) writeJournal(tx executor, event string, order *types.Order, counter int64, value, price decimal.Amount) (sequence int64, err error) {
+
+	var (
+		payload = []byte("{}")
+	)
+
+	if event == journalAccept || event == journalAmend {
+		if payload, err = json.Marshal(order); err != nil {
+			return sequence, err
+		}
+	}
+
+	if err := tx.QueryRow("insert into journal (event, order_id, counter_id, base_unit, quote_unit, type, value, price, payload) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id", event, order.GetId(), counter, order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType(), value, price, payload).Scan(&sequence); err != nil {
+		return sequence, err
+	}
+
+	return sequence, nil
+}
+
+// queryJournal - This function returns the events of the book written after the given sequence number, up to the given last
+// sequence number, zero means all events, in the order in which they have been written.
+func (a *Service) queryJournal(base, quote, _type string, sequence, last int64) ([]*entry, error) {
+
+	var (
+		entries []*entry
+	)
+
+	if last == 0 {
+		last = 1<<63 - 1
+	}
+
+	rows, err := a.Context.Db.Query("select id, event, order_id, counter_id, value, price, payload from journal where base_unit = $1 and quote_unit = $2 and type = $3 and id > $4 and id <= $5 order by id", base, quote, _type, sequence, last)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			item    entry
+			payload []byte
+		)
+
+		if err := rows.Scan(&item.id, &item.event, &item.orderId, &item.counter, &item.value, &item.price, &payload); err != nil {
+			return entries, err
+		}
+
+		item.order = new(types.Order)
+		if err := json.Unmarshal(payload, item.order); err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, &item)
+	}
+
+	return entries, rows.Err()
+}
+
+// apply - This function replays an event of the journal on the book, the same way the engine has changed the book when the event
+// was written. The accepted order is placed into the book right away, its fills take it out again, and its remainder
+// that is not allowed to rest is taken out by its cancel event. The function returns an error if the event does not fit
+// the book, for example a fill of an order that is not in the book or a fill larger than the rest of an order.
+func (b *book) apply(item *entry) error {
+
+	switch item.event {
+	case journalAccept:
+
+		b.push(item.order)
+
+	case journalCancel:
+
+		// A waiting conditional order has never been in the book, its cancel does not change the book.
+		b.remove(item.orderId)
+
+	case journalAmend:
+
+		order := b.find(item.orderId)
+		if order == nil {
+			return fmt.Errorf("amend of the order %v that is not in the book", item.orderId)
+		}
+
+		// The order keeps its place in the queue only when the price stays the same and the value is not increased, the
+		// same rule as in AmendOrder.
+		price, value := decimal.Parse(item.order.GetPrice()), decimal.Parse(item.order.GetValue())
+		requeue := !price.Equal(decimal.Parse(order.GetPrice())) || value.GreaterThan(decimal.Parse(order.GetValue()))
+		if requeue {
+			b.remove(order.GetId())
+		}
+
+		order.Price, order.Quantity, order.Value = item.order.GetPrice(), item.order.GetQuantity(), item.order.GetValue()
+
+		if requeue {
+			b.push(order)
+		} else {
+			b.touch(order)
+		}
+
+	case journalDecrement:
+
+		order := b.find(item.orderId)
+		if order == nil {
+			return fmt.Errorf("decrement of the order %v that is not in the book", item.orderId)
+		}
+
+		order.Value = decimal.Parse(order.GetValue()).Sub(item.value).String()
+		b.touch(order)
+
+	case journalFill:
+
+		for _, id := range []int64{item.orderId, item.counter} {
+
+			order := b.find(id)
+			if order == nil {
+				return fmt.Errorf("fill of the order %v that is not in the book", id)
+			}
+
+			value := decimal.Parse(order.GetValue()).Sub(item.value)
+			if value.IsNegative() {
+				return fmt.Errorf("fill of %v is larger than the rest %v of the order %v", item.value, order.GetValue(), id)
+			}
+
+			order.Value = value.String()
+			if value.IsZero() {
+				b.remove(id)
+			} else {
+				b.touch(order)
+			}
+		}
+
+	case journalRequeue:
+
+		order := b.remove(item.orderId)
+		if order == nil {
+			return fmt.Errorf("requeue of the order %v that is not in the book", item.orderId)
+		}
+		b.push(order)
+
+	default:
+		return fmt.Errorf("unknown event %v", item.event)
+	}
+
+	return nil
+}
+
+// writeCheckpoint - This function writes the state of the book into the checkpoints table together with the sequence number of the
+// last event of the journal. The book must be locked by the caller, so no event of the book can be written in the
+// meantime. The first checkpoint of a book is kept as the starting point of the replay, the checkpoints between it and
+// the new one are not needed any more and are deleted.
+func (a *Service) writeCheckpoint(book *book) error {
+
+	var (
+		sequence int64
+	)
+
+	if err := a.Context.Db.QueryRow("select coalesce(max(id), 0) from journal").Scan(&sequence); err != nil {
+		return err
+	}
+
+	orders, err := json.Marshal(append(append([]*types.Order{}, book.bids...), book.asks...))
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.Context.Db.Exec("insert into checkpoints (base_unit, quote_unit, type, sequence, orders) values ($1, $2, $3, $4, $5)", book.base, book.quote, book._type, sequence, orders); err != nil {
+		return err
+	}
+
+	if _, err := a.Context.Db.Exec("delete from checkpoints where base_unit = $1 and quote_unit = $2 and type = $3 and id > (select min(id) from checkpoints where base_unit = $1 and quote_unit = $2 and type = $3) and id < (select max(id) from checkpoints where base_unit = $1 and quote_unit = $2 and type = $3)", book.base, book.quote, book._type); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// queryCheckpoint - This function returns the orders and the sequence number of the first (first = true) or the latest checkpoint
+// of the book. If the book has no checkpoint, the function returns no orders and the sequence number zero.
+func (a *Service) queryCheckpoint(base, quote, _type string, first bool) (orders []*types.Order, sequence int64, err error) {
+
+	var (
+		payload []byte
+		sort    = "desc"
+	)
+
+	if first {
+		sort = "asc"
+	}
+
+	if err := a.Context.Db.QueryRow(fmt.Sprintf("select sequence, orders from checkpoints where base_unit = $1 and quote_unit = $2 and type = $3 order by id %s limit 1", sort), base, quote, _type).Scan(&sequence, &payload); err != nil {
+		return orders, 0, nil
+	}
+
+	if err := json.Unmarshal(payload, &orders); err != nil {
+		return orders, sequence, err
+	}
+
+	return orders, sequence, nil
+}
+
+// restoreCheckpoint - This function rebuilds the in-memory order books from their latest checkpoints and the events of the journal
+// written after them, instead of scanning the orders table. The books that have events but no checkpoint are replayed
+// from their first event. The function returns false if there is no checkpoint at all, the books are then restored
+// from the orders table.
+func (a *Service) restoreCheckpoint() bool {
+
+	var (
+		exist bool
+		keys  [][3]string
+	)
+
+	if err := a.Context.Db.QueryRow("select exists(select id from checkpoints)").Scan(&exist); a.Context.Debug(err) || !exist {
+		return false
+	}
+
+	rows, err := a.Context.Db.Query("select base_unit, quote_unit, type from checkpoints union select distinct base_unit, quote_unit, type from journal")
+	if a.Context.Debug(err) {
+		return false
+	}
+
+	for rows.Next() {
+
+		var (
+			key [3]string
+		)
+
+		if err := rows.Scan(&key[0], &key[1], &key[2]); a.Context.Debug(err) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+
+		orders, sequence, err := a.queryCheckpoint(key[0], key[1], key[2], false)
+		if a.Context.Debug(err) {
+			continue
+		}
+
+		book := a.queryBook(key[0], key[1], key[2])
+		for _, order := range orders {
+			book.push(order)
+		}
+
+		entries, err := a.queryJournal(key[0], key[1], key[2], sequence, 0)
+		if a.Context.Debug(err) {
+			continue
+		}
+
+		for _, item := range entries {
+			a.Context.Debug(book.apply(item))
+		}
+	}
+
+	return true
+}
+
+// QueryReplay - This function rebuilds the book and the fills of the given pair and type from the journal and compares them with
+// the orders and the trades tables. The replay starts from the first checkpoint of the book, or from an empty book, and
+// applies all events up to the last event written before the tables were read. The book is locked only while the end of
+// the journal and the tables are read, the replay itself runs without the lock. Every difference is returned as a
+// discrepancy: an event that does not fit the book, a pending order that is missing in the rebuilt book or the other
+// way round, a different rest or price of an order, and a trade that is missing on either side or differs.
+func (a *Service) QueryReplay(base, quote, _type string) (*types.Replay, error) {
+
+	var (
+		response = types.Replay{BaseUnit: base, QuoteUnit: quote, Type: _type}
+		pending  = make(map[int64]*types.Order)
+		trades   = make(map[[2]int64]*types.Trade)
+		last     int64
+	)
+
+	orders, sequence, err := a.queryCheckpoint(base, quote, _type, true)
+	if err != nil {
+		return &response, err
+	}
+
+	if err := func() error {
+
+		book := a.queryBook(base, quote, _type)
+		book.Lock()
+		defer book.Unlock()
+
+		if err := a.Context.Db.QueryRow("select coalesce(max(id), 0) from journal").Scan(&last); err != nil {
+			return err
+		}
+
+		rows, err := a.Context.Db.Query("select id, value, price from orders where base_unit = $1 and quote_unit = $2 and type = $3 and status = $4", base, quote, _type, types.StatusPending)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+
+			var (
+				item types.Order
+			)
+
+			if err := rows.Scan(&item.Id, &item.Value, &item.Price); err != nil {
+				return err
+			}
+			pending[item.GetId()] = &item
+		}
+
+		rows, err = a.Context.Db.Query("select t.sequence, t.order_id, t.quantity, t.price from trades t inner join orders o on o.id = t.order_id where t.base_unit = $1 and t.quote_unit = $2 and o.type = $3 and t.sequence > $4 and t.sequence <= $5", base, quote, _type, sequence, last)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+
+			var (
+				item     types.Trade
+				position int64
+			)
+
+			if err := rows.Scan(&position, &item.Id, &item.Quantity, &item.Price); err != nil {
+				return err
+			}
+			trades[[2]int64{position, item.GetId()}] = &item
+		}
+
+		return nil
+	}(); err != nil {
+		return &response, err
+	}
+
+	entries, err := a.queryJournal(base, quote, _type, sequence, last)
+	if err != nil {
+		return &response, err
+	}
+
+	// The book is rebuilt in a new book that is not registered, so the book of the engine is never changed by the replay.
+	rebuild := &book{base: base, quote: quote, _type: _type}
+	for _, order := range orders {
+		rebuild.push(order)
+	}
+
+	for _, item := range entries {
+
+		// Every fill produces a trade of both orders with the filled value at the price of the fill.
+		if item.event == journalFill {
+			for _, id := range []int64{item.orderId, item.counter} {
+
+				trade, ok := trades[[2]int64{item.id, id}]
+				switch {
+				case !ok:
+					response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{Sequence: item.id, OrderId: id, Kind: "trade_missing", Journal: item.value.String()})
+				case !decimal.Parse(trade.GetQuantity()).Equal(item.value) || !decimal.Parse(trade.GetPrice()).Equal(item.price):
+					response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{Sequence: item.id, OrderId: id, Kind: "trade", Journal: fmt.Sprintf("%v@%v", item.value, item.price), Table: fmt.Sprintf("%v@%v", trade.GetQuantity(), trade.GetPrice())})
+				}
+				delete(trades, [2]int64{item.id, id})
+			}
+			response.Trades += 2
+		}
+
+		if err := rebuild.apply(item); err != nil {
+			response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{Sequence: item.id, OrderId: item.orderId, Kind: "event", Journal: err.Error()})
+		}
+		response.Events++
+	}
+
+	// The trades that are left have been written without a fill event in the journal.
+	for key, trade := range trades {
+		response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{Sequence: key[0], OrderId: key[1], Kind: "trade_unexpected", Table: trade.GetQuantity()})
+	}
+
+	for _, side := range [][]*types.Order{rebuild.bids, rebuild.asks} {
+		for _, order := range side {
+
+			item, ok := pending[order.GetId()]
+			switch {
+			case !ok:
+				response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{OrderId: order.GetId(), Kind: "order_unexpected", Journal: order.GetValue()})
+			case !decimal.Parse(item.GetValue()).Equal(decimal.Parse(order.GetValue())):
+				response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{OrderId: order.GetId(), Kind: "order_value", Journal: order.GetValue(), Table: item.GetValue()})
+			case !decimal.Parse(item.GetPrice()).Equal(decimal.Parse(order.GetPrice())):
+				response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{OrderId: order.GetId(), Kind: "order_price", Journal: order.GetPrice(), Table: item.GetPrice()})
+			}
+			delete(pending, order.GetId())
+			response.Orders++
+		}
+	}
+
+	// The pending orders that are left are not in the rebuilt book.
+	for id, item := range pending {
+		response.Discrepancies = append(response.Discrepancies, &types.Discrepancy{OrderId: id, Kind: "order_missing", Table: item.GetValue()})
+	}
+	response.Sequence = last
+
+	return &response, nil
+}
+
+// checkpoint - The purpose of this code is to write a checkpoint of every order book every minute, so the books can be rebuilt at
+// startup from their latest checkpoints and the tail of the journal.
+func (a *Service) checkpoint() {
+
+	// The code creates a ticker that triggers every minute and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Minute * 1)
+	for range ticker.C {
+		a.writeCheckpoints()
+	}
+}
+
+// writeCheckpoints - This function writes a checkpoint of every order book, every book is locked only while its own checkpoint is written.
+func (a *Service) writeCheckpoints() {
+
+	var (
+		rows []*book
+	)
+
+	// The books are copied from the registry first, so the registry is not locked while the checkpoints are written.
+	books.Lock()
+	for _, row := range books.pairs {
+		rows = append(rows, row)
+	}
+	books.Unlock()
+
+	for _, row := range rows {
+		row.Lock()
+		err := a.writeCheckpoint(row)
+		row.Unlock()
+
+		if a.Context.Debug(err) {
+			continue
+		}
+	}
+}
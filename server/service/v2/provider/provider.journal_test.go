@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestBook_Apply(t *testing.T) {
+	b := new(book)
+
+	entries := []*entry{
+		{event: journalAccept, orderId: 1, order: &types.Order{Id: 1, Assigning: types.AssigningSell, Price: "100", Value: "2"}},
+		{event: journalAccept, orderId: 2, order: &types.Order{Id: 2, Assigning: types.AssigningSell, Price: "100", Value: "1"}},
+		{event: journalAccept, orderId: 3, order: &types.Order{Id: 3, Assigning: types.AssigningBuy, Price: "101", Value: "2.5"}},
+		{event: journalFill, orderId: 3, counter: 1, value: decimal.Parse("2"), price: decimal.Parse("100")},
+		{event: journalFill, orderId: 3, counter: 2, value: decimal.Parse("0.5"), price: decimal.Parse("100")},
+		{event: journalCancel, orderId: 9},
+	}
+	for _, item := range entries {
+		if err := b.apply(item); err != nil {
+			t.Fatalf("apply() = %v, want nil", err)
+		}
+	}
+
+	// The taker and the first maker have been filled completely, the second maker rests with the rest of its value.
+	if len(b.bids) != 0 || len(b.asks) != 1 || b.asks[0].GetId() != 2 || b.asks[0].GetValue() != "0.5" {
+		t.Fatalf("book = %v %v, want order 2 (0.5)", b.bids, b.asks)
+	}
+
+	b.apply(&entry{event: journalAccept, orderId: 4, order: &types.Order{Id: 4, Assigning: types.AssigningSell, Price: "99", Value: "1"}})
+
+	// The amended order with a new price loses its place in the queue.
+	if err := b.apply(&entry{event: journalAmend, orderId: 2, order: &types.Order{Id: 2, Price: "99", Quantity: "1", Value: "0.5"}}); err != nil {
+		t.Fatalf("apply() = %v, want nil", err)
+	}
+	if b.asks[0].GetId() != 4 || b.asks[1].GetId() != 2 {
+		t.Errorf("asks = %v, want orders 4 and 2", b.asks)
+	}
+
+	if err := b.apply(&entry{event: journalFill, orderId: 5, counter: 4, value: decimal.Parse("1")}); err == nil {
+		t.Errorf("apply() = nil, want an error for an order that is not in the book")
+	}
+	if err := b.apply(&entry{event: journalDecrement, orderId: 4, value: decimal.Parse("0.25")}); err != nil || b.asks[0].GetValue() != "0.75" {
+		t.Errorf("apply() = %v, value %v, want 0.75", err, b.asks[0].GetValue())
+	}
+}
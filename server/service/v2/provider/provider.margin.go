@@ -0,0 +1,721 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/assets/common/marketplace"
+	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
+	"github.com/cryptogateway/backend-envoys/server/types"
+	"google.golang.org/grpc/status"
+)
+
+// The default settings of the cross margin mode, they apply to what is not configured in the Margin section of the
+// configuration. The margin level is the value of all assets of the cross balance divided by the value of all loans with
+// their interest. A new loan or a withdrawal can not bring the level below the initial level, below the call level the
+// user is notified, and below the liquidation level the assets are sold to repay the loans.
+var (
+	marginValuation   = "usd"
+	marginInitial     = decimal.Parse("1.5")
+	marginCall        = decimal.Parse("1.3")
+	marginLiquidation = decimal.Parse("1.1")
+)
+
+// margins - The margins variable keeps the last known margin status of every user with loans. It is used to publish a margin
+// call only once when the level falls below the call level, and to make sure the assets of a user are never liquidated
+// by two goroutines at the same time.
+var margins = struct {
+	sync.Mutex
+	users map[int64]string
+}{
+	users: make(map[int64]string),
+}
+
+// valuations - The valuations variable keeps the marketplace prices of the assets that are not traded against the valuation
+// unit on the exchange. It is refreshed in the background by valuation(), so an asset is valued without any network
+// request while the rows of a loan, a transfer or a fill are locked.
+var valuations = struct {
+	sync.Mutex
+	prices map[string]decimal.Amount
+}{
+	prices: make(map[string]decimal.Amount),
+}
+
+// queryLevels - This function returns the settings of the cross margin mode from the Margin section of the configuration: the
+// valuation unit and the initial, the call and the liquidation margin levels. A setting that is not configured, or a
+// level that is not a positive number, keeps its default.
+func (a *Service) queryLevels() (valuation string, initial, call, liquidation decimal.Amount) {
+
+	valuation, initial, call, liquidation = marginValuation, marginInitial, marginCall, marginLiquidation
+
+	if a.Context.Margin == nil {
+		return valuation, initial, call, liquidation
+	}
+
+	if len(a.Context.Margin.Valuation) > 0 {
+		valuation = a.Context.Margin.Valuation
+	}
+
+	if level := decimal.Parse(a.Context.Margin.Initial); level.IsPositive() {
+		initial = level
+	}
+
+	if level := decimal.Parse(a.Context.Margin.Call); level.IsPositive() {
+		call = level
+	}
+
+	if level := decimal.Parse(a.Context.Margin.Liquidation); level.IsPositive() {
+		liquidation = level
+	}
+
+	return valuation, initial, call, liquidation
+}
+
+// queryValuation - This function returns the price of one unit of the given asset in the valuation unit of the configuration,
+// which is used to compare the assets and the loans of the cross balance. The price is taken from the pair of the asset
+// with the valuation unit, from the inverse pair, or from the marketplace price cached by valuation() if the exchange has no
+// such pair. It never makes a network request, it is called inside transactions that hold row locks.
+func (a *Service) queryValuation(symbol string) (price decimal.Amount, ok bool) {
+
+	valuation, _, _, _ := a.queryLevels()
+
+	// The valuation unit itself is always worth one.
+	if symbol == valuation {
+		return decimal.New(1).Amount(), true
+	}
+
+	// This code takes the price of the direct pair (asset/valuation) from the database.
+	if value, ok := a.queryPrice(symbol, valuation); ok && value.IsPositive() {
+		return value, true
+	}
+
+	// This code takes the price of the inverse pair (valuation/asset) from the database and inverts it.
+	if value, ok := a.queryPrice(valuation, symbol); ok && value.IsPositive() {
+		return decimal.New(1).Amount().DivRound(value, 18), true
+	}
+
+	// The asset is not traded against the valuation unit on the exchange, so the cached marketplace price is taken.
+	valuations.Lock()
+	defer valuations.Unlock()
+
+	if value, ok := valuations.prices[symbol]; ok && value.IsPositive() {
+		return value, true
+	}
+
+	return price, false
+}
+
+// queryMargin - This function calculates the margin level of the cross balance of a user. The assets are the cross balances
+// together with the amounts reserved by the pending cross orders, the liabilities are the loans with the accrued
+// interest, both are valued in the valuation unit. If the user has no loans, the level is zero and the status is normal.
+// The cross balances and the loans are read through the given executor and their rows are locked, so inside a
+// transaction the margin level can not be changed by a concurrent transfer or loan of the user until it ends.
+func (a *Service) queryMargin(tx executor, userId int64) (*pbprovider.ResponseMargin, error) {
+
+	var (
+		response            = new(pbprovider.ResponseMargin)
+		assets, liabilities decimal.Amount
+	)
+
+	_, _, call, liquidation := a.queryLevels()
+
+	// This code sums the values of all cross balances of the user.
+	rows, err := tx.Query("select symbol, value from balances where user_id = $1 and type = $2 and value > 0 order by id for update", userId, types.TypeCross)
+	if err != nil {
+		return response, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			symbol string
+			value  decimal.Amount
+		)
+
+		if err := rows.Scan(&symbol, &value); err != nil {
+			return response, err
+		}
+
+		// Assets that can not be valued are not taken into account, they can not be used as collateral.
+		if price, ok := a.queryValuation(symbol); ok {
+			assets = assets.Add(value.Mul(price))
+		}
+	}
+
+	// The rows are read before the next query is made, a transaction can only read one result set at a time.
+	rows.Close()
+
+	// The amounts reserved by the pending and the waiting cross orders still belong to the user, so they are part of the
+	// assets: the quote amount of the buy orders and the base amount of the sell orders.
+	orders, err := tx.Query("select assigning, base_unit, quote_unit, value, price from orders where user_id = $1 and type = $2 and (status = $3 or status = $4)", userId, types.TypeCross, types.StatusPending, types.StatusWaiting)
+	if err != nil {
+		return response, err
+	}
+	defer orders.Close()
+
+	for orders.Next() {
+
+		var (
+			item         types.Order
+			value, price decimal.Amount
+		)
+
+		if err := orders.Scan(&item.Assigning, &item.BaseUnit, &item.QuoteUnit, &value, &price); err != nil {
+			return response, err
+		}
+
+		switch item.GetAssigning() {
+		case types.AssigningBuy:
+			if rate, ok := a.queryValuation(item.GetQuoteUnit()); ok {
+				assets = assets.Add(value.Mul(price).Mul(rate))
+			}
+		case types.AssigningSell:
+			if rate, ok := a.queryValuation(item.GetBaseUnit()); ok {
+				assets = assets.Add(value.Mul(rate))
+			}
+		}
+	}
+
+	orders.Close()
+
+	// The loans of the user with their accrued interest are the liabilities of the cross balance.
+	loans, err := tx.Query("select id, user_id, symbol, value, interest, status, create_at from loans where user_id = $1 and status = $2 order by id for update", userId, types.StatusPending)
+	if err != nil {
+		return response, err
+	}
+	defer loans.Close()
+
+	for loans.Next() {
+
+		var (
+			item            types.Loan
+			value, interest decimal.Amount
+		)
+
+		if err := loans.Scan(&item.Id, &item.UserId, &item.Symbol, &value, &interest, &item.Status, &item.CreateAt); err != nil {
+			return response, err
+		}
+		item.Value, item.Interest = value.String(), interest.String()
+
+		// A loan that can not be valued can not be compared with the collateral, so the margin can not be calculated.
+		price, ok := a.queryValuation(item.GetSymbol())
+		if !ok {
+			return response, status.Errorf(11695, "the price of the asset %v is not available", item.GetSymbol())
+		}
+		liabilities = liabilities.Add(value.Add(interest).Mul(price))
+
+		response.Fields = append(response.Fields, &item)
+	}
+
+	response.UserId = userId
+	response.Assets = assets.String()
+	response.Liabilities = liabilities.String()
+	response.Level = decimal.Zero.String()
+	response.Status = types.MarginNormal
+
+	// The margin level is only defined when the user has loans.
+	if liabilities.IsPositive() {
+
+		level := assets.DivRound(liabilities, 8)
+		response.Level = level.String()
+
+		switch {
+		case level.LessThan(liquidation):
+			response.Status = types.MarginLiquidation
+		case level.LessThan(call):
+			response.Status = types.MarginCall
+		}
+	}
+
+	return response, nil
+}
+
+// queryLevel - This function checks whether the margin level of a user stays at or above the initial level when the value of the
+// assets and the liabilities of the cross balance change by the given amounts (in the valuation unit). It is used inside
+// the transaction that takes a new loan or withdraws the collateral, so the checked level is the one the change is
+// written against.
+func (a *Service) queryLevel(tx executor, userId int64, assets, liabilities decimal.Amount) error {
+
+	_, initial, _, _ := a.queryLevels()
+
+	margin, err := a.queryMargin(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	// The assets and the liabilities after the change.
+	assets, liabilities = decimal.Parse(margin.GetAssets()).Add(assets), decimal.Parse(margin.GetLiabilities()).Add(liabilities)
+
+	// Without liabilities there is nothing to secure.
+	if !liabilities.IsPositive() {
+		return nil
+	}
+
+	if assets.DivRound(liabilities, 8).LessThan(initial) {
+		return status.Errorf(11696, "the margin level can not fall below %v", initial)
+	}
+
+	return nil
+}
+
+// writeRepay - This function repays the loan of the given asset from the cross balance of the user. The interest is paid first
+// and is charged as a fee of the asset, the rest of the quantity repays the borrowed value. If the loan is repaid
+// completely, it is closed. The quantity is limited by the debt and by the cross balance of the user.
+func (a *Service) writeRepay(userId int64, symbol string, quantity decimal.Amount) (decimal.Amount, error) {
+
+	var (
+		value, interest, balance decimal.Amount
+	)
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return quantity, err
+	}
+	defer tx.Rollback()
+
+	// The loan and the balance are locked, so the same debt can not be repaid twice by concurrent requests.
+	if err := tx.QueryRow("select value, interest from loans where user_id = $1 and symbol = $2 and status = $3 for update", userId, symbol, types.StatusPending).Scan(&value, &interest); err != nil {
+		return quantity, status.Errorf(11697, "there is no loan of %v", symbol)
+	}
+
+	if err := tx.QueryRow("select value from balances where user_id = $1 and symbol = $2 and type = $3 for update", userId, symbol, types.TypeCross).Scan(&balance); err != nil {
+		return quantity, err
+	}
+
+	// The quantity can not be higher than the debt and than the balance.
+	if debt := value.Add(interest); quantity.GreaterThan(debt) {
+		quantity = debt
+	}
+	if quantity.GreaterThan(balance) {
+		quantity = balance
+	}
+	if !quantity.IsPositive() {
+		return quantity, status.Error(11698, "there is not enough funds on your cross balance to repay the loan")
+	}
+
+	// The interest is paid before the borrowed value.
+	paid := decimal.Min(quantity, interest)
+
+	if _, err := tx.Exec("update loans set interest = interest - $3, value = value - $4 where user_id = $1 and symbol = $2 and status = $5", userId, symbol, paid, quantity.Sub(paid), types.StatusPending); err != nil {
+		return quantity, err
+	}
+
+	// A loan without value and interest is repaid completely and is closed.
+	if quantity.Equal(value.Add(interest)) {
+		if _, err := tx.Exec("update loans set status = $3 where user_id = $1 and symbol = $2 and status = $4", userId, symbol, types.StatusFilled, types.StatusPending); err != nil {
+			return quantity, err
+		}
+	}
+
+	// The paid interest is the income of the exchange, it is charged as a fee of the asset.
+	if paid.IsPositive() {
+		if _, err := tx.Exec("update assets set fees_charges = fees_charges + $2 where symbol = $1;", symbol, paid); err != nil {
+			return quantity, err
+		}
+	}
+
+	if err := a.writeBalance(tx, symbol, types.TypeCross, userId, quantity, types.BalanceMinus); err != nil {
+		return quantity, err
+	}
+
+	return quantity, tx.Commit()
+}
+
+// writeMarket - This function places a market order on behalf of a user, the same way as SetOrder does, and matches it against
+// the order book with trade. It is used by the liquidation to sell the collateral of a user. The quantity is the base
+// quantity of the order for both sides, a buy order is limited to the quantity its cross balance can pay for.
+func (a *Service) writeMarket(userId int64, base, quote, assigning string, quantity decimal.Amount) error {
+
+	var (
+		order    types.Order
+		opposite = types.AssigningBuy
+	)
+
+	// The precision of the pair defines the precision of the quantity and of the price.
+	b, q, err := a.queryDecimal(base, quote, types.TypeCross)
+	if err != nil {
+		return err
+	}
+
+	if assigning == types.AssigningBuy {
+		opposite = types.AssigningSell
+	}
+
+	// The market order walks the opposite side of the book level by level, the same way as in SetOrder, and the price of the
+	// order is the price of the worst order reached, so the order crosses every level of the walk. The quantity is a base
+	// quantity for both sides here, so it is consumed the way the quantity of a sell order is.
+	book := a.queryBook(base, quote, types.TypeCross)
+	book.Lock()
+	quantity, price, _ := book.sweep(&types.Order{Assigning: types.AssigningSell, UserId: userId}, opposite, quantity.Truncate(b))
+	book.Unlock()
+
+	price = price.Truncate(q)
+	if !quantity.IsPositive() || !price.IsPositive() {
+		return status.Error(11597, "there is no liquidity in the book to fill the market order")
+	}
+
+	// A buy order reserves its quantity at the worst price of the walk, so it is limited to what the cross balance of the
+	// quote unit can pay at that price.
+	if assigning == types.AssigningBuy {
+		if balance := a.QueryBalance(quote, types.TypeCross, userId); quantity.Mul(price).GreaterThan(balance) {
+			quantity = balance.Div(price)
+		}
+	}
+
+	order.Quantity = quantity.Truncate(b).String()
+	order.Value = order.GetQuantity()
+	order.Price = price.String()
+	order.UserId = userId
+	order.BaseUnit = base
+	order.QuoteUnit = quote
+	order.Assigning = assigning
+	order.Trading = types.TradingMarket
+	order.Type = types.TypeCross
+	order.Status = types.StatusPending
+	order.CreateAt = time.Now().UTC().Format(time.RFC3339)
+
+	// The balance that receives the fills of the order is created if the user does not have it yet.
+	symbol, side := base, types.AssigningSell
+	if assigning == types.AssigningSell {
+		symbol, side = quote, types.AssigningBuy
+	}
+
+	if err := a.writeAsset(symbol, types.TypeCross, userId, false); err != nil {
+		return err
+	}
+
+	// The amount reserved by the order is validated and taken from the cross balance, the same way as in SetOrder.
+	if err := a.writeOpen(&order); err != nil {
+		return err
+	}
+
+	a.trade(&order, side)
+
+	// What could not be filled at once must not stay in the book, the liquidation is repeated with the next check.
+	if decimal.Parse(order.GetValue()).IsPositive() && order.GetStatus() == types.StatusPending {
+		if err := a.writeCancel(&order); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queryGross - This function returns the amount of the asset a user has to receive from a trade, so that the given amount is left
+// after the taker fee of the user, which is charged on the received asset.
+func (a *Service) queryGross(userId int64, symbol string, amount decimal.Amount) decimal.Amount {
+
+	var (
+		r, d decimal.Amount
+	)
+
+	if err := a.Context.Db.QueryRow("select fees_trade, fees_discount from assets where symbol = $1", symbol).Scan(&r, &d); a.Context.Debug(err) {
+		return amount
+	}
+
+	// The part of the received amount that is left after the fee, in percent.
+	rest := decimal.New(100).Amount().Sub(decimal.Parse(a.queryTier(a.Context.Db, userId, r.Sub(d), r).GetTaker()))
+	if !rest.IsPositive() {
+		return amount
+	}
+
+	return amount.Mul(decimal.New(100).Amount()).Div(rest)
+}
+
+// queryProceeds - This function walks the bids of the pair with sweep and returns the base quantity a sale has to take from them
+// to receive the given quote amount. The amount is consumed at the price of every bid, the same way the quote amount of a
+// buy order is consumed, and the bids of the user are skipped. If the bids are not deep enough, all of them are taken.
+func (a *Service) queryProceeds(base, quote string, userId int64, amount decimal.Amount) decimal.Amount {
+
+	book := a.queryBook(base, quote, types.TypeCross)
+	book.Lock()
+	defer book.Unlock()
+
+	quantity, _, _ := book.sweep(&types.Order{Assigning: types.AssigningBuy, UserId: userId}, types.AssigningBuy, amount)
+
+	return quantity
+}
+
+// writeLiquidation - This function liquidates the cross balance of a user whose margin level fell below the liquidation level.
+// All pending cross orders are canceled, the loans are repaid from the balances of the borrowed assets, and if that is not
+// enough, the other assets of the cross balance are sold for the borrowed assets with market orders through trade, and the
+// loans are repaid again.
+func (a *Service) writeLiquidation(margin *pbprovider.ResponseMargin) {
+
+	// This code cancels all pending and waiting cross orders of the user, the reserved amounts are returned to the cross balance.
+	rows, err := a.Context.Db.Query("select id, value, quantity, price, assigning, base_unit, quote_unit, user_id, type, status from orders where user_id = $1 and type = $2 and (status = $3 or status = $4)", margin.GetUserId(), types.TypeCross, types.StatusPending, types.StatusWaiting)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	var (
+		orders []*types.Order
+	)
+
+	for rows.Next() {
+
+		var (
+			item types.Order
+		)
+
+		if err := rows.Scan(&item.Id, &item.Value, &item.Quantity, &item.Price, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.Type, &item.Status); a.Context.Debug(err) {
+			continue
+		}
+		orders = append(orders, &item)
+	}
+	rows.Close()
+
+	for _, item := range orders {
+		if err := a.writeCancel(item); a.Context.Debug(err) {
+			continue
+		}
+	}
+
+	for _, loan := range margin.GetFields() {
+
+		// The debt of the loan with the accrued interest.
+		debt := decimal.Parse(loan.GetValue()).Add(decimal.Parse(loan.GetInterest()))
+
+		// First, the loan is repaid from the balance of the borrowed asset.
+		if paid, err := a.writeRepay(margin.GetUserId(), loan.GetSymbol(), debt); err == nil {
+			debt = debt.Sub(paid)
+		}
+
+		if !debt.IsPositive() {
+			continue
+		}
+
+		// The rest of the debt is covered by selling the other assets of the cross balance for the borrowed asset. Every asset
+		// that is traded against the borrowed asset is sold until the debt is covered.
+		assets, err := a.Context.Db.Query("select symbol, value from balances where user_id = $1 and type = $2 and symbol != $3 and value > 0", margin.GetUserId(), types.TypeCross, loan.GetSymbol())
+		if a.Context.Debug(err) {
+			continue
+		}
+
+		var (
+			symbols  []string
+			balances []decimal.Amount
+		)
+
+		for assets.Next() {
+
+			var (
+				symbol string
+				value  decimal.Amount
+			)
+
+			if err := assets.Scan(&symbol, &value); a.Context.Debug(err) {
+				continue
+			}
+			symbols, balances = append(symbols, symbol), append(balances, value)
+		}
+		assets.Close()
+
+		for i, symbol := range symbols {
+
+			// The remaining debt is checked before every sale, so no more collateral is sold than needed.
+			if !debt.IsPositive() {
+				break
+			}
+
+			// The fee of the trade is charged on the borrowed asset that is received, so the debt is grossed up by the taker rate
+			// of the user to get what has to be received before the fee.
+			gross := a.queryGross(margin.GetUserId(), loan.GetSymbol(), debt)
+
+			switch {
+			case a.queryValidatePair(symbol, loan.GetSymbol(), types.TypeCross) == nil:
+
+				// The asset is the base unit of the pair, it is sold for the borrowed asset. The bids are walked for the quantity
+				// whose proceeds cover the debt, no more of the balance is sold than that.
+				if quantity := a.queryProceeds(symbol, loan.GetSymbol(), margin.GetUserId(), gross); quantity.IsPositive() {
+					if err := a.writeMarket(margin.GetUserId(), symbol, loan.GetSymbol(), types.AssigningSell, decimal.Min(balances[i], quantity)); a.Context.Debug(err) {
+						continue
+					}
+				}
+
+			case a.queryValidatePair(loan.GetSymbol(), symbol, types.TypeCross) == nil:
+
+				// The asset is the quote unit of the pair, the debt is bought with it.
+				if err := a.writeMarket(margin.GetUserId(), loan.GetSymbol(), symbol, types.AssigningBuy, gross); a.Context.Debug(err) {
+					continue
+				}
+
+			default:
+				continue
+			}
+
+			// The bought asset is used to repay the loan right away.
+			if paid, err := a.writeRepay(margin.GetUserId(), loan.GetSymbol(), debt); err == nil {
+				debt = debt.Sub(paid)
+			}
+		}
+	}
+
+	// This code is intended to publish the liquidated margin to an exchange with the routing key "margin/liquidation".
+	if err := a.Context.Publish(margin, "exchange", "margin/liquidation"); a.Context.Debug(err) {
+		return
+	}
+}
+
+// replayMargin - This function checks the margin level of a user. When the level falls below the call level, a margin call is
+// published once, and when it falls below the liquidation level, the cross balance of the user is liquidated.
+func (a *Service) replayMargin(userId int64) {
+
+	margin, err := a.queryMargin(a.Context.Db, userId)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	// The last known status of the user is replaced with the current one. A liquidation that is already running is not
+	// started again until it has finished.
+	margins.Lock()
+	previous := margins.users[userId]
+	if previous == types.MarginLiquidation {
+		margins.Unlock()
+		return
+	}
+	margins.users[userId] = margin.GetStatus()
+	margins.Unlock()
+
+	switch margin.GetStatus() {
+	case types.MarginCall:
+
+		// The margin call is published only when the level falls below the call level, not on every check.
+		if previous != types.MarginCall {
+			if err := a.Context.Publish(margin, "exchange", "margin/call"); a.Context.Debug(err) {
+				return
+			}
+		}
+
+	case types.MarginLiquidation:
+
+		a.writeLiquidation(margin)
+
+		// The liquidation is finished, the status is checked again with the next replay.
+		margins.Lock()
+		delete(margins.users, userId)
+		margins.Unlock()
+	}
+}
+
+// interest - This function is used to accrue the interest of the loans. Every hour the interest of all open loans is increased
+// by the borrowed value multiplied by the hourly rate of the borrowed asset (assets.fees_borrow).
+func (a *Service) interest() {
+
+	// The code creates a ticker that triggers every hour and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Hour * 1)
+	for range ticker.C {
+
+		// This code accrues the interest of all open loans in a single statement, so every loan is charged exactly once per hour.
+		if _, err := a.Context.Db.Exec("update loans l set interest = l.interest + l.value * a.fees_borrow from assets a where a.symbol = l.symbol and l.status = $1", types.StatusPending); a.Context.Debug(err) {
+			continue
+		}
+	}
+}
+
+// margin - This function is used to replay the cross margin. Every minute the margin level of all users with open loans is
+// checked, so margin calls are published and the cross balances below the liquidation level are liquidated.
+func (a *Service) margin() {
+
+	// The code creates a ticker that triggers every minute and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Minute * 1)
+	for range ticker.C {
+
+		func() {
+
+			// This code queries all users with open loans.
+			rows, err := a.Context.Db.Query("select distinct user_id from loans where status = $1", types.StatusPending)
+			if a.Context.Debug(err) {
+				return
+			}
+
+			var (
+				users []int64
+			)
+
+			for rows.Next() {
+
+				var (
+					userId int64
+				)
+
+				if err := rows.Scan(&userId); a.Context.Debug(err) {
+					continue
+				}
+				users = append(users, userId)
+			}
+			rows.Close()
+
+			for _, userId := range users {
+				a.replayMargin(userId)
+			}
+		}()
+	}
+}
+
+// valuation - This function refreshes the cached marketplace prices of the valuation right away, and then the code creates
+// a ticker that triggers every minute and refreshes them each time the ticker is triggered.
+func (a *Service) valuation() {
+
+	a.replayValuation()
+
+	ticker := time.NewTicker(time.Minute * 1)
+	for range ticker.C {
+		a.replayValuation()
+	}
+}
+
+// replayValuation - This function caches the marketplace prices of the assets that are not traded against the valuation unit
+// on the exchange. The assets are read and their rows are closed before the marketplace is asked, and the cache is only
+// locked to store a result, so the slow requests never hold a lock.
+func (a *Service) replayValuation() {
+
+	valuation, _, _, _ := a.queryLevels()
+
+	// This code queries all active assets.
+	rows, err := a.Context.Db.Query("select symbol from assets where status = $1", true)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	var (
+		symbols []string
+	)
+
+	for rows.Next() {
+
+		var (
+			symbol string
+		)
+
+		if err := rows.Scan(&symbol); a.Context.Debug(err) {
+			continue
+		}
+		symbols = append(symbols, symbol)
+	}
+	rows.Close()
+
+	for _, symbol := range symbols {
+
+		if symbol == valuation {
+			continue
+		}
+
+		// An asset with a pair against the valuation unit is valued from the pair.
+		if price, ok := a.queryPrice(symbol, valuation); ok && price.IsPositive() {
+			continue
+		}
+
+		if price, ok := a.queryPrice(valuation, symbol); ok && price.IsPositive() {
+			continue
+		}
+
+		if value := marketplace.Price().Unit(symbol, valuation); value > 0 {
+			valuations.Lock()
+			valuations.prices[symbol] = decimal.New(value).Amount()
+			valuations.Unlock()
+		}
+	}
+}
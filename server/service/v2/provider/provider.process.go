@@ -2,256 +2,462 @@ package provider
 
 import (
 	"context"
+	"database/sql"
+	"strings"
 
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"github.com/cryptogateway/backend-envoys/assets/common/query"
 	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
 	"github.com/cryptogateway/backend-envoys/server/types"
-	"google.golang.org/grpc/status"
 )
 
-// trade - This function is used to replay a trade init. It takes an order and a side (BID or ASK) as parameters. It then queries
-// the database for orders with the same base unit, quote unit and user ID, and with a status of "PENDING". It then
-// iterates through the results and checks if the order's price is higher than the item's price for a BID position and
-// lower for an ASK position. If this is the case, it calls the replayTradeProcess() function. Finally, it logs any matches or failed matches.
+// trade - This function is used to match an order against the in-memory order book of its pair. It takes an order and the side
+// of the book (BID or ASK) that the order is matched against. The resting orders are walked from the best price to the
+// worst one, and for the same price in the order of their arrival, so the order is always executed at the best available
+// price. The walk stops when the order is filled or when the next resting order no longer crosses the order price. If the
+// order is not filled completely, the remainder is placed into the book.
 func (a *Service) trade(order *types.Order, assigning string) {
 
 	// This code is checking for an error when publishing to the exchange. If an error occurs, the code is printing out the
 	// error and returning.
-	if err := a.Context.Publish(order, "exchange", "order/create"); a.Context.Debug(err) {
+	if err := a.writePublish(order, "order/create"); a.Context.Debug(err) {
 		return
 	}
 
-	// This code is querying the "orders" table in a database for data that matches the given parameters. It is using the
-	// parameters given to query for a specific set of data from the "orders" table. It is using the $1, $2, $3, $4, $5 and
-	// $6 to represent the given parameters. The query is also ordering the results by the "id" column. It is checking for
-	// errors and deferring the closing of the rows.
-	rows, err := a.Context.Db.Query(`select id, assigning, base_unit, quote_unit, value, quantity, price, user_id, type, status from orders where assigning = $1 and base_unit = $2 and quote_unit = $3 and user_id != $4 and type = $5 and status = $6 order by id`, assigning, order.GetBaseUnit(), order.GetQuoteUnit(), order.GetUserId(), order.GetType(), types.StatusPending)
-	if a.Context.Debug(err) {
+	// The book of the pair is locked for the whole matching process, so the orders placed on the same pair at the same
+	// time are matched one after another and a resting order can never be filled twice.
+	book := a.queryBook(order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType())
+	book.Lock()
+	defer a.release(book)
+
+	// The order is accepted by the engine, the event is written before any of its fills. A journal that can not be written
+	// does not stop the matching, the replay reports the missing event.
+	_, err := a.writeJournal(a.Context.Db, journalAccept, order, 0, decimal.Zero, decimal.Zero)
+	a.Context.Debug(err)
+
+	a.match(book, order, assigning)
+}
+
+// match - This function matches the order against the given side of the book, which must be locked by the caller. It checks
+// the time in force of the order, walks the resting orders and places the remainder of the order into the book. It is
+// used by trade for the new orders and by AmendOrder for the orders that are requeued after a change.
+func (a *Service) match(book *book, order *types.Order, assigning string) {
+
+	// During the call auction of the pair the orders are only collected in the book, they are matched at the uncross. The
+	// same applies to the orders that reach the book of a halted pair, the book is uncrossed when the pair is resumed.
+	if _, ok := a.queryAuction(order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType()); ok || a.queryHalted(order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType()) {
+		book.push(order)
 		return
 	}
-	defer rows.Close()
 
-	// The purpose of the for loop is to iterate over a set of rows from a database query. The rows.Next() function advances
-	// the iterator to the next row in the result set, returning false when there are no more rows to iterate over.
-	for rows.Next() {
+	// The time in force of the order is checked against the book while it is locked: a fill-or-kill order is rejected
+	// unless the book can fill it entirely, and a post-only order is rejected if it would take any liquidity. The rejected
+	// order is refunded and published to the "order/cancel" channel.
+	switch order.GetTimeInForce() {
+	case types.TimeInForceFOK:
+		if book.liquidity(order, assigning).LessThan(decimal.Parse(order.GetValue())) {
+			a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatsRejected))
+			return
+		}
+	case types.TimeInForcePostOnly:
+		if book.liquidity(order, assigning).IsPositive() {
+			a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatsRejected))
+			return
+		}
+	}
+
+	// The purpose of the for loop is to iterate over the resting orders of the opposite side of the book, starting from the
+	// best price. The side is copied, so filled orders can be removed from the book during the iteration. When the slice of
+	// an iceberg order is filled, the order is placed at the back of its queue and the walk starts again from the best
+	// price, because the copy of the side no longer has the order of the book.
+	for walk := true; walk; {
+		walk = a.walk(book, order, assigning)
+	}
 
-		// Item is a variable of type Order from the types package, used to store a reference to an Order.
-		var (
-			item types.Order
-		)
+	// The remainder of the order that could not be matched rests in the book and waits for the opposite orders. The
+	// remainder of an immediate-or-cancel order is canceled and refunded instead, and so is the remainder of a fill-or-kill
+	// order whose matching has been interrupted by a halt of the pair.
+	if decimal.Parse(order.GetValue()).IsPositive() && order.GetStatus() == types.StatusPending {
 
-		// This code is attempting to scan the rows of a database table, assigning each column value to a variable (item.Id,
-		// item.Assigning, etc.). The if statement is checking for any errors that might occur when scanning the rows and
-		// returning any errors that might be present.
-		if err = rows.Scan(&item.Id, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.Value, &item.Quantity, &item.Price, &item.UserId, &item.Type, &item.Status); a.Context.Debug(err) {
+		if order.GetTimeInForce() == types.TimeInForceIOC || order.GetTimeInForce() == types.TimeInForceFOK {
+			a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatusCancel))
 			return
 		}
 
-		// Check if the order is in a pending status and update the order value accordingly.
-		if row := a.queryOrder(order.GetId()); row.GetStatus() == types.StatusPending {
-			order.Value = row.GetValue()
+		// A fill that has halted the pair stops the matching, the remainder may still cross the opposite side then. It
+		// rests in the book without being matched, and the book is uncrossed when the pair is resumed.
+		book.push(order)
+	}
+}
+
+// walk - This function walks the resting orders of the given side once, from the best price to the worst, and matches the order
+// with them. It returns true if the slice of an iceberg order has been filled and the order has been placed at the back
+// of its queue, the walk has to be started again then.
+func (a *Service) walk(book *book, order *types.Order, assigning string) bool {
+
+	for _, item := range book.side(assigning) {
+
+		// The order has been filled completely, there is nothing left to match.
+		if !decimal.Parse(order.GetValue()).IsPositive() {
+			break
+		}
+
+		// A fill may have moved the price out of the price band of the pair and halted it, the matching is paused then.
+		if a.queryHalted(order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType()) {
+			break
 		}
 
-		// This switch statement is used to check for a match between the order and item prices, depending on the side of the
-		// trade (bid or ask). If the order and item prices match, the trade process is replayed. If not, a message is logged
-		// for the user. If the side is invalid, an error is returned.
-		switch assigning {
-
-		case types.AssigningBuy: // Buy at BID price.
-
-			// This code checks whether the price of an order is greater than or equal to the price of an item. If it is, it will
-			// log a message and call the replayTradeProcess function. If it is not, it will log another message.
-			if order.GetPrice() >= item.GetPrice() {
-				a.Context.Logger.Infof("[BID]: (item [%v]) >= (order [%v]), order ID: %v", order.GetPrice(), item.GetPrice(), item.GetId())
-
-				// A switch statement is used to evaluate the type of order provided and executes the appropriate processing.
-				// If the order type is either Spot or Stock, the defaultProcess function is called; otherwise the marginProcess function is called if the order type is Margin.
-				switch order.GetType() {
-				case types.TypeSpot, types.TypeStock:
-					a.defaultProcess(types.AssigningBuy, order, &item)
-					break
-				case types.TypeCross:
-					a.marginProcess(types.AssigningBuy, order, &item)
-					break
-				}
+		// The resting orders are sorted by price, so when the current order does not cross the order price, none of the
+		// following orders do either, and the walk can be stopped.
+		if !book.cross(order, item) {
+			a.Context.Logger.Infof("[%v]: no matches found: (order [%v]) ~ (item [%v])", strings.ToUpper(assigning), order.GetPrice(), item.GetPrice())
+			break
+		}
 
-			} else {
-				a.Context.Logger.Infof("[BID]: no matches found: (item [%v]) >= (order [%v])", order.GetPrice(), item.GetPrice())
+		// Orders of the same user are never matched with each other, the self-trade prevention mode of the order decides
+		// which of the two orders is canceled. The walk continues only while the order itself is still pending.
+		if item.GetUserId() == order.GetUserId() {
+			a.selfTrade(book, order, item)
+			if order.GetStatus() != types.StatusPending {
+				break
 			}
+			continue
+		}
 
+		// A market buy order never spends more than its budget. The book may have changed since the order was priced, so the
+		// walk stops at a trade that the rest of the budget can not pay, and the rest is returned to the balance.
+		if budget := order.GetBudget(); len(budget) > 0 && decimal.Min(decimal.Parse(order.GetValue()), peak(item)).Mul(decimal.Parse(item.GetPrice())).GreaterThan(decimal.Parse(budget)) {
 			break
+		}
 
-		case types.AssigningSell: // Sell at ASK price.
-
-			// This code is checking if the price of an order is lower than or equal to the price of an item. If it is, it will
-			// log an informational message and call the replayTradeProcess() method. If not, it will log a different
-			// informational message.
-			if order.GetPrice() <= item.GetPrice() {
-				a.Context.Logger.Infof("[ASK]: (order [%v]) <= (item [%v]), order ID: %v", order.GetPrice(), item.GetPrice(), item.GetId())
-
-				// A switch statement is used to evaluate the type of order provided and executes the appropriate processing.
-				// If the order type is either Spot or Stock, the defaultProcess function is called; otherwise the marginProcess function is called if the order type is Margin.
-				switch order.GetType() {
-				case types.TypeSpot, types.TypeStock:
-					a.defaultProcess(types.AssigningSell, order, &item)
-					break
-				case types.TypeCross:
-					a.marginProcess(types.AssigningSell, order, &item)
-					break
-				}
+		a.Context.Logger.Infof("[%v]: (order [%v]) ~ (item [%v]), order ID: %v", strings.ToUpper(assigning), order.GetPrice(), item.GetPrice(), item.GetId())
+
+		// The slice and the value of the resting order are remembered, to find out whether the slice has been filled.
+		slice, value := peak(item), decimal.Parse(item.GetValue())
+
+		// A switch statement is used to evaluate the type of order provided and executes the appropriate processing.
+		// If the order type is either Spot or Stock, the defaultProcess function is called; otherwise the marginProcess function is called if the order type is Margin.
+		// The trade is always executed at the price of the resting order, which is the best price available in the book at
+		// the moment of the match.
+		switch order.GetType() {
+		case types.TypeSpot, types.TypeStock:
+			a.defaultProcess(assigning, decimal.Parse(item.GetPrice()), order, item)
+		case types.TypeCross:
+			a.marginProcess(assigning, decimal.Parse(item.GetPrice()), order, item)
+		}
+
+		// The resting order that has been filled completely is removed from the book, the level of a partially filled
+		// order has changed as well. The iceberg order whose slice has been filled is replenished with the next slice
+		// at the back of its queue.
+		if !decimal.Parse(item.GetValue()).IsPositive() {
+			book.remove(item.GetId())
+		} else if decimal.Parse(item.GetDisplay()).IsPositive() && value.Sub(decimal.Parse(item.GetValue())).Equal(slice) {
+			_, err := a.writeJournal(a.Context.Db, journalRequeue, item, 0, decimal.Zero, decimal.Zero)
+			a.Context.Debug(err)
+			book.push(book.remove(item.GetId()))
+			return decimal.Parse(order.GetValue()).IsPositive()
+		} else {
+			book.touch(item)
+		}
+	}
 
-			} else {
-				a.Context.Logger.Infof("[ASK]: no matches found: (order [%v]) <= (item [%v])", order.GetPrice(), item.GetPrice())
+	return false
+}
+
+// selfTrade - This function is called when the order would be matched with a resting order of the same user. Depending on the
+// self-trade prevention mode of the order, the newest order (the order itself), the oldest order (the resting order) or
+// both of them are canceled. In the decrement-and-cancel mode both orders are decreased by the smaller of the two
+// remaining values, so the smaller order is canceled and the larger one continues with the rest. The canceled orders
+// are refunded and published to the "order/cancel" channel. The book of the pair is locked by the caller.
+func (a *Service) selfTrade(book *book, order, item *types.Order) {
+
+	switch order.GetSelfTrade() {
+	case types.SelfTradeCancelOldest:
+
+		book.remove(item.GetId())
+		a.Context.Debug(a.writeRefund(item, types.StatusPending, types.StatusCancel))
+
+	case types.SelfTradeCancelBoth:
+
+		book.remove(item.GetId())
+		a.Context.Debug(a.writeRefund(item, types.StatusPending, types.StatusCancel))
+		a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatusCancel))
+
+	case types.SelfTradeDecrement:
+
+		value, rest := decimal.Parse(order.GetValue()), decimal.Parse(item.GetValue())
+
+		switch {
+		case value.GreaterThan(rest):
+
+			// The resting order is the smaller one, it is canceled and the order continues with the rest of its value.
+			book.remove(item.GetId())
+			if err := a.writeRefund(item, types.StatusPending, types.StatusCancel); a.Context.Debug(err) {
+				return
 			}
+			a.Context.Debug(a.writeDecrement(order, rest))
 
-			break
-		default:
-			if err := a.Context.Debug(status.Error(11589, "invalid assigning trade position")); err {
+		case value.LessThan(rest):
+
+			// The order is the smaller one, it is canceled and the resting order stays in the book with the rest of its value.
+			if err := a.writeRefund(order, types.StatusPending, types.StatusCancel); a.Context.Debug(err) {
 				return
 			}
+			a.Context.Debug(a.writeDecrement(item, value))
+			book.touch(item)
+
+		default:
+
+			book.remove(item.GetId())
+			a.Context.Debug(a.writeRefund(item, types.StatusPending, types.StatusCancel))
+			a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatusCancel))
 		}
-	}
 
-	// The purpose of this code is to check for errors when using the rows.Err() function. It returns an error if there is
-	// one and returns the function if this is the case.
-	if err = rows.Err(); a.Context.Debug(err) {
-		return
+	default:
+
+		// The newest order is the order itself, it is canceled and the resting order stays in the book.
+		a.Context.Debug(a.writeRefund(order, types.StatusPending, types.StatusCancel))
 	}
 }
 
 // defaultProcess - This function is used to replay a trade process. It updates two orders with different amounts to determine the result
 // of a trade. It updates the order status in the database with pending in to filled, updates the balance by adding the
-// amount of the order to the balance, and sends a mail. In addition, it logs information about the trade.
-func (a *Service) defaultProcess(assigning string, params ...*types.Order) {
-
-	// The purpose of this code is to declare two variables, instance and migrate. The variable instance is declared as an
-	// integer, and migrate is declared as a query.Migrate object with the Context field set to the value of the variable e.Context.
+// amount of the order to the balance, and sends a mail. In addition, it logs information about the trade. The first
+// order is the taker order, the second one is the resting (maker) order from the book, in the call auction the newer and
+// the older of the two resting orders, and the trade is executed at the given price, which is the price of the resting order in the continuous matching and the clearing price in the call
+// auction. The whole fill is settled inside a single database transaction: both orders are locked,
+// both orders, both trades, the balances and the fees are written, and only after the commit the in-memory values of
+// the orders are updated, the mails are sent and the new statuses are published.
+func (a *Service) defaultProcess(assigning string, price decimal.Amount, params ...*types.Order) {
+
+	// The purpose of this code is to declare the variables used by the trade process. The variable instance is declared as
+	// an integer, values holds the remaining values of both orders locked in the database, and migrate is declared as a
+	// query.Migrate object with the Context field set to the value of the variable e.Context.
 	var (
-		price    float64
 		instance int
+		values   [2]decimal.Amount
+		budget   = decimal.Parse(params[0].GetBudget())
 		migrate  = query.Migrate{
 			Context: a.Context,
 		}
 	)
 
+	// The transaction is started before anything is written, so the fill is either settled completely or not at all. The
+	// deferred rollback does nothing once the transaction has been committed.
+	tx, err := a.Context.Db.Begin()
+	if a.Context.Debug(err) {
+		return
+	}
+	defer tx.Rollback()
+
+	// Both orders are locked with "for update", always in the order of their ids so two fills can never wait for each other.
+	// The remaining values are taken from the locked rows, not from memory, so a concurrent fill of the same order can not
+	// spend the same remaining value twice.
+	for _, i := range a.queryLockOrder(params[0].GetId(), params[1].GetId()) {
+		if err := tx.QueryRow("select value from orders where id = $1 and type = $2 and status = $3 for update;", params[i].GetId(), params[i].GetType(), types.StatusPending).Scan(&values[i]); err != nil {
+
+			// The order is no longer pending in the database, for example it has been canceled, so it can not be matched any
+			// more and its in-memory value is cleared, which removes it from the book.
+			if err == sql.ErrNoRows {
+				params[i].Value = decimal.Zero.String()
+				return
+			}
+			a.Context.Debug(err)
+			return
+		}
+	}
+
 	// This code is checking whether the value of the first parameter is greater than or equal to the value of the second
 	// parameter. If it is, the instance variable is set to 1.
-	if params[0].GetValue() >= params[1].GetValue() {
+	if values[0].GreaterThanOrEqual(values[1]) {
 		instance = 1
 	}
 
-	// This switch statement is used to determine the price based on the side (bid or ask) of an order. The switch statement
-	// checks for the side of the order and assigns the price accordingly, using the params array. If the side is BID, it
-	// will assign the price from the second element in the params array. If the side is ASK, it will assign the price from
-	// the first element in the params array.
-	switch assigning {
-	case types.AssigningBuy:
-		price = params[1].GetPrice()
-	case types.AssigningSell:
-		price = params[0].GetPrice()
+	// The filled amount is the remaining value of the smaller of the two orders.
+	value := values[instance]
+
+	// The resting iceberg order can only be filled up to its current slice, the rest of it waits for its next place in the queue.
+	if slice := peak(&types.Order{Value: values[1].String(), Display: params[1].GetDisplay()}); value.GreaterThan(slice) {
+		value = slice
+	}
+
+	// There is nothing to settle, the remaining values in memory are synchronized with the database.
+	if !value.IsPositive() {
+		params[0].Value, params[1].Value = values[0].String(), values[1].String()
+		return
 	}
 
-	// This code is used to update an order status from pending to filled when the order is completed. It also updates the
-	// quantity of the orders and sets the necessary parameters for the order. Finally, it logs the parameters of the order.
-	if params[instance].GetValue() > 0 {
+	// The fill is written to the journal in the same transaction, its sequence number is kept in both trades.
+	sequence, err := a.writeJournal(tx, journalFill, params[0], params[1].GetId(), value, price)
+	if a.Context.Debug(err) {
+		return
+	}
 
-		// The purpose of the for loop is to iterate over the parameters passed in and update the "value" of the specified
-		// order in the database. It also sets the status of the order to FILLED if the value is equal to 0. The code also
-		// checks for any errors that may occur during the process. Lastly, the code sends an email to the user associated with the order once the order is filled.
-		for i := 0; i < 2; i++ {
+	// The purpose of the for loop is to iterate over the parameters passed in and update the "value" of the specified
+	// order in the database. It also sets the status of the order to FILLED if the value is equal to 0.
+	for i := 0; i < 2; i++ {
 
-			// The purpose of this code is to declare a variable named "value" of type float64. This variable can be used to store a decimal number, such as 3.14159.
-			var (
-				value float64
-			)
+		// This if statement is used to update the "value" of a particular order in the database. The parameters passed in are
+		// used in the query to find the specific order to update. If the query fails, the function will return and the
+		// transaction is rolled back.
+		if err := tx.QueryRow("update orders set value = value - $2 where id = $1 and type = $3 and status = $4 returning value;", params[i].GetId(), value, params[i].GetType(), types.StatusPending).Scan(&values[i]); a.Context.Debug(err) {
+			return
+		}
 
-			// This if statement is used to update the "value" of a particular order in the database. The parameters passed in are
-			// used in the query to find the specific order to update. If the query is successful, the "value" of the order is
-			// stored in the "value" variable and the function will continue. If the query fails, the function will return.
-			if err := a.Context.Db.QueryRow("update orders set value = value - $2 where id = $1 and type = $3 and status = $4 returning value;", params[i].GetId(), params[instance].GetValue(), params[i].GetType(), types.StatusPending).Scan(&value); a.Context.Debug(err) {
+		if values[i].IsZero() {
+
+			// This code is performing an update on the orders table in a database. It is setting the status of the order with the
+			// specified ID to the specified status (in this case, FILLED). The code is also checking for any errors that may
+			// occur during the process. If an error is found, the code will return without proceeding.
+			if _, err := tx.Exec("update orders set status = $3 where id = $1 and type = $2;", params[i].GetId(), params[i].GetType(), types.StatusFilled); a.Context.Debug(err) {
 				return
 			}
+		}
+	}
 
-			if value == 0 {
+	switch params[1].GetAssigning() {
+	case types.AssigningBuy:
 
-				// This code is performing an update on the orders table in a database. It is setting the status of the order with the
-				// specified ID to the specified status (in this case, FILLED). The code is also checking for any errors that may
-				// occur during the process. If an error is found, the code will return without proceeding.
-				if _, err := a.Context.Db.Exec("update orders set status = $3 where id = $1 and type = $2;", params[i].GetId(), params[i].GetType(), types.StatusFilled); a.Context.Debug(err) {
-					return
-				}
+		// Order trades logs.
+		quantity, err := a.writeTrade(tx, params[0].GetId(), params[0].GetQuoteUnit(), value, price, sequence, true, false)
+		if a.Context.Debug(err) {
+			return
+		}
 
-				go migrate.SendMail(params[i].GetUserId(), "order_filled", params[i].GetId(), a.queryQuantity(params[i].GetAssigning(), params[i].GetQuantity(), price, false), params[i].GetBaseUnit(), params[i].GetQuoteUnit(), params[i].GetAssigning())
-			}
+		// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
+		// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
+		if err := a.writeBalance(tx, params[0].GetQuoteUnit(), params[0].GetType(), params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
+			return
 		}
 
-		switch params[1].GetAssigning() {
-		case types.AssigningBuy:
+		// Order trades logs.
+		quantity, err = a.writeTrade(tx, params[1].GetId(), params[0].GetBaseUnit(), value, price, sequence, false, true)
+		if a.Context.Debug(err) {
+			return
+		}
 
-			// Order trades logs.
-			quantity, err := a.writeTrade(params[0].GetId(), params[0].GetQuoteUnit(), params[instance].GetValue(), price, true)
-			if a.Context.Debug(err) {
-				return
-			}
+		// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
+		// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
+		if err := a.writeBalance(tx, params[0].GetBaseUnit(), params[0].GetType(), params[1].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
+			return
+		}
 
-			// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
-			// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
-			if err := a.WriteBalance(params[0].GetQuoteUnit(), params[0].GetType(), params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
+		// The resting buy order is filled at its own price in the continuous matching, but at the lower clearing price in
+		// the call auction, where the newer ask is the taker. The difference is returned to the balance of the buyer.
+		if refund := decimal.Parse(params[1].GetPrice()).Sub(price); refund.IsPositive() {
+			if err := a.writeBalance(tx, params[0].GetQuoteUnit(), params[0].GetType(), params[1].GetUserId(), value.Mul(refund), types.BalancePlus); a.Context.Debug(err) {
 				return
 			}
+		}
 
-			// Order trades logs.
-			quantity, err = a.writeTrade(params[1].GetId(), params[0].GetBaseUnit(), params[instance].GetValue(), price, false)
-			if a.Context.Debug(err) {
-				return
-			}
+		break
+	case types.AssigningSell:
 
-			// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
-			// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
-			if err := a.WriteBalance(params[0].GetBaseUnit(), params[0].GetType(), params[1].GetUserId(), quantity, types.BalancePlus); err != nil {
-				return
+		// Order trades logs.
+		quantity, err := a.writeTrade(tx, params[0].GetId(), params[0].GetBaseUnit(), value, price, sequence, false, false)
+		if a.Context.Debug(err) {
+			return
+		}
+
+		// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
+		// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
+		if err := a.writeBalance(tx, params[0].GetBaseUnit(), params[0].GetType(), params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
+			return
+		}
+
+		// Order trades logs.
+		quantity, err = a.writeTrade(tx, params[1].GetId(), params[0].GetQuoteUnit(), value, price, sequence, true, true)
+		if a.Context.Debug(err) {
+			return
+		}
+
+		// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
+		// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
+		if err := a.writeBalance(tx, params[0].GetQuoteUnit(), params[0].GetType(), params[1].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
+			return
+		}
+
+		// A market buy order pays the trade from its budget at the price of the trade, and what is left of the budget is
+		// returned to the balance of the buyer once the order is filled.
+		if len(params[0].GetBudget()) > 0 {
+
+			if budget = budget.Sub(value.Mul(price)); values[0].IsZero() && budget.IsPositive() {
+				if err := a.writeBalance(tx, params[0].GetQuoteUnit(), params[0].GetType(), params[0].GetUserId(), budget, types.BalancePlus); a.Context.Debug(err) {
+					return
+				}
+				budget = decimal.Zero
 			}
 
 			break
-		case types.AssigningSell:
+		}
 
-			// Order trades logs.
-			quantity, err := a.writeTrade(params[0].GetId(), params[0].GetBaseUnit(), params[instance].GetValue(), price, false)
-			if a.Context.Debug(err) {
+		// The buyer has reserved the quote amount at the price of the buy order, the trade has been executed at the
+		// lower price of the resting ask, so the difference is returned to the balance of the buyer.
+		if refund := decimal.Parse(params[0].GetPrice()).Sub(price); assigning == types.AssigningSell && refund.IsPositive() {
+			if err := a.writeBalance(tx, params[0].GetQuoteUnit(), params[0].GetType(), params[0].GetUserId(), value.Mul(refund), types.BalancePlus); a.Context.Debug(err) {
 				return
 			}
+		}
 
-			// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
-			// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
-			if err := a.WriteBalance(params[0].GetBaseUnit(), params[0].GetType(), params[0].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
-				return
-			}
+		break
+	}
 
-			// Order trades logs.
-			quantity, err = a.writeTrade(params[1].GetId(), params[0].GetQuoteUnit(), params[instance].GetValue(), price, true)
-			if a.Context.Debug(err) {
-				return
-			}
+	// The fill is committed, from this point on the orders, the trades, the balances and the fees are consistent in the
+	// database. If the commit fails, nothing of the fill has been stored and the in-memory orders stay unchanged.
+	if err := tx.Commit(); a.Context.Debug(err) {
+		return
+	}
 
-			// This code is part of a function that allows the user to set the balance of a certain item to a certain quantity.
-			// The purpose of the if statement is to check if there is an error when setting the balance. If there is an error, the function will return without doing anything.
-			if err := a.WriteBalance(params[0].GetQuoteUnit(), params[0].GetType(), params[1].GetUserId(), quantity, types.BalancePlus); a.Context.Debug(err) {
-				return
-			}
+	// The purpose of the for loop is to synchronize the in-memory orders with the committed values, publish the new status of
+	// both orders and send a mail to the users whose orders have been filled.
+	if len(params[0].GetBudget()) > 0 {
+		params[0].Budget = budget.String()
+	}
 
-			break
+	for i := 0; i < 2; i++ {
+
+		params[i].Value = values[i].String()
+		if values[i].IsZero() {
+			params[i].Status = types.StatusFilled
+			go migrate.SendMail(params[i].GetUserId(), "order_filled", params[i].GetId(), a.queryQuantity(params[i].GetAssigning(), decimal.Parse(params[i].GetQuantity()), price, false), params[i].GetBaseUnit(), params[i].GetQuoteUnit(), params[i].GetAssigning())
+		}
+
+		// The purpose of the code snippet is to publish a particular order to an exchange with the routing key "order/status".
+		if err := a.writePublish(a.queryOrder(params[i].GetId()), "order/status"); a.Context.Debug(err) {
+			return
 		}
 	}
 
+	// The price of the trade is checked against the price band of the pair first, a price that breaches the band halts the
+	// pair before the rest of the running match and the waiting conditional orders can be executed.
+	a.replayBand(params[0].GetBaseUnit(), params[0].GetQuoteUnit(), params[0].GetType(), price)
+
 	//The purpose of this code is to create a new API client for the pbprovider package using the existing gRPC client in the context.
-	if _, err := a.SetTicker(context.Background(), &pbprovider.SetRequestTicker{Key: a.Context.Secrets[2], Price: params[0].GetPrice(), Value: params[0].GetValue(), BaseUnit: params[0].GetBaseUnit(), QuoteUnit: params[0].GetQuoteUnit(), Assigning: params[0].GetAssigning()}); a.Context.Debug(err) {
+	if _, err := a.SetTicker(context.Background(), &pbprovider.SetRequestTicker{Key: a.Context.Secrets[2], Price: price.String(), Value: value.String(), BaseUnit: params[0].GetBaseUnit(), QuoteUnit: params[0].GetQuoteUnit(), Assigning: params[0].GetAssigning(), Type: params[0].GetType()}); a.Context.Debug(err) {
 		return
 	}
 }
 
-// marginProcess - This function is used to replay a trade process. It updates two orders with different amounts to determine the result
-// of a trade. It updates the order status in the database with pending in to filled, updates the balance by adding the
-// amount of the order to the balance, and sends a mail. In addition, it logs information about the trade.
-func (a *Service) marginProcess(assigning string, params ...*types.Order) {
-	// TODO margin trade process.
+// queryLockOrder - This function returns the indexes of the two orders of a fill in the order in which their rows must be locked.
+// The rows are always locked from the lower id to the higher one, so two transactions locking the same pair of orders
+// can not deadlock.
+func (a *Service) queryLockOrder(first, second int64) []int {
+	if first > second {
+		return []int{1, 0}
+	}
+	return []int{0, 1}
+}
+
+// marginProcess - This function is used to replay a trade process of the cross margin orders. The fill is settled the same way as
+// a spot fill by defaultProcess, the balances of the cross orders are kept in the cross balance type. After the fill, the
+// margin levels of both users are checked in the background, because the prices and the assets of the cross balances
+// have changed, and a margin call or a liquidation may be required. The check runs in a goroutine, since a liquidation
+// places new orders and the book of the pair is still locked by the running match.
+func (a *Service) marginProcess(assigning string, price decimal.Amount, params ...*types.Order) {
+
+	a.defaultProcess(assigning, price, params...)
+
+	for _, item := range params {
+		go a.replayMargin(item.GetUserId())
+	}
 }
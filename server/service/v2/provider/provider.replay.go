@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"github.com/cryptogateway/backend-envoys/assets/common/help"
 	"github.com/cryptogateway/backend-envoys/assets/common/marketplace"
 	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbprovider"
@@ -85,7 +86,7 @@ func (a *Service) market() {
 			// This code allows the program to query a database and retrieve the values of the 'id', 'price', 'base_unit', and
 			// 'quote_unit' columns from the 'pairs' table, where the 'status' column is equal to 'true'. The code then closes the
 			// rows when the query is complete.
-			rows, err := a.Context.Db.Query(`select id, price, base_unit, quote_unit from pairs where status = $1 order by id`, true)
+			rows, err := a.Context.Db.Query(`select id, price, base_unit, quote_unit, type from pairs where status = $1 order by id`, true)
 			if a.Context.Debug(err) {
 				return
 			}
@@ -99,20 +100,21 @@ func (a *Service) market() {
 				// This is a variable declaration statement. The variable 'pair' is being declared as type 'types.Pair'. This allows
 				// the variable to store a pair of values (e.g. two integers, two strings, two objects, etc.).
 				var (
-					item types.Pair
+					item  types.Pair
+					price decimal.Amount
 				)
 
 				// This code is checking for an error when scanning the rows of a database table. The if statement scans the rows of
 				// the database table using the Scan() method, and if it encounters an error, it will log the error and continue
 				// scanning the remaining rows.
-				if err := rows.Scan(&item.Id, &item.Price, &item.BaseUnit, &item.QuoteUnit); a.Context.Debug(err) {
+				if err := rows.Scan(&item.Id, &price, &item.BaseUnit, &item.QuoteUnit, &item.Type); a.Context.Debug(err) {
 					continue
 				}
 
 				// This code is setting a ticker for a currency pair in order to track its price. The context.Background() is used to
 				// create a basic context, the SetRequest contains the key, price, base unit, quote unit, and assigning type.
 				// Finally, the e.Context.Debug(err) is used to debug any errors that may occur during the process. If an error occurs, the code will continue.
-				if _, err := a.SetTicker(context.Background(), &pbprovider.SetRequestTicker{Key: a.Context.Secrets[2], Price: item.GetPrice(), BaseUnit: item.GetBaseUnit(), QuoteUnit: item.GetQuoteUnit(), Assigning: types.AssigningSupply}); a.Context.Debug(err) {
+				if _, err := a.SetTicker(context.Background(), &pbprovider.SetRequestTicker{Key: a.Context.Secrets[2], Price: price.String(), BaseUnit: item.GetBaseUnit(), QuoteUnit: item.GetQuoteUnit(), Assigning: types.AssigningSupply, Type: item.GetType()}); a.Context.Debug(err) {
 					continue
 				}
 			}
@@ -120,9 +122,10 @@ func (a *Service) market() {
 	}
 }
 
-// price - The purpose of this code is to update the prices of pairs at a specific time interval. It first loads the pair ids,
-// prices, base units, and quote units from the pairs table where the status is active. It then gets the candles for the
-// base and quote units and calculates the new price based on the data. Lastly, it updates the price of the pair in the database.
+// price - The purpose of this code is to update the prices of pairs at a specific time interval. The price of a pair is the
+// price of the last trade of its book, the trades of the other types of books with the same units are not taken into
+// account. A pair that has not been traded yet takes the price of its external market as it is: the marketplace for a
+// spot pair and the closing price of the last minute for a stock pair. A pair without any price keeps its price.
 func (a *Service) price() {
 
 	// The code above creates a new ticker that will run once a minute and then loop through each range of the ticker.C
@@ -132,103 +135,150 @@ func (a *Service) price() {
 
 		func() {
 
-			// This code queries a database for pairs with a status of true and orders them by their ID. It uses the
-			// e.Context.Db.Query() function to execute a query and assigns the output of the query to the rows variable. If there
-			// is an error, it calls the e.Context.Debug() function to debug the error, and if successful, it will defer the
-			// rows.Close() function to close the rows after the function call.
-			rows, err := a.Context.Db.Query(`select id, price, base_unit, quote_unit, type from pairs where status = $1 order by id`, true)
+			var (
+				pairs []*types.Pair
+			)
+
+			// The active pairs are loaded first and the rows are closed before any price is updated.
+			rows, err := a.Context.Db.Query(`select id, base_unit, quote_unit, type from pairs where status = $1 order by id`, true)
 			if a.Context.Debug(err) {
 				return
 			}
-			defer rows.Close()
 
-			// The for loop with the rows.Next() statement is used to loop through a result set of an SQL query. The rows.Next()
-			// statement advances the current row pointer to the next row and returns true if it was successful. This loop is used
-			// to iterate through each row in the result set and perform an action on it.
 			for rows.Next() {
 
-				// This code creates two variables, pair and price, of the types.Pair and float64 respectively. This allows
-				// the program to store and use data of these two types.
 				var (
-					pair  types.Pair
-					price float64
+					pair types.Pair
 				)
 
-				// This code is used to scan the rows of data from a database and assign the values to variables. The if statement is
-				// used to check for any errors that may occur when scanning the rows. If an error is found, the code will skip to
-				// the next row. The e.Context.Debug() function is used to provide more information about what caused the error,
-				// which can help with debugging.
-				if err := rows.Scan(&pair.Id, &pair.Price, &pair.BaseUnit, &pair.QuoteUnit, &pair.Type); a.Context.Debug(err) {
-					return
+				if err := rows.Scan(&pair.Id, &pair.BaseUnit, &pair.QuoteUnit, &pair.Type); a.Context.Debug(err) {
+					continue
 				}
 
-				// The purpose of this code is to retrieve two candles from a given pair of base and quote units. The GetTicker()
-				// function is used to retrieve the candles and the returned value is stored in the migrate variable. If an error is
-				// encountered, the code will skip the iteration and continue to the next one.
-				ticker, err := a.GetTicker(context.Background(), &pbprovider.GetRequestTicker{BaseUnit: pair.GetBaseUnit(), QuoteUnit: pair.GetQuoteUnit(), Limit: 2})
-				if a.Context.Debug(err) {
-					return
-				}
+				pairs = append(pairs, &pair)
+			}
+			rows.Close()
 
-				switch pair.GetType() {
-				case types.TypeStock:
+			for _, pair := range pairs {
 
-					// This code retrieves the closing price of a given pair from the YHFIN API and stores it in the "price" variable.
-					if resp, _ := goyhfin.GetTickerData(strings.ToUpper(pair.GetBaseUnit()), goyhfin.OneMinute, goyhfin.OneMinute, false); len(resp.Quotes) > 0 {
-						price = resp.Quotes[0].Close
-					}
+				var (
+					price decimal.Amount
+				)
+
+				// The price of the last trade of the book, the prices supplied by the market replay are not trades.
+				_ = a.Context.Db.QueryRow("select price from ohlcv where base_unit = $1 and quote_unit = $2 and type = $3 and assigning <> $4 order by create_at desc limit 1", pair.GetBaseUnit(), pair.GetQuoteUnit(), pair.GetType(), types.AssigningSupply).Scan(&price)
+
+				if !price.IsPositive() {
+
+					switch pair.GetType() {
+					case types.TypeStock:
 
-					break
-				case types.TypeSpot:
+						// This code retrieves the closing price of a given pair from the YHFIN API.
+						if resp, _ := goyhfin.GetTickerData(strings.ToUpper(pair.GetBaseUnit()), goyhfin.OneMinute, goyhfin.OneMinute, false); len(resp.Quotes) > 0 {
+							price = decimal.New(resp.Quotes[0].Close).Amount()
+						}
 
-					// Check if the unit price of the pair is available in the marketplace and set the price if available.
-					if resp := marketplace.Price().Unit(pair.GetBaseUnit(), pair.GetQuoteUnit()); resp > 0 {
-						price = resp
+					case types.TypeSpot:
+
+						// Check if the unit price of the pair is available in the marketplace and set the price if available.
+						if resp := marketplace.Price().Unit(pair.GetBaseUnit(), pair.GetQuoteUnit()); resp > 0 {
+							price = decimal.New(resp).Amount()
+						}
 					}
+				}
 
-					break
+				if !price.IsPositive() {
+					continue
 				}
 
-				// This is an if statement that checks whether the variable price is equal to 0. If it is, the code inside the curly
-				// braces will be executed. Otherwise, it will be skipped.
-				if price == 0 {
-
-					// This code is used to calculate the price of an item. It checks if to migrate.Fields array has any elements in
-					// it. If it does, it takes the first element, gets its price, adds that to the price of the pair, and divides the
-					// sum by 2. If the array is empty, it just returns the price of the pair.
-					if len(ticker.Fields) > 0 {
-						price = (ticker.Fields[0].GetPrice() + pair.GetPrice()) / 2
-					} else {
-						price = pair.GetPrice()
-					}
+				// This code is attempting to update a row in the database table "pairs" with the given values.
+				if _, err := a.Context.Db.Exec("update pairs set price = $4 where base_unit = $1 and quote_unit = $2 and type = $3;", pair.GetBaseUnit(), pair.GetQuoteUnit(), pair.GetType(), price); a.Context.Debug(err) {
+					continue
+				}
+			}
+		}()
+	}
+}
 
-				} else {
+// expire - The purpose of this code is to expire the good-till-date orders. Every minute the pending and the waiting orders
+// whose expiration time has passed are loaded and canceled with writeCancel, which removes them from the book and
+// refunds their remaining value the same way as CancelOrder does.
+func (a *Service) expire() {
 
-					// This code is calculating the price of an item. The purpose of the if statement is to check if there are any
-					// "ticker.Fields" present. If there are, then the price is calculated by taking the average of the price, the
-					// pair's price, and the price of the first field in to migrate.Fields array. If there are no migrate.Fields, then
-					// the price is calculated by taking the average of the price and the pair's price.
-					if len(ticker.Fields) > 0 {
-						price = (price + pair.GetPrice() + ticker.Fields[0].GetPrice()) / 3
-					} else {
-						price = (price + pair.GetPrice()) / 2
-					}
+	// The code creates a ticker that triggers every minute and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Minute * 1)
+	for range ticker.C {
 
-					// This piece of code is calculating the price of a pair of something.  The if statement is checking if the price of
-					// the pair is more than 100. If it is, then the price is reduced by 1/8 of the difference between the initial price
-					// and the new price.
-					if (price - pair.GetPrice()) > 100 {
-						price -= (price - pair.GetPrice()) - (price-pair.GetPrice())/8
-					}
+		func() {
+
+			// The expired orders are loaded first and the rows are closed before any order is canceled.
+			rows, err := a.Context.Db.Query("select id, value, quantity, price, assigning, base_unit, quote_unit, user_id, type, status from orders where time_in_force = $1 and expire_at <= now() and (status = $2 or status = $3)", types.TimeInForceGTD, types.StatusPending, types.StatusWaiting)
+			if a.Context.Debug(err) {
+				return
+			}
+
+			var (
+				orders []*types.Order
+			)
+
+			for rows.Next() {
+
+				var (
+					item types.Order
+				)
 
+				if err := rows.Scan(&item.Id, &item.Value, &item.Quantity, &item.Price, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.UserId, &item.Type, &item.Status); a.Context.Debug(err) {
+					continue
 				}
+				orders = append(orders, &item)
+			}
+			rows.Close()
 
-				// This code is attempting to update a row in the database table "pairs" with the given values. The if statement is
-				// checking to see if there is an error and if there is, the code will continue without changing the values.
-				if _, err := a.Context.Db.Exec("update pairs set price = $3 where base_unit = $1 and quote_unit = $2;", pair.GetBaseUnit(), pair.GetQuoteUnit(), price); a.Context.Debug(err) {
-					return
+			for _, item := range orders {
+				if err := a.writeCancel(item); a.Context.Debug(err) {
+					continue
 				}
 			}
 		}()
 	}
 }
+
+// snapshot - The purpose of this code is to publish a full snapshot of every order book to the "depth/snapshot" channel at a
+// regular interval. The snapshot carries the sequence number of the last depth diff of the book, so a client that has
+// detected a gap in the diffs can resync from it without calling GetDepth.
+func (a *Service) snapshot() {
+
+	// The code creates a ticker that triggers every ten seconds and runs a loop that executes each time the ticker is triggered.
+	ticker := time.NewTicker(time.Second * 10)
+	for range ticker.C {
+
+		var (
+			rows []*book
+		)
+
+		// The books are copied from the registry first, so the registry is not locked while the snapshots are published.
+		books.Lock()
+		for _, row := range books.pairs {
+			rows = append(rows, row)
+		}
+		books.Unlock()
+
+		for _, row := range rows {
+
+			row.Lock()
+			response := &pbprovider.ResponseDepth{
+				Bids:      row.depth(types.AssigningBuy, decimal.Zero, 100),
+				Asks:      row.depth(types.AssigningSell, decimal.Zero, 100),
+				Sequence:  row.sequence,
+				BaseUnit:  row.base,
+				QuoteUnit: row.quote,
+				Type:      row._type,
+			}
+			row.Unlock()
+
+			if err := a.Context.Publish(response, "exchange", "depth/snapshot"); a.Context.Debug(err) {
+				continue
+			}
+		}
+	}
+}
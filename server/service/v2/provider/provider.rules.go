@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+	"google.golang.org/grpc/status"
+)
+
+// rules - The rules struct holds the trading rules of a pair: the precision of the base and the quote unit, the price tick size,
+// the quantity step, the minimum notional (price multiplied by quantity) and the maximum number of open orders of a user
+// on the pair. A tick size, a step, a minimum notional or a maximum number of orders equal to zero means no limit.
+type rules struct {
+	base, quote int32
+	tick        decimal.Amount
+	step        decimal.Amount
+	notional    decimal.Amount
+	orders      int32
+}
+
+// queryRules - This function returns the trading rules of the pair from the pairs table. Cross orders are placed on the spot
+// pairs, so they use the rules of the spot pair. If the pair does not exist, an error is returned.
+func (a *Service) queryRules(base, quote, _type string) (*rules, error) {
+
+	var (
+		response rules
+	)
+
+	// Convert TypeCross to TypeSpot, cross orders are placed on the spot pairs.
+	if _type == types.TypeCross {
+		_type = types.TypeSpot
+	}
+
+	if err := a.Context.Db.QueryRow("select base_decimal, quote_decimal, tick_size, step_size, min_notional, max_orders from pairs where base_unit = $1 and quote_unit = $2 and type = $3", base, quote, _type).Scan(&response.base, &response.quote, &response.tick, &response.step, &response.notional, &response.orders); err != nil {
+		return nil, status.Errorf(11585, "this pair %v-%v does not exist", base, quote)
+	}
+
+	return &response, nil
+}
+
+// floor - This function rounds the quantity down to the quantity step of the pair. It is used for the quantities that are
+// calculated by the exchange, for example the quantity of a market buy order, which the user can not round in advance.
+func (r *rules) floor(quantity decimal.Amount) decimal.Amount {
+
+	if !r.step.IsPositive() {
+		return quantity
+	}
+
+	return quantity.Div(r.step).Floor().Mul(r.step)
+}
+
+// validate - This function checks the price, the trigger price, the quantity and the display quantity of the order against the
+// tick size, the quantity step and the minimum notional of the pair. Every rule is reported with its own error code, so
+// clients can tell which value has to be rounded.
+func (r *rules) validate(order *types.Order) error {
+
+	price, quantity := decimal.Parse(order.GetPrice()), decimal.Parse(order.GetQuantity())
+
+	// The price of a market order is taken from the book and the prices of a trailing stop order follow the last price, they
+	// are not given by the user, so only the given prices are checked.
+	trading := order.GetTrading()
+	given := trading != types.TradingMarket && trading != types.TradingTrailingStop && trading != types.TradingTrailingStopLimit
+
+	if r.tick.IsPositive() && given && !price.Mod(r.tick).IsZero() {
+		return status.Errorf(11637, "the price %v must be a multiple of the tick size %v", price, r.tick)
+	}
+
+	if trigger := decimal.Parse(order.GetTrigger()); r.tick.IsPositive() && given && !trigger.Mod(r.tick).IsZero() {
+		return status.Errorf(11638, "the trigger price %v must be a multiple of the tick size %v", trigger, r.tick)
+	}
+
+	if r.step.IsPositive() && !quantity.Mod(r.step).IsZero() {
+		return status.Errorf(11625, "the quantity %v must be a multiple of the quantity step %v", quantity, r.step)
+	}
+
+	if display := decimal.Parse(order.GetDisplay()); r.step.IsPositive() && !display.Mod(r.step).IsZero() {
+		return status.Errorf(11625, "the display quantity %v must be a multiple of the quantity step %v", display, r.step)
+	}
+
+	if r.notional.IsPositive() && price.Mul(quantity).LessThan(r.notional) {
+		return status.Errorf(11626, "the order value %v is below the minimum notional %v", price.Mul(quantity), r.notional)
+	}
+
+	return nil
+}
+
+// queryValidateCount - This function checks that the user has not reached the maximum number of open orders on the pair. The
+// pending orders and the waiting conditional orders are both counted as open.
+func (a *Service) queryValidateCount(r *rules, order *types.Order) error {
+
+	var (
+		count int32
+	)
+
+	if r.orders <= 0 {
+		return nil
+	}
+
+	if err := a.Context.Db.QueryRow("select count(*) from orders where user_id = $1 and base_unit = $2 and quote_unit = $3 and type = $4 and (status = $5 or status = $6)", order.GetUserId(), order.GetBaseUnit(), order.GetQuoteUnit(), order.GetType(), types.StatusPending, types.StatusWaiting).Scan(&count); err != nil {
+		return err
+	}
+
+	if count >= r.orders {
+		return status.Errorf(11627, "the maximum number of open orders on the pair is %v", r.orders)
+	}
+
+	return nil
+}
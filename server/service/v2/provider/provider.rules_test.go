@@ -0,0 +1,44 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestRules_Validate(t *testing.T) {
+	r := &rules{tick: decimal.Parse("0.5"), step: decimal.Parse("0.01"), notional: decimal.Parse("10")}
+
+	tests := []struct {
+		name  string
+		order *types.Order
+		want  bool
+	}{
+		{name: "valid", order: &types.Order{Trading: types.TradingLimit, Price: "100.5", Quantity: "0.12"}, want: true},
+		{name: "tick", order: &types.Order{Trading: types.TradingLimit, Price: "100.3", Quantity: "0.12"}, want: false},
+		{name: "trigger", order: &types.Order{Trading: types.TradingStopLimit, Price: "100.5", Trigger: "100.2", Quantity: "0.12"}, want: false},
+		{name: "step", order: &types.Order{Trading: types.TradingLimit, Price: "100.5", Quantity: "0.125"}, want: false},
+		{name: "notional", order: &types.Order{Trading: types.TradingLimit, Price: "100.5", Quantity: "0.09"}, want: false},
+		{name: "market", order: &types.Order{Trading: types.TradingMarket, Price: "100.37", Quantity: "0.12"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.validate(tt.order); (err == nil) != tt.want {
+				t.Errorf("validate() error = %v, want valid %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules_Floor(t *testing.T) {
+	r := &rules{step: decimal.Parse("0.01")}
+	if value := r.floor(decimal.Parse("1.239")); value.String() != "1.23" {
+		t.Errorf("floor() = %v, want 1.23", value)
+	}
+
+	r = &rules{}
+	if value := r.floor(decimal.Parse("1.239")); value.String() != "1.239" {
+		t.Errorf("floor() = %v, want 1.239", value)
+	}
+}
@@ -0,0 +1,254 @@
+package provider
+
+import (
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+// queryTriggered - This function checks whether the last price of the pair has reached the trigger price of a conditional order.
+// A stop order protects against the price moving against the user: the buy order is triggered when the price rises to
+// the trigger price, the sell order when it falls to it. A take profit order is the opposite one: the buy order is
+// triggered when the price falls to the trigger price, the sell order when it rises to it. A trailing stop order is a
+// stop order whose trigger price follows the price.
+func queryTriggered(trading, assigning string, trigger, price decimal.Amount) bool {
+
+	switch trading {
+	case types.TradingStopLimit, types.TradingStopMarket, types.TradingTrailingStop, types.TradingTrailingStopLimit:
+
+		if assigning == types.AssigningBuy {
+			return price.GreaterThanOrEqual(trigger)
+		}
+		return price.LessThanOrEqual(trigger)
+
+	case types.TradingTakeProfit:
+
+		if assigning == types.AssigningBuy {
+			return price.LessThanOrEqual(trigger)
+		}
+		return price.GreaterThanOrEqual(trigger)
+	}
+
+	return false
+}
+
+// queryTrailing - This function returns the trigger price of a trailing stop order for the given watermark, which is the best
+// price observed since the order has been placed: the highest price for a sell order and the lowest one for a buy order.
+// The trigger price is the watermark moved against the order by the offset, which is an absolute amount of the quote
+// unit or a percentage of the watermark.
+func queryTrailing(assigning string, offset decimal.Amount, percent bool, watermark decimal.Amount) decimal.Amount {
+
+	if percent {
+		offset = watermark.Mul(offset).Div(decimal.New(100).Amount())
+	}
+
+	if assigning == types.AssigningBuy {
+		return watermark.Add(offset)
+	}
+
+	return watermark.Sub(offset)
+}
+
+// queryLast - This function returns the last price of the pair recorded in the ohlcv table, which is the price the trigger
+// prices of the conditional orders are compared with. If the pair has no records yet, zero is returned.
+func (a *Service) queryLast(base, quote string) (price decimal.Amount) {
+	_ = a.Context.Db.QueryRow("select price from ohlcv where base_unit = $1 and quote_unit = $2 order by create_at desc limit 1", base, quote).Scan(&price)
+	return price
+}
+
+// replayTrigger - This function is called with every new last price of a pair. It loads the waiting conditional orders of the
+// pair, and every order whose trigger price has been reached by the last price is activated. The trigger price of a
+// trailing stop order that has not been reached is ratcheted when the last price is a new watermark of the order.
+func (a *Service) replayTrigger(base, quote string, price decimal.Amount) {
+
+	var (
+		orders   []*types.Order
+		trailing []*types.Order
+	)
+
+	if !price.IsPositive() {
+		return
+	}
+
+	// The waiting orders are loaded first and the rows are closed before any order is activated, because the activation
+	// writes into the same table and matches the order against the book.
+	rows, err := a.Context.Db.Query("select id, assigning, base_unit, quote_unit, value, quantity, price, trigger, user_id, type, trading, status, time_in_force, self_trade, display, hidden, trailing_offset, trailing_percent, watermark, create_at from orders where base_unit = $1 and quote_unit = $2 and status = $3 order by id", base, quote, types.StatusWaiting)
+	if a.Context.Debug(err) {
+		return
+	}
+
+	for rows.Next() {
+
+		var (
+			item types.Order
+		)
+
+		if err := rows.Scan(&item.Id, &item.Assigning, &item.BaseUnit, &item.QuoteUnit, &item.Value, &item.Quantity, &item.Price, &item.Trigger, &item.UserId, &item.Type, &item.Trading, &item.Status, &item.TimeInForce, &item.SelfTrade, &item.Display, &item.Hidden, &item.TrailingOffset, &item.TrailingPercent, &item.Watermark, &item.CreateAt); a.Context.Debug(err) {
+			continue
+		}
+
+		// The conditional orders of a halted pair wait for the first last price after trading on the pair is resumed, and the
+		// conditional orders of a pair in the call auction wait for the first last price after the uncross.
+		if _, ok := a.queryAuction(base, quote, item.GetType()); ok || a.queryHalted(base, quote, item.GetType()) {
+			continue
+		}
+
+		if queryTriggered(item.GetTrading(), item.GetAssigning(), decimal.Parse(item.GetTrigger()), price) {
+			orders = append(orders, &item)
+			continue
+		}
+
+		// The watermark of a trailing sell order is the highest price since it has been placed, the watermark of a trailing
+		// buy order is the lowest one.
+		if watermark := decimal.Parse(item.GetWatermark()); (item.GetTrading() == types.TradingTrailingStop || item.GetTrading() == types.TradingTrailingStopLimit) && ((item.GetAssigning() == types.AssigningSell && price.GreaterThan(watermark)) || (item.GetAssigning() == types.AssigningBuy && price.LessThan(watermark))) {
+			trailing = append(trailing, &item)
+		}
+	}
+	rows.Close()
+
+	for _, item := range trailing {
+		if err := a.writeTrailing(item, price); a.Context.Debug(err) {
+			continue
+		}
+	}
+
+	for _, item := range orders {
+		if err := a.writeTrigger(item); a.Context.Debug(err) {
+			continue
+		}
+	}
+}
+
+// writeTrailing - This function moves the watermark of a trailing stop order to the given price and ratchets its trigger price,
+// which only ever moves in favour of the order. The order is updated only while it is waiting, and the new trigger
+// price is published to the "order/status" channel.
+func (a *Service) writeTrailing(item *types.Order, price decimal.Amount) error {
+
+	// The precision of the pair defines the precision of the trigger price.
+	_, q, err := a.queryDecimal(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+	if err != nil {
+		return err
+	}
+
+	trigger := queryTrailing(item.GetAssigning(), decimal.Parse(item.GetTrailingOffset()), item.GetTrailingPercent(), price).Truncate(q)
+	if !trigger.IsPositive() {
+		return nil
+	}
+
+	// The prices are replayed concurrently, so the watermark is compared again in the update, an older price never replaces a better watermark.
+	result, err := a.Context.Db.Exec("update orders set trigger = $2, watermark = $3 where id = $1 and status = $4 and ((assigning = $5 and watermark < $3) or (assigning = $6 and watermark > $3))", item.GetId(), trigger, price, types.StatusWaiting, types.AssigningSell, types.AssigningBuy)
+	if err != nil {
+		return err
+	}
+
+	// The order has been canceled or activated in the meantime, there is nothing to publish.
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+	item.Trigger, item.Watermark = trigger.String(), price.String()
+
+	if err := a.writePublish(item, "order/status"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeTrigger - This function activates a waiting conditional order. The status of the order is changed from waiting to pending
+// in a transaction, so an order that is canceled or activated at the same time is activated only once. A stop market
+// and a trailing stop order get the market price, a trailing stop limit order gets its last trigger price. A buy order never
+// spends more than the quote amount it reserved at its price: at a higher price its quantity is reduced to what the
+// reservation covers, and the unused part of the reservation is returned to the balance. The activated order is then
+// matched against the book the same way as a new order.
+func (a *Service) writeTrigger(item *types.Order) error {
+
+	var (
+		assigning string
+	)
+
+	tx, err := a.Context.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("update orders set status = $2 where id = $1 and status = $3", item.GetId(), types.StatusPending, types.StatusWaiting)
+	if err != nil {
+		return err
+	}
+
+	// The order has been canceled or activated in the meantime, there is nothing to do.
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+
+	if trading := item.GetTrading(); trading == types.TradingStopMarket || trading == types.TradingTrailingStop || trading == types.TradingTrailingStopLimit {
+
+		// The rules of the pair define the precision of the price and the quantity step of the reduced quantity.
+		pair, err := a.queryRules(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType())
+		if err != nil {
+			return err
+		}
+
+		price := decimal.Parse(item.GetTrigger())
+		if trading != types.TradingTrailingStopLimit {
+			price = a.queryMarket(item.GetBaseUnit(), item.GetQuoteUnit(), item.GetType(), item.GetAssigning()).Truncate(pair.quote)
+		}
+
+		if !price.IsPositive() {
+			return nil
+		}
+
+		// The buy order reserved its quote amount at its price. The fill is capped at that amount, so at a higher price the
+		// quantity is reduced to what the reservation covers, and whatever the order does not use is refunded.
+		if item.GetAssigning() == types.AssigningBuy {
+
+			value := decimal.Parse(item.GetValue())
+			reserved := value.Mul(decimal.Parse(item.GetPrice()))
+
+			if value.Mul(price).GreaterThan(reserved) {
+				value = pair.floor(reserved.Div(price).Truncate(pair.base))
+
+				// The reservation does not cover a single step of the quantity at the new price, the order is canceled and refunded.
+				if !value.IsPositive() {
+					if err := tx.Rollback(); err != nil {
+						return err
+					}
+					return a.writeCancel(item)
+				}
+
+				if _, err := tx.Exec("update orders set quantity = $2, value = $2 where id = $1", item.GetId(), value); err != nil {
+					return err
+				}
+				item.Quantity, item.Value = value.String(), value.String()
+			}
+
+			if refund := reserved.Sub(value.Mul(price)); refund.IsPositive() {
+				if err := a.writeBalance(tx, item.GetQuoteUnit(), item.GetType(), item.GetUserId(), refund, types.BalancePlus); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := tx.Exec("update orders set price = $2 where id = $1", item.GetId(), price); err != nil {
+			return err
+		}
+		item.Price = price.String()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	item.Status = types.StatusPending
+
+	// The activated order is matched against the opposite side of the book.
+	switch item.GetAssigning() {
+	case types.AssigningBuy:
+		assigning = types.AssigningSell
+	case types.AssigningSell:
+		assigning = types.AssigningBuy
+	}
+
+	a.trade(item, assigning)
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
+	"github.com/cryptogateway/backend-envoys/server/types"
+)
+
+func TestQueryTriggered(t *testing.T) {
+	type args struct {
+		trading   string
+		assigning string
+		trigger   string
+		price     string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{name: "stop buy above", args: args{trading: types.TradingStopLimit, assigning: types.AssigningBuy, trigger: "100", price: "101"}, want: true},
+		{name: "stop buy below", args: args{trading: types.TradingStopMarket, assigning: types.AssigningBuy, trigger: "100", price: "99"}, want: false},
+		{name: "stop sell below", args: args{trading: types.TradingStopMarket, assigning: types.AssigningSell, trigger: "100", price: "99"}, want: true},
+		{name: "stop sell equal", args: args{trading: types.TradingStopLimit, assigning: types.AssigningSell, trigger: "100", price: "100"}, want: true},
+		{name: "take profit buy below", args: args{trading: types.TradingTakeProfit, assigning: types.AssigningBuy, trigger: "100", price: "99"}, want: true},
+		{name: "take profit sell below", args: args{trading: types.TradingTakeProfit, assigning: types.AssigningSell, trigger: "100", price: "99"}, want: false},
+		{name: "trailing sell below", args: args{trading: types.TradingTrailingStop, assigning: types.AssigningSell, trigger: "95", price: "94"}, want: true},
+		{name: "trailing buy below", args: args{trading: types.TradingTrailingStopLimit, assigning: types.AssigningBuy, trigger: "105", price: "104"}, want: false},
+		{name: "limit", args: args{trading: types.TradingLimit, assigning: types.AssigningBuy, trigger: "100", price: "101"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryTriggered(tt.args.trading, tt.args.assigning, decimal.Parse(tt.args.trigger), decimal.Parse(tt.args.price)); got != tt.want {
+				t.Errorf("queryTriggered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTrailing(t *testing.T) {
+	type args struct {
+		assigning string
+		offset    string
+		percent   bool
+		watermark string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{name: "sell absolute", args: args{assigning: types.AssigningSell, offset: "5", watermark: "100"}, want: "95"},
+		{name: "buy absolute", args: args{assigning: types.AssigningBuy, offset: "5", watermark: "100"}, want: "105"},
+		{name: "sell percent", args: args{assigning: types.AssigningSell, offset: "2", percent: true, watermark: "150"}, want: "147"},
+		{name: "buy percent", args: args{assigning: types.AssigningBuy, offset: "2", percent: true, watermark: "150"}, want: "153"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryTrailing(tt.args.assigning, decimal.Parse(tt.args.offset), tt.args.percent, decimal.Parse(tt.args.watermark)); got.String() != tt.want {
+				t.Errorf("queryTrailing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
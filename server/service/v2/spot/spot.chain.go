@@ -650,7 +650,7 @@ func (e *Service) transfer(userId, txId int64, symbol string, to string, value,
 			// This statement is used to add the reserve amount for a user to their account. The parameters passed to the
 			// setReserve function are the userId, owner, chain symbol, amount, platform, protocol, and balance type. The
 			// statement then checks for any errors that occurred while setting the reserve, and if there was an error, the statement will return.
-			if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), decimal.New(value).Add(fees).Float(), chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
+			if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), decimal.New(value).Add(fees).Amount(), chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
 				return
 			}
 
@@ -659,7 +659,7 @@ func (e *Service) transfer(userId, txId int64, symbol string, to string, value,
 			// This code is a part of a function that is attempting to set a reserve for a user on a given platform and chain. The
 			// purpose of the if statement is to check if an error occurs when the reserve is being set. If an error occurs, the
 			// function will return and stop executing. The e.Context.Debug(err) is used to log the error, so that it can be investigated later.
-			if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), value, chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
+			if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), decimal.New(value).Amount(), chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
 				return
 			}
 		}
@@ -671,23 +671,23 @@ func (e *Service) transfer(userId, txId int64, symbol string, to string, value,
 
 		// This code is checking to see if a reserve is set for a given userId, owner, chain symbol, fees, platform, and
 		// balance. If the reserve is set, it will continue the code, but if there is an error, it will debug the error and then return.
-		if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), fees, chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
+		if err := _provider.WriteReserve(userId, owner, chain.GetParentSymbol(), decimal.New(fees).Amount(), chain.GetPlatform(), types.ProtocolMainnet, types.BalanceMinus); e.Context.Debug(err) {
 			return
 		}
 
 		// Update the reserve account, the amount that was deposited for the withdrawal of the token is converted and debited in a partial amount, excluding commission, for example:
 		// (fee: 0.006 eth) * (price: 2450 tst) = 14.7 tst; (value: 1000 - fees: 14.7 tst = 985.3 tst); This amount is 985.3 tst and will be overwritten without commission.
-		if err := _provider.WriteReserve(userId, owner, symbol, decimal.New(value).Sub(convert).Float(), chain.GetPlatform(), protocol, types.BalanceMinus); e.Context.Debug(err) {
+		if err := _provider.WriteReserve(userId, owner, symbol, decimal.New(value).Sub(convert).Amount(), chain.GetPlatform(), protocol, types.BalanceMinus); e.Context.Debug(err) {
 			return
 		}
 
 		// The purpose of this code is to check if the value of reverse is greater than or equal to the fees. The reverse
 		// variable is set to the return value of the function e.getReverse(), which takes four parameters: userId, owner, symbol, and chain.GetPlatform().
-		if reverse := _provider.QueryReverse(userId, owner, chain.GetParentSymbol(), chain.GetPlatform()); reverse >= fees {
+		if reverse := _provider.QueryReverse(userId, owner, chain.GetParentSymbol(), chain.GetPlatform()); reverse.GreaterThanOrEqual(decimal.New(fees).Amount()) {
 
 			// This code is used to set a reverse transaction for the given user, owner, symbol, fees, platform and balance type.
 			// If there is an error in setting the reverse transaction, the error is logged and the code returns.
-			if err := _provider.WriteReverse(userId, owner, chain.GetParentSymbol(), fees, chain.GetPlatform(), types.BalanceMinus); e.Context.Debug(err) {
+			if err := _provider.WriteReverse(userId, owner, chain.GetParentSymbol(), decimal.New(fees).Amount(), chain.GetPlatform(), types.BalanceMinus); e.Context.Debug(err) {
 				return
 			}
 
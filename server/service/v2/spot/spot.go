@@ -26,38 +26,37 @@ func (e *Service) Initialization() {
 
 // queryValidateWithdraw - This function is used to validate a withdrawal request. It checks to make sure that the requested withdrawal amount is
 // not greater than the reserve, the balance, the maximum, and the minimum, and it also takes into account any fees that
-// the user might have to pay. If any of the conditions are not met, the function returns an error.
-func (e *Service) queryValidateWithdrawal(quantity, reserve, balance, max, min, fees float64) error {
+// the user might have to pay. If any of the conditions are not met, the function returns an error. The amounts are
+// compared exactly, so a balance or a reserve is never rounded up to cover the claimed amount.
+func (e *Service) queryValidateWithdrawal(quantity, reserve, balance, max, min, fees decimal.Amount) error {
 
-	// This statement is creating a new variable called proportion that stores the result of the operation
-	// decimal.New(min).Add(fees).Float(). The operation decimal.New(min) creates a new decimal from the value of min, and
-	// then the Add(fees) method adds the value of fees to the new decimal. Finally, the Float() method converts the
-	// resulting decimal to a float value, which is then stored in the variable proportion.
+	// This statement is creating a new variable called proportion that stores the minimum amount of the withdrawal
+	// together with its fees.
 	var (
-		proportion = decimal.New(min).Add(fees).Float()
+		proportion = min.Add(fees)
 	)
 
 	// This code is used to check if the claimed amount is greater than the reserve. If it is, it will return an error
 	// message with status code 47784.
-	if quantity > reserve {
+	if quantity.GreaterThan(reserve) {
 		return status.Errorf(47784, "the claimed amount %v is greater than the reserve %v itself", quantity, reserve)
 	}
 
 	// This code checks if the requested quantity is more than the available balance. If it is greater than the balance, it
 	// returns an error message with the status code 48584. This prevents users from spending more money than they have.
-	if quantity > balance {
+	if quantity.GreaterThan(balance) {
 		return status.Errorf(48584, "the claimed amount %v is more than what you have on your balance %v", quantity, balance)
 	}
 
 	// This code checks if the quantity is less than the proportion and, if it is, it returns an error indicating that the
 	// withdrawal amount must not be less than the minimum amount.
-	if quantity < proportion {
+	if quantity.LessThan(proportion) {
 		return status.Errorf(48880, "the withdrawal amount %v must not be less than the minimum amount: %v", quantity, proportion)
 	}
 
 	// This code is used to check if the quantity declared for withdrawal is greater than the maximum allowed. If it is, an
 	// error is returned with an appropriate error message.
-	if quantity > max {
+	if quantity.GreaterThan(max) {
 		return status.Errorf(70083, "the amount %v declared for withdrawal should not be more than allowed %v", quantity, max)
 	}
 
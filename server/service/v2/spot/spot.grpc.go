@@ -161,7 +161,7 @@ func (e *Service) SetWithdraw(ctx context.Context, req *pbspot.SetRequestWithdra
 		// The purpose of this line of code is to assign the value returned by the GetPrice() function to the req.Price
 		// variable. This variable may be used later in the program to calculate the total cost of a purchase, or to determine
 		// the cost of an individual item.
-		req.Price = price.GetPrice()
+		req.Price = decimal.Parse(price.GetPrice()).InexactFloat64()
 
 		// The purpose of this statement is to assign the value returned from the GetFees() method of the contract
 		// object to the GetFees property of the chain object.
@@ -184,7 +184,7 @@ func (e *Service) SetWithdraw(ctx context.Context, req *pbspot.SetRequestWithdra
 
 	// This code is checking if any errors arise when withdrawing a certain quantity of a certain currency from a certain
 	// platform or protocol. If an error occurs, the code returns an error response.
-	if err := e.queryValidateWithdrawal(req.GetQuantity(), _provider.QueryReserve(req.GetSymbol(), req.GetPlatform(), contract.GetProtocol()), _provider.QueryBalance(req.GetSymbol(), types.TypeSpot, auth), currency.GetMaxWithdraw(), currency.GetMinWithdraw(), fees); err != nil {
+	if err := e.queryValidateWithdrawal(decimal.New(req.GetQuantity()).Amount(), _provider.QueryReserve(req.GetSymbol(), req.GetPlatform(), contract.GetProtocol()), _provider.QueryBalance(req.GetSymbol(), types.TypeSpot, auth), decimal.Parse(currency.GetMaxWithdraw()), decimal.Parse(currency.GetMinWithdraw()), decimal.New(fees).Amount()); err != nil {
 		return &response, err
 	}
 
@@ -196,7 +196,7 @@ func (e *Service) SetWithdraw(ctx context.Context, req *pbspot.SetRequestWithdra
 
 	// This code is checking for an error when attempting to set a balance for a symbol with a given quantity. If there is
 	// an error, the program will debug the error and return the response and an error.
-	if err := _provider.WriteBalance(req.GetSymbol(), types.TypeSpot, auth, req.GetQuantity(), types.BalanceMinus); e.Context.Debug(err) {
+	if err := _provider.WriteBalance(req.GetSymbol(), types.TypeSpot, auth, decimal.New(req.GetQuantity()).Amount(), types.BalanceMinus); e.Context.Debug(err) {
 		return &response, err
 	}
 
@@ -289,7 +289,7 @@ func (e *Service) CancelWithdraw(ctx context.Context, req *pbspot.CancelRequestW
 
 		// This code is checking for an error when setting a balance for a user's account. If an error occurs, it will log the
 		// error and return an error response.
-		if err := _provider.WriteBalance(item.GetSymbol(), types.TypeSpot, item.GetUserId(), item.GetValue(), types.BalancePlus); e.Context.Debug(err) {
+		if err := _provider.WriteBalance(item.GetSymbol(), types.TypeSpot, item.GetUserId(), decimal.New(item.GetValue()).Amount(), types.BalancePlus); e.Context.Debug(err) {
 			return &response, err
 		}
 
@@ -485,8 +485,8 @@ func (e *Service) confirmation() {
 
 					// This code is checking to see if the price is greater than 0 before calculating the fees. If the price is greater
 					// than 0, then it calculates the fees by multiplying the contract fees by the price.
-					if price.GetPrice() > 0 {
-						chain.Fees = decimal.New(contract.GetFees()).Mul(price.GetPrice()).Float()
+					if price := decimal.Parse(price.GetPrice()); price.IsPositive() {
+						chain.Fees = decimal.New(decimal.New(contract.GetFees()).Amount().Mul(price)).Float()
 					}
 				}
 
@@ -525,7 +525,7 @@ func (e *Service) confirmation() {
 					// This code is setting up a reverse balance change in a database, and is checking for errors while doing so. The if
 					// statement is checking to see if the setReverse() function returns an error, and if it does, it prints the error
 					// to the debug log and returns. If the setReverse() function does not return an error, the code continues to execute.
-					if err := _provider.WriteReverse(item.GetUserId(), item.GetTo(), item.GetSymbol(), item.GetValue(), item.GetPlatform(), types.BalancePlus); e.Context.Debug(err) {
+					if err := _provider.WriteReverse(item.GetUserId(), item.GetTo(), item.GetSymbol(), decimal.New(item.GetValue()).Amount(), item.GetPlatform(), types.BalancePlus); e.Context.Debug(err) {
 						return
 					}
 
@@ -534,7 +534,7 @@ func (e *Service) confirmation() {
 
 				// The purpose of this code is to set a reserve for a specified user, symbol, value, platform, and protocol. If an
 				// error occurs, the code will continue to execute. The e.Context.Debug(err) line logs the error for debugging purposes.
-				if err := _provider.WriteReserve(item.GetUserId(), item.GetTo(), item.GetSymbol(), item.GetValue(), item.GetPlatform(), item.GetProtocol(), types.BalancePlus); e.Context.Debug(err) {
+				if err := _provider.WriteReserve(item.GetUserId(), item.GetTo(), item.GetSymbol(), decimal.New(item.GetValue()).Amount(), item.GetPlatform(), item.GetProtocol(), types.BalancePlus); e.Context.Debug(err) {
 					return
 				}
 
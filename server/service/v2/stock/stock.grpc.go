@@ -3,6 +3,7 @@ package stock
 import (
 	"context"
 	"fmt"
+	"github.com/cryptogateway/backend-envoys/assets/common/decimal"
 	"github.com/cryptogateway/backend-envoys/server/proto/v2/pbstock"
 	"github.com/cryptogateway/backend-envoys/server/service/v2/account"
 	"github.com/cryptogateway/backend-envoys/server/types"
@@ -925,7 +926,7 @@ func (s *Service) SetAction(ctx context.Context, req *pbstock.SetRequestAction)
 
 			// The purpose of this code is to query the database for a user's balance on a certain stock or other asset, and then
 			// store the retrieved balance in the item.Balance variable.
-			if _ = s.Context.Db.QueryRow(`select value from balances where symbol = $1 and user_id = $2 and type = $3`, req.GetSymbol(), auth, types.TypeStock).Scan(&item.Balance); item.GetBalance() == 0 {
+			if _ = s.Context.Db.QueryRow(`select value from balances where symbol = $1 and user_id = $2 and type = $3`, req.GetSymbol(), auth, types.TypeStock).Scan(&item.Balance); !decimal.Parse(item.GetBalance()).IsPositive() {
 				return &response, status.Error(796743, "your asset balance is zero, you cannot withdraw the asset from circulation")
 			}
 
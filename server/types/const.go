@@ -23,9 +23,19 @@ const (
 	AssigningOpen  = "open"
 	AssigningClose = "close"
 
+	AssigningBorrow = "borrow"
+	AssigningRepay  = "repay"
+
+	MarginNormal      = "normal"
+	MarginCall        = "call"
+	MarginLiquidation = "liquidation"
+
 	PositionLong  = "long"
 	PositionShort = "short"
 
+	ModeCross    = "cross"
+	ModeIsolated = "isolated"
+
 	StatusCancel     = "cancel"
 	StatusFilled     = "filled"
 	StatusPending    = "pending"
@@ -36,9 +46,26 @@ const (
 	StatusAccess     = "access"
 	StatsRejected    = "rejected"
 	StatusBlocked    = "blocked"
+	StatusWaiting    = "waiting"
+
+	TradingMarket            = "market"
+	TradingLimit             = "limit"
+	TradingStopLimit         = "stop_limit"
+	TradingStopMarket        = "stop_market"
+	TradingTakeProfit        = "take_profit"
+	TradingTrailingStop      = "trailing_stop"
+	TradingTrailingStopLimit = "trailing_stop_limit"
+
+	TimeInForceGTC      = "gtc"
+	TimeInForceIOC      = "ioc"
+	TimeInForceFOK      = "fok"
+	TimeInForceGTD      = "gtd"
+	TimeInForcePostOnly = "post_only"
 
-	TradingMarket = "market"
-	TradingLimit  = "limit"
+	SelfTradeCancelNewest = "cancel_newest"
+	SelfTradeCancelOldest = "cancel_oldest"
+	SelfTradeCancelBoth   = "cancel_both"
+	SelfTradeDecrement    = "decrement_and_cancel"
 
 	GroupAction = "action"
 	GroupCrypto = "crypto"
@@ -202,6 +229,7 @@ func Status(request string) error {
 		StatusAccess:     true,
 		StatsRejected:    true,
 		StatusBlocked:    true,
+		StatusWaiting:    true,
 	}
 	if _, ok := statuses[request]; !ok {
 		return errors.New("Invalid status")
@@ -221,6 +249,33 @@ func Type(request string) error {
 	return nil
 }
 
+func TimeInForce(request string) error {
+	forces := map[string]bool{
+		TimeInForceGTC:      true,
+		TimeInForceIOC:      true,
+		TimeInForceFOK:      true,
+		TimeInForceGTD:      true,
+		TimeInForcePostOnly: true,
+	}
+	if _, ok := forces[request]; !ok {
+		return errors.New("Invalid time in force")
+	}
+	return nil
+}
+
+func SelfTrade(request string) error {
+	modes := map[string]bool{
+		SelfTradeCancelNewest: true,
+		SelfTradeCancelOldest: true,
+		SelfTradeCancelBoth:   true,
+		SelfTradeDecrement:    true,
+	}
+	if _, ok := modes[request]; !ok {
+		return errors.New("Invalid self trade prevention mode")
+	}
+	return nil
+}
+
 func Group(request string) error {
 	groups := map[string]bool{
 		GroupAction: true,
@@ -243,3 +298,14 @@ func Position(request string) error {
 	}
 	return nil
 }
+
+func Mode(request string) error {
+	modes := map[string]bool{
+		ModeCross:    true,
+		ModeIsolated: true,
+	}
+	if _, ok := modes[request]; !ok {
+		return errors.New("Invalid margin mode")
+	}
+	return nil
+}